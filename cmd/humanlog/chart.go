@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/NimbleMarkets/ntcharts/barchart"
+	"github.com/NimbleMarkets/ntcharts/canvas/runes"
+	"github.com/NimbleMarkets/ntcharts/linechart"
+	"github.com/NimbleMarkets/ntcharts/linechart/timeserieslinechart"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/term"
+	queryv1 "github.com/humanlogio/api/go/svc/query/v1"
+	"github.com/humanlogio/api/go/svc/query/v1/queryv1connect"
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/internal/pkg/state"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/humanlogio/humanlog/pkg/sink/chartsink"
+	"github.com/urfave/cli"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	chartCmdName = "chart"
+)
+
+func chartCmd(
+	getCtx func(cctx *cli.Context) context.Context,
+	getLogger func(cctx *cli.Context) *slog.Logger,
+	getCfg func(cctx *cli.Context) *config.Config,
+	getState func(cctx *cli.Context) *state.State,
+	getHTTPClient func(cctx *cli.Context, apiURL string) *http.Client,
+) cli.Command {
+
+	fieldFlag := cli.StringFlag{
+		Name:  "field",
+		Usage: "numeric key to chart, durations are charted in milliseconds",
+	}
+	byFlag := cli.StringFlag{
+		Name:  "by",
+		Usage: "key to group the values by, with one line per value of the key and percentile",
+	}
+	percentilesFlag := cli.StringFlag{
+		Name:  "p",
+		Usage: "comma separated percentiles to chart over time",
+		Value: "50,95,99",
+	}
+	bucketsFlag := cli.IntFlag{
+		Name:  "buckets",
+		Usage: "how many buckets of time to compute the percentiles over",
+		Value: 60,
+	}
+	binsFlag := cli.IntFlag{
+		Name:  "bins",
+		Usage: "how many bins the histogram of values has",
+		Value: 10,
+	}
+	localhostFlag := cli.BoolFlag{
+		Name:  "localhost",
+		Usage: "chart the events matching the query given as arguments, from the localhost query service instead of stdin",
+	}
+	sinceFlag := cli.DurationFlag{
+		Name:  "since",
+		Usage: "with --localhost, how far back to query events",
+		Value: time.Hour,
+	}
+
+	return cli.Command{
+		Name:      chartCmdName,
+		Usage:     "Chart percentiles over time and a histogram of the values of a numeric key",
+		ArgsUsage: "[query]",
+		Flags: []cli.Flag{
+			fieldFlag,
+			byFlag,
+			percentilesFlag,
+			bucketsFlag,
+			binsFlag,
+			localhostFlag,
+			sinceFlag,
+		},
+
+		Action: func(cctx *cli.Context) error {
+			ctx := getCtx(cctx)
+			cfg := getCfg(cctx)
+
+			field := cctx.String(fieldFlag.Name)
+			if field == "" {
+				return fmt.Errorf("--%s is required", fieldFlag.Name)
+			}
+			percentiles, err := chartsink.ParsePercentiles(cctx.String(percentilesFlag.Name))
+			if err != nil {
+				return fmt.Errorf("invalid --%s: %v", percentilesFlag.Name, err)
+			}
+			sampler := chartsink.NewSampler(field, cctx.String(byFlag.Name))
+
+			if cctx.Bool(localhostFlag.Name) {
+				if cfg.ExperimentalFeatures == nil || cfg.ExperimentalFeatures.ServeLocalhost == nil {
+					return fmt.Errorf("localhost feature is not enabled or not configured, can't dial localhost")
+				}
+				apiURL := fmt.Sprintf("http://localhost:%d", cfg.ExperimentalFeatures.ServeLocalhost.Port)
+				queryClient := queryv1connect.NewQueryServiceClient(getHTTPClient(cctx, apiURL), apiURL)
+				var environmentID int64
+				if state := getState(cctx); state.CurrentEnvironmentID != nil {
+					environmentID = *state.CurrentEnvironmentID
+				}
+				query := strings.Join(cctx.Args(), " ")
+				from := time.Now().Add(-cctx.Duration(sinceFlag.Name))
+				if err := queryLocalhost(ctx, queryClient, environmentID, query, from, sampler); err != nil {
+					return err
+				}
+			} else {
+				handlerOpts, err := handlerOptionsFrom(cfg)
+				if err != nil {
+					return err
+				}
+				if err := scanStdin(ctx, sampler, handlerOpts); err != nil {
+					return err
+				}
+			}
+			if len(sampler.Groups()) == 0 {
+				return fmt.Errorf("no event has a numeric value for %q", field)
+			}
+
+			width, height, err := term.GetSize(os.Stdout.Fd())
+			if err != nil {
+				width, height = 80, 24
+			}
+			return printChart(os.Stdout, sampler, field, percentiles, cctx.Int(bucketsFlag.Name), cctx.Int(binsFlag.Name), width, height)
+		},
+	}
+}
+
+// queryLocalhost passes the events matching `query` since `from` to the
+// sink, page by page.
+func queryLocalhost(ctx context.Context, queryClient queryv1connect.QueryServiceClient, environmentID int64, query string, from time.Time, sink sink.Sink) error {
+	parseRes, err := queryClient.Parse(ctx, connect.NewRequest(&queryv1.ParseRequest{Query: query}))
+	if err != nil {
+		return fmt.Errorf("parsing query: %v", err)
+	}
+	lq := parseRes.Msg.Query
+	if lq.Timerange == nil {
+		lq.Timerange = new(typesv1.Timerange)
+	}
+	if lq.Timerange.From == nil {
+		lq.Timerange.From = typesv1.ExprLiteral(typesv1.ValTimestamp(timestamppb.New(from)))
+	}
+	req := &queryv1.QueryRequest{
+		EnvironmentId: environmentID,
+		Query:         lq,
+		Limit:         1000,
+	}
+	for {
+		res, err := queryClient.Query(ctx, connect.NewRequest(req))
+		if err != nil {
+			return fmt.Errorf("calling Query: %v", err)
+		}
+		tabular, ok := res.Msg.Data.Shape.(*typesv1.Data_Tabular)
+		if !ok {
+			return fmt.Errorf("todo: handle data shape %T", res.Msg.Data.Shape)
+		}
+		events, ok := tabular.Tabular.Shape.(*typesv1.Tabular_LogEvents)
+		if !ok {
+			return fmt.Errorf("todo: handle data shape %T", tabular.Tabular.Shape)
+		}
+		for _, ev := range events.LogEvents.Events {
+			if err := sink.Receive(ctx, &typesv1.LogEvent{
+				ParsedAt:   ev.ParsedAt,
+				Raw:        ev.Raw,
+				Structured: ev.Structured,
+			}); err != nil {
+				return err
+			}
+		}
+		if res.Msg.Next == nil {
+			return nil
+		}
+		req.Cursor = res.Msg.Next
+	}
+}
+
+// chartColors are the ANSI colors the lines are drawn with, in turn.
+var chartColors = []string{"4", "2", "3", "5", "6", "1", "12", "10", "11", "13", "14", "9"}
+
+func printChart(w io.Writer, sampler *chartsink.Sampler, field string, percentiles []float64, buckets, bins, width, height int) error {
+	from, to := sampler.TimeRange()
+	if !to.After(from) {
+		to = from.Add(time.Second)
+	}
+	layout := "15:04:05"
+	if to.Sub(from) > 24*time.Hour {
+		layout = "01/02 15:04"
+	}
+	histogram := sampler.Histogram(bins)
+	lineHeight := max(height-len(histogram)-6, 10)
+
+	tslc := timeserieslinechart.New(width, lineHeight,
+		timeserieslinechart.WithTimeRange(from, to),
+	)
+	tslc.XLabelFormatter = linechart.LabelFormatter(func(i int, f float64) string {
+		return time.Unix(int64(f), 0).Format(layout)
+	})
+	var (
+		names  []string
+		legend []string
+	)
+	for i, series := range sampler.Series(buckets, percentiles) {
+		if len(series.Points) == 0 {
+			continue
+		}
+		name := "p" + strconv.FormatFloat(series.Percentile, 'f', -1, 64)
+		if series.Group != "" {
+			name = series.Group + " " + name
+		}
+		style := lipgloss.NewStyle().Foreground(lipgloss.Color(chartColors[i%len(chartColors)]))
+		for _, p := range series.Points {
+			tslc.PushDataSet(name, timeserieslinechart.TimePoint{Time: p.At, Value: p.Value})
+		}
+		tslc.SetDataSetStyle(name, style)
+		tslc.SetDataSetLineStyle(name, runes.ThinLineStyle)
+		names = append(names, name)
+		legend = append(legend, style.Render("─ "+name))
+	}
+	tslc.DrawDataSets(names)
+
+	// the bars are labeled by hand, horizontal barcharts don't draw labels
+	var ranges, counts []string
+	for _, bin := range histogram {
+		ranges = append(ranges, fmt.Sprintf("%.4g-%.4g ", bin.Low, bin.High))
+		counts = append(counts, " "+strconv.FormatInt(bin.Count, 10))
+	}
+	rangeColumn := lipgloss.NewStyle().Align(lipgloss.Right).Render(strings.Join(ranges, "\n"))
+	countColumn := strings.Join(counts, "\n")
+	barWidth := max(width-lipgloss.Width(rangeColumn)-lipgloss.Width(countColumn), 10)
+	bc := barchart.New(barWidth, len(histogram), barchart.WithHorizontalBars(), barchart.WithNoAxis(), barchart.WithBarGap(0))
+	for _, bin := range histogram {
+		bc.Push(barchart.BarData{Values: []barchart.BarValue{{
+			Value: float64(bin.Count),
+			Style: lipgloss.NewStyle().Foreground(lipgloss.Color(chartColors[0])),
+		}}})
+	}
+	bc.Draw()
+	bars := lipgloss.JoinHorizontal(lipgloss.Top, rangeColumn, bc.View(), countColumn)
+
+	_, err := fmt.Fprintf(w, "%s over time\n%s\n%s\n\n%s histogram\n%s\n",
+		field, tslc.View(), strings.Join(legend, "  "),
+		field, bars,
+	)
+	return err
+}
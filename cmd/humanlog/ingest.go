@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"connectrpc.com/connect"
@@ -19,6 +20,7 @@ import (
 	"github.com/humanlogio/humanlog/pkg/auth"
 	"github.com/humanlogio/humanlog/pkg/sink"
 	"github.com/humanlogio/humanlog/pkg/sink/logsvcsink"
+	"github.com/humanlogio/humanlog/pkg/spool"
 	"github.com/urfave/cli"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -72,12 +74,43 @@ func ingest(
 	case "stream":
 		fallthrough // use the stream sink as default, it's the best tradeoff for performance and compatibility
 	default:
-		snk = logsvcsink.StartStreamSink(ctx, ll, client, "api", uint64(*state.MachineID), 1<<20, 100*time.Millisecond, true, notifyUnableToIngest)
+		spl, err := openSpool(getCfg(cctx), "api")
+		if err != nil {
+			return nil, err
+		}
+		if spl != nil {
+			snk = logsvcsink.StartSpooledStreamSink(ctx, ll, client, "api", uint64(*state.MachineID), 1<<20, 100*time.Millisecond, spl, notifyUnableToIngest)
+		} else {
+			snk = logsvcsink.StartStreamSink(ctx, ll, client, "api", uint64(*state.MachineID), 1<<20, 100*time.Millisecond, true, notifyUnableToIngest)
+		}
 	}
 
 	return snk, nil
 }
 
+// openSpool opens a spool for the sink `name` under the state dir, if the
+// config enables it. If it can't be opened, the sink buffers in memory.
+func openSpool(cfg *config.Config, name string) (*spool.Spool, error) {
+	opts, ok, err := spool.OptsFrom(cfg.Spool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spool config: %v", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	stateDir, err := state.GetDefaultStateDirpath()
+	if err != nil {
+		logwarn("can't spool logs to disk, buffering them in memory: %v", err)
+		return nil, nil
+	}
+	spl, err := spool.OpenLane(filepath.Join(stateDir, "spool", name), opts)
+	if err != nil {
+		logwarn("can't spool logs to disk, buffering them in memory: %v", err)
+		return nil, nil
+	}
+	return spl, nil
+}
+
 func createIngestionToken(
 	ctx context.Context,
 	ll *slog.Logger,
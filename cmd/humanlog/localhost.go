@@ -12,6 +12,7 @@ import (
 	"github.com/humanlogio/api/go/svc/ingest/v1/ingestv1connect"
 	"github.com/humanlogio/humanlog/pkg/sink"
 	"github.com/humanlogio/humanlog/pkg/sink/logsvcsink"
+	"github.com/humanlogio/humanlog/pkg/spool"
 )
 
 func dialLocalhostServer(
@@ -20,6 +21,7 @@ func dialLocalhostServer(
 	machineID uint64,
 	port int,
 	localhostHttpClient *http.Client,
+	spl *spool.Spool,
 	notifyUnableToIngest func(err error),
 ) (localsink sink.Sink, done func(context.Context) error, err error) {
 	localhostAddr := net.JoinHostPort("localhost", strconv.Itoa(port))
@@ -29,7 +31,12 @@ func dialLocalhostServer(
 	}
 	logdebug("sending logs to localhost forwarder")
 	client := ingestv1connect.NewIngestServiceClient(localhostHttpClient, addr.String())
-	localhostSink := logsvcsink.StartStreamSink(ctx, ll, client, "local", machineID, 1<<20, 100*time.Millisecond, true, notifyUnableToIngest)
+	var localhostSink sink.Sink
+	if spl != nil {
+		localhostSink = logsvcsink.StartSpooledStreamSink(ctx, ll, client, "local", machineID, 1<<20, 100*time.Millisecond, spl, notifyUnableToIngest)
+	} else {
+		localhostSink = logsvcsink.StartStreamSink(ctx, ll, client, "local", machineID, 1<<20, 100*time.Millisecond, true, notifyUnableToIngest)
+	}
 	return localhostSink, func(ctx context.Context) error {
 		logdebug("flushing localhost sink")
 		return localhostSink.Close(ctx)
@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -27,7 +28,15 @@ import (
 	"github.com/humanlogio/humanlog/internal/pkg/config"
 	"github.com/humanlogio/humanlog/internal/pkg/state"
 	"github.com/humanlogio/humanlog/pkg/auth"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/patterns"
 	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/humanlogio/humanlog/pkg/sink/alertsink"
+	"github.com/humanlogio/humanlog/pkg/sink/dedupsink"
+	"github.com/humanlogio/humanlog/pkg/sink/enrichsink"
+	"github.com/humanlogio/humanlog/pkg/sink/filtersink"
+	"github.com/humanlogio/humanlog/pkg/sink/groupsink"
+	"github.com/humanlogio/humanlog/pkg/sink/redactsink"
 	"github.com/humanlogio/humanlog/pkg/sink/stdiosink"
 	"github.com/humanlogio/humanlog/pkg/sink/teesink"
 	"github.com/mattn/go-colorable"
@@ -114,13 +123,13 @@ func newApp() *cli.App {
 
 	skipFlag := cli.StringSliceFlag{
 		Name:  "skip",
-		Usage: "keys to skip when parsing a log entry",
+		Usage: "keys to skip when parsing a log entry: plain keys (also skipping the keys nested under them), globs like '*_id' or regexps like '/^req_/'",
 		Value: &skip,
 	}
 
 	keepFlag := cli.StringSliceFlag{
 		Name:  "keep",
-		Usage: "keys to keep when parsing a log entry",
+		Usage: "keys to keep when parsing a log entry, even if unchanged or skipped, using the same patterns as --skip",
 		Value: &keep,
 	}
 
@@ -145,6 +154,12 @@ func newApp() *cli.App {
 		Value: *config.DefaultConfig.TruncateLength,
 	}
 
+	truncateStrategy := cli.StringFlag{
+		Name:  "truncate-strategy",
+		Usage: "how to shorten values that don't fit: end, middle (keeps both ends, good for IDs) or wrap (wraps lines to the terminal width)",
+		Value: *config.DefaultConfig.TruncateStrategy,
+	}
+
 	colorFlag := cli.StringFlag{
 		Name:  "color",
 		Usage: "specify color mode: auto, on/force, off",
@@ -156,12 +171,149 @@ func newApp() *cli.App {
 		Usage: "use black as the base foreground color (for terminals with light backgrounds)",
 	}
 
+	detectBg := cli.BoolTFlag{
+		Name:  "detect-bg",
+		Usage: "ask the terminal whether its background is light, unless light-bg is set on the command line or in the config (--detect-bg=false to not ask)",
+	}
+
+	theme := cli.StringFlag{
+		Name:  "theme",
+		Usage: fmt.Sprintf("color theme to use, one of %q", stdiosink.ThemeNames()),
+		Value: *config.DefaultConfig.Theme,
+	}
+
+	hashColorKeys := cli.StringSlice{}
+	hashColorKeysFlag := cli.StringSliceFlag{
+		Name:  "hash-color",
+		Usage: "keys whose values are colored according to their value, making it easy to spot lines that share a value (i.e. request_id, service)",
+		Value: &hashColorKeys,
+	}
+
 	timeFormat := cli.StringFlag{
 		Name:  "time-format",
 		Usage: "output time format, see https://golang.org/pkg/time/ for details",
 		Value: stdiosink.DefaultStdioOpts.TimeFormat,
 	}
 
+	timeMode := cli.StringFlag{
+		Name:  "time-mode",
+		Usage: "what to show in the time column: absolute (using --time-format), relative (to the first event), delta (since the previous event) or ago (relative to now)",
+		Value: *config.DefaultConfig.TimeMode,
+	}
+
+	slowGap := cli.StringFlag{
+		Name:  "slow-gap",
+		Usage: "with --time-mode=delta, highlight events that came at least this long after the previous one",
+		Value: *config.DefaultConfig.SlowGap,
+	}
+
+	hyperlinks := cli.StringFlag{
+		Name:  "hyperlinks",
+		Usage: "turn callers, URLs and trace IDs into clickable links in terminals that support it: auto, on, off",
+		Value: *config.DefaultConfig.Hyperlinks.Mode,
+	}
+
+	statusLine := cli.BoolFlag{
+		Name:  "status-line",
+		Usage: "keep running counts per level, events/sec and the time since the last error at the bottom of the terminal",
+	}
+
+	sourceRoot := cli.StringFlag{
+		Name:  "source-root",
+		Usage: "directory that relative caller paths are found in, defaults to the current directory",
+	}
+
+	editorURL := cli.StringFlag{
+		Name:  "editor-url",
+		Usage: "template for links to callers, i.e. vscode://file/{path}:{line}",
+		Value: stdiosink.DefaultEditorURL,
+	}
+
+	traceURL := cli.StringFlag{
+		Name:  "trace-url",
+		Usage: "template for links to trace IDs, i.e. http://localhost:16686/trace/{value}",
+	}
+
+	dedup := cli.StringFlag{
+		Name:  "dedup",
+		Usage: "collapse the repeats of an event printed within this long into one, i.e. 5s",
+	}
+
+	groupBy := cli.StringFlag{
+		Name:  "group-by",
+		Usage: "print the events sharing a value of one of these comma separated keys together, once none came for a while, i.e. trace_id,request_id",
+	}
+
+	groupIdle := cli.StringFlag{
+		Name:  "group-idle",
+		Usage: "with --group-by, how long a group waits for more events before it's printed, i.e. 2s",
+	}
+
+	patternIDs := cli.BoolFlag{
+		Name:  "pattern-ids",
+		Usage: "add the ID of the pattern of their message to events, as listed by humanlog patterns",
+	}
+
+	tags := cli.StringSliceFlag{
+		Name:  "tag",
+		Usage: "label attached to the events sent to humanlog, i.e. --tag env=prod (can be repeated)",
+	}
+
+	minLevel := cli.StringFlag{
+		Name:  "min-level",
+		Usage: "only show events of this level or more severe: " + strings.Join(filtersink.Levels, ", "),
+	}
+
+	where := cli.StringFlag{
+		Name:  "where",
+		Usage: "only show events matching this LogQL expression, i.e. 'service == \"api\" && status >= 500'",
+	}
+
+	query := cli.StringFlag{
+		Name:  "query",
+		Usage: "evaluate this LogQL query over the input, i.e. 'where status >= 500 | summarize count() by service | sort by count() desc'",
+	}
+
+	grep := cli.StringFlag{
+		Name:  "grep",
+		Usage: "only show lines matching this regexp, and highlight what it matches",
+	}
+
+	since := cli.StringFlag{
+		Name:  "since",
+		Usage: "only show events timestamped at or after this time, i.e. 2024-12-13T19:30:00Z, 19:30 or 15m (ago)",
+	}
+
+	until := cli.StringFlag{
+		Name:  "until",
+		Usage: "only show events timestamped before this time, in the same formats as --since",
+	}
+
+	sorted := cli.BoolFlag{
+		Name:  "sorted",
+		Usage: "the input is sorted by time, stop reading it once past --until (unless logs are sent to be stored, which needs all of it)",
+	}
+
+	afterContext := cli.IntFlag{
+		Name:  "after-context, A",
+		Usage: "show this many events after each event that is shown by the filters above",
+	}
+
+	beforeContext := cli.IntFlag{
+		Name:  "before-context, B",
+		Usage: "show this many events before each event that is shown by the filters above",
+	}
+
+	contextLines := cli.IntFlag{
+		Name:  "context, C",
+		Usage: "show this many events before and after each event that is shown by the filters above",
+	}
+
+	pipelineStats := cli.BoolFlag{
+		Name:  "stats",
+		Usage: "when done, print how many events each stage received, sent and dropped, and how long sending them took",
+	}
+
 	ignoreInterrupts := cli.BoolFlag{
 		Name:  "ignore-interrupts, i",
 		Usage: "ignore interrupts",
@@ -399,8 +551,11 @@ func newApp() *cli.App {
 		machineCmd(getCtx, getLogger, getCfg, getState, getTokenSource, getAPIUrl, getHTTPClient),
 		queryCmd(getCtx, getLogger, getCfg, getState, getTokenSource, getAPIUrl, getHTTPClient),
 		gennyCmd(getCtx, getLogger, getCfg, getState),
+		patternsCmd(getCtx, getLogger, getCfg, getState),
+		statsCmd(getCtx, getLogger, getCfg, getState),
+		chartCmd(getCtx, getLogger, getCfg, getState, getHTTPClient),
 	)
-	app.Flags = []cli.Flag{configFlag, skipFlag, keepFlag, sortLongest, skipUnchanged, truncates, truncateLength, colorFlag, lightBg, timeFormat, ignoreInterrupts, messageFieldsFlag, timeFieldsFlag, levelFieldsFlag, apiServerAddr}
+	app.Flags = []cli.Flag{configFlag, skipFlag, keepFlag, sortLongest, skipUnchanged, truncates, truncateLength, truncateStrategy, colorFlag, lightBg, detectBg, theme, hashColorKeysFlag, timeFormat, timeMode, slowGap, hyperlinks, sourceRoot, editorURL, traceURL, statusLine, dedup, groupBy, groupIdle, patternIDs, tags, minLevel, where, query, grep, since, until, sorted, afterContext, beforeContext, contextLines, pipelineStats, ignoreInterrupts, messageFieldsFlag, timeFieldsFlag, levelFieldsFlag, apiServerAddr}
 	app.Action = func(cctx *cli.Context) error {
 		// flags overwrite config file
 		if cctx.IsSet(sortLongest.Name) {
@@ -415,12 +570,55 @@ func newApp() *cli.App {
 		if cctx.IsSet(truncateLength.Name) {
 			cfg.TruncateLength = ptr(cctx.Int(truncateLength.Name))
 		}
+		if cctx.IsSet(truncateStrategy.Name) {
+			cfg.TruncateStrategy = ptr(cctx.String(truncateStrategy.Name))
+		}
 		if cctx.IsSet(lightBg.Name) {
 			cfg.LightBg = ptr(cctx.Bool(lightBg.Name))
 		}
+		if cctx.IsSet(detectBg.Name) {
+			cfg.DetectBg = ptr(cctx.BoolT(detectBg.Name))
+		}
+		if cctx.IsSet(theme.Name) {
+			cfg.Theme = ptr(cctx.String(theme.Name))
+		}
+		if cctx.IsSet(hashColorKeysFlag.Name) {
+			cfg.HashColorKeys = ptr([]string(hashColorKeys))
+		}
 		if cctx.IsSet(timeFormat.Name) {
 			cfg.TimeFormat = ptr(cctx.String(timeFormat.Name))
 		}
+		if cctx.IsSet(timeMode.Name) {
+			cfg.TimeMode = ptr(cctx.String(timeMode.Name))
+		}
+		if cctx.IsSet(slowGap.Name) {
+			cfg.SlowGap = ptr(cctx.String(slowGap.Name))
+		}
+		if cctx.IsSet(hyperlinks.Name) || cctx.IsSet(sourceRoot.Name) || cctx.IsSet(editorURL.Name) || cctx.IsSet(traceURL.Name) {
+			var hl config.Hyperlinks
+			if cfg.Hyperlinks != nil {
+				hl = *cfg.Hyperlinks
+			}
+			if cctx.IsSet(hyperlinks.Name) {
+				hl.Mode = ptr(cctx.String(hyperlinks.Name))
+			}
+			if cctx.IsSet(sourceRoot.Name) {
+				hl.SourceRoot = ptr(cctx.String(sourceRoot.Name))
+			}
+			if cctx.IsSet(editorURL.Name) {
+				hl.EditorURL = ptr(cctx.String(editorURL.Name))
+			}
+			if cctx.IsSet(traceURL.Name) {
+				hl.TraceURL = ptr(cctx.String(traceURL.Name))
+			}
+			cfg.Hyperlinks = &hl
+		}
+		if cctx.IsSet(statusLine.Name) {
+			cfg.StatusLine = ptr(cctx.Bool(statusLine.Name))
+		}
+		if cctx.IsSet(patternIDs.Name) {
+			cfg.PatternIDs = ptr(cctx.Bool(patternIDs.Name))
+		}
 		if cctx.IsSet(colorFlag.Name) {
 			cfg.ColorMode = ptr(cctx.String(colorFlag.Name))
 		}
@@ -442,6 +640,34 @@ func newApp() *cli.App {
 			cfg.LevelFields = ptr([]string(levelFields))
 		}
 
+		if cctx.IsSet(dedup.Name) {
+			stdioDedup := config.DedupSink{}
+			if cfg.Dedup != nil && cfg.Dedup.Stdio != nil {
+				stdioDedup = *cfg.Dedup.Stdio
+			}
+			stdioDedup.Window = ptr(cctx.String(dedup.Name))
+			dedupCfg := config.Dedup{}
+			if cfg.Dedup != nil {
+				dedupCfg = *cfg.Dedup
+			}
+			dedupCfg.Stdio = &stdioDedup
+			cfg.Dedup = &dedupCfg
+		}
+
+		if cctx.IsSet(groupBy.Name) || cctx.IsSet(groupIdle.Name) {
+			group := config.Group{}
+			if cfg.Group != nil {
+				group = *cfg.Group
+			}
+			if cctx.IsSet(groupBy.Name) {
+				group.Keys = ptr(strings.Split(cctx.String(groupBy.Name), ","))
+			}
+			if cctx.IsSet(groupIdle.Name) {
+				group.Idle = ptr(cctx.String(groupIdle.Name))
+			}
+			cfg.Group = &group
+		}
+
 		if cctx.IsSet(strings.Split(ignoreInterrupts.Name, ",")[0]) {
 			cfg.Interrupt = ptr(cctx.Bool(strings.Split(ignoreInterrupts.Name, ",")[0]))
 		}
@@ -450,11 +676,13 @@ func newApp() *cli.App {
 		if *cfg.Interrupt {
 			signal.Ignore(os.Interrupt)
 		}
-
-		if cfg.Skip != nil && cfg.Keep != nil {
-			if len(*cfg.Skip) > 0 && len(*cfg.Keep) > 0 {
-				fatalf(cctx, "can only use one of %q and %q", skipFlag.Name, keepFlag.Name)
-			}
+		if cctx.Bool(pipelineStats.Name) {
+			// deferred first so that it's printed after the sinks flushed
+			defer func() {
+				if err := printPipelineStats(os.Stderr); err != nil {
+					logerror("couldn't print --%s: %v", pipelineStats.Name, err)
+				}
+			}()
 		}
 
 		sinkOpts, errs := stdiosink.StdioOptsFrom(*cfg)
@@ -463,10 +691,173 @@ func newApp() *cli.App {
 				logerror("config error: %v", err)
 			}
 		}
+		// the background is only detected when light-bg wasn't set, by the
+		// flag or in the config
+		if cfg.LightBg == nil && cfg.DetectBg != nil && *cfg.DetectBg && isatty.IsTerminal(os.Stdout.Fd()) {
+			if light, ok := stdiosink.DetectLightBg(500 * time.Millisecond); ok {
+				logdebug("detected a light terminal background: %v", light)
+				sinkOpts.LightBg = light
+			}
+		}
+		if cfg.Hyperlinks != nil && cfg.Hyperlinks.Mode != nil {
+			if mode, _ := config.GrokColorMode(*cfg.Hyperlinks.Mode); mode == config.ColorModeAuto {
+				sinkOpts.Hyperlinks = isatty.IsTerminal(os.Stdout.Fd())
+			}
+		}
+		sinkOpts.TermWidth = stdiosink.DetectTermWidth(os.Stdout.Fd())
+
+		filterOpts := filtersink.Opts{MinLevel: cctx.String(minLevel.Name)}
+		if expr := cctx.String(where.Name); expr != "" {
+			var err error
+			filterOpts.Where, err = logqleval.ParseFilter(expr)
+			if err != nil {
+				fatalf(cctx, "invalid --%s: %v", where.Name, err)
+			}
+		}
+		if pattern := cctx.String(grep.Name); pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fatalf(cctx, "invalid --%s: %v", grep.Name, err)
+			}
+			filterOpts.Grep = re
+			sinkOpts.Highlight = re
+		}
+		loc := sinkOpts.TimeZone
+		if loc == nil {
+			loc = time.Local
+		}
+		now := time.Now()
+		if bound := cctx.String(since.Name); bound != "" {
+			var err error
+			if filterOpts.Since, err = filtersink.ParseTimeBound(bound, now, loc); err != nil {
+				fatalf(cctx, "invalid --%s: %v", since.Name, err)
+			}
+		}
+		if bound := cctx.String(until.Name); bound != "" {
+			var err error
+			if filterOpts.Until, err = filtersink.ParseTimeBound(bound, now, loc); err != nil {
+				fatalf(cctx, "invalid --%s: %v", until.Name, err)
+			}
+		}
+		filterOpts.Sorted = cctx.Bool(sorted.Name)
+		if filterOpts.Sorted && cfg.ExperimentalFeatures != nil &&
+			((cfg.ExperimentalFeatures.SendLogsToCloud != nil && *cfg.ExperimentalFeatures.SendLogsToCloud) || cfg.ExperimentalFeatures.ServeLocalhost != nil) {
+			// the lines past --until are still sent to be stored
+			logwarn("--%s has no effect while logs are sent to be stored, all the input is read", sorted.Name)
+			filterOpts.Sorted = false
+		}
+		filterOpts.Before = cctx.Int(strings.Split(contextLines.Name, ",")[0])
+		filterOpts.After = filterOpts.Before
+		if cctx.IsSet(strings.Split(beforeContext.Name, ",")[0]) {
+			filterOpts.Before = cctx.Int(strings.Split(beforeContext.Name, ",")[0])
+		}
+		if cctx.IsSet(strings.Split(afterContext.Name, ",")[0]) {
+			filterOpts.After = cctx.Int(strings.Split(afterContext.Name, ",")[0])
+		}
+		if filterOpts.Before > 0 || filterOpts.After > 0 {
+			filterOpts.Separator = []byte("--")
+		}
+		var reportedWhereErr bool
+		filterOpts.OnError = func(err error) {
+			if !reportedWhereErr {
+				reportedWhereErr = true
+				logwarn("can't evaluate --%s on some events, hiding them: %v", where.Name, err)
+			}
+		}
+
+		var parsedQuery *logqleval.Query
+		if q := cctx.String(query.Name); q != "" {
+			var err error
+			if parsedQuery, err = logqleval.ParseQuery(q); err != nil {
+				fatalf(cctx, "invalid --%s: %v", query.Name, err)
+			}
+		}
+
 		var sink sink.Sink
-		sink = stdiosink.NewStdio(colorable.NewColorableStdout(), sinkOpts)
-		handlerOpts := humanlog.HandlerOptionsFrom(*cfg)
+		stdio := stdiosink.NewStdio(colorable.NewColorableStdout(), sinkOpts)
+		sink = stdio
+		// tables are printed at the end, there's nothing to keep counts of
+		showStatusLine := parsedQuery == nil || !parsedQuery.Tabular()
+		if cfg.StatusLine != nil && *cfg.StatusLine && showStatusLine && isatty.IsTerminal(os.Stdout.Fd()) {
+			statusSink := stdiosink.NewStatusLine(stdio, stdiosink.DefaultStatusLineInterval)
+			defer func() {
+				if err := statusSink.Close(context.Background()); err != nil {
+					logerror("couldn't clear the status line: %v", err)
+				}
+			}()
+			sink = statusSink
+		}
+		if opts, ok, err := groupsink.OptsFrom(cfg.Group); err != nil {
+			fatalf(cctx, "invalid group: %v", err)
+		} else if ok {
+			grouper := groupsink.NewGrouper(sink, opts)
+			defer func() {
+				if err := grouper.Flush(context.Background()); err != nil {
+					logerror("couldn't print the grouped events: %v", err)
+				}
+			}()
+			sink = grouper
+		}
+		var stdioDedupCfg, remoteDedupCfg *config.DedupSink
+		if cfg.Dedup != nil {
+			stdioDedupCfg, remoteDedupCfg = cfg.Dedup.Stdio, cfg.Dedup.Remote
+		}
+		if opts, ok, err := dedupsink.OptsFrom(stdioDedupCfg); err != nil {
+			fatalf(cctx, "invalid dedup.stdio: %v", err)
+		} else if ok {
+			opts.Name, opts.ReportLimited = "stdio", true
+			stdioDedup := dedupsink.NewDeduper(sink, opts)
+			defer func() {
+				if err := stdioDedup.Flush(context.Background()); err != nil {
+					logerror("couldn't print the repeated events: %v", err)
+				}
+			}()
+			sink = stdioDedup
+		}
+		remoteDedupOpts, dedupRemote, err := dedupsink.OptsFrom(remoteDedupCfg)
+		if err != nil {
+			fatalf(cctx, "invalid dedup.remote: %v", err)
+		}
+		cliTags, err := enrichsink.ParseTags(cctx.StringSlice(tags.Name))
+		if err != nil {
+			fatalf(cctx, "invalid --tag: %v", err)
+		}
+		enrichOpts, enrich, err := enrichsink.OptsFrom(cfg.Enrich, cliTags)
+		if err != nil {
+			fatalf(cctx, "invalid enrich: %v", err)
+		}
+		// the remote sinks keep the most recent events when they can't keep
+		// up, and their errors don't stop the logs from being printed
+		remoteTeePolicy := teesink.Policy{Overflow: teesink.OverflowDropOldest, OnError: teesink.ErrorRetry}
+		asyncTeeOpts := teesink.AsyncOpts{OnError: func(branch string, err error) {
+			logerror("couldn't send logs: %v", err)
+		}}
+		var evaluator *logqleval.Evaluator
+		if parsedQuery != nil {
+			evaluator = logqleval.NewEvaluator(parsedQuery, sink)
+			var reportedQueryErr bool
+			evaluator.OnError = func(err error) {
+				if !reportedQueryErr {
+					reportedQueryErr = true
+					logwarn("can't evaluate --%s on some events, skipping them: %v", query.Name, err)
+				}
+			}
+			sink = evaluator
+		}
+		if filterOpts.MinLevel != "" || filterOpts.Where != nil || filterOpts.Grep != nil || !filterOpts.Since.IsZero() || !filterOpts.Until.IsZero() {
+			filter, err := filtersink.NewFilter(sink, filterOpts)
+			if err != nil {
+				fatalf(cctx, "invalid filter: %v", err)
+			}
+			sink = filter
+		}
+		handlerOpts, err := handlerOptionsFrom(cfg)
+		if err != nil {
+			fatalf(cctx, "%v", err)
+		}
 
+		// the localhost service evaluates the alerts on the events it's sent
+		forwardingToLocalhost := false
 		if cfg.ExperimentalFeatures != nil {
 			if cfg.ExperimentalFeatures.SendLogsToCloud != nil && *cfg.ExperimentalFeatures.SendLogsToCloud {
 				ll := getLogger(cctx)
@@ -507,6 +898,18 @@ func newApp() *cli.App {
 				if err != nil {
 					return fmt.Errorf("can't send logs: %v", err)
 				}
+				if enrich {
+					remotesink = enrichsink.NewEnricher(remotesink, enrichOpts)
+				}
+				if dedupRemote {
+					opts := remoteDedupOpts
+					opts.Name = "api"
+					remotesink = dedupsink.NewDeduper(remotesink, opts)
+				}
+				// so that sending logs never holds back printing them
+				remotesink = teesink.NewAsyncTeeSink(asyncTeeOpts, teesink.Branch{
+					Name: "api", Sink: remotesink, Policy: remoteTeePolicy,
+				})
 				defer func() {
 					ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
 					defer cancel()
@@ -518,7 +921,7 @@ func newApp() *cli.App {
 					}
 				}()
 				loginfo("saving to %s", apiURL)
-				sink = teesink.NewTeeSink(sink, remotesink)
+				sink = teesink.NewNamedTeeSink("api", sink, remotesink)
 			}
 
 			if cfg.ExperimentalFeatures.ServeLocalhost != nil {
@@ -539,9 +942,14 @@ func newApp() *cli.App {
 				}
 
 				machineID = uint64(*state.MachineID)
+				spl, err := openSpool(cfg, "local")
+				if err != nil {
+					fatalf(cctx, "%v", err)
+				}
 				localhostSink, done, err := dialLocalhostServer(
 					ctx, ll, machineID, localhostCfg.Port,
 					getLocalhostHTTPClient(cctx),
+					spl,
 					func(err error) {
 						logerror("unable to ingest logs with localhost: %v", err)
 					},
@@ -549,7 +957,22 @@ func newApp() *cli.App {
 				if err != nil {
 					logerror("failed to start localhost service: %v", err)
 				} else {
-					sink = teesink.NewTeeSink(sink, localhostSink)
+					if enrich {
+						enricher := enrichsink.NewEnricher(localhostSink, enrichOpts)
+						localhostSink, done = enricher, enricher.Close
+					}
+					if dedupRemote {
+						opts := remoteDedupOpts
+						opts.Name = "local"
+						deduper := dedupsink.NewDeduper(localhostSink, opts)
+						localhostSink, done = deduper, deduper.Close
+					}
+					async := teesink.NewAsyncTeeSink(asyncTeeOpts, teesink.Branch{
+						Name: "local", Sink: localhostSink, Policy: remoteTeePolicy,
+					})
+					localhostSink, done = async, async.Close
+					sink = teesink.NewNamedTeeSink("local", sink, localhostSink)
+					forwardingToLocalhost = true
 					defer func() {
 						ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
 						defer cancel()
@@ -564,6 +987,31 @@ func newApp() *cli.App {
 			}
 		}
 
+		if cfg.PatternIDs != nil && *cfg.PatternIDs {
+			sink = patterns.NewTagger(sink, patterns.NewMiner(patterns.Opts{}))
+		}
+
+		if cfg.Alerts != nil && len(*cfg.Alerts) > 0 && !forwardingToLocalhost {
+			rules, err := alertsink.RulesFrom(*cfg.Alerts)
+			if err != nil {
+				fatalf(cctx, "invalid alerts: %v", err)
+			}
+			alerts := alertsink.NewEngine(rules, alertsink.Opts{OnError: func(rule string, err error) {
+				logerror("couldn't notify about alert %q: %v", rule, err)
+			}})
+			defer alerts.Close()
+			sink = alerts.Wrap(sink)
+		}
+
+		// redact before anything is printed, stored or sent
+		redactOpts, err := redactsink.OptsFrom(*cfg)
+		if err != nil {
+			fatalf(cctx, "invalid redaction rules: %v", err)
+		}
+		if len(redactOpts.Rules) > 0 {
+			sink = redactsink.NewRedactor(sink, redactOpts)
+		}
+
 		in := os.Stdin
 		if isatty.IsTerminal(in.Fd()) {
 			loginfo("reading stdin...")
@@ -581,15 +1029,58 @@ func newApp() *cli.App {
 			}
 		}()
 
-		if err := humanlog.Scan(ctx, in, sink, handlerOpts); err != nil {
+		if err := humanlog.Scan(ctx, in, sink, handlerOpts); errors.Is(err, filtersink.ErrPastUntil) {
+			logdebug("stopped reading: %v", err)
+		} else if err != nil {
 			logerror("scanning caught an error: %v", err)
 		}
 
+		if evaluator != nil {
+			// results are still wanted when interrupted
+			if err := evaluator.Flush(context.WithoutCancel(ctx)); err != nil {
+				logerror("couldn't finish evaluating --%s: %v", query.Name, err)
+			} else if table := evaluator.Table(); table != nil {
+				rows := make([][]string, 0, len(table.Rows))
+				for _, row := range table.Rows {
+					cells := make([]string, 0, len(row))
+					for _, v := range row {
+						cells = append(cells, logqleval.FormatVal(v))
+					}
+					rows = append(rows, cells)
+				}
+				if err := stdio.WriteTable(table.Columns, rows); err != nil {
+					logerror("couldn't print the results of --%s: %v", query.Name, err)
+				}
+			}
+		}
+
 		return nil
 	}
 	return app
 }
 
+// handlerOptionsFrom are the options of the handlers of the events read,
+// with the transforms of the config.
+func handlerOptionsFrom(cfg *config.Config) (*humanlog.HandlerOptions, error) {
+	handlerOpts := humanlog.HandlerOptionsFrom(*cfg)
+	transforms, err := humanlog.TransformsFrom(*cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transforms: %v", err)
+	}
+	handlerOpts.Transforms = transforms
+	return handlerOpts, nil
+}
+
+// scanStdin reads the events of stdin for the commands that summarize them.
+// What they summarized so far is still wanted when interrupted, so they
+// carry on once the scan stops.
+func scanStdin(ctx context.Context, sink sink.Sink, handlerOpts *humanlog.HandlerOptions) error {
+	if err := humanlog.Scan(ctx, os.Stdin, sink, handlerOpts); err != nil {
+		return fmt.Errorf("scanning caught an error: %v", err)
+	}
+	return nil
+}
+
 func ptr[T any](v T) *T {
 	return &v
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/internal/pkg/state"
+	"github.com/humanlogio/humanlog/pkg/patterns"
+	"github.com/humanlogio/humanlog/pkg/sink/stdiosink"
+	"github.com/mattn/go-colorable"
+	"github.com/urfave/cli"
+)
+
+const (
+	patternsCmdName = "patterns"
+)
+
+func patternsCmd(
+	getCtx func(cctx *cli.Context) context.Context,
+	getLogger func(cctx *cli.Context) *slog.Logger,
+	getCfg func(cctx *cli.Context) *config.Config,
+	getState func(cctx *cli.Context) *state.State,
+) cli.Command {
+
+	topFlag := cli.IntFlag{
+		Name:  "top",
+		Usage: "only show this many of the most frequent patterns, 0 shows them all",
+	}
+	similarityFlag := cli.Float64Flag{
+		Name:  "similarity",
+		Usage: "share of tokens a message must have in common with a pattern to be one of its messages, between 0 and 1",
+		Value: patterns.DefaultSimilarity,
+	}
+
+	return cli.Command{
+		Name:  patternsCmdName,
+		Usage: "Read logs from stdin and print the patterns of their messages, with counts",
+		Flags: []cli.Flag{
+			topFlag,
+			similarityFlag,
+		},
+
+		Action: func(cctx *cli.Context) error {
+			ctx := getCtx(cctx)
+			cfg := getCfg(cctx)
+
+			similarity := cctx.Float64(similarityFlag.Name)
+			if similarity <= 0 || similarity > 1 {
+				return fmt.Errorf("--%s must be between 0 and 1, not %v", similarityFlag.Name, similarity)
+			}
+			handlerOpts, err := handlerOptionsFrom(cfg)
+			if err != nil {
+				return err
+			}
+			sinkOpts, errs := stdiosink.StdioOptsFrom(*cfg)
+			if len(errs) > 0 {
+				for _, err := range errs {
+					logerror("config error: %v", err)
+				}
+			}
+
+			miner := patterns.NewMiner(patterns.Opts{Similarity: similarity})
+			tagger := patterns.NewTagger(discardSink{}, miner)
+			if err := scanStdin(ctx, tagger, handlerOpts); err != nil {
+				return err
+			}
+
+			clusters := miner.Clusters()
+			if top := cctx.Int(topFlag.Name); top > 0 && top < len(clusters) {
+				clusters = clusters[:top]
+			}
+			loc := sinkOpts.TimeZone
+			if loc == nil {
+				loc = time.Local
+			}
+			formatTime := func(t time.Time) string {
+				if t.IsZero() {
+					return ""
+				}
+				return t.In(loc).Format(sinkOpts.TimeFormat)
+			}
+			rows := make([][]string, 0, len(clusters))
+			for _, c := range clusters {
+				rows = append(rows, []string{
+					c.ID,
+					strconv.FormatInt(c.Count, 10),
+					formatTime(c.First),
+					formatTime(c.Last),
+					c.Template(),
+					strings.Join(c.Variables(), ", "),
+				})
+			}
+			stdio := stdiosink.NewStdio(colorable.NewColorableStdout(), sinkOpts)
+			return stdio.WriteTable([]string{patterns.Key, "count", "first_seen", "last_seen", "template", "example"}, rows)
+		},
+	}
+}
+
+// discardSink drops the events, when only what's learned from them matters.
+type discardSink struct{}
+
+func (discardSink) Receive(ctx context.Context, ev *typesv1.LogEvent) error { return nil }
+func (discardSink) Close(ctx context.Context) error                         { return nil }
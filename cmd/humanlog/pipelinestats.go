@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/humanlogio/humanlog/pkg/metrics"
+)
+
+// pipelineStages are in the order events go through them, the stages of
+// the sinks sending events to a humanlog service come after. Stages named
+// after an instance, like "tee:api", are ordered with their kind.
+var pipelineStages = []string{"scan", "tee", "queue", "buffer", "batch", "spool"}
+
+// stageRank is the position of the kind of the stage in pipelineStages, or
+// len(pipelineStages) if it isn't one of them.
+func stageRank(stage string) int {
+	kind, _, _ := strings.Cut(stage, ":")
+	if i := slices.Index(pipelineStages, kind); i >= 0 {
+		return i
+	}
+	return len(pipelineStages)
+}
+
+type stageStats struct {
+	received, sent, dropped, retried, queued float64
+	batches, sends                           uint64
+	batchSize, sendMs                        float64
+}
+
+// printPipelineStats prints a summary of the metrics of the pipeline, as
+// asked with --stats.
+func printPipelineStats(w io.Writer) error {
+	stages := make(map[string]*stageStats)
+	for _, s := range metrics.Pipeline.Snapshot() {
+		stage := s.Labels["stage"]
+		st, ok := stages[stage]
+		if !ok {
+			st = &stageStats{}
+			stages[stage] = st
+		}
+		switch s.Name {
+		case "humanlog_events_received_total":
+			st.received = s.Value
+		case "humanlog_events_sent_total":
+			st.sent = s.Value
+		case "humanlog_events_dropped_total":
+			st.dropped = s.Value
+		case "humanlog_send_retries_total":
+			st.retried = s.Value
+		case "humanlog_queue_depth":
+			st.queued = s.Value
+		case "humanlog_batch_size":
+			st.batches, st.batchSize = s.Count, s.Sum
+		case "humanlog_send_latency_ms":
+			st.sends, st.sendMs = s.Count, s.Sum
+		}
+	}
+	order := make([]string, 0, len(stages))
+	for stage := range stages {
+		order = append(order, stage)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		ri, rj := stageRank(order[i]), stageRank(order[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return order[i] < order[j]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "stage\treceived\tsent\tdropped\tretried\tqueued\tbatches\tavg batch\tavg send\t")
+	for _, stage := range order {
+		st := stages[stage]
+		avgBatch, avgSend := "-", "-"
+		if st.batches > 0 {
+			avgBatch = strconv.FormatFloat(st.batchSize/float64(st.batches), 'f', 1, 64)
+		}
+		if st.sends > 0 {
+			avgSend = strconv.FormatFloat(st.sendMs/float64(st.sends), 'f', 1, 64) + "ms"
+		}
+		fmt.Fprintf(tw, "%s\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f\t%d\t%s\t%s\t\n",
+			stage, st.received, st.sent, st.dropped, st.retried, st.queued, st.batches, avgBatch, avgSend)
+	}
+	return tw.Flush()
+}
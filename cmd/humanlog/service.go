@@ -34,7 +34,12 @@ import (
 	"github.com/humanlogio/humanlog/internal/pkg/state"
 	"github.com/humanlogio/humanlog/pkg/auth"
 	"github.com/humanlogio/humanlog/pkg/localstorage"
+	"github.com/humanlogio/humanlog/pkg/metrics"
 	"github.com/humanlogio/humanlog/pkg/retry"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/humanlogio/humanlog/pkg/sink/alertsink"
+	"github.com/humanlogio/humanlog/pkg/sink/metricsink"
+	"github.com/humanlogio/humanlog/pkg/sink/tapsink"
 	ksvc "github.com/kardianos/service"
 	"github.com/rs/cors"
 	"github.com/urfave/cli"
@@ -415,6 +420,33 @@ func (hdl *serviceHandler) runLocalhost(
 		}
 	}()
 
+	var (
+		observers = []func(*typesv1.LogEvent){func(*typesv1.LogEvent) {
+			metrics.Received.Inc("service")
+		}}
+		registry *metrics.Registry
+	)
+	if hdl.config.Alerts != nil && len(*hdl.config.Alerts) > 0 {
+		rules, err := alertsink.RulesFrom(*hdl.config.Alerts)
+		if err != nil {
+			return fmt.Errorf("invalid alerts: %v", err)
+		}
+		alerts := alertsink.NewEngine(rules, alertsink.Opts{OnError: func(rule string, err error) {
+			ll.ErrorContext(ctx, "unable to notify about alert", slog.String("rule", rule), slog.Any("err", err))
+		}})
+		defer alerts.Close()
+		observers = append(observers, alerts.Observe)
+	}
+	if hdl.config.Metrics != nil && len(*hdl.config.Metrics) > 0 {
+		registry = metrics.NewRegistry()
+		deriver, err := metricsink.NewDeriver(registry, *hdl.config.Metrics)
+		if err != nil {
+			return fmt.Errorf("invalid metrics: %v", err)
+		}
+		observers = append(observers, deriver.Observe)
+	}
+	storage = tappedStorage{Storage: storage, observers: observers}
+
 	ll.InfoContext(ctx, "preparing localhost services")
 
 	mux := http.NewServeMux()
@@ -423,6 +455,10 @@ func (hdl *serviceHandler) runLocalhost(
 	mux.Handle(localhostv1connect.NewLocalhostServiceHandler(localhostsvc))
 	mux.Handle(ingestv1connect.NewIngestServiceHandler(localhostsvc))
 	mux.Handle(queryv1connect.NewQueryServiceHandler(localhostsvc))
+	if registry != nil {
+		mux.Handle("/metrics", registry.Handler())
+	}
+	mux.Handle("/debug/metrics", metrics.Pipeline.Handler())
 
 	httphdl := h2c.NewHandler(mux, &http2.Server{})
 	httphdl = withCORS(httphdl)
@@ -645,3 +681,18 @@ func withCORS(connectHandler http.Handler) http.Handler {
 	})
 	return c.Handler(connectHandler)
 }
+
+// tappedStorage has the events ingested observed, i.e. to count them,
+// evaluate alert rules and derive metrics from them.
+type tappedStorage struct {
+	localstorage.Storage
+	observers []func(*typesv1.LogEvent)
+}
+
+func (s tappedStorage) SinkFor(ctx context.Context, machineID, sessionID int64) (sink.Sink, time.Duration, error) {
+	snk, heartbeatIn, err := s.Storage.SinkFor(ctx, machineID, sessionID)
+	if err != nil {
+		return nil, heartbeatIn, err
+	}
+	return tapsink.NewTap(snk, s.observers...), heartbeatIn, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/internal/pkg/state"
+	"github.com/humanlogio/humanlog/pkg/sink/statsink"
+	"github.com/humanlogio/humanlog/pkg/sink/stdiosink"
+	"github.com/mattn/go-colorable"
+	"github.com/urfave/cli"
+)
+
+const (
+	statsCmdName = "stats"
+)
+
+func statsCmd(
+	getCtx func(cctx *cli.Context) context.Context,
+	getLogger func(cctx *cli.Context) *slog.Logger,
+	getCfg func(cctx *cli.Context) *config.Config,
+	getState func(cctx *cli.Context) *state.State,
+) cli.Command {
+
+	topFlag := cli.IntFlag{
+		Name:  "top",
+		Usage: "how many of the most frequent message templates and keys to show",
+		Value: statsink.DefaultTop,
+	}
+	jsonFlag := cli.BoolFlag{
+		Name:  "json",
+		Usage: "print the statistics as JSON",
+	}
+
+	return cli.Command{
+		Name:  statsCmdName,
+		Usage: "Read logs from stdin and print statistics about them",
+		Flags: []cli.Flag{
+			topFlag,
+			jsonFlag,
+		},
+
+		Action: func(cctx *cli.Context) error {
+			ctx := getCtx(cctx)
+			cfg := getCfg(cctx)
+
+			collector := statsink.NewCollector(cctx.Int(topFlag.Name))
+			handlerOpts, err := handlerOptionsFrom(cfg)
+			if err != nil {
+				return err
+			}
+			handlerOpts.OnHandled = collector.Handled
+			if err := scanStdin(ctx, collector, handlerOpts); err != nil {
+				return err
+			}
+			report := collector.Report()
+
+			if cctx.Bool(jsonFlag.Name) {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(report)
+			}
+			sinkOpts, errs := stdiosink.StdioOptsFrom(*cfg)
+			if len(errs) > 0 {
+				for _, err := range errs {
+					logerror("config error: %v", err)
+				}
+			}
+			return printStats(colorable.NewColorableStdout(), sinkOpts, report)
+		},
+	}
+}
+
+type statsTable struct {
+	columns []string
+	rows    [][]string
+}
+
+func printStats(w io.Writer, opts stdiosink.StdioOpts, r statsink.Report) error {
+	loc := opts.TimeZone
+	if loc == nil {
+		loc = time.Local
+	}
+	formatTime := func(t time.Time, layout string) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.In(loc).Format(layout)
+	}
+	percent := func(n int64) string {
+		if r.Events == 0 {
+			return strconv.FormatInt(n, 10)
+		}
+		return fmt.Sprintf("%d (%.1f%%)", n, 100*float64(n)/float64(r.Events))
+	}
+	counts := func(m map[string]int64) [][]string {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if m[names[i]] != m[names[j]] {
+				return m[names[i]] > m[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		rows := make([][]string, 0, len(names))
+		for _, name := range names {
+			rows = append(rows, []string{name, percent(m[name])})
+		}
+		return rows
+	}
+
+	perMinute := make([][]string, 0, len(r.PerMinute))
+	for _, m := range r.PerMinute {
+		perMinute = append(perMinute, []string{formatTime(m.Minute, "Jan _2 15:04"), strconv.FormatInt(m.Events, 10)})
+	}
+	templates := make([][]string, 0, len(r.Templates))
+	for _, t := range r.Templates {
+		templates = append(templates, []string{t.ID, strconv.FormatInt(t.Events, 10), t.Template})
+	}
+	keys := make([][]string, 0, len(r.Keys))
+	for _, k := range r.Keys {
+		cardinality := strconv.FormatInt(k.Cardinality, 10)
+		if k.Capped {
+			cardinality += "+"
+		}
+		keys = append(keys, []string{k.Key, strconv.FormatInt(k.Events, 10), cardinality})
+	}
+	tables := []statsTable{
+		{
+			[]string{"events", "structured", "raw", "first", "last", "rate"},
+			[][]string{{
+				strconv.FormatInt(r.Events, 10),
+				percent(r.Structured),
+				percent(r.Raw),
+				formatTime(r.First, opts.TimeFormat),
+				formatTime(r.Last, opts.TimeFormat),
+				fmt.Sprintf("%.1f/min", r.RatePerMinute),
+			}},
+		},
+		{[]string{"handler", "lines"}, counts(r.Handlers)},
+		{[]string{"level", "events"}, counts(r.Levels)},
+		{[]string{"minute", "events"}, perMinute},
+		{[]string{"pattern_id", "events", "template"}, templates},
+		{[]string{"key", "events", "cardinality"}, keys},
+	}
+
+	stdio := stdiosink.NewStdio(w, opts)
+	for i, table := range tables {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if err := stdio.WriteTable(table.columns, table.rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -57,7 +57,11 @@ func TestHarness(t *testing.T) {
 				t.Fatalf("errs=%v", errs)
 			}
 			s := stdiosink.NewStdio(gotw, sinkOpts)
-			err = Scan(ctx, bytes.NewReader(input), s, HandlerOptionsFrom(cfg))
+			handlerOpts := HandlerOptionsFrom(cfg)
+			if handlerOpts.Transforms, err = TransformsFrom(cfg); err != nil {
+				t.Fatalf("compiling transforms: %v", err)
+			}
+			err = Scan(ctx, bytes.NewReader(input), s, handlerOpts)
 			if err != nil {
 				t.Fatalf("scanning input: %v", err)
 			}
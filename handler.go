@@ -28,6 +28,13 @@ type HandlerOptions struct {
 	TimeFields    []string
 	MessageFields []string
 	LevelFields   []string
+	// Transforms are applied, in order, to each structured event.
+	Transforms []Transform
+	// OnHandled, if set, is called with the name of the handler that
+	// recognized each line, i.e. `HandlerJSON`, before the line's event is
+	// passed on to the sink. It's called with "" for lines that weren't
+	// recognized.
+	OnHandled func(handler string)
 
 	timeNow func() time.Time
 }
@@ -0,0 +1,65 @@
+package localsvc
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/humanlogio/humanlog/pkg/sink/logsvcsink"
+)
+
+// spooledSeqs remembers, per machine and session, the seq of the last event
+// stored from a spool. A spooled sink sends the events it wasn't told were
+// stored again, i.e. after a disconnect, and those that were are skipped.
+// It's kept in memory, so it's forgotten when the service restarts.
+type spooledSeqs struct {
+	mu   sync.Mutex
+	last map[spooledSession]uint64
+}
+
+type spooledSession struct {
+	machineID, sessionID int64
+}
+
+// parseSpoolSeqs reads the seqs of the first and last events of a stream,
+// which spooled sinks set in `logsvcsink.SpoolSeqsHeader`.
+func parseSpoolSeqs(h http.Header) (first, last uint64, ok bool) {
+	firstStr, lastStr, found := strings.Cut(h.Get(logsvcsink.SpoolSeqsHeader), "-")
+	if !found {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseUint(firstStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	last, err = strconv.ParseUint(lastStr, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// stored is how many of the events from `first` to `last` of the session
+// were stored already.
+func (s *spooledSeqs) stored(session spooledSession, first, last uint64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.last[session]
+	if !ok || prev < first {
+		return 0
+	}
+	return int(min(prev, last) - first + 1)
+}
+
+// store records that the events of the session up to `last` were stored.
+func (s *spooledSeqs) store(session spooledSession, last uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		s.last = make(map[spooledSession]uint64)
+	}
+	if last > s.last[session] {
+		s.last[session] = last
+	}
+}
@@ -0,0 +1,134 @@
+package localsvc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/humanlogio/api/go/svc/ingest/v1/ingestv1connect"
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/state"
+	"github.com/humanlogio/humanlog/pkg/localstorage"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/humanlogio/humanlog/pkg/sink/logsvcsink"
+	"github.com/humanlogio/humanlog/pkg/spool"
+	"github.com/stretchr/testify/require"
+)
+
+// memStorage stores the raw lines of the events it's sent.
+type memStorage struct {
+	localstorage.Storage
+
+	mu     sync.Mutex
+	stored []string
+}
+
+func (s *memStorage) SinkFor(ctx context.Context, machineID, sessionID int64) (sink.Sink, time.Duration, error) {
+	return memSink{s}, time.Hour, nil
+}
+
+func (s *memStorage) Heartbeat(ctx context.Context, machineID, sessionID int64) (time.Duration, error) {
+	return time.Hour, nil
+}
+
+func (s *memStorage) lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.stored...)
+}
+
+type memSink struct{ s *memStorage }
+
+func (m memSink) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.stored = append(m.s.stored, string(ev.Raw))
+	return nil
+}
+
+func (m memSink) Close(ctx context.Context) error { return nil }
+
+// loseFirstAck has the first stream stored, but fails to confirm it, as if
+// the connection broke right after.
+type loseFirstAck struct {
+	mu   sync.Mutex
+	lost bool
+}
+
+func (l *loseFirstAck) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc { return next }
+
+func (l *loseFirstAck) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (l *loseFirstAck) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		l.mu.Lock()
+		lose := !l.lost
+		l.lost = true
+		l.mu.Unlock()
+		if lose {
+			conn = ackless{conn}
+		}
+		return next(ctx, conn)
+	}
+}
+
+type ackless struct{ connect.StreamingHandlerConn }
+
+func (ackless) Send(any) error {
+	return connect.NewError(connect.CodeUnavailable, errors.New("connection reset"))
+}
+
+func TestIngestStreamSkipsReplayedEvents(t *testing.T) {
+	storage := &memStorage{}
+	svc := New(slog.Default(), &state.State{}, &typesv1.Version{}, storage)
+	mux := http.NewServeMux()
+	mux.Handle(ingestv1connect.NewIngestServiceHandler(svc, connect.WithInterceptors(&loseFirstAck{})))
+	srv := httptest.NewUnstartedServer(mux)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	client := ingestv1connect.NewIngestServiceClient(srv.Client(), srv.URL)
+
+	spl, err := spool.Open(t.TempDir(), spool.Opts{})
+	require.NoError(t, err)
+	ctx := context.Background()
+	snk := logsvcsink.StartSpooledStreamSink(ctx, slog.Default(), client, "local", 1, 100, time.Millisecond, spl, func(error) {})
+	for _, msg := range []string{"1", "2", "3"} {
+		require.NoError(t, snk.Receive(ctx, &typesv1.LogEvent{Raw: []byte(msg)}))
+	}
+	require.Eventually(t, func() bool { return spl.Pending() == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, snk.Receive(ctx, &typesv1.LogEvent{Raw: []byte("4")}))
+	require.NoError(t, snk.Close(ctx))
+
+	require.Equal(t, []string{"1", "2", "3", "4"}, storage.lines(), "what was stored before the ack was lost is stored once")
+}
+
+func TestSpooledSeqs(t *testing.T) {
+	var seqs spooledSeqs
+	session := spooledSession{machineID: 1, sessionID: 2}
+	require.Zero(t, seqs.stored(session, 1, 3))
+	seqs.store(session, 3)
+	require.Equal(t, 3, seqs.stored(session, 1, 3))
+	require.Equal(t, 2, seqs.stored(session, 2, 5), "the stream overlaps what was stored")
+	require.Zero(t, seqs.stored(session, 4, 5))
+	require.Zero(t, seqs.stored(spooledSession{machineID: 1, sessionID: 3}, 1, 3), "other sessions are apart")
+
+	h := http.Header{}
+	h.Set(logsvcsink.SpoolSeqsHeader, "4-7")
+	first, last, ok := parseSpoolSeqs(h)
+	require.True(t, ok)
+	require.Equal(t, []uint64{4, 7}, []uint64{first, last})
+	for _, bad := range []string{"", "4", "7-4", "a-b"} {
+		h.Set(logsvcsink.SpoolSeqsHeader, bad)
+		_, _, ok := parseSpoolSeqs(h)
+		require.False(t, ok, bad)
+	}
+}
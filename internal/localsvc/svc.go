@@ -27,6 +27,7 @@ type Service struct {
 	state      *state.State
 	ownVersion *typesv1.Version
 	storage    localstorage.Storage
+	spooled    spooledSeqs
 }
 
 func New(ll *slog.Logger, state *state.State, ownVersion *typesv1.Version, storage localstorage.Storage) *Service {
@@ -119,6 +120,21 @@ func (svc *Service) IngestStream(ctx context.Context, req *connect.ClientStream[
 		slog.Int64("session_id", sessionID),
 	)
 	ll.DebugContext(ctx, "receiving data from stream")
+
+	// the events a spooled sink sends again that were already stored are
+	// skipped, they're the first of the stream
+	session := spooledSession{machineID: machineID, sessionID: sessionID}
+	first, last, spooled := parseSpoolSeqs(req.RequestHeader())
+	var skip int
+	if spooled {
+		skip = svc.spooled.stored(session, first, last)
+	}
+	skipStored := func(evs []*typesv1.LogEvent) []*typesv1.LogEvent {
+		n := min(skip, len(evs))
+		skip -= n
+		return evs[n:]
+	}
+
 	snk, heartbeatIn, err := svc.storage.SinkFor(ctx, machineID, sessionID)
 	if err != nil {
 		ll.ErrorContext(ctx, "obtaining sink for stream", slog.Any("err", err))
@@ -136,7 +152,7 @@ func (svc *Service) IngestStream(ctx context.Context, req *connect.ClientStream[
 
 	if bsnk, ok := snk.(sink.BatchSink); ok {
 		// ingest the first message
-		msg.Events = fixEventsTimestamps(ctx, ll, msg.Events)
+		msg.Events = fixEventsTimestamps(ctx, ll, skipStored(msg.Events))
 		if err := bsnk.ReceiveBatch(ctx, msg.Events); err != nil {
 			ll.ErrorContext(ctx, "ingesting event batch", slog.Any("err", err))
 			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("ingesting event batch: %v", err))
@@ -144,7 +160,7 @@ func (svc *Service) IngestStream(ctx context.Context, req *connect.ClientStream[
 		// then wait for more
 		for req.Receive() {
 			msg := req.Msg()
-			msg.Events = fixEventsTimestamps(ctx, ll, msg.Events)
+			msg.Events = fixEventsTimestamps(ctx, ll, skipStored(msg.Events))
 			if err := bsnk.ReceiveBatch(ctx, msg.Events); err != nil {
 				ll.ErrorContext(ctx, "ingesting event batch", slog.Any("err", err))
 				return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("ingesting event batch: %v", err))
@@ -152,7 +168,7 @@ func (svc *Service) IngestStream(ctx context.Context, req *connect.ClientStream[
 		}
 	} else {
 		// ingest the first message
-		msg.Events = fixEventsTimestamps(ctx, ll, msg.Events)
+		msg.Events = fixEventsTimestamps(ctx, ll, skipStored(msg.Events))
 		for _, ev := range msg.Events {
 			if err := snk.Receive(ctx, ev); err != nil {
 				ll.ErrorContext(ctx, "ingesting event", slog.Any("err", err))
@@ -162,7 +178,7 @@ func (svc *Service) IngestStream(ctx context.Context, req *connect.ClientStream[
 		// then wait for more
 		for req.Receive() {
 			msg := req.Msg()
-			msg.Events = fixEventsTimestamps(ctx, ll, msg.Events)
+			msg.Events = fixEventsTimestamps(ctx, ll, skipStored(msg.Events))
 			for _, ev := range msg.Events {
 				if ev.ParsedAt != nil && ev.ParsedAt.Seconds < 0 {
 					ev.ParsedAt = timestamppb.Now()
@@ -183,6 +199,9 @@ func (svc *Service) IngestStream(ctx context.Context, req *connect.ClientStream[
 		ll.ErrorContext(ctx, "ingesting localhost stream", slog.Any("err", err))
 		return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("ingesting localhost stream: %v", err))
 	}
+	if spooled {
+		svc.spooled.store(session, last)
+	}
 	res := &igv1.IngestStreamResponse{
 		SessionId:   uint64(sessionID),
 		HeartbeatIn: durationpb.New(heartbeatIn),
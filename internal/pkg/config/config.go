@@ -12,21 +12,48 @@ import (
 
 var DefaultConfig = Config{
 	Version:             1,
-	Skip:                ptr([]string{}),
-	Keep:                ptr([]string{}),
-	TimeFields:          ptr([]string{"time", "ts", "@timestamp", "timestamp", "Timestamp"}),
-	MessageFields:       ptr([]string{"message", "msg", "Body"}),
-	LevelFields:         ptr([]string{"level", "lvl", "loglevel", "severity", "SeverityText"}),
-	SortLongest:         ptr(true),
-	SkipUnchanged:       ptr(true),
-	Truncates:           ptr(true),
-	LightBg:             ptr(false),
-	ColorMode:           ptr("auto"),
-	TruncateLength:      ptr(15),
-	TimeFormat:          ptr(time.Stamp),
-	Interrupt:           ptr(false),
-	SkipCheckForUpdates: ptr(false),
+	Skip:                Ptr([]string{}),
+	Keep:                Ptr([]string{}),
+	TimeFields:          Ptr([]string{"time", "ts", "@timestamp", "timestamp", "Timestamp"}),
+	MessageFields:       Ptr([]string{"message", "msg", "Body"}),
+	LevelFields:         Ptr([]string{"level", "lvl", "loglevel", "severity", "SeverityText"}),
+	SortLongest:         Ptr(true),
+	SkipUnchanged:       Ptr(true),
+	Truncates:           Ptr(true),
+	DetectBg:            Ptr(true),
+	ColorMode:           Ptr("auto"),
+	TruncateLength:      Ptr(15),
+	TruncateStrategy:    Ptr("end"),
+	TimeFormat:          Ptr(time.Stamp),
+	TimeMode:            Ptr("absolute"),
+	SlowGap:             Ptr("1s"),
+	Interrupt:           Ptr(false),
+	SkipCheckForUpdates: Ptr(false),
 	Palette:             nil,
+	Theme:               Ptr("default"),
+	HashColorKeys:       Ptr([]string{}),
+	ValueRenderers: Ptr([]ValueRenderer{
+		{Keys: []string{"*_ns", "*Ns"}, Types: []string{"int", "float"}, As: "duration_ns"},
+		{Keys: []string{"*_us", "*Us"}, Types: []string{"int", "float"}, As: "duration_us"},
+		{Keys: []string{"*_ms", "*Ms", "duration", "latency", "elapsed", "took"}, Types: []string{"int", "float"}, As: "duration_ms"},
+		{Keys: []string{"*_seconds", "*_secs"}, Types: []string{"int", "float"}, As: "duration_s"},
+		{Keys: []string{"bytes", "*_bytes", "size", "*_size", "content_length", "*.content_length"}, Types: []string{"int", "float"}, As: "bytes"},
+		{Keys: []string{"status", "status_code", "*_status", "*.status", "*.status_code"}, Types: []string{"int"}, As: "http_status"},
+		{Types: []string{"bool"}, As: "bool"},
+		{Types: []string{"time"}, As: "time"},
+		{Keys: []string{"*_at", "*_time", "*_ts"}, Types: []string{"string"}, As: "time"},
+	}),
+	Hyperlinks: &Hyperlinks{
+		Mode: Ptr("auto"),
+	},
+	StatusLine: Ptr(false),
+	Redact: &Redact{
+		Rules: Ptr([]RedactRule{
+			{Detector: "jwt", Action: "mask"},
+			{Detector: "bearer", Action: "mask"},
+			{Detector: "aws-key", Action: "mask"},
+		}),
+	},
 }
 
 func GetDefaultConfigFilepath() (string, error) {
@@ -115,23 +142,41 @@ func WriteConfigFile(path string, config *Config) error {
 }
 
 type Config struct {
-	Version             int          `json:"version"`
-	Skip                *[]string    `json:"skip"`
-	Keep                *[]string    `json:"keep"`
-	TimeFields          *[]string    `json:"time-fields"`
-	MessageFields       *[]string    `json:"message-fields"`
-	LevelFields         *[]string    `json:"level-fields"`
-	SortLongest         *bool        `json:"sort-longest"`
-	SkipUnchanged       *bool        `json:"skip-unchanged"`
-	Truncates           *bool        `json:"truncates"`
-	LightBg             *bool        `json:"light-bg"`
-	ColorMode           *string      `json:"color-mode"`
-	TruncateLength      *int         `json:"truncate-length"`
-	TimeFormat          *string      `json:"time-format"`
-	TimeZone            *string      `json:"time-zone"`
-	Palette             *TextPalette `json:"palette"`
-	Interrupt           *bool        `json:"interrupt"`
-	SkipCheckForUpdates *bool        `json:"skip_check_updates"`
+	Version             int              `json:"version"`
+	Skip                *[]string        `json:"skip"`
+	Keep                *[]string        `json:"keep"`
+	TimeFields          *[]string        `json:"time-fields"`
+	MessageFields       *[]string        `json:"message-fields"`
+	LevelFields         *[]string        `json:"level-fields"`
+	SortLongest         *bool            `json:"sort-longest"`
+	SkipUnchanged       *bool            `json:"skip-unchanged"`
+	Truncates           *bool            `json:"truncates"`
+	LightBg             *bool            `json:"light-bg"`
+	DetectBg            *bool            `json:"detect-bg"` // unless LightBg is set
+	ColorMode           *string          `json:"color-mode"`
+	TruncateLength      *int             `json:"truncate-length"`
+	TruncateStrategy    *string          `json:"truncate-strategy"`
+	TimeFormat          *string          `json:"time-format"`
+	TimeZone            *string          `json:"time-zone"`
+	TimeMode            *string          `json:"time-mode"`
+	SlowGap             *string          `json:"slow-gap"`
+	Palette             *TextPalette     `json:"palette"`
+	Theme               *string          `json:"theme"`
+	HashColorKeys       *[]string        `json:"hash-color-keys"`
+	ValueRenderers      *[]ValueRenderer `json:"value-renderers"`
+	Hyperlinks          *Hyperlinks      `json:"hyperlinks"`
+	StatusLine          *bool            `json:"status-line"`
+	PatternIDs          *bool            `json:"pattern-ids"`
+	Redact              *Redact          `json:"redact"`
+	Transforms          *[]Transform     `json:"transforms"`
+	Dedup               *Dedup           `json:"dedup"`
+	Enrich              *Enrich          `json:"enrich"`
+	Group               *Group           `json:"group"`
+	Alerts              *[]Alert         `json:"alerts"`
+	Metrics             *[]Metric        `json:"metrics"`
+	Spool               *Spool           `json:"spool"`
+	Interrupt           *bool            `json:"interrupt"`
+	SkipCheckForUpdates *bool            `json:"skip_check_updates"`
 
 	ExperimentalFeatures *Features `json:"experimental_features"`
 
@@ -160,26 +205,26 @@ func (cfg Config) populateEmpty(other *Config) *Config {
 	cpcfg := cfg
 	out := &cpcfg
 	if out.Skip == nil && out.Keep == nil {
-		// skip and keep are mutually exclusive, so these are
-		// either both set by default, or not at all
+		// keep overrides skip, so these are either both set
+		// by default, or not at all
 		out.Skip = other.Skip
 		out.Keep = other.Keep
 	}
 	if other.TimeFields != nil {
 		if out.TimeFields == nil {
-			out.TimeFields = ptr(make([]string, 0, len(*other.TimeFields)))
+			out.TimeFields = Ptr(make([]string, 0, len(*other.TimeFields)))
 		}
 		*out.TimeFields = append(*out.TimeFields, *other.TimeFields...)
 	}
 	if out.MessageFields == nil && other.MessageFields != nil {
 		if out.MessageFields == nil {
-			out.MessageFields = ptr(make([]string, 0, len(*other.MessageFields)))
+			out.MessageFields = Ptr(make([]string, 0, len(*other.MessageFields)))
 		}
 		*out.MessageFields = append(*out.MessageFields, *other.MessageFields...)
 	}
 	if out.LevelFields == nil && other.LevelFields != nil {
 		if out.LevelFields == nil {
-			out.LevelFields = ptr(make([]string, 0, len(*other.LevelFields)))
+			out.LevelFields = Ptr(make([]string, 0, len(*other.LevelFields)))
 		}
 		*out.LevelFields = append(*out.LevelFields, *other.LevelFields...)
 	}
@@ -195,21 +240,85 @@ func (cfg Config) populateEmpty(other *Config) *Config {
 	if out.LightBg == nil && other.LightBg != nil {
 		out.LightBg = other.LightBg
 	}
+	if out.DetectBg == nil && other.DetectBg != nil {
+		out.DetectBg = other.DetectBg
+	}
 	if out.ColorMode == nil && other.ColorMode != nil {
 		out.ColorMode = other.ColorMode
 	}
 	if out.TruncateLength == nil && other.TruncateLength != nil {
 		out.TruncateLength = other.TruncateLength
 	}
+	if out.TruncateStrategy == nil && other.TruncateStrategy != nil {
+		out.TruncateStrategy = other.TruncateStrategy
+	}
 	if out.TimeFormat == nil && other.TimeFormat != nil {
 		out.TimeFormat = other.TimeFormat
 	}
 	if out.TimeZone == nil && other.TimeZone != nil {
 		out.TimeZone = other.TimeZone
 	}
+	if out.TimeMode == nil && other.TimeMode != nil {
+		out.TimeMode = other.TimeMode
+	}
+	if out.SlowGap == nil && other.SlowGap != nil {
+		out.SlowGap = other.SlowGap
+	}
 	if out.Palette == nil && other.Palette != nil {
 		out.Palette = other.Palette
 	}
+	if out.Theme == nil && other.Theme != nil {
+		out.Theme = other.Theme
+	}
+	if out.HashColorKeys == nil && other.HashColorKeys != nil {
+		out.HashColorKeys = other.HashColorKeys
+	}
+	if out.ValueRenderers == nil && other.ValueRenderers != nil {
+		out.ValueRenderers = other.ValueRenderers
+	}
+	if out.Hyperlinks == nil && other.Hyperlinks != nil {
+		out.Hyperlinks = other.Hyperlinks
+	}
+	if out.StatusLine == nil && other.StatusLine != nil {
+		out.StatusLine = other.StatusLine
+	}
+	if out.PatternIDs == nil && other.PatternIDs != nil {
+		out.PatternIDs = other.PatternIDs
+	}
+	if out.Redact == nil && other.Redact != nil {
+		out.Redact = other.Redact
+	} else if out.Redact != nil && other.Redact != nil {
+		// setting only the hash key mustn't drop the default rules
+		redact := *out.Redact
+		if redact.Rules == nil {
+			redact.Rules = other.Redact.Rules
+		}
+		if redact.HashKey == nil {
+			redact.HashKey = other.Redact.HashKey
+		}
+		out.Redact = &redact
+	}
+	if out.Transforms == nil && other.Transforms != nil {
+		out.Transforms = other.Transforms
+	}
+	if out.Dedup == nil && other.Dedup != nil {
+		out.Dedup = other.Dedup
+	}
+	if out.Enrich == nil && other.Enrich != nil {
+		out.Enrich = other.Enrich
+	}
+	if out.Group == nil && other.Group != nil {
+		out.Group = other.Group
+	}
+	if out.Alerts == nil && other.Alerts != nil {
+		out.Alerts = other.Alerts
+	}
+	if out.Metrics == nil && other.Metrics != nil {
+		out.Metrics = other.Metrics
+	}
+	if out.Spool == nil && other.Spool != nil {
+		out.Spool = other.Spool
+	}
 	if out.Interrupt == nil && other.Interrupt != nil {
 		out.Interrupt = other.Interrupt
 	}
@@ -228,6 +337,7 @@ func (cfg Config) populateEmpty(other *Config) *Config {
 type TextPalette struct {
 	KeyColor              []string `json:"key"`
 	ValColor              []string `json:"val"`
+	ValLightBgColor       []string `json:"val_light_bg"`
 	TimeLightBgColor      []string `json:"time_light_bg"`
 	TimeDarkBgColor       []string `json:"time_dark_bg"`
 	MsgLightBgColor       []string `json:"msg_light_bg"`
@@ -243,6 +353,182 @@ type TextPalette struct {
 	UnknownLevelColor     []string `json:"unknown_level"`
 }
 
+// ValueRenderer renders values of matching keys and types in a more readable
+// way. `Keys` are glob patterns, `Types` are any of "string", "int", "float",
+// "bool", "time" or "duration". When either is empty, it matches everything.
+// `As` is one of "duration_ns", "duration_us", "duration_ms", "duration_s",
+// "bytes", "http_status", "bool" or "time". The default renderers are
+// replaced by those of the config file, `"value-renderers": []` turns them
+// off.
+type ValueRenderer struct {
+	Keys  []string `json:"keys,omitempty"`
+	Types []string `json:"types,omitempty"`
+	As    string   `json:"as"`
+}
+
+// Hyperlinks configures the OSC 8 links printed on values. `Mode` is "auto",
+// "on" or "off", like the color mode. `EditorURL` is a template such as
+// "vscode://file/{path}:{line}" and `TraceURL` one such as
+// "http://localhost:16686/trace/{value}".
+type Hyperlinks struct {
+	Mode       *string   `json:"mode"`
+	SourceRoot *string   `json:"source-root"`
+	EditorURL  *string   `json:"editor-url"`
+	CallerKeys *[]string `json:"caller-keys"`
+	TraceURL   *string   `json:"trace-url"`
+	TraceKeys  *[]string `json:"trace-keys"`
+}
+
+// Redact hides secrets and personal data from events before they're printed
+// or sent anywhere. Setting `Rules` replaces the default ones, which only
+// mask credentials. `HashKey`, when set, keys the hashes of the "hash"
+// action so that they can't be reversed by hashing guesses.
+type Redact struct {
+	Rules   *[]RedactRule `json:"rules"`
+	HashKey *string       `json:"hash-key"`
+}
+
+// RedactRule finds what to redact with either a built-in `Detector`
+// ("jwt", "bearer", "aws-key", "email", "credit-card" or "ip"), a regexp
+// `Pattern`, or `Keys` whose values are redacted whole, with the same
+// patterns as `Skip`. `Action` is "mask" (the default), "hash" or "drop".
+type RedactRule struct {
+	Name     string   `json:"name,omitempty"`
+	Detector string   `json:"detector,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+	Action   string   `json:"action,omitempty"`
+}
+
+// Transform changes the KVs of structured events before they reach any
+// sink, in the order the transforms are listed. `Op` is one of:
+//
+//   - "rename": moves the value of `Key` to `To`
+//   - "copy": copies the value of `Key` to `To`
+//   - "drop": removes `Key`, with the same patterns as `Skip`
+//   - "default": sets `Key` to `Value` when it's missing
+//   - "cast": converts the value of `Key` to `Type`, one of "string",
+//     "int", "float", "bool", "time" or "duration"
+//   - "extract": matches the regexp `Pattern` on the value of `Key`, and
+//     sets a key per named group to what it captured
+//   - "promote": makes the value of `Key` the "msg", "lvl" or "ts" (in
+//     `To`) of the event, and removes it from the KVs
+//   - "parse": derives fields from the value of `Key`, a `Type` of
+//     "user-agent", "url" or "ip". They're set under `To`, or `Key` if
+//     empty, i.e. "user_agent.browser". IP addresses are also matched
+//     against the CIDRs of the named `Ranges`
+//
+// `When`, a LogQL expression, limits the transform to the events it's
+// truthy on, i.e. `lvl == "" && exists(severity)`.
+type Transform struct {
+	Op      string              `json:"op"`
+	Key     string              `json:"key"`
+	To      string              `json:"to,omitempty"`
+	Value   interface{}         `json:"value,omitempty"`
+	Type    string              `json:"type,omitempty"`
+	Pattern string              `json:"pattern,omitempty"`
+	Ranges  map[string][]string `json:"ranges,omitempty"`
+	When    string              `json:"when,omitempty"`
+}
+
+// Dedup collapses repeated events and rate limits them, separately for what's
+// printed on `Stdio` and what's sent to `Remote` sinks, like the cloud or
+// localhost. Only what's printed gets warnings about the events that were
+// rate limited.
+type Dedup struct {
+	Stdio  *DedupSink `json:"stdio"`
+	Remote *DedupSink `json:"remote"`
+}
+
+// DedupSink collapses the repeats of an event seen within `Window`, a
+// duration like "5s", into one event. `RateLimits` are by level, with "*"
+// for the levels that aren't listed.
+type DedupSink struct {
+	Window     *string               `json:"window"`
+	RateLimits *map[string]RateLimit `json:"rate-limits"`
+}
+
+type RateLimit struct {
+	PerSecond float64 `json:"per-second"`
+	Burst     int     `json:"burst,omitempty"`
+}
+
+// Enrich attaches metadata about where events come from to those sent to
+// remote sinks, like the cloud or localhost. `Fields` are any of
+// "hostname", "pid", "user", "cwd", "git" (the branch and commit of the
+// current directory) and "k8s" (the pod and namespace from the downward API
+// env vars). `Tags` are added as they are. `Scope` is "event" to add them
+// to every structured event, or "session" to send them once, in an event
+// that starts the session.
+type Enrich struct {
+	Fields *[]string          `json:"fields"`
+	Tags   *map[string]string `json:"tags"`
+	Scope  *string            `json:"scope"`
+}
+
+// Spool writes the events sent to remote sinks, like the cloud or
+// localhost, to disk under the state dir before they're sent. Those that
+// couldn't be sent, because the sink was unreachable or humanlog exited
+// first, are sent once it's reachable again, or on the next run. It holds
+// at most `MaxBytes`, and drops events older than `MaxAge`, a duration
+// like "72h".
+type Spool struct {
+	Enabled  *bool   `json:"enabled"`
+	MaxBytes *int64  `json:"max-bytes"`
+	MaxAge   *string `json:"max-age"`
+}
+
+// Group prints the events that share a correlation key contiguously, once
+// none came for `Idle`, a duration like "2s". Events are grouped by the
+// first of the `Keys` they have. The spans of a group are nested under
+// their parents, by `SpanKey` and `ParentKey`.
+type Group struct {
+	Keys      *[]string `json:"keys"`
+	Idle      *string   `json:"idle"`
+	SpanKey   *string   `json:"span-key"`
+	ParentKey *string   `json:"parent-key"`
+}
+
+// Alert is a rule evaluated on the events as they're read, or by the
+// service when they're forwarded to it, and on those ingested by the
+// service. Events match it when they're at least at `Level` and `Where`, a
+// LogQL filter like `service == "payments"`, is truthy on them. It fires
+// when more than `Count` events matched within `Window` (1m by default), or
+// when `Absent` is set, once no event matched for that long. It's resolved
+// once that's no longer the case. `Debounce` (1m by default) is how long
+// after notifying the rule waits before notifying about firing again.
+// Notifications are sent to the desktop, POSTed as JSON to `Webhook`,
+// and/or passed to `Command`, which is run by the shell.
+type Alert struct {
+	Name     string `json:"name"`
+	Level    string `json:"level,omitempty"`
+	Where    string `json:"where,omitempty"`
+	Count    int    `json:"count,omitempty"`
+	Window   string `json:"window,omitempty"`
+	Absent   string `json:"absent,omitempty"`
+	Debounce string `json:"debounce,omitempty"`
+	Desktop  bool   `json:"desktop,omitempty"`
+	Webhook  string `json:"webhook,omitempty"`
+	Command  string `json:"command,omitempty"`
+}
+
+// Metric is derived from the events ingested by the service, and exposed in
+// the Prometheus format on the /metrics endpoint of the localhost server.
+// Only the events on which `Where`, a LogQL filter, is truthy are accounted
+// for. A "counter" counts them, or adds up their `Value` if it's set. A
+// "histogram" observes their `Value` into `Buckets`. `Value` and `Labels`
+// are keys or LogQL expressions, like `latency_ms` or `lvl`, and each value
+// of the `Labels` makes a series.
+type Metric struct {
+	Name    string    `json:"name"`
+	Help    string    `json:"help,omitempty"`
+	Type    string    `json:"type"`
+	Where   string    `json:"where,omitempty"`
+	Value   string    `json:"value,omitempty"`
+	Labels  []string  `json:"labels,omitempty"`
+	Buckets []float64 `json:"buckets,omitempty"`
+}
+
 type ColorMode int
 
 const (
@@ -264,6 +550,7 @@ func GrokColorMode(colorMode string) (ColorMode, error) {
 	}
 }
 
-func ptr[T any](v T) *T {
+// Ptr points to a copy of `v`, for setting the fields of a config.
+func Ptr[T any](v T) *T {
 	return &v
 }
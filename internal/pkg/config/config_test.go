@@ -2,6 +2,8 @@ package config
 
 import (
 	"encoding/json"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -18,30 +20,30 @@ func TestConfig_populateEmpty(t *testing.T) {
 		{
 			input: Config{},
 			other: &Config{
-				Skip: ptr([]string{"hello"}),
+				Skip: Ptr([]string{"hello"}),
 			},
 			want: &Config{
-				Skip: ptr([]string{"hello"}),
+				Skip: Ptr([]string{"hello"}),
 			},
 		},
 		{
 			input: Config{
-				Skip: ptr([]string{"hello"}),
+				Skip: Ptr([]string{"hello"}),
 			},
 			other: &Config{},
 			want: &Config{
-				Skip: ptr([]string{"hello"}),
+				Skip: Ptr([]string{"hello"}),
 			},
 		},
 		{
 			input: Config{
-				Skip: ptr([]string{"hello"}),
+				Skip: Ptr([]string{"hello"}),
 			},
 			other: &Config{
-				Skip: ptr([]string{"world"}),
+				Skip: Ptr([]string{"world"}),
 			},
 			want: &Config{
-				Skip: ptr([]string{"hello"}),
+				Skip: Ptr([]string{"hello"}),
 			},
 		},
 	}
@@ -66,3 +68,15 @@ func TestConfig_populateEmpty(t *testing.T) {
 		})
 	}
 }
+
+func TestReadConfigFileRedactHashKeyOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"redact": {"hash-key": "secret"}}`), 0600))
+
+	dflt := DefaultConfig
+	cfg, err := ReadConfigFile(path, &dflt)
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Redact)
+	require.Equal(t, "secret", *cfg.Redact.HashKey)
+	require.Equal(t, DefaultConfig.Redact.Rules, cfg.Redact.Rules, "the default rules are kept")
+}
@@ -0,0 +1,128 @@
+// Package keymatch matches the keys of structured log events against
+// user-given patterns.
+//
+// A pattern is one of:
+//
+//   - a plain key, i.e. `kubernetes`, which matches that key and every key
+//     flattened under it, like `kubernetes.pod.name`
+//   - a glob, i.e. `*_id` or `kubernetes.labels.*`, where `*` matches any
+//     run of characters (dots included), `?` a single character and
+//     `[...]` a class of characters. Like plain keys, a glob matching a
+//     prefix of a flattened key matches the whole key.
+//   - a regular expression between slashes, i.e. `/^(req|resp)_/`, which is
+//     matched as is against the full key.
+package keymatch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matcher matches keys against a set of patterns. A nil *Matcher matches
+// nothing.
+type Matcher struct {
+	exact    map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+// Compile builds a Matcher out of `patterns`. It returns nil if there are
+// no patterns.
+func Compile(patterns []string) (*Matcher, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	m := &Matcher{exact: make(map[string]struct{})}
+	for _, pattern := range patterns {
+		switch {
+		case isRegexp(pattern):
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid key pattern %q: %v", pattern, err)
+			}
+			m.patterns = append(m.patterns, re)
+		case isGlob(pattern):
+			re, err := globToRegexp(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key pattern %q: %v", pattern, err)
+			}
+			m.patterns = append(m.patterns, re)
+		default:
+			m.exact[pattern] = struct{}{}
+		}
+	}
+	return m, nil
+}
+
+// MustCompile is like Compile but panics on invalid patterns.
+func MustCompile(patterns ...string) *Matcher {
+	m, err := Compile(patterns)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Match reports whether `key` matches any of the patterns.
+func (m *Matcher) Match(key string) bool {
+	if m == nil {
+		return false
+	}
+	if len(m.exact) > 0 {
+		// `a.b.c` is matched by `a.b.c`, `a.b` and `a`
+		for prefix := key; ; {
+			if _, ok := m.exact[prefix]; ok {
+				return true
+			}
+			i := strings.LastIndexByte(prefix, '.')
+			if i <= 0 {
+				break
+			}
+			prefix = prefix[:i]
+		}
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegexp(pattern string) bool {
+	return len(pattern) >= 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/'
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// globToRegexp anchors the glob at both ends, allowing it to match a
+// dot-separated prefix of a key.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^(?:")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	sb.WriteString(`)(?:\..*)?$`)
+	return regexp.Compile(sb.String())
+}
@@ -0,0 +1,91 @@
+package keymatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		match    []string
+		noMatch  []string
+	}{
+		{
+			name:     "exact",
+			patterns: []string{"caller"},
+			match:    []string{"caller"},
+			noMatch:  []string{"callers", "the_caller", ""},
+		},
+		{
+			name:     "nested under a plain key",
+			patterns: []string{"kubernetes"},
+			match:    []string{"kubernetes", "kubernetes.pod", "kubernetes.labels.app"},
+			noMatch:  []string{"kubernetes_pod", "k8s.kubernetes"},
+		},
+		{
+			name:     "suffix glob",
+			patterns: []string{"*_id"},
+			match:    []string{"trace_id", "span_id", "req.user_id"},
+			noMatch:  []string{"id", "trace_ids"},
+		},
+		{
+			name:     "nested glob",
+			patterns: []string{"kubernetes.labels.*"},
+			match:    []string{"kubernetes.labels.app", "kubernetes.labels.app.version"},
+			noMatch:  []string{"kubernetes.labels", "kubernetes.pod"},
+		},
+		{
+			name:     "glob prefix of a nested key",
+			patterns: []string{"http?"},
+			match:    []string{"https", "https.status"},
+			noMatch:  []string{"http", "https_status"},
+		},
+		{
+			name:     "character class",
+			patterns: []string{"[!a]pp", "x[0-9]"},
+			match:    []string{"opp", "x1"},
+			noMatch:  []string{"app", "xa"},
+		},
+		{
+			name:     "regexp",
+			patterns: []string{"/^(req|resp)_/"},
+			match:    []string{"req_id", "resp_size"},
+			noMatch:  []string{"request", "x.req_id"},
+		},
+		{
+			name:     "many patterns",
+			patterns: []string{"pid", "*.secret", "/token/"},
+			match:    []string{"pid", "db.secret", "auth_token"},
+			noMatch:  []string{"ppid", "secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Compile(tt.patterns)
+			require.NoError(t, err)
+			for _, key := range tt.match {
+				require.True(t, m.Match(key), "%q should match %q", tt.patterns, key)
+			}
+			for _, key := range tt.noMatch {
+				require.False(t, m.Match(key), "%q shouldn't match %q", tt.patterns, key)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, pattern := range []string{"/(/", "a[b"} {
+		_, err := Compile([]string{pattern})
+		require.Error(t, err, pattern)
+	}
+}
+
+func TestNilMatcher(t *testing.T) {
+	m, err := Compile(nil)
+	require.NoError(t, err)
+	require.Nil(t, m)
+	require.False(t, m.Match("anything"))
+}
@@ -0,0 +1,717 @@
+// Package logqleval evaluates LogQL expressions against log events, without
+// needing a storage engine.
+package logqleval
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/humanlogio/api/go/pkg/logql"
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+)
+
+// ParseFilter parses the expression of a `where` statement, i.e.
+// `service == "api" && status >= 500`.
+func ParseFilter(s string) (*typesv1.Expr, error) {
+	q, err := logql.Parse("where " + s)
+	if err != nil {
+		return nil, err
+	}
+	stmts := q.GetQuery().GetStatements()
+	if len(stmts) != 1 || stmts[0].GetFilter() == nil || q.GetQuery().GetRender() != nil {
+		return nil, fmt.Errorf("%q isn't a single filter expression", s)
+	}
+	expr := stmts[0].GetFilter().GetExpr()
+	if err := compileLiterals(expr); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// Match reports whether `expr` evaluates to a truthy value on `ev`.
+func Match(expr *typesv1.Expr, ev *typesv1.LogEvent) (bool, error) {
+	v, err := Eval(expr, ev)
+	if err != nil {
+		return false, err
+	}
+	return Truthy(v), nil
+}
+
+// Eval evaluates `expr` on `ev`. Identifiers resolve, in order, to:
+//   - `ts`, `lvl`, `msg` and `raw`: the fields of the event
+//   - `kv`: an object holding all the KVs, for keys that aren't valid
+//     identifiers, i.e. `kv["user-agent"]`
+//   - anything else: the KV of that name. Selectors on identifiers, like
+//     `http.status`, resolve to the KVs that were flattened that way.
+//
+// Missing KVs evaluate to null.
+func Eval(expr *typesv1.Expr, ev *typesv1.LogEvent) (*typesv1.Val, error) {
+	switch e := expr.GetExpr().(type) {
+	case *typesv1.Expr_Literal:
+		return e.Literal, nil
+	case *typesv1.Expr_Identifier:
+		return identifier(e.Identifier.Name, ev), nil
+	case *typesv1.Expr_Selector:
+		if path, ok := selectorPath(expr); ok {
+			if v, ok := lookupKV(path, ev); ok {
+				return v, nil
+			}
+		}
+		x, err := Eval(e.Selector.X, ev)
+		if err != nil {
+			return nil, err
+		}
+		return field(x, e.Selector.Identifier.GetName()), nil
+	case *typesv1.Expr_Indexor:
+		x, err := Eval(e.Indexor.X, ev)
+		if err != nil {
+			return nil, err
+		}
+		index, err := Eval(e.Indexor.Index, ev)
+		if err != nil {
+			return nil, err
+		}
+		return indexOf(x, index)
+	case *typesv1.Expr_Unary:
+		arg, err := Eval(e.Unary.Arg, ev)
+		if err != nil {
+			return nil, err
+		}
+		return unary(e.Unary.Op, arg)
+	case *typesv1.Expr_Binary:
+		return binary(e.Binary, ev)
+	case *typesv1.Expr_FuncCall:
+		return call(e.FuncCall, ev)
+	default:
+		return nil, fmt.Errorf("unsupported expression %T", e)
+	}
+}
+
+func identifier(name string, ev *typesv1.LogEvent) *typesv1.Val {
+	data := ev.GetStructured()
+	switch name {
+	case "ts":
+		if data.GetTimestamp() == nil {
+			return typesv1.ValNull()
+		}
+		return typesv1.ValTimestamp(data.GetTimestamp())
+	case "lvl":
+		return typesv1.ValStr(data.GetLvl())
+	case "msg":
+		return typesv1.ValStr(data.GetMsg())
+	case "raw":
+		return typesv1.ValStr(string(ev.GetRaw()))
+	case "kv":
+		return typesv1.ValObj(data.GetKvs()...)
+	}
+	if v, ok := lookupKV(name, ev); ok {
+		return v
+	}
+	return typesv1.ValNull()
+}
+
+func lookupKV(key string, ev *typesv1.LogEvent) (*typesv1.Val, bool) {
+	for _, kv := range ev.GetStructured().GetKvs() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// selectorPath turns `a.b.c` back into the name of a flattened key.
+func selectorPath(expr *typesv1.Expr) (string, bool) {
+	switch e := expr.GetExpr().(type) {
+	case *typesv1.Expr_Identifier:
+		return e.Identifier.Name, true
+	case *typesv1.Expr_Selector:
+		prefix, ok := selectorPath(e.Selector.X)
+		if !ok {
+			return "", false
+		}
+		return prefix + "." + e.Selector.Identifier.GetName(), true
+	default:
+		return "", false
+	}
+}
+
+func field(x *typesv1.Val, name string) *typesv1.Val {
+	for _, kv := range x.GetObj().GetKvs() {
+		if kv.Key == name {
+			return kv.Value
+		}
+	}
+	return typesv1.ValNull()
+}
+
+func indexOf(x, index *typesv1.Val) (*typesv1.Val, error) {
+	switch xv := x.GetKind().(type) {
+	case *typesv1.Val_Obj:
+		key, ok := index.GetKind().(*typesv1.Val_Str)
+		if !ok {
+			return nil, fmt.Errorf("objects can only be indexed by strings, not %s", typeName(index))
+		}
+		return field(x, key.Str), nil
+	case *typesv1.Val_Arr:
+		i, ok := index.GetKind().(*typesv1.Val_I64)
+		if !ok {
+			return nil, fmt.Errorf("arrays can only be indexed by integers, not %s", typeName(index))
+		}
+		if i.I64 < 0 || i.I64 >= int64(len(xv.Arr.Items)) {
+			return typesv1.ValNull(), nil
+		}
+		return xv.Arr.Items[i.I64], nil
+	case *typesv1.Val_Null:
+		return x, nil
+	default:
+		return nil, fmt.Errorf("can't index a %s", typeName(x))
+	}
+}
+
+func unary(op typesv1.UnaryOp_Operator, arg *typesv1.Val) (*typesv1.Val, error) {
+	switch op {
+	case typesv1.UnaryOp_NOT:
+		return typesv1.ValBool(!Truthy(arg)), nil
+	case typesv1.UnaryOp_NEG:
+		switch v := arg.GetKind().(type) {
+		case *typesv1.Val_I64:
+			return typesv1.ValI64(-v.I64), nil
+		case *typesv1.Val_F64:
+			return typesv1.ValF64(-v.F64), nil
+		case *typesv1.Val_Dur:
+			return typesv1.ValDuration(-v.Dur.AsDuration()), nil
+		}
+		if f, ok := toFloat(arg); ok {
+			return typesv1.ValF64(-f), nil
+		}
+		return nil, fmt.Errorf("can't negate a %s", typeName(arg))
+	default:
+		return nil, fmt.Errorf("unsupported unary operator %v", op)
+	}
+}
+
+func binary(b *typesv1.BinaryOp, ev *typesv1.LogEvent) (*typesv1.Val, error) {
+	lhs, err := Eval(b.Lhs, ev)
+	if err != nil {
+		return nil, err
+	}
+	// short circuit before evaluating the right hand side
+	switch b.Op {
+	case typesv1.BinaryOp_LOG_AND:
+		if !Truthy(lhs) {
+			return typesv1.ValBool(false), nil
+		}
+	case typesv1.BinaryOp_LOG_OR:
+		if Truthy(lhs) {
+			return typesv1.ValBool(true), nil
+		}
+	}
+	rhs, err := Eval(b.Rhs, ev)
+	if err != nil {
+		return nil, err
+	}
+	switch b.Op {
+	case typesv1.BinaryOp_LOG_AND, typesv1.BinaryOp_LOG_OR:
+		return typesv1.ValBool(Truthy(rhs)), nil
+	case typesv1.BinaryOp_CMP_EQ:
+		c, ok := compare(lhs, rhs)
+		return typesv1.ValBool(ok && c == 0), nil
+	case typesv1.BinaryOp_CMP_NOTEQ:
+		c, ok := compare(lhs, rhs)
+		return typesv1.ValBool(!ok || c != 0), nil
+	case typesv1.BinaryOp_CMP_GT:
+		c, ok := compare(lhs, rhs)
+		return typesv1.ValBool(ok && c > 0), nil
+	case typesv1.BinaryOp_CMP_GTE:
+		c, ok := compare(lhs, rhs)
+		return typesv1.ValBool(ok && c >= 0), nil
+	case typesv1.BinaryOp_CMP_LT:
+		c, ok := compare(lhs, rhs)
+		return typesv1.ValBool(ok && c < 0), nil
+	case typesv1.BinaryOp_CMP_LTE:
+		c, ok := compare(lhs, rhs)
+		return typesv1.ValBool(ok && c <= 0), nil
+	case typesv1.BinaryOp_SET_IN, typesv1.BinaryOp_SET_NOTIN:
+		set, ok := rhs.GetKind().(*typesv1.Val_Arr)
+		if !ok {
+			return nil, fmt.Errorf("`in` needs an array on its right, not a %s", typeName(rhs))
+		}
+		found := false
+		for _, item := range set.Arr.Items {
+			if c, ok := compare(lhs, item); ok && c == 0 {
+				found = true
+				break
+			}
+		}
+		return typesv1.ValBool(found == (b.Op == typesv1.BinaryOp_SET_IN)), nil
+	case typesv1.BinaryOp_NUM_ADD, typesv1.BinaryOp_NUM_SUB, typesv1.BinaryOp_NUM_MUL, typesv1.BinaryOp_NUM_DIV:
+		return arithmetic(b.Op, lhs, rhs)
+	default:
+		return nil, fmt.Errorf("unsupported binary operator %v", b.Op)
+	}
+}
+
+func arithmetic(op typesv1.BinaryOp_Operator, lhs, rhs *typesv1.Val) (*typesv1.Val, error) {
+	if v, ok := timeArithmetic(op, lhs, rhs); ok {
+		return v, nil
+	}
+	li, lok := lhs.GetKind().(*typesv1.Val_I64)
+	ri, rok := rhs.GetKind().(*typesv1.Val_I64)
+	if lok && rok && !(op == typesv1.BinaryOp_NUM_DIV && (ri.I64 == 0 || li.I64%ri.I64 != 0)) {
+		switch op {
+		case typesv1.BinaryOp_NUM_ADD:
+			return typesv1.ValI64(li.I64 + ri.I64), nil
+		case typesv1.BinaryOp_NUM_SUB:
+			return typesv1.ValI64(li.I64 - ri.I64), nil
+		case typesv1.BinaryOp_NUM_MUL:
+			return typesv1.ValI64(li.I64 * ri.I64), nil
+		case typesv1.BinaryOp_NUM_DIV:
+			return typesv1.ValI64(li.I64 / ri.I64), nil
+		}
+	}
+	lf, lok := toFloat(lhs)
+	rf, rok := toFloat(rhs)
+	if !lok || !rok {
+		if isNull(lhs) || isNull(rhs) {
+			return typesv1.ValNull(), nil
+		}
+		return nil, fmt.Errorf("can't do arithmetic on a %s and a %s", typeName(lhs), typeName(rhs))
+	}
+	switch op {
+	case typesv1.BinaryOp_NUM_ADD:
+		return typesv1.ValF64(lf + rf), nil
+	case typesv1.BinaryOp_NUM_SUB:
+		return typesv1.ValF64(lf - rf), nil
+	case typesv1.BinaryOp_NUM_MUL:
+		return typesv1.ValF64(lf * rf), nil
+	default:
+		return typesv1.ValF64(lf / rf), nil
+	}
+}
+
+// timeArithmetic moves timestamps by durations, i.e. `now() - 1h`, and
+// measures the durations between timestamps.
+func timeArithmetic(op typesv1.BinaryOp_Operator, lhs, rhs *typesv1.Val) (*typesv1.Val, bool) {
+	lts, ltsOK := lhs.GetKind().(*typesv1.Val_Ts)
+	ld, ldOK := lhs.GetKind().(*typesv1.Val_Dur)
+	rts, rtsOK := rhs.GetKind().(*typesv1.Val_Ts)
+	rd, rdOK := rhs.GetKind().(*typesv1.Val_Dur)
+	switch {
+	case ltsOK && rdOK && op == typesv1.BinaryOp_NUM_ADD:
+		return typesv1.ValTime(lts.Ts.AsTime().Add(rd.Dur.AsDuration())), true
+	case ltsOK && rdOK && op == typesv1.BinaryOp_NUM_SUB:
+		return typesv1.ValTime(lts.Ts.AsTime().Add(-rd.Dur.AsDuration())), true
+	case ldOK && rtsOK && op == typesv1.BinaryOp_NUM_ADD:
+		return typesv1.ValTime(rts.Ts.AsTime().Add(ld.Dur.AsDuration())), true
+	case ltsOK && rtsOK && op == typesv1.BinaryOp_NUM_SUB:
+		return typesv1.ValDuration(lts.Ts.AsTime().Sub(rts.Ts.AsTime())), true
+	case ldOK && rdOK && op == typesv1.BinaryOp_NUM_ADD:
+		return typesv1.ValDuration(ld.Dur.AsDuration() + rd.Dur.AsDuration()), true
+	case ldOK && rdOK && op == typesv1.BinaryOp_NUM_SUB:
+		return typesv1.ValDuration(ld.Dur.AsDuration() - rd.Dur.AsDuration()), true
+	default:
+		return nil, false
+	}
+}
+
+// compare orders two values. `ok` is false when they can't be compared,
+// i.e. when either is null or their types don't match. Strings holding
+// numbers compare as numbers, since logfmt values are all strings.
+func compare(a, b *typesv1.Val) (c int, ok bool) {
+	if isNull(a) || isNull(b) {
+		return 0, false
+	}
+	switch av := a.GetKind().(type) {
+	case *typesv1.Val_Str:
+		if bv, ok := b.GetKind().(*typesv1.Val_Str); ok {
+			return strings.Compare(av.Str, bv.Str), true
+		}
+	case *typesv1.Val_Bool:
+		if bb, ok := toBool(b); ok {
+			return compareBool(av.Bool, bb), true
+		}
+		return 0, false
+	case *typesv1.Val_Ts:
+		if bt, ok := toTime(b); ok {
+			return av.Ts.AsTime().Compare(bt), true
+		}
+		return 0, false
+	case *typesv1.Val_Dur:
+		if bd, ok := toDuration(b); ok {
+			return compareOrdered(av.Dur.AsDuration(), bd), true
+		}
+		return 0, false
+	}
+	switch b.GetKind().(type) {
+	case *typesv1.Val_Bool, *typesv1.Val_Ts, *typesv1.Val_Dur:
+		c, ok := compare(b, a)
+		return -c, ok
+	}
+	ai, aok := a.GetKind().(*typesv1.Val_I64)
+	bi, bok := b.GetKind().(*typesv1.Val_I64)
+	if aok && bok {
+		return compareOrdered(ai.I64, bi.I64), true
+	}
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if aok && bok {
+		return compareOrdered(af, bf), true
+	}
+	return 0, false
+}
+
+func compareOrdered[T int64 | float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// Truthy decides whether a value counts as true in a filter.
+func Truthy(v *typesv1.Val) bool {
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_Bool:
+		return t.Bool
+	case *typesv1.Val_Str:
+		return t.Str != ""
+	case *typesv1.Val_I64:
+		return t.I64 != 0
+	case *typesv1.Val_F64:
+		return t.F64 != 0 && !math.IsNaN(t.F64)
+	case *typesv1.Val_Ts:
+		return !t.Ts.AsTime().IsZero()
+	case *typesv1.Val_Dur:
+		return t.Dur.AsDuration() != 0
+	case *typesv1.Val_Arr:
+		return len(t.Arr.Items) > 0
+	case *typesv1.Val_Obj:
+		return len(t.Obj.Kvs) > 0
+	default:
+		return false
+	}
+}
+
+// Numeric is the number a value stands for, durations being counted in
+// milliseconds. NaN and infinities aren't numbers that can be charted or
+// measured, so they're not numeric.
+func Numeric(v *typesv1.Val) (float64, bool) {
+	f, ok := numeric(v)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+func numeric(v *typesv1.Val) (float64, bool) {
+	switch k := v.GetKind().(type) {
+	case *typesv1.Val_I64:
+		return float64(k.I64), true
+	case *typesv1.Val_F64:
+		return k.F64, true
+	case *typesv1.Val_Dur:
+		return float64(k.Dur.AsDuration()) / float64(time.Millisecond), true
+	case *typesv1.Val_Str:
+		if f, err := strconv.ParseFloat(k.Str, 64); err == nil {
+			return f, true
+		}
+		if d, err := time.ParseDuration(k.Str); err == nil {
+			return float64(d) / float64(time.Millisecond), true
+		}
+	}
+	return 0, false
+}
+
+func isNull(v *typesv1.Val) bool {
+	if v == nil || v.Kind == nil {
+		return true
+	}
+	_, ok := v.Kind.(*typesv1.Val_Null)
+	return ok
+}
+
+func toFloat(v *typesv1.Val) (float64, bool) {
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_I64:
+		return float64(t.I64), true
+	case *typesv1.Val_F64:
+		return t.F64, true
+	case *typesv1.Val_Str:
+		f, err := strconv.ParseFloat(t.Str, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func toBool(v *typesv1.Val) (bool, bool) {
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_Bool:
+		return t.Bool, true
+	case *typesv1.Val_Str:
+		b, err := strconv.ParseBool(t.Str)
+		return b, err == nil
+	default:
+		return false, false
+	}
+}
+
+func toTime(v *typesv1.Val) (time.Time, bool) {
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_Ts:
+		return t.Ts.AsTime(), true
+	case *typesv1.Val_Str:
+		ts, err := time.Parse(time.RFC3339Nano, t.Str)
+		return ts, err == nil
+	default:
+		return time.Time{}, false
+	}
+}
+
+func toDuration(v *typesv1.Val) (time.Duration, bool) {
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_Dur:
+		return t.Dur.AsDuration(), true
+	case *typesv1.Val_Str:
+		d, err := time.ParseDuration(t.Str)
+		return d, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func toString(v *typesv1.Val) (string, bool) {
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_Str:
+		return t.Str, true
+	case *typesv1.Val_I64:
+		return strconv.FormatInt(t.I64, 10), true
+	case *typesv1.Val_F64:
+		return strconv.FormatFloat(t.F64, 'g', -1, 64), true
+	case *typesv1.Val_Bool:
+		return strconv.FormatBool(t.Bool), true
+	case *typesv1.Val_Ts:
+		return t.Ts.AsTime().Format(time.RFC3339Nano), true
+	case *typesv1.Val_Dur:
+		return t.Dur.AsDuration().String(), true
+	default:
+		return "", false
+	}
+}
+
+func typeName(v *typesv1.Val) string {
+	switch v.GetKind().(type) {
+	case *typesv1.Val_Str:
+		return "string"
+	case *typesv1.Val_I64:
+		return "integer"
+	case *typesv1.Val_F64:
+		return "float"
+	case *typesv1.Val_Bool:
+		return "bool"
+	case *typesv1.Val_Ts:
+		return "timestamp"
+	case *typesv1.Val_Dur:
+		return "duration"
+	case *typesv1.Val_Arr:
+		return "array"
+	case *typesv1.Val_Obj:
+		return "object"
+	case *typesv1.Val_Map:
+		return "map"
+	default:
+		return "null"
+	}
+}
+
+// funcs are the functions that can be called in expressions.
+var funcs = map[string]func(args []*typesv1.Val) (*typesv1.Val, error){
+	"contains":   stringPredicate("contains", strings.Contains),
+	"startswith": stringPredicate("startswith", strings.HasPrefix),
+	"endswith":   stringPredicate("endswith", strings.HasSuffix),
+	"matches": func(args []*typesv1.Val) (*typesv1.Val, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("matches(s, regexp) takes 2 arguments, got %d", len(args))
+		}
+		s, ok := toString(args[0])
+		if !ok {
+			return typesv1.ValBool(false), nil
+		}
+		pattern, ok := args[1].GetKind().(*typesv1.Val_Str)
+		if !ok {
+			return nil, fmt.Errorf("matches(s, regexp) needs a string regexp, not a %s", typeName(args[1]))
+		}
+		re, err := compileRegexp(pattern.Str)
+		if err != nil {
+			return nil, err
+		}
+		return typesv1.ValBool(re.MatchString(s)), nil
+	},
+	"lower": func(args []*typesv1.Val) (*typesv1.Val, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("lower(s) takes 1 argument, got %d", len(args))
+		}
+		s, ok := toString(args[0])
+		if !ok {
+			return typesv1.ValNull(), nil
+		}
+		return typesv1.ValStr(strings.ToLower(s)), nil
+	},
+	"exists": func(args []*typesv1.Val) (*typesv1.Val, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("exists(x) takes 1 argument, got %d", len(args))
+		}
+		return typesv1.ValBool(!isNull(args[0])), nil
+	},
+	"bin": bin,
+	"now": func(args []*typesv1.Val) (*typesv1.Val, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("now() takes no arguments, got %d", len(args))
+		}
+		return typesv1.ValTime(time.Now()), nil
+	},
+}
+
+// bin rounds timestamps down to a multiple of a duration, and numbers down
+// to a multiple of a number, i.e. to summarize by `bin(ts, 1m)`.
+func bin(args []*typesv1.Val) (*typesv1.Val, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("bin(x, size) takes 2 arguments, got %d", len(args))
+	}
+	if isNull(args[0]) {
+		return typesv1.ValNull(), nil
+	}
+	if size, ok := toDuration(args[1]); ok {
+		if size <= 0 {
+			return nil, fmt.Errorf("bin(x, size) needs a positive size, not %s", size)
+		}
+		ts, ok := toTime(args[0])
+		if !ok {
+			return nil, fmt.Errorf("bin(x, %s) needs a timestamp, not a %s", size, typeName(args[0]))
+		}
+		return typesv1.ValTime(ts.Truncate(size)), nil
+	}
+	size, ok := toFloat(args[1])
+	if !ok || size <= 0 {
+		return nil, fmt.Errorf("bin(x, size) needs a positive size, not %s", typeName(args[1]))
+	}
+	x, ok := toFloat(args[0])
+	if !ok {
+		return nil, fmt.Errorf("bin(x, size) needs a number, not a %s", typeName(args[0]))
+	}
+	_, intX := args[0].GetKind().(*typesv1.Val_I64)
+	_, intSize := args[1].GetKind().(*typesv1.Val_I64)
+	binned := math.Floor(x/size) * size
+	if intX && intSize {
+		return typesv1.ValI64(int64(binned)), nil
+	}
+	return typesv1.ValF64(binned), nil
+}
+
+func stringPredicate(name string, fn func(s, substr string) bool) func(args []*typesv1.Val) (*typesv1.Val, error) {
+	return func(args []*typesv1.Val) (*typesv1.Val, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s(s, substr) takes 2 arguments, got %d", name, len(args))
+		}
+		s, ok := toString(args[0])
+		if !ok {
+			return typesv1.ValBool(false), nil
+		}
+		substr, ok := toString(args[1])
+		if !ok {
+			return typesv1.ValBool(false), nil
+		}
+		return typesv1.ValBool(fn(s, substr)), nil
+	}
+}
+
+func call(fn *typesv1.FuncCall, ev *typesv1.LogEvent) (*typesv1.Val, error) {
+	impl, ok := funcs[fn.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", fn.Name)
+	}
+	args := make([]*typesv1.Val, 0, len(fn.Args))
+	for _, arg := range fn.Args {
+		v, err := Eval(arg, ev)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	return impl(args)
+}
+
+// literalRegexps are the regexps written in the expressions parsed, which
+// are compiled once, when parsing them. Those that come from the events are
+// compiled each time, since they could all be different.
+var literalRegexps sync.Map
+
+// compileLiterals compiles the regexps written in `expr`, so that they're
+// invalid as soon as it's parsed, and not compiled for every event.
+func compileLiterals(expr *typesv1.Expr) error {
+	switch e := expr.GetExpr().(type) {
+	case *typesv1.Expr_Selector:
+		return compileLiterals(e.Selector.X)
+	case *typesv1.Expr_Indexor:
+		if err := compileLiterals(e.Indexor.X); err != nil {
+			return err
+		}
+		return compileLiterals(e.Indexor.Index)
+	case *typesv1.Expr_Unary:
+		return compileLiterals(e.Unary.Arg)
+	case *typesv1.Expr_Binary:
+		if err := compileLiterals(e.Binary.Lhs); err != nil {
+			return err
+		}
+		return compileLiterals(e.Binary.Rhs)
+	case *typesv1.Expr_FuncCall:
+		args := e.FuncCall.Args
+		if e.FuncCall.Name == "matches" && len(args) == 2 {
+			if pattern, ok := args[1].GetLiteral().GetKind().(*typesv1.Val_Str); ok {
+				if _, ok := literalRegexps.Load(pattern.Str); !ok {
+					re, err := compileRegexp(pattern.Str)
+					if err != nil {
+						return err
+					}
+					literalRegexps.Store(pattern.Str, re)
+				}
+			}
+		}
+		for _, arg := range args {
+			if err := compileLiterals(arg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := literalRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp %q: %v", pattern, err)
+	}
+	return re, nil
+}
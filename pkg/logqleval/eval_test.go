@@ -0,0 +1,109 @@
+package logqleval
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMatch(t *testing.T) {
+	ev := &typesv1.LogEvent{
+		Raw: []byte(`{"msg":"request done"}`),
+		Structured: &typesv1.StructuredLogEvent{
+			Timestamp: timestamppb.New(time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)),
+			Lvl:       "error",
+			Msg:       "request done",
+			Kvs: []*typesv1.KV{
+				typesv1.KeyVal("service", typesv1.ValStr("api")),
+				typesv1.KeyVal("status", typesv1.ValI64(503)),
+				typesv1.KeyVal("latency", typesv1.ValF64(1.5)),
+				typesv1.KeyVal("retries", typesv1.ValStr("3")),
+				typesv1.KeyVal("http.method", typesv1.ValStr("GET")),
+				typesv1.KeyVal("user-agent", typesv1.ValStr("curl/8.0")),
+				typesv1.KeyVal("cached", typesv1.ValBool(false)),
+			},
+		},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`service == "api" && status >= 500`, true},
+		{`service == "api" && status < 500`, false},
+		{`service != "api" || status == 503`, true},
+		{`latency > 1`, true},
+		{`(latency * 1000) >= 1500`, true},
+		{`retries > 2`, true},
+		{`retries == 3`, true},
+		{`http.method == "GET"`, true},
+		{`kv["user-agent"] == "curl/8.0"`, true},
+		{`lvl == "error" && msg == "request done"`, true},
+		{`status in [500, 502, 503]`, true},
+		{`status not in [500, 502, 503]`, false},
+		{`missing == "x"`, false},
+		{`missing != "x"`, true},
+		{`exists(missing)`, false},
+		{`exists(service)`, true},
+		{`!(cached)`, true},
+		{`contains(msg, "done")`, true},
+		{`startswith(kv["user-agent"], "curl")`, true},
+		{`matches(service, "^a.i$")`, true},
+		{`lower(http.method) == "get"`, true},
+		{`ts >= 2024-12-13T19:00:00Z`, true},
+		{`(status == 200 || status == 503) && !(service == "web")`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := ParseFilter(tt.expr)
+			require.NoError(t, err)
+			got, err := Match(expr, ev)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	ev := &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{}}
+	for _, s := range []string{`nope(msg)`, `status in "a"`} {
+		expr, err := ParseFilter(s)
+		require.NoError(t, err, s)
+		_, err = Match(expr, ev)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, s := range []string{`status >=`, `status == 1 | summarize count()`, `matches(msg, "(")`, `!matches(msg, "[")`} {
+		_, err := ParseFilter(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestNumeric(t *testing.T) {
+	for _, tt := range []struct {
+		val  *typesv1.Val
+		want float64
+		ok   bool
+	}{
+		{typesv1.ValI64(12), 12, true},
+		{typesv1.ValF64(1.5), 1.5, true},
+		{typesv1.ValStr("42.5"), 42.5, true},
+		{typesv1.ValStr("1.5s"), 1500, true},
+		{typesv1.ValDuration(250 * time.Microsecond), 0.25, true},
+		{typesv1.ValStr("slow"), 0, false},
+		{typesv1.ValBool(true), 0, false},
+		{typesv1.ValStr("NaN"), 0, false},
+		{typesv1.ValStr("+Inf"), 0, false},
+		{typesv1.ValF64(math.Inf(-1)), 0, false},
+		{typesv1.ValStr("1e400"), 0, false},
+	} {
+		got, ok := Numeric(tt.val)
+		require.Equal(t, tt.ok, ok, tt.val.String())
+		require.Equal(t, tt.want, got, tt.val.String())
+	}
+}
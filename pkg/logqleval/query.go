@@ -0,0 +1,628 @@
+package logqleval
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/humanlogio/api/go/pkg/logql"
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SortKey orders the results of a query.
+type SortKey struct {
+	Expr *typesv1.Expr
+	Desc bool
+}
+
+// Query is a LogQL query that can be evaluated over a stream of events.
+type Query struct {
+	from, to time.Time
+	stages   []stage
+	sortBy   []SortKey
+	tabular  bool
+}
+
+type stage interface{ isStage() }
+
+type filterStage struct{ expr *typesv1.Expr }
+
+type projectStage struct {
+	projections []*typesv1.ProjectOperator_Projection
+}
+
+type summarizeStage struct {
+	fn *typesv1.FuncCall
+	by []*typesv1.Expr
+}
+
+func (filterStage) isStage()    {}
+func (projectStage) isStage()   {}
+func (summarizeStage) isStage() {}
+
+// sortStatement matches the `sort by` statements that LogQL doesn't know
+// about, which are taken out of the query before it's parsed.
+var sortStatement = regexp.MustCompile(`^sort\s+by\s+`)
+
+// ParseQuery parses a LogQL query, i.e.
+//
+//	where status >= 500 | summarize count() by service | sort by count() desc
+//
+// On top of what LogQL parses, the query can end with `sort by` statements,
+// which take a comma separated list of expressions, each optionally
+// followed by `asc` or `desc`.
+func ParseQuery(s string) (*Query, error) {
+	stmts := splitStatements(s)
+	var sorts []SortKey
+	for len(stmts) > 0 {
+		last := strings.TrimSpace(stmts[len(stmts)-1])
+		loc := sortStatement.FindStringIndex(last)
+		if loc == nil {
+			break
+		}
+		keys, err := parseSortKeys(last[loc[1]:])
+		if err != nil {
+			return nil, err
+		}
+		// the last sort is the one that wins
+		if sorts == nil {
+			sorts = keys
+		}
+		stmts = stmts[:len(stmts)-1]
+	}
+	for _, stmt := range stmts {
+		if sortStatement.MatchString(strings.TrimSpace(stmt)) {
+			return nil, fmt.Errorf("`sort by` can only come at the end of a query")
+		}
+	}
+	lq, err := logql.Parse(strings.Join(stmts, "|"))
+	if err != nil {
+		return nil, err
+	}
+	return Compile(lq, sorts)
+}
+
+// splitStatements splits a query on the pipes that aren't in strings.
+func splitStatements(s string) []string {
+	var (
+		out      []string
+		start    int
+		inString bool
+		escaped  bool
+	)
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && inString:
+			escaped = true
+		case r == '"':
+			inString = !inString
+		case r == '|' && !inString:
+			// `||` is a logical or, not a pipe
+			if strings.HasPrefix(s[i:], "||") || (i > 0 && s[i-1] == '|') {
+				continue
+			}
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+func parseSortKeys(s string) ([]SortKey, error) {
+	var keys []SortKey
+	for _, part := range splitOutsideStrings(s, ',') {
+		part = strings.TrimSpace(part)
+		key := SortKey{}
+		switch {
+		case strings.HasSuffix(part, " desc"):
+			key.Desc = true
+			part = strings.TrimSuffix(part, " desc")
+		case strings.HasSuffix(part, " asc"):
+			part = strings.TrimSuffix(part, " asc")
+		}
+		expr, err := ParseFilter(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sort key %q: %v", part, err)
+		}
+		key.Expr = expr
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("`sort by` needs at least one expression")
+	}
+	return keys, nil
+}
+
+func splitOutsideStrings(s string, sep rune) []string {
+	var (
+		out      []string
+		start    int
+		depth    int
+		inString bool
+		escaped  bool
+	)
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && inString:
+			escaped = true
+		case r == '"':
+			inString = !inString
+		case inString:
+		case r == '(' || r == '[':
+			depth++
+		case r == ')' || r == ']':
+			depth--
+		case r == sep && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+// Compile prepares a parsed query to be evaluated.
+func Compile(lq *typesv1.LogQuery, sortBy []SortKey) (*Query, error) {
+	q := &Query{sortBy: sortBy}
+	if ctx := lq.GetContext(); ctx.GetMachineId() != nil || ctx.GetSessionId() != nil {
+		return nil, fmt.Errorf("machine and session contexts can't be used on a local stream")
+	}
+	if tr := lq.GetTimerange(); tr != nil {
+		var err error
+		if q.from, err = timeBound(tr.From); err != nil {
+			return nil, fmt.Errorf("invalid `from`: %v", err)
+		}
+		if q.to, err = timeBound(tr.To); err != nil {
+			return nil, fmt.Errorf("invalid `to`: %v", err)
+		}
+	}
+	if lq.GetQuery().GetRender() != nil {
+		return nil, fmt.Errorf("`render` statements can't be used on a local stream")
+	}
+	// aggregates are columns of the rows that follow a summary, which the
+	// statements after it refer to by calling the aggregate again
+	aggregates := make(map[string]bool)
+	for i, stmt := range lq.GetQuery().GetStatements() {
+		if err := compileStatement(stmt); err != nil {
+			return nil, fmt.Errorf("statement %d: %v", i, err)
+		}
+		switch s := stmt.GetStmt().(type) {
+		case *typesv1.Statement_Filter:
+			q.stages = append(q.stages, filterStage{expr: aggregateRefs(s.Filter.GetExpr(), aggregates)})
+		case *typesv1.Statement_Project:
+			projections := make([]*typesv1.ProjectOperator_Projection, 0, len(s.Project.GetProjections()))
+			for _, p := range s.Project.GetProjections() {
+				projections = append(projections, &typesv1.ProjectOperator_Projection{
+					Column: p.GetColumn(),
+					Value:  aggregateRefs(p.GetValue(), aggregates),
+				})
+			}
+			q.stages = append(q.stages, projectStage{projections: projections})
+			q.tabular = true
+		case *typesv1.Statement_Summarize:
+			fn := s.Summarize.GetAggregateFunction()
+			if err := checkAggregate(fn); err != nil {
+				return nil, fmt.Errorf("statement %d: %v", i, err)
+			}
+			by := make([]*typesv1.Expr, 0, len(s.Summarize.GetBy().GetScalars()))
+			for _, expr := range s.Summarize.GetBy().GetScalars() {
+				by = append(by, aggregateRefs(expr, aggregates))
+			}
+			q.stages = append(q.stages, summarizeStage{fn: fn, by: by})
+			q.tabular = true
+			aggregates[ExprString(&typesv1.Expr{Expr: &typesv1.Expr_FuncCall{FuncCall: fn}})] = true
+		default:
+			return nil, fmt.Errorf("statement %d: unsupported statement %T", i, s)
+		}
+	}
+	for i := range q.sortBy {
+		q.sortBy[i].Expr = aggregateRefs(q.sortBy[i].Expr, aggregates)
+	}
+	return q, nil
+}
+
+// compileStatement compiles the regexps written in the expressions of the
+// statement.
+func compileStatement(stmt *typesv1.Statement) error {
+	var exprs []*typesv1.Expr
+	switch s := stmt.GetStmt().(type) {
+	case *typesv1.Statement_Filter:
+		exprs = append(exprs, s.Filter.GetExpr())
+	case *typesv1.Statement_Project:
+		for _, p := range s.Project.GetProjections() {
+			exprs = append(exprs, p.GetValue())
+		}
+	case *typesv1.Statement_Summarize:
+		exprs = append(exprs, s.Summarize.GetBy().GetScalars()...)
+	}
+	for _, expr := range exprs {
+		if err := compileLiterals(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregateRefs replaces the calls to aggregates in `expr` by references to
+// the columns they computed.
+func aggregateRefs(expr *typesv1.Expr, aggregates map[string]bool) *typesv1.Expr {
+	if expr == nil || len(aggregates) == 0 {
+		return expr
+	}
+	switch e := expr.GetExpr().(type) {
+	case *typesv1.Expr_FuncCall:
+		name := ExprString(expr)
+		if aggregates[name] {
+			return typesv1.ExprIdentifier(name)
+		}
+		args := make([]*typesv1.Expr, 0, len(e.FuncCall.Args))
+		for _, arg := range e.FuncCall.Args {
+			args = append(args, aggregateRefs(arg, aggregates))
+		}
+		return &typesv1.Expr{Expr: &typesv1.Expr_FuncCall{FuncCall: &typesv1.FuncCall{Name: e.FuncCall.Name, Args: args}}}
+	case *typesv1.Expr_Unary:
+		return &typesv1.Expr{Expr: &typesv1.Expr_Unary{Unary: &typesv1.UnaryOp{
+			Op:  e.Unary.Op,
+			Arg: aggregateRefs(e.Unary.Arg, aggregates),
+		}}}
+	case *typesv1.Expr_Binary:
+		return &typesv1.Expr{Expr: &typesv1.Expr_Binary{Binary: &typesv1.BinaryOp{
+			Op:  e.Binary.Op,
+			Lhs: aggregateRefs(e.Binary.Lhs, aggregates),
+			Rhs: aggregateRefs(e.Binary.Rhs, aggregates),
+		}}}
+	default:
+		return expr
+	}
+}
+
+func timeBound(expr *typesv1.Expr) (time.Time, error) {
+	if expr == nil {
+		return time.Time{}, nil
+	}
+	v, err := Eval(expr, &typesv1.LogEvent{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	ts, ok := toTime(v)
+	if !ok {
+		return time.Time{}, fmt.Errorf("needs a timestamp, not a %s", typeName(v))
+	}
+	return ts, nil
+}
+
+// Tabular tells whether the query returns a table, rather than events.
+func (q *Query) Tabular() bool { return q.tabular }
+
+// Table is the result of a tabular query.
+type Table struct {
+	Columns []string
+	Rows    [][]*typesv1.Val
+}
+
+// Evaluator runs a query over the events it receives. Queries that only
+// filter events pass them on to the next sink as they come, unless they
+// need to be sorted. The results of tabular queries are available from
+// Table once the evaluator is flushed.
+type Evaluator struct {
+	q      *Query
+	next   sink.Sink
+	stages []stage
+
+	results []*typesv1.LogEvent
+	table   *Table
+	flushed bool
+	// OnError is told about expressions that fail to evaluate, the
+	// events they fail on are dropped.
+	OnError func(err error)
+}
+
+var _ sink.Sink = (*Evaluator)(nil)
+
+func NewEvaluator(q *Query, next sink.Sink) *Evaluator {
+	e := &Evaluator{q: q, next: next, stages: make([]stage, len(q.stages))}
+	for i, st := range q.stages {
+		if s, ok := st.(summarizeStage); ok {
+			st = newSummarizer(s)
+		}
+		e.stages[i] = st
+	}
+	return e
+}
+
+func (e *Evaluator) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	if !e.q.from.IsZero() || !e.q.to.IsZero() {
+		ts := ev.GetStructured().GetTimestamp()
+		if ts == nil {
+			return nil
+		}
+		t := ts.AsTime()
+		if t.Before(e.q.from) || (!e.q.to.IsZero() && !t.Before(e.q.to)) {
+			return nil
+		}
+	}
+	return e.push(ctx, ev, 0)
+}
+
+// push runs `ev` through the stages, starting at `from`.
+func (e *Evaluator) push(ctx context.Context, ev *typesv1.LogEvent, from int) error {
+	for _, st := range e.stages[from:] {
+		switch s := st.(type) {
+		case filterStage:
+			ok, err := Match(s.expr, ev)
+			if err != nil {
+				e.reportError(err)
+				return nil
+			}
+			if !ok {
+				return nil
+			}
+		case projectStage:
+			if ev.Structured == nil {
+				// raw lines have no columns
+				return nil
+			}
+			row, err := project(s.projections, ev)
+			if err != nil {
+				e.reportError(err)
+				return nil
+			}
+			ev = row
+		case *summarizer:
+			if ev.Structured == nil {
+				return nil
+			}
+			if err := s.add(ev); err != nil {
+				e.reportError(err)
+			}
+			return nil
+		}
+	}
+	if !e.q.tabular && len(e.q.sortBy) == 0 {
+		return e.next.Receive(ctx, ev)
+	}
+	// the scanner reuses the events it sends
+	e.results = append(e.results, proto.Clone(ev).(*typesv1.LogEvent))
+	return nil
+}
+
+func (e *Evaluator) reportError(err error) {
+	if e.OnError != nil {
+		e.OnError(err)
+	}
+}
+
+// Flush computes the results that can only be known once all the events
+// were received. Sorted events are passed on to the next sink.
+func (e *Evaluator) Flush(ctx context.Context) error {
+	if e.flushed {
+		return nil
+	}
+	e.flushed = true
+	for i, st := range e.stages {
+		s, ok := st.(*summarizer)
+		if !ok {
+			continue
+		}
+		for _, row := range s.rows() {
+			if err := e.push(ctx, row, i+1); err != nil {
+				return err
+			}
+		}
+	}
+	if len(e.q.sortBy) > 0 {
+		e.sortResults()
+	}
+	if !e.q.tabular {
+		for _, ev := range e.results {
+			if err := e.next.Receive(ctx, ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	e.table = toTable(e.results)
+	return nil
+}
+
+func (e *Evaluator) Close(ctx context.Context) error {
+	if err := e.Flush(ctx); err != nil {
+		return err
+	}
+	return e.next.Close(ctx)
+}
+
+// Table returns the results of a tabular query, once flushed.
+func (e *Evaluator) Table() *Table {
+	return e.table
+}
+
+func (e *Evaluator) sortResults() {
+	keys := make([][]*typesv1.Val, len(e.results))
+	for i, ev := range e.results {
+		keys[i] = make([]*typesv1.Val, len(e.q.sortBy))
+		for j, by := range e.q.sortBy {
+			v, err := Eval(by.Expr, ev)
+			if err != nil {
+				v = typesv1.ValNull()
+			}
+			keys[i][j] = v
+		}
+	}
+	idx := make([]int, len(e.results))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		for j, by := range e.q.sortBy {
+			ka, kb := keys[idx[a]][j], keys[idx[b]][j]
+			// nulls go last, whatever the order
+			if isNull(ka) || isNull(kb) {
+				if isNull(ka) != isNull(kb) {
+					return isNull(kb)
+				}
+				continue
+			}
+			c, ok := compare(ka, kb)
+			if !ok || c == 0 {
+				continue
+			}
+			if by.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	sorted := make([]*typesv1.LogEvent, len(e.results))
+	for i, j := range idx {
+		sorted[i] = e.results[j]
+	}
+	e.results = sorted
+}
+
+func project(projections []*typesv1.ProjectOperator_Projection, ev *typesv1.LogEvent) (*typesv1.LogEvent, error) {
+	cols := make([]string, 0, len(projections))
+	vals := make([]*typesv1.Val, 0, len(projections))
+	for _, p := range projections {
+		name := p.GetColumn().GetName()
+		expr := p.GetValue()
+		if expr == nil {
+			expr = typesv1.ExprIdentifier(name)
+		}
+		v, err := Eval(expr, ev)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+		vals = append(vals, v)
+	}
+	return newRow(cols, vals), nil
+}
+
+// newRow holds a row of a table in an event, so that the statements that
+// follow can refer to its columns.
+func newRow(cols []string, vals []*typesv1.Val) *typesv1.LogEvent {
+	data := &typesv1.StructuredLogEvent{Kvs: make([]*typesv1.KV, 0, len(cols))}
+	for i, col := range cols {
+		v := vals[i]
+		switch col {
+		case "ts":
+			if ts, ok := toTime(v); ok {
+				data.Timestamp = timestamppb.New(ts)
+			}
+		case "lvl":
+			data.Lvl, _ = toString(v)
+		case "msg":
+			data.Msg, _ = toString(v)
+		}
+		data.Kvs = append(data.Kvs, typesv1.KeyVal(col, v))
+	}
+	return &typesv1.LogEvent{Structured: data}
+}
+
+func toTable(rows []*typesv1.LogEvent) *Table {
+	t := &Table{}
+	index := make(map[string]int)
+	for _, row := range rows {
+		for _, kv := range row.GetStructured().GetKvs() {
+			if _, ok := index[kv.Key]; !ok {
+				index[kv.Key] = len(t.Columns)
+				t.Columns = append(t.Columns, kv.Key)
+			}
+		}
+	}
+	for _, row := range rows {
+		vals := make([]*typesv1.Val, len(t.Columns))
+		for i := range vals {
+			vals[i] = typesv1.ValNull()
+		}
+		for _, kv := range row.GetStructured().GetKvs() {
+			vals[index[kv.Key]] = kv.Value
+		}
+		t.Rows = append(t.Rows, vals)
+	}
+	return t
+}
+
+// FormatVal prints a value the way it's shown in tables.
+func FormatVal(v *typesv1.Val) string {
+	if s, ok := toString(v); ok {
+		return s
+	}
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_Arr:
+		items := make([]string, 0, len(t.Arr.Items))
+		for _, item := range t.Arr.Items {
+			items = append(items, FormatVal(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case *typesv1.Val_Obj:
+		kvs := make([]string, 0, len(t.Obj.Kvs))
+		for _, kv := range t.Obj.Kvs {
+			kvs = append(kvs, kv.Key+": "+FormatVal(kv.Value))
+		}
+		return "{" + strings.Join(kvs, ", ") + "}"
+	default:
+		return ""
+	}
+}
+
+// ExprString prints an expression back, i.e. to name a column after it.
+func ExprString(expr *typesv1.Expr) string {
+	switch e := expr.GetExpr().(type) {
+	case *typesv1.Expr_Literal:
+		if s, ok := e.Literal.GetKind().(*typesv1.Val_Str); ok {
+			return fmt.Sprintf("%q", s.Str)
+		}
+		return FormatVal(e.Literal)
+	case *typesv1.Expr_Identifier:
+		return e.Identifier.Name
+	case *typesv1.Expr_Selector:
+		return ExprString(e.Selector.X) + "." + e.Selector.Identifier.GetName()
+	case *typesv1.Expr_Indexor:
+		return ExprString(e.Indexor.X) + "[" + ExprString(e.Indexor.Index) + "]"
+	case *typesv1.Expr_FuncCall:
+		args := make([]string, 0, len(e.FuncCall.Args))
+		for _, arg := range e.FuncCall.Args {
+			args = append(args, ExprString(arg))
+		}
+		return e.FuncCall.Name + "(" + strings.Join(args, ", ") + ")"
+	case *typesv1.Expr_Unary:
+		op := "!"
+		if e.Unary.Op == typesv1.UnaryOp_NEG {
+			op = "-"
+		}
+		return op + "(" + ExprString(e.Unary.Arg) + ")"
+	case *typesv1.Expr_Binary:
+		return ExprString(e.Binary.Lhs) + " " + binaryOps[e.Binary.Op] + " " + ExprString(e.Binary.Rhs)
+	default:
+		return "?"
+	}
+}
+
+var binaryOps = map[typesv1.BinaryOp_Operator]string{
+	typesv1.BinaryOp_LOG_AND:   "&&",
+	typesv1.BinaryOp_LOG_OR:    "||",
+	typesv1.BinaryOp_NUM_ADD:   "+",
+	typesv1.BinaryOp_NUM_SUB:   "-",
+	typesv1.BinaryOp_NUM_DIV:   "/",
+	typesv1.BinaryOp_NUM_MUL:   "*",
+	typesv1.BinaryOp_CMP_EQ:    "==",
+	typesv1.BinaryOp_CMP_NOTEQ: "!=",
+	typesv1.BinaryOp_CMP_GT:    ">",
+	typesv1.BinaryOp_CMP_GTE:   ">=",
+	typesv1.BinaryOp_CMP_LT:    "<",
+	typesv1.BinaryOp_CMP_LTE:   "<=",
+	typesv1.BinaryOp_SET_IN:    "in",
+	typesv1.BinaryOp_SET_NOTIN: "not in",
+}
@@ -0,0 +1,156 @@
+package logqleval
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/sink/bufsink"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func msgs(evs []*typesv1.LogEvent) []string {
+	var out []string
+	for _, ev := range evs {
+		out = append(out, ev.GetStructured().GetMsg())
+	}
+	return out
+}
+
+func queryEvents() []*typesv1.LogEvent {
+	base := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	event := func(offset time.Duration, msg, service string, status int64, latency float64) *typesv1.LogEvent {
+		return &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{
+			Timestamp: timestamppb.New(base.Add(offset)),
+			Lvl:       "info",
+			Msg:       msg,
+			Kvs: []*typesv1.KV{
+				typesv1.KeyVal("service", typesv1.ValStr(service)),
+				typesv1.KeyVal("status", typesv1.ValI64(status)),
+				typesv1.KeyVal("latency", typesv1.ValF64(latency)),
+			},
+		}}
+	}
+	return []*typesv1.LogEvent{
+		event(0, "a", "api", 200, 0.1),
+		event(10*time.Second, "b", "web", 503, 1.5),
+		{Raw: []byte("panic: nope")},
+		event(30*time.Second, "c", "api", 500, 0.3),
+		event(70*time.Second, "d", "api", 502, 0.2),
+		event(80*time.Second, "e", "web", 200, 0.4),
+	}
+}
+
+func TestEvaluatorTable(t *testing.T) {
+	tests := []struct {
+		query   string
+		columns []string
+		rows    [][]string
+	}{
+		{
+			query:   `where status >= 500 | summarize count() by service | sort by count() desc`,
+			columns: []string{"service", "count()"},
+			rows:    [][]string{{"api", "2"}, {"web", "1"}},
+		},
+		{
+			query:   `summarize max(latency) by service | sort by service desc`,
+			columns: []string{"service", "max(latency)"},
+			rows:    [][]string{{"web", "1.5"}, {"api", "0.3"}},
+		},
+		{
+			query:   `summarize count() by bin(ts, 1m)`,
+			columns: []string{"bin(ts, 1m0s)", "count()"},
+			rows: [][]string{
+				{"2024-12-13T19:36:00Z", "3"},
+				{"2024-12-13T19:37:00Z", "2"},
+			},
+		},
+		{
+			query:   `summarize sum(status) by service | where sum(status) > 1000 | project service`,
+			columns: []string{"service"},
+			rows:    [][]string{{"api"}},
+		},
+		{
+			query:   `where service == "web" | project msg, code=status`,
+			columns: []string{"msg", "code"},
+			rows:    [][]string{{"b", "503"}, {"e", "200"}},
+		},
+		{
+			query:   `project msg, slow=latency > 1 | sort by slow desc, msg`,
+			columns: []string{"msg", "slow"},
+			rows:    [][]string{{"b", "true"}, {"a", "false"}, {"c", "false"}, {"d", "false"}, {"e", "false"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseQuery(tt.query)
+			require.NoError(t, err)
+			require.True(t, q.Tabular())
+
+			ctx := context.Background()
+			e := NewEvaluator(q, bufsink.NewSizedBufferedSink(100, nil))
+			e.OnError = func(err error) { t.Fatal(err) }
+			for _, ev := range queryEvents() {
+				require.NoError(t, e.Receive(ctx, ev))
+			}
+			require.NoError(t, e.Flush(ctx))
+
+			table := e.Table()
+			require.Equal(t, tt.columns, table.Columns)
+			var rows [][]string
+			for _, row := range table.Rows {
+				var vals []string
+				for _, v := range row {
+					vals = append(vals, FormatVal(v))
+				}
+				rows = append(rows, vals)
+			}
+			require.Equal(t, tt.rows, rows)
+		})
+	}
+}
+
+func TestEvaluatorEvents(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{`where service == "api"`, []string{"a", "c", "d"}},
+		{`where status >= 500 | sort by latency desc`, []string{"b", "c", "d"}},
+		{`{from==2024-12-13T19:36:20.0Z to==2024-12-13T19:37:15.0Z} where service == "api"`, []string{"c", "d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseQuery(tt.query)
+			require.NoError(t, err)
+			require.False(t, q.Tabular())
+
+			ctx := context.Background()
+			rec := bufsink.NewSizedBufferedSink(100, nil)
+			e := NewEvaluator(q, rec)
+			for _, ev := range queryEvents() {
+				require.NoError(t, e.Receive(ctx, ev))
+			}
+			require.NoError(t, e.Close(ctx))
+			require.Equal(t, tt.want, msgs(rec.Buffered))
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		`summarize median(latency)`,
+		`summarize count(latency)`,
+		`sort by status | where status > 1`,
+		`where status > 1 | sort by`,
+		`where matches(msg, "(") | project msg`,
+		`project m=matches(msg, "(")`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			_, err := ParseQuery(query)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package logqleval
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// aggregate accumulates the values of a group.
+type aggregate interface {
+	add(v *typesv1.Val) error
+	result() *typesv1.Val
+}
+
+// aggregators are the aggregate functions `summarize` can call, by the
+// number of arguments they take.
+var aggregators = map[string]struct {
+	args int
+	new  func() aggregate
+}{
+	"count": {0, func() aggregate { return &countAgg{} }},
+	"sum":   {1, func() aggregate { return &sumAgg{} }},
+	"avg":   {1, func() aggregate { return &avgAgg{} }},
+	"min":   {1, func() aggregate { return &extremumAgg{keep: -1} }},
+	"max":   {1, func() aggregate { return &extremumAgg{keep: 1} }},
+}
+
+func aggregatorNames() []string {
+	names := make([]string, 0, len(aggregators))
+	for name := range aggregators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkAggregate(fn *typesv1.FuncCall) error {
+	agg, ok := aggregators[fn.GetName()]
+	if !ok {
+		return fmt.Errorf("unknown aggregate function %q, try one of %q", fn.GetName(), aggregatorNames())
+	}
+	if len(fn.GetArgs()) != agg.args {
+		return fmt.Errorf("%s() takes %d arguments, got %d", fn.GetName(), agg.args, len(fn.GetArgs()))
+	}
+	return nil
+}
+
+type countAgg struct{ n int64 }
+
+func (a *countAgg) add(*typesv1.Val) error { a.n++; return nil }
+func (a *countAgg) result() *typesv1.Val   { return typesv1.ValI64(a.n) }
+
+// sumAgg sums integers as integers, until it's given a float.
+type sumAgg struct {
+	i       int64
+	f       float64
+	isFloat bool
+}
+
+func (a *sumAgg) add(v *typesv1.Val) error {
+	if isNull(v) {
+		return nil
+	}
+	if i, ok := v.GetKind().(*typesv1.Val_I64); ok && !a.isFloat {
+		a.i += i.I64
+		return nil
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return fmt.Errorf("sum() needs numbers, not a %s", typeName(v))
+	}
+	if !a.isFloat {
+		a.isFloat = true
+		a.f = float64(a.i)
+	}
+	a.f += f
+	return nil
+}
+
+func (a *sumAgg) result() *typesv1.Val {
+	if a.isFloat {
+		return typesv1.ValF64(a.f)
+	}
+	return typesv1.ValI64(a.i)
+}
+
+type avgAgg struct {
+	sum float64
+	n   int
+}
+
+func (a *avgAgg) add(v *typesv1.Val) error {
+	if isNull(v) {
+		return nil
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return fmt.Errorf("avg() needs numbers, not a %s", typeName(v))
+	}
+	a.sum += f
+	a.n++
+	return nil
+}
+
+func (a *avgAgg) result() *typesv1.Val {
+	if a.n == 0 {
+		return typesv1.ValNull()
+	}
+	return typesv1.ValF64(a.sum / float64(a.n))
+}
+
+// extremumAgg keeps the smallest value when `keep` is -1, the largest when
+// it's 1.
+type extremumAgg struct {
+	keep int
+	v    *typesv1.Val
+}
+
+func (a *extremumAgg) add(v *typesv1.Val) error {
+	if isNull(v) {
+		return nil
+	}
+	if a.v == nil {
+		a.v = proto.Clone(v).(*typesv1.Val)
+		return nil
+	}
+	c, ok := compare(v, a.v)
+	if !ok {
+		return fmt.Errorf("can't compare a %s to a %s", typeName(v), typeName(a.v))
+	}
+	if c == a.keep {
+		a.v = proto.Clone(v).(*typesv1.Val)
+	}
+	return nil
+}
+
+func (a *extremumAgg) result() *typesv1.Val {
+	if a.v == nil {
+		return typesv1.ValNull()
+	}
+	return a.v
+}
+
+// summarizer groups the events it's given by the values of the `by`
+// expressions, and aggregates each group.
+type summarizer struct {
+	summarizeStage
+	columns []string
+	groups  map[string]*group
+	// order keeps the groups in the order they were first seen
+	order []*group
+}
+
+type group struct {
+	by  []*typesv1.Val
+	agg aggregate
+}
+
+func (*summarizer) isStage() {}
+
+func newSummarizer(s summarizeStage) *summarizer {
+	columns := make([]string, 0, len(s.by)+1)
+	for _, expr := range s.by {
+		columns = append(columns, ExprString(expr))
+	}
+	columns = append(columns, ExprString(&typesv1.Expr{Expr: &typesv1.Expr_FuncCall{FuncCall: s.fn}}))
+	return &summarizer{
+		summarizeStage: s,
+		columns:        columns,
+		groups:         make(map[string]*group),
+	}
+}
+
+func (s *summarizer) add(ev *typesv1.LogEvent) error {
+	by := make([]*typesv1.Val, 0, len(s.by))
+	var key strings.Builder
+	for _, expr := range s.by {
+		v, err := Eval(expr, ev)
+		if err != nil {
+			return err
+		}
+		by = append(by, v)
+		key.WriteString(typeName(v))
+		key.WriteByte(0)
+		key.WriteString(FormatVal(v))
+		key.WriteByte(0)
+	}
+	var arg *typesv1.Val
+	if args := s.fn.GetArgs(); len(args) > 0 {
+		var err error
+		if arg, err = Eval(args[0], ev); err != nil {
+			return err
+		}
+	}
+	g, ok := s.groups[key.String()]
+	if !ok {
+		// the scanner reuses events, and their values with them
+		for i, v := range by {
+			by[i] = proto.Clone(v).(*typesv1.Val)
+		}
+		g = &group{by: by, agg: aggregators[s.fn.GetName()].new()}
+	}
+	if err := g.agg.add(arg); err != nil {
+		return err
+	}
+	if !ok {
+		s.groups[key.String()] = g
+		s.order = append(s.order, g)
+	}
+	return nil
+}
+
+// rows returns a row per group, with a column per `by` expression followed
+// by the aggregate.
+func (s *summarizer) rows() []*typesv1.LogEvent {
+	rows := make([]*typesv1.LogEvent, 0, len(s.order))
+	for _, g := range s.order {
+		rows = append(rows, newRow(s.columns, append(g.by, g.agg.result())))
+	}
+	return rows
+}
@@ -0,0 +1,369 @@
+// Package metrics keeps counters, gauges and histograms, and exposes them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxSeries bounds how many sets of label values a metric keeps track of,
+// observations for new ones are dropped beyond it.
+const MaxSeries = 10000
+
+// DefaultBuckets are the upper bounds of the buckets of histograms, when
+// none are set. They suit latencies in milliseconds.
+var DefaultBuckets = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+var validName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Registry holds metrics, which are written in the order of their names.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+type metric struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	// series are looked up without locking, since they're updated for every
+	// event going through the pipeline. `mu` is only held to add them.
+	series  sync.Map
+	mu      sync.Mutex
+	nseries int
+}
+
+type series struct {
+	labelValues []string
+	value       atomicFloat
+	// for histograms, `counts` are per bucket, not cumulative
+	counts []atomic.Uint64
+	sum    atomicFloat
+	count  atomic.Uint64
+}
+
+type atomicFloat struct{ bits atomic.Uint64 }
+
+func (f *atomicFloat) Load() float64 { return math.Float64frombits(f.bits.Load()) }
+
+func (f *atomicFloat) Store(v float64) { f.bits.Store(math.Float64bits(v)) }
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ m *metric }
+
+// Gauge is a value that goes up and down.
+type Gauge struct{ m *metric }
+
+// Histogram counts observations in buckets.
+type Histogram struct{ m *metric }
+
+// Counter registers a counter whose series are distinguished by `labels`.
+func (r *Registry) Counter(name, help string, labels ...string) (*Counter, error) {
+	m, err := r.register(name, help, kindCounter, labels, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{m: m}, nil
+}
+
+// Gauge registers a gauge whose series are distinguished by `labels`.
+func (r *Registry) Gauge(name, help string, labels ...string) (*Gauge, error) {
+	m, err := r.register(name, help, kindGauge, labels, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Gauge{m: m}, nil
+}
+
+// Histogram registers a histogram with the upper bounds of its `buckets`,
+// `DefaultBuckets` if empty.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) (*Histogram, error) {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] == buckets[i-1] {
+			return nil, fmt.Errorf("metric %q has bucket %v twice", name, buckets[i])
+		}
+	}
+	m, err := r.register(name, help, kindHistogram, labels, buckets)
+	if err != nil {
+		return nil, err
+	}
+	return &Histogram{m: m}, nil
+}
+
+func (r *Registry) register(name, help string, kind kind, labels []string, buckets []float64) (*metric, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("%q isn't a valid metric name", name)
+	}
+	seen := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		if !validName.MatchString(label) || strings.Contains(label, ":") || strings.HasPrefix(label, "__") {
+			return nil, fmt.Errorf("metric %q: %q isn't a valid label name", name, label)
+		}
+		if label == "le" && kind == kindHistogram {
+			return nil, fmt.Errorf("metric %q: histograms can't have a %q label", name, label)
+		}
+		if seen[label] {
+			return nil, fmt.Errorf("metric %q has label %q twice", name, label)
+		}
+		seen[label] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		return nil, fmt.Errorf("metric %q is already registered", name)
+	}
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+	}
+	r.metrics[name] = m
+	return m, nil
+}
+
+// get returns the series of the label values, or nil if there are too
+// many series already.
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %q has %d labels, got %d values", m.name, len(m.labels), len(labelValues)))
+	}
+	var key string
+	if len(labelValues) == 1 {
+		key = labelValues[0]
+	} else {
+		key = strings.Join(labelValues, "\xff")
+	}
+	if s, ok := m.series.Load(key); ok {
+		return s.(*series)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series.Load(key); ok {
+		return s.(*series)
+	}
+	if m.nseries >= MaxSeries {
+		return nil
+	}
+	s := &series{labelValues: append([]string(nil), labelValues...)}
+	if m.kind == kindHistogram {
+		s.counts = make([]atomic.Uint64, len(m.buckets))
+	}
+	m.series.Store(key, s)
+	m.nseries++
+	return s
+}
+
+// Add adds `v`, which can't be negative, to the series of the label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	if s := c.m.get(labelValues); s != nil {
+		s.value.Add(v)
+	}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Set sets the series of the label values to `v`.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	if s := g.m.get(labelValues); s != nil {
+		s.value.Store(v)
+	}
+}
+
+// Add adds `v`, which can be negative, to the series of the label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	if s := g.m.get(labelValues); s != nil {
+		s.value.Add(v)
+	}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if math.IsNaN(v) {
+		return
+	}
+	s := h.m.get(labelValues)
+	if s == nil {
+		return
+	}
+	if i := sort.SearchFloat64s(h.m.buckets, v); i < len(s.counts) {
+		s.counts[i].Add(1)
+	}
+	s.sum.Add(v)
+	s.count.Add(1)
+}
+
+// Sample is the state of a series at the time of a snapshot. `Value` is
+// the value of counters and gauges, `Sum` and `Count` are those of the
+// observations of histograms.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+	Sum    float64
+	Count  uint64
+}
+
+// Snapshot returns the state of all the series, in the order of their
+// names and label values.
+func (r *Registry) Snapshot() []Sample {
+	var samples []Sample
+	for _, m := range r.sorted() {
+		for _, s := range m.sortedSeries() {
+			labels := make(map[string]string, len(m.labels))
+			for i, label := range m.labels {
+				labels[label] = s.labelValues[i]
+			}
+			samples = append(samples, Sample{Name: m.name, Labels: labels, Value: s.value.Load(), Sum: s.sum.Load(), Count: s.count.Load()})
+		}
+	}
+	return samples
+}
+
+func (r *Registry) sorted() []*metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]*metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	return metrics
+}
+
+// sortedSeries returns the series in the order of their label values.
+func (m *metric) sortedSeries() []*series {
+	var keys []string
+	m.series.Range(func(key, _ any) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	out := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		s, _ := m.series.Load(key)
+		out = append(out, s.(*series))
+	}
+	return out
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	for _, m := range r.sorted() {
+		m.write(&sb)
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (m *metric) write(sb *strings.Builder) {
+	if m.help != "" {
+		fmt.Fprintf(sb, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	}
+	fmt.Fprintf(sb, "# TYPE %s %s\n", m.name, m.kind)
+	for _, s := range m.sortedSeries() {
+		if m.kind != kindHistogram {
+			fmt.Fprintf(sb, "%s%s %s\n", m.name, labelSet(m.labels, s.labelValues, ""), formatFloat(s.value.Load()))
+			continue
+		}
+		// observations can happen while writing, the count is read first
+		// so that no bucket is over it
+		count := s.count.Load()
+		var cumulative uint64
+		for i, upper := range m.buckets {
+			cumulative += s.counts[i].Load()
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name, labelSet(m.labels, s.labelValues, formatFloat(upper)), min(cumulative, count))
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name, labelSet(m.labels, s.labelValues, "+Inf"), count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", m.name, labelSet(m.labels, s.labelValues, ""), formatFloat(s.sum.Load()))
+		fmt.Fprintf(sb, "%s_count%s %d\n", m.name, labelSet(m.labels, s.labelValues, ""), count)
+	}
+}
+
+// Handler serves the metrics, i.e. on /metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+func labelSet(labels, values []string, le string) string {
+	if len(labels) == 0 && le == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)+1)
+	for i, label := range labels {
+		pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
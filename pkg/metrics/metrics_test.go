@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	reg := NewRegistry()
+	errors, err := reg.Counter("errors_total", "Errors by service.", "service")
+	require.NoError(t, err)
+	latency, err := reg.Histogram("latency_ms", "", []float64{100, 10})
+	require.NoError(t, err)
+
+	errors.Inc("api")
+	errors.Inc(`we"b`)
+	errors.Add(2, "api")
+	errors.Add(-1, "api")
+	latency.Observe(5)
+	latency.Observe(10)
+	latency.Observe(50)
+	latency.Observe(500)
+
+	var sb strings.Builder
+	_, err = reg.WriteTo(&sb)
+	require.NoError(t, err)
+	require.Equal(t, `# HELP errors_total Errors by service.
+# TYPE errors_total counter
+errors_total{service="api"} 3
+errors_total{service="we\"b"} 1
+# TYPE latency_ms histogram
+latency_ms_bucket{le="10"} 2
+latency_ms_bucket{le="100"} 3
+latency_ms_bucket{le="+Inf"} 4
+latency_ms_sum 565
+latency_ms_count 4
+`, sb.String())
+
+	rec := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, sb.String(), rec.Body.String())
+	require.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+}
+
+func TestRegistryInvalid(t *testing.T) {
+	reg := NewRegistry()
+	_, err := reg.Counter("1st", "")
+	require.Error(t, err)
+	_, err = reg.Counter("ok", "", "")
+	require.Error(t, err)
+	_, err = reg.Counter("ok", "", "a", "a")
+	require.Error(t, err)
+	_, err = reg.Histogram("h", "", nil, "le")
+	require.Error(t, err)
+	_, err = reg.Histogram("h", "", []float64{1, 1})
+	require.Error(t, err)
+	_, err = reg.Counter("ok", "")
+	require.NoError(t, err)
+	_, err = reg.Counter("ok", "")
+	require.Error(t, err, "already registered")
+}
+
+func TestGaugeAndSnapshot(t *testing.T) {
+	reg := NewRegistry()
+	depth, err := reg.Gauge("queue_depth", "", "stage")
+	require.NoError(t, err)
+	sizes, err := reg.Histogram("batch_size", "", []float64{10})
+	require.NoError(t, err)
+
+	depth.Set(5, "tee")
+	depth.Add(-2, "tee")
+	depth.Add(1, "api")
+	sizes.Observe(4)
+	sizes.Observe(20)
+
+	require.Equal(t, []Sample{
+		{Name: "batch_size", Labels: map[string]string{}, Sum: 24, Count: 2},
+		{Name: "queue_depth", Labels: map[string]string{"stage": "api"}, Value: 1},
+		{Name: "queue_depth", Labels: map[string]string{"stage": "tee"}, Value: 3},
+	}, reg.Snapshot())
+
+	var sb strings.Builder
+	_, err = reg.WriteTo(&sb)
+	require.NoError(t, err)
+	require.Contains(t, sb.String(), "# TYPE queue_depth gauge\nqueue_depth{stage=\"api\"} 1\nqueue_depth{stage=\"tee\"} 3\n")
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	reg := NewRegistry()
+	count, err := reg.Counter("count", "", "stage")
+	require.NoError(t, err)
+	sizes, err := reg.Histogram("sizes", "", []float64{1}, "stage")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				count.Inc("scan")
+				sizes.Observe(1, "scan")
+			}
+		}()
+	}
+	wg.Wait()
+
+	samples := reg.Snapshot()
+	require.Len(t, samples, 2)
+	require.Equal(t, float64(8000), samples[0].Value)
+	require.Equal(t, uint64(8000), samples[1].Count)
+	require.Equal(t, float64(8000), samples[1].Sum)
+}
@@ -0,0 +1,36 @@
+package metrics
+
+// Pipeline holds the metrics humanlog keeps about its own ingestion
+// pipeline. They're labeled with the stage they're about: "scan",
+// "tee:<name>" for each tee, "queue:<branch>" for the branches of an async
+// tee, "buffer", "batch:<sink>" for the batches of a sink, "spool",
+// "service", or the name of a sink sending events to a humanlog service,
+// like "api" or "local".
+var Pipeline = NewRegistry()
+
+// BatchBuckets suit the sizes of the batches of events.
+var BatchBuckets = []float64{1, 10, 100, 1000, 10000, 100000, 1000000}
+
+var (
+	Received = must(Pipeline.Counter(
+		"humanlog_events_received_total", "Events received by a stage.", "stage"))
+	Sent = must(Pipeline.Counter(
+		"humanlog_events_sent_total", "Events a stage passed on or sent.", "stage"))
+	Dropped = must(Pipeline.Counter(
+		"humanlog_events_dropped_total", "Events a stage couldn't keep or send.", "stage"))
+	Retried = must(Pipeline.Counter(
+		"humanlog_send_retries_total", "Attempts at reaching a humanlog service that failed and were retried.", "stage"))
+	QueueDepth = must(Pipeline.Gauge(
+		"humanlog_queue_depth", "Events waiting in the buffer of a stage.", "stage"))
+	BatchSize = must(Pipeline.Histogram(
+		"humanlog_batch_size", "Events per batch a stage passed on or sent.", BatchBuckets, "stage"))
+	SendLatency = must(Pipeline.Histogram(
+		"humanlog_send_latency_ms", "Milliseconds it took a stage to send a batch.", DefaultBuckets, "stage"))
+)
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
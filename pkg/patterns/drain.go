@@ -0,0 +1,278 @@
+// Package patterns finds the templates that log messages are made from, so
+// that the few shapes a flood of messages takes can be looked at instead of
+// the messages themselves.
+package patterns
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Wildcard stands for the parts of a template that vary between messages.
+const Wildcard = "<*>"
+
+const (
+	DefaultDepth       = 4
+	DefaultSimilarity  = 0.4
+	DefaultMaxChildren = 100
+	DefaultMaxClusters = 1000
+)
+
+type Opts struct {
+	// Depth of the tree messages are sorted in, the first `Depth-2` tokens
+	// of a message decide which clusters it's compared with.
+	Depth int
+	// Similarity is the share of tokens a message must have in common with
+	// a template to be one of its messages, between 0 and 1.
+	Similarity float64
+	// MaxChildren bounds how many different tokens are told apart at each
+	// level of the tree, the others share a wildcard branch.
+	MaxChildren int
+	// MaxClusters bounds how many templates are kept. The one seen least
+	// recently is forgotten to make room for a new one.
+	MaxClusters int
+}
+
+// Cluster is a template, and what's known about the messages made from it.
+type Cluster struct {
+	// ID is derived from the first message of the cluster, with its tokens
+	// that contain digits taken out. It doesn't change as the template is
+	// refined, and it's the same across runs for the same kind of message.
+	ID     string
+	Tokens []string
+	Count  int64
+	First  time.Time
+	Last   time.Time
+
+	example []string
+	leaf    *node
+}
+
+// Template is the template of the cluster, with wildcards where messages
+// differ.
+func (c *Cluster) Template() string {
+	return strings.Join(c.Tokens, " ")
+}
+
+// Variables are what the wildcards of the template were in the last message
+// of the cluster.
+func (c *Cluster) Variables() []string {
+	var vars []string
+	for i, tok := range c.Tokens {
+		if tok == Wildcard && i < len(c.example) {
+			vars = append(vars, c.example[i])
+		}
+	}
+	return vars
+}
+
+type node struct {
+	children map[string]*node
+	clusters []*Cluster
+}
+
+func newNode() *node {
+	return &node{children: make(map[string]*node)}
+}
+
+// Miner sorts messages into clusters as they come, following Drain (He et
+// al., "Drain: An Online Log Parsing Approach with Fixed Depth Tree").
+// It's not safe for concurrent use.
+type Miner struct {
+	opts     Opts
+	byLength map[int]*node
+	byID     map[string]*Cluster
+}
+
+func NewMiner(opts Opts) *Miner {
+	if opts.Depth < 3 {
+		opts.Depth = DefaultDepth
+	}
+	if opts.Similarity <= 0 || opts.Similarity > 1 {
+		opts.Similarity = DefaultSimilarity
+	}
+	if opts.MaxChildren <= 0 {
+		opts.MaxChildren = DefaultMaxChildren
+	}
+	if opts.MaxClusters <= 0 {
+		opts.MaxClusters = DefaultMaxClusters
+	}
+	return &Miner{
+		opts:     opts,
+		byLength: make(map[int]*node),
+		byID:     make(map[string]*Cluster),
+	}
+}
+
+// Add sorts `msg`, seen at `at`, into the cluster of its template, and
+// returns that cluster. `at` can be zero when it's not known.
+func (m *Miner) Add(msg string, at time.Time) *Cluster {
+	tokens := strings.Fields(msg)
+	masked := make([]string, len(tokens))
+	for i, tok := range tokens {
+		masked[i] = mask(tok)
+	}
+	leaf := m.leaf(masked)
+	c := m.match(leaf, masked)
+	if c == nil {
+		c = m.newCluster(leaf, masked, at)
+	} else {
+		for i, tok := range masked {
+			if c.Tokens[i] != tok {
+				c.Tokens[i] = Wildcard
+			}
+		}
+	}
+	c.Count++
+	if !at.IsZero() {
+		if c.First.IsZero() || at.Before(c.First) {
+			c.First = at
+		}
+		if at.After(c.Last) {
+			c.Last = at
+		}
+	}
+	c.example = tokens
+	return c
+}
+
+// Clusters returns the clusters, the ones with the most messages first.
+func (m *Miner) Clusters() []*Cluster {
+	out := make([]*Cluster, 0, len(m.byID))
+	for _, c := range m.byID {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		if !out[i].First.Equal(out[j].First) {
+			return out[i].First.Before(out[j].First)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// leaf finds the node holding the clusters `tokens` can be part of,
+// making the branches that lead to it if they're missing.
+func (m *Miner) leaf(tokens []string) *node {
+	n, ok := m.byLength[len(tokens)]
+	if !ok {
+		n = newNode()
+		m.byLength[len(tokens)] = n
+	}
+	for i := 0; i < m.opts.Depth-2 && i < len(tokens); i++ {
+		tok := tokens[i]
+		next, ok := n.children[tok]
+		if !ok {
+			if len(n.children) >= m.opts.MaxChildren {
+				tok = Wildcard
+			}
+			if next, ok = n.children[tok]; !ok {
+				next = newNode()
+				n.children[tok] = next
+			}
+		}
+		n = next
+	}
+	return n
+}
+
+func (m *Miner) match(leaf *node, tokens []string) *Cluster {
+	var (
+		best       *Cluster
+		bestSim    = -1.0
+		bestParams = -1
+	)
+	for _, c := range leaf.clusters {
+		sim, params := similarity(c.Tokens, tokens)
+		if sim > bestSim || (sim == bestSim && params > bestParams) {
+			best, bestSim, bestParams = c, sim, params
+		}
+	}
+	if best == nil || bestSim < m.opts.Similarity {
+		return nil
+	}
+	return best
+}
+
+// similarity is the share of tokens that are the same in the template and
+// the message, and how many wildcards the template has.
+func similarity(template, tokens []string) (float64, int) {
+	if len(tokens) == 0 {
+		return 1, 0
+	}
+	same, params := 0, 0
+	for i, tok := range template {
+		switch {
+		case tok == Wildcard:
+			params++
+		case tok == tokens[i]:
+			same++
+		}
+	}
+	return float64(same) / float64(len(tokens)), params
+}
+
+func (m *Miner) newCluster(leaf *node, masked []string, at time.Time) *Cluster {
+	if len(m.byID) >= m.opts.MaxClusters {
+		m.evict()
+	}
+	template := strings.Join(masked, " ")
+	id := hashID(template)
+	for i := 1; m.byID[id] != nil; i++ {
+		id = hashID(fmt.Sprintf("%s\x00%d", template, i))
+	}
+	c := &Cluster{
+		ID:     id,
+		Tokens: append([]string(nil), masked...),
+		First:  at,
+		Last:   at,
+		leaf:   leaf,
+	}
+	leaf.clusters = append(leaf.clusters, c)
+	m.byID[id] = c
+	return c
+}
+
+func (m *Miner) evict() {
+	var oldest *Cluster
+	for _, c := range m.byID {
+		if oldest == nil || c.Last.Before(oldest.Last) {
+			oldest = c
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(m.byID, oldest.ID)
+	clusters := oldest.leaf.clusters[:0]
+	for _, c := range oldest.leaf.clusters {
+		if c != oldest {
+			clusters = append(clusters, c)
+		}
+	}
+	oldest.leaf.clusters = clusters
+}
+
+func hashID(s string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// mask replaces tokens that contain digits, like IDs, counts and
+// durations, which are rarely part of a template.
+func mask(tok string) string {
+	for _, r := range tok {
+		if unicode.IsDigit(r) {
+			return Wildcard
+		}
+	}
+	return tok
+}
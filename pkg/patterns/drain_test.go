@@ -0,0 +1,93 @@
+package patterns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/sink/bufsink"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMiner(t *testing.T) {
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	m := NewMiner(Opts{})
+
+	first := m.Add("connection to db-1 lost, retrying in 2s", now)
+	m.Add("request 42 took 12ms", now)
+	m.Add("connection to db-2 lost, retrying in 5s", now.Add(time.Second))
+	m.Add("request 43 took 8ms", now.Add(2*time.Second))
+	m.Add("cache miss for key session", now.Add(3*time.Second))
+	m.Add("cache miss for key profile", now.Add(4*time.Second))
+	last := m.Add("connection to db-3 lost, retrying in 1s", now.Add(5*time.Second))
+	require.Same(t, first, last)
+
+	var got []string
+	for _, c := range m.Clusters() {
+		got = append(got, c.Template())
+	}
+	require.Equal(t, []string{
+		"connection to <*> lost, retrying in <*>",
+		"request <*> took <*>",
+		"cache miss for key <*>",
+	}, got)
+
+	c := m.Clusters()[0]
+	require.Equal(t, int64(3), c.Count)
+	require.Equal(t, now, c.First)
+	require.Equal(t, now.Add(5*time.Second), c.Last)
+	require.Equal(t, []string{"db-3", "1s"}, c.Variables())
+	require.Equal(t, []string{"profile"}, m.Clusters()[2].Variables())
+}
+
+func TestMinerStableIDs(t *testing.T) {
+	a := NewMiner(Opts{}).Add("request 42 took 12ms", time.Time{})
+	b := NewMiner(Opts{}).Add("request 7 took 3ms", time.Time{})
+	require.Equal(t, a.ID, b.ID)
+
+	m := NewMiner(Opts{})
+	id := m.Add("cache miss for key session", time.Time{}).ID
+	// refining the template keeps the ID
+	require.Equal(t, id, m.Add("cache miss for key profile", time.Time{}).ID)
+	require.NotEqual(t, id, m.Add("cache hit", time.Time{}).ID)
+}
+
+func TestMinerMaxClusters(t *testing.T) {
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	m := NewMiner(Opts{MaxClusters: 2})
+	m.Add("one", now)
+	m.Add("two words", now.Add(time.Second))
+	m.Add("three words here", now.Add(2*time.Second))
+
+	var got []string
+	for _, c := range m.Clusters() {
+		got = append(got, c.Template())
+	}
+	require.ElementsMatch(t, []string{"two words", "three words here"}, got)
+}
+
+func TestTagger(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := bufsink.NewSizedBufferedSink(100, nil)
+	m := NewMiner(Opts{})
+	tagger := NewTagger(rec, m)
+
+	for _, msg := range []string{"request 42 took 12ms", "request 43 took 8ms"} {
+		require.NoError(t, tagger.Receive(ctx, &typesv1.LogEvent{
+			ParsedAt:   timestamppb.New(now),
+			Structured: &typesv1.StructuredLogEvent{Timestamp: timestamppb.New(now), Msg: msg},
+		}))
+	}
+	require.NoError(t, tagger.Receive(ctx, &typesv1.LogEvent{ParsedAt: timestamppb.New(now), Raw: []byte("not structured")}))
+	require.NoError(t, tagger.Close(ctx))
+
+	require.Len(t, rec.Buffered, 3)
+	id := rec.Buffered[0].Structured.Kvs[0]
+	require.Equal(t, Key, id.Key)
+	require.Equal(t, id, rec.Buffered[1].Structured.Kvs[0])
+	require.Nil(t, rec.Buffered[2].Structured)
+	require.Len(t, m.Clusters(), 2)
+}
@@ -0,0 +1,55 @@
+package patterns
+
+import (
+	"context"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/sink"
+)
+
+// Key is the key of the ID of its pattern, on structured events.
+const Key = "pattern_id"
+
+// Tagger sorts the events it passes on to the next sink into the clusters
+// of a miner: structured events by their message and raw lines as they
+// are. Structured events are given the ID of their cluster.
+type Tagger struct {
+	next  sink.Sink
+	miner *Miner
+}
+
+var _ sink.Sink = (*Tagger)(nil)
+
+func NewTagger(next sink.Sink, miner *Miner) *Tagger {
+	return &Tagger{next: next, miner: miner}
+}
+
+func (t *Tagger) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	var at time.Time
+	if ev.ParsedAt != nil {
+		at = ev.ParsedAt.AsTime()
+	}
+	data := ev.Structured
+	if data == nil {
+		t.miner.Add(string(ev.Raw), at)
+		return t.next.Receive(ctx, ev)
+	}
+	if ts := data.Timestamp; ts != nil && !ts.AsTime().IsZero() {
+		at = ts.AsTime()
+	}
+	c := t.miner.Add(data.Msg, at)
+	id := typesv1.ValStr(c.ID)
+	for _, kv := range data.Kvs {
+		if kv.Key == Key {
+			kv.Value = id
+			return t.next.Receive(ctx, ev)
+		}
+	}
+	data.Kvs = append(data.Kvs, typesv1.KeyVal(Key, id))
+	return t.next.Receive(ctx, ev)
+}
+
+func (t *Tagger) Close(ctx context.Context) error {
+	return t.next.Close(ctx)
+}
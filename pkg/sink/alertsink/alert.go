@@ -0,0 +1,341 @@
+// Package alertsink evaluates alert rules on the events passed through it,
+// and notifies when they fire and when they're resolved.
+package alertsink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/humanlogio/humanlog/pkg/sink/filtersink"
+	"github.com/humanlogio/humanlog/pkg/sink/tapsink"
+)
+
+const (
+	DefaultWindow   = time.Minute
+	DefaultDebounce = time.Minute
+
+	// queueSize bounds how many notifications wait to be sent, the ones
+	// that don't fit are dropped.
+	queueSize = 100
+)
+
+// Rule matches the events at least at `Level` on which `Where` is truthy,
+// or all of them when neither is set. It fires when more than `Count`
+// events matched within `Window`, or, when `Absent` isn't zero, once no
+// event matched for that long.
+type Rule struct {
+	Name      string
+	Level     string
+	Where     *typesv1.Expr
+	Count     int
+	Window    time.Duration
+	Absent    time.Duration
+	Debounce  time.Duration
+	Notifiers []Notifier
+}
+
+type Opts struct {
+	// OnError is told about the notifications that couldn't be sent.
+	OnError func(rule string, err error)
+}
+
+type rule struct {
+	Rule
+	minLevel int
+	// matches are the times of the last `Count+1` matches, which is all
+	// that's needed to tell whether more than `Count` are within the window
+	matches   []time.Time
+	lastMatch time.Time
+	lastMsg   string
+
+	firing     bool
+	notified   bool
+	notifiedAt time.Time
+}
+
+type queued struct {
+	n         Notification
+	notifiers []Notifier
+}
+
+// Engine keeps the state of the rules, across all the sinks it wraps.
+// Rules are evaluated when events match them, and every second for those
+// that fire or are resolved as time passes. Times are those at which
+// events are received, not their timestamps, since rules are about what's
+// happening now.
+type Engine struct {
+	opts Opts
+
+	mu    sync.Mutex
+	rules []*rule
+
+	queue   chan queued
+	timeNow func() time.Time
+	stop    chan struct{}
+	done    chan struct{}
+	sent    chan struct{}
+}
+
+func NewEngine(rules []Rule, opts Opts) *Engine {
+	return newEngine(rules, opts, time.Now, true)
+}
+
+func newEngine(rules []Rule, opts Opts, timeNow func() time.Time, tick bool) *Engine {
+	e := &Engine{
+		opts:    opts,
+		queue:   make(chan queued, queueSize),
+		timeNow: timeNow,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		sent:    make(chan struct{}),
+	}
+	now := timeNow()
+	for _, r := range rules {
+		minLevel := -1
+		if r.Level != "" {
+			minLevel, _ = filtersink.LevelRank(r.Level)
+		}
+		e.rules = append(e.rules, &rule{Rule: r, minLevel: minLevel, lastMatch: now})
+	}
+	go e.send()
+	if !tick {
+		close(e.done)
+		return e
+	}
+	go e.tick()
+	return e
+}
+
+func (e *Engine) tick() {
+	defer close(e.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			e.Check()
+		}
+	}
+}
+
+func (e *Engine) send() {
+	defer close(e.sent)
+	for q := range e.queue {
+		for _, notifier := range q.notifiers {
+			if err := notifier.Notify(context.Background(), q.n); err != nil && e.opts.OnError != nil {
+				e.opts.OnError(q.n.Rule, err)
+			}
+		}
+	}
+}
+
+// Observe evaluates the rules an event matches.
+func (e *Engine) Observe(ev *typesv1.LogEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.timeNow()
+	for _, r := range e.rules {
+		if !r.match(ev) {
+			continue
+		}
+		r.lastMatch = now
+		r.lastMsg = ev.GetStructured().GetMsg()
+		if r.Absent == 0 {
+			r.matches = append(r.matches, now)
+			if len(r.matches) > r.Count+1 {
+				r.matches = r.matches[len(r.matches)-r.Count-1:]
+			}
+		}
+		e.check(r, now)
+	}
+}
+
+// Check evaluates the rules that fire or are resolved as time passes.
+func (e *Engine) Check() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.timeNow()
+	for _, r := range e.rules {
+		e.check(r, now)
+	}
+}
+
+func (e *Engine) check(r *rule, now time.Time) {
+	var (
+		firing  bool
+		count   int
+		message string
+	)
+	if r.Absent > 0 {
+		firing = now.Sub(r.lastMatch) >= r.Absent
+		message = fmt.Sprintf("no matching events for %v", r.Absent)
+	} else {
+		for len(r.matches) > 0 && now.Sub(r.matches[0]) >= r.Window {
+			r.matches = r.matches[1:]
+		}
+		count = len(r.matches)
+		firing = count > r.Count
+		if r.Count == 0 {
+			message = "matching event: " + r.lastMsg
+		} else {
+			message = fmt.Sprintf("more than %d matching events within %v, the last one: %s", r.Count, r.Window, r.lastMsg)
+		}
+	}
+	r.firing = firing
+	switch {
+	case firing && !r.notified:
+		// debouncing delays the notification, it's sent by a later check
+		// if the rule still fires by then
+		if !r.notifiedAt.IsZero() && now.Sub(r.notifiedAt) < r.Debounce {
+			return
+		}
+		r.notified, r.notifiedAt = true, now
+		e.notify(r, Notification{Rule: r.Name, State: StateFiring, Message: message, At: now, Count: count})
+	case !firing && r.notified:
+		r.notified = false
+		e.notify(r, Notification{Rule: r.Name, State: StateResolved, Message: "resolved", At: now, Count: count})
+	}
+}
+
+func (e *Engine) notify(r *rule, n Notification) {
+	select {
+	case e.queue <- queued{n: n, notifiers: r.Notifiers}:
+	default:
+		if e.opts.OnError != nil {
+			e.opts.OnError(r.Name, fmt.Errorf("too many notifications waiting, dropped the %s one", n.State))
+		}
+	}
+}
+
+func (r *rule) match(ev *typesv1.LogEvent) bool {
+	if r.Level == "" && r.Where == nil {
+		return true
+	}
+	if ev.Structured == nil {
+		return false
+	}
+	if r.Level != "" {
+		rank, ok := filtersink.LevelRank(ev.Structured.Lvl)
+		if !ok || rank < r.minLevel {
+			return false
+		}
+	}
+	if r.Where != nil {
+		// events the filter can't be evaluated on don't match
+		ok, err := logqleval.Match(r.Where, ev)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops evaluating the rules as time passes, and waits for the
+// notifications to be sent.
+func (e *Engine) Close() {
+	select {
+	case <-e.stop:
+		return
+	default:
+		close(e.stop)
+	}
+	<-e.done
+	close(e.queue)
+	<-e.sent
+}
+
+// Wrap returns a sink that has the engine observe the events it passes
+// on to `next`.
+func (e *Engine) Wrap(next sink.Sink) *tapsink.Tap {
+	return tapsink.NewTap(next, e.Observe)
+}
+
+// RulesFrom reads the rules of the config.
+func RulesFrom(cfgs []config.Alert) ([]Rule, error) {
+	rules := make([]Rule, 0, len(cfgs))
+	names := make(map[string]bool, len(cfgs))
+	for i, cfg := range cfgs {
+		r, err := ruleFrom(cfg)
+		if err != nil {
+			name := cfg.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("alert %s: %v", name, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("alert %s: there's another one with that name", r.Name)
+		}
+		names[r.Name] = true
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func ruleFrom(cfg config.Alert) (r Rule, err error) {
+	r = Rule{Name: cfg.Name, Level: strings.ToLower(cfg.Level), Count: cfg.Count}
+	if r.Name == "" {
+		return r, fmt.Errorf("needs a name")
+	}
+	if r.Level != "" {
+		if _, ok := filtersink.LevelRank(r.Level); !ok {
+			return r, fmt.Errorf("unknown level %q, levels are %s", cfg.Level, strings.Join(filtersink.Levels, ", "))
+		}
+	}
+	if cfg.Where != "" {
+		if r.Where, err = logqleval.ParseFilter(cfg.Where); err != nil {
+			return r, fmt.Errorf("invalid where: %v", err)
+		}
+	}
+	if r.Count < 0 {
+		return r, fmt.Errorf("count can't be negative")
+	}
+	duration := func(name, s string, def time.Duration) (time.Duration, error) {
+		if s == "" {
+			return def, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		if d <= 0 {
+			return 0, fmt.Errorf("%s must be positive, not %v", name, d)
+		}
+		return d, nil
+	}
+	if r.Window, err = duration("window", cfg.Window, DefaultWindow); err != nil {
+		return r, err
+	}
+	if r.Absent, err = duration("absent", cfg.Absent, 0); err != nil {
+		return r, err
+	}
+	if r.Debounce, err = duration("debounce", cfg.Debounce, DefaultDebounce); err != nil {
+		return r, err
+	}
+	if r.Absent > 0 && (cfg.Count != 0 || cfg.Window != "") {
+		return r, fmt.Errorf("absent can't be used along with count or window")
+	}
+
+	if cfg.Desktop {
+		r.Notifiers = append(r.Notifiers, Desktop{})
+	}
+	if cfg.Webhook != "" {
+		r.Notifiers = append(r.Notifiers, Webhook{URL: cfg.Webhook})
+	}
+	if cfg.Command != "" {
+		r.Notifiers = append(r.Notifiers, Command{Cmd: cfg.Command})
+	}
+	if len(r.Notifiers) == 0 {
+		return r, fmt.Errorf("needs a desktop, webhook or command to notify")
+	}
+	return r, nil
+}
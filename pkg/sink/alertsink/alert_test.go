@@ -0,0 +1,230 @@
+package alertsink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+type recordNotifier struct {
+	mu  sync.Mutex
+	got []string
+}
+
+func (r *recordNotifier) Notify(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.got = append(r.got, n.Rule+" "+n.State+": "+n.Message)
+	return nil
+}
+
+func event(lvl, msg string, kvs ...*typesv1.KV) *typesv1.LogEvent {
+	return &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{Lvl: lvl, Msg: msg, Kvs: kvs}}
+}
+
+func mustRules(t *testing.T, cfgs ...config.Alert) []Rule {
+	rules, err := RulesFrom(cfgs)
+	require.NoError(t, err)
+	return rules
+}
+
+func TestEngineMatches(t *testing.T) {
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := &recordNotifier{}
+	rules := mustRules(t, config.Alert{Name: "payments", Level: "error", Where: `service == "payments"`, Debounce: "2m", Command: "true"})
+	rules[0].Notifiers = []Notifier{rec}
+	e := newEngine(rules, Opts{}, func() time.Time { return now }, false)
+
+	payments := typesv1.KeyVal("service", typesv1.ValStr("payments"))
+	e.Observe(event("info", "charged", payments))
+	e.Observe(event("error", "timeout", typesv1.KeyVal("service", typesv1.ValStr("search"))))
+	e.Observe(&typesv1.LogEvent{Raw: []byte("panic: payments")})
+	e.Observe(event("error", "card declined", payments))
+	// still firing, no new notification
+	now = now.Add(30 * time.Second)
+	e.Observe(event("fatal", "card declined again", payments))
+	now = now.Add(59 * time.Second)
+	e.Check()
+	now = now.Add(time.Second)
+	e.Check()
+	// debounced: it fires, but too soon after the last notification
+	e.Observe(event("error", "card declined", payments))
+	now = now.Add(time.Minute)
+	e.Check()
+	e.Observe(event("error", "card declined once more", payments))
+	e.Close()
+
+	require.Equal(t, []string{
+		"payments firing: matching event: card declined",
+		"payments resolved: resolved",
+		"payments firing: matching event: card declined once more",
+	}, rec.got)
+}
+
+func TestEngineDebounceDelays(t *testing.T) {
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := &recordNotifier{}
+	rules := mustRules(t, config.Alert{Name: "errors", Level: "error", Debounce: "2m", Command: "true"})
+	rules[0].Notifiers = []Notifier{rec}
+	e := newEngine(rules, Opts{}, func() time.Time { return now }, false)
+
+	e.Observe(event("error", "timeout"))
+	now = now.Add(time.Minute)
+	e.Check()
+	// fires again too soon after the last notification, and keeps firing
+	now = now.Add(10 * time.Second)
+	e.Observe(event("error", "timeout again"))
+	now = now.Add(30 * time.Second)
+	e.Observe(event("error", "still timing out"))
+	e.Check()
+	now = now.Add(20 * time.Second)
+	e.Check()
+	e.Close()
+
+	require.Equal(t, []string{
+		"errors firing: matching event: timeout",
+		"errors resolved: resolved",
+		"errors firing: matching event: still timing out",
+	}, rec.got, "the notification is sent once the debounce is over")
+}
+
+func TestEngineCount(t *testing.T) {
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := &recordNotifier{}
+	rules := mustRules(t, config.Alert{Name: "errors", Level: "error", Count: 3, Window: "1m", Debounce: "1s", Command: "true"})
+	rules[0].Notifiers = []Notifier{rec}
+	e := newEngine(rules, Opts{}, func() time.Time { return now }, false)
+
+	for i := 0; i < 3; i++ {
+		e.Observe(event("error", "oops"))
+		now = now.Add(10 * time.Second)
+	}
+	require.Empty(t, rec.got)
+	e.Observe(event("error", "oops again"))
+	for i := 0; i < 100; i++ {
+		e.Observe(event("error", "and again"))
+	}
+	now = now.Add(time.Minute)
+	e.Check()
+	e.Close()
+
+	require.Equal(t, []string{
+		"errors firing: more than 3 matching events within 1m0s, the last one: oops again",
+		"errors resolved: resolved",
+	}, rec.got)
+}
+
+func TestEngineAbsent(t *testing.T) {
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := &recordNotifier{}
+	rules := mustRules(t, config.Alert{Name: "quiet", Absent: "5m", Debounce: "1s", Command: "true"})
+	rules[0].Notifiers = []Notifier{rec}
+	e := newEngine(rules, Opts{}, func() time.Time { return now }, false)
+
+	now = now.Add(4 * time.Minute)
+	e.Check()
+	e.Observe(&typesv1.LogEvent{Raw: []byte("still alive")})
+	now = now.Add(5 * time.Minute)
+	e.Check()
+	now = now.Add(time.Minute)
+	e.Observe(event("info", "back"))
+	e.Close()
+
+	require.Equal(t, []string{
+		"quiet firing: no matching events for 5m0s",
+		"quiet resolved: resolved",
+	}, rec.got)
+}
+
+func TestTap(t *testing.T) {
+	ctx := context.Background()
+	rec := &recordNotifier{}
+	rules := mustRules(t, config.Alert{Name: "any", Command: "true"})
+	rules[0].Notifiers = []Notifier{rec}
+	e := newEngine(rules, Opts{}, time.Now, false)
+
+	var got int
+	next := sinkFunc(func(ev *typesv1.LogEvent) { got++ })
+	tap := e.Wrap(next)
+	require.NoError(t, tap.ReceiveBatch(ctx, []*typesv1.LogEvent{event("info", "a"), event("info", "b")}))
+	require.NoError(t, tap.Receive(ctx, event("info", "c")))
+	require.NoError(t, tap.Close(ctx))
+	e.Close()
+
+	require.Equal(t, 3, got)
+	require.Equal(t, []string{"any firing: matching event: a"}, rec.got)
+}
+
+type sinkFunc func(ev *typesv1.LogEvent)
+
+func (f sinkFunc) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	f(ev)
+	return nil
+}
+
+func (f sinkFunc) Close(ctx context.Context) error { return nil }
+
+func TestWebhook(t *testing.T) {
+	var got Notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer srv.Close()
+
+	n := Notification{Rule: "errors", State: StateFiring, Message: "oops", At: time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC), Count: 4}
+	require.NoError(t, Webhook{URL: srv.URL}.Notify(context.Background(), n))
+	require.Equal(t, n, got)
+
+	require.Error(t, Webhook{URL: srv.URL + "/nope\x7f"}.Notify(context.Background(), n))
+}
+
+func TestCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	cmd := Command{Cmd: `echo "$HUMANLOG_ALERT_RULE $HUMANLOG_ALERT_STATE $HUMANLOG_ALERT_COUNT" > ` + out}
+	require.NoError(t, cmd.Notify(context.Background(), Notification{Rule: "errors", State: StateResolved, Count: 2}))
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "errors resolved 2", strings.TrimSpace(string(b)))
+
+	require.ErrorContains(t, Command{Cmd: "echo nope >&2; exit 3"}.Notify(context.Background(), Notification{}), "nope")
+}
+
+func TestRulesFrom(t *testing.T) {
+	rules := mustRules(t,
+		config.Alert{Name: "errors", Level: "ERROR", Count: 50, Window: "1m", Desktop: true, Webhook: "http://localhost:1234"},
+		config.Alert{Name: "quiet", Absent: "5m", Command: "true"},
+	)
+	require.Len(t, rules, 2)
+	require.Equal(t, "error", rules[0].Level)
+	require.Equal(t, []Notifier{Desktop{}, Webhook{URL: "http://localhost:1234"}}, rules[0].Notifiers)
+	require.Equal(t, DefaultDebounce, rules[0].Debounce)
+	require.Equal(t, 5*time.Minute, rules[1].Absent)
+
+	for _, bad := range []config.Alert{
+		{Command: "true"},
+		{Name: "a"},
+		{Name: "a", Level: "loud", Command: "true"},
+		{Name: "a", Where: "service ==", Command: "true"},
+		{Name: "a", Count: -1, Command: "true"},
+		{Name: "a", Window: "soon", Command: "true"},
+		{Name: "a", Debounce: "-1s", Command: "true"},
+		{Name: "a", Absent: "5m", Count: 3, Command: "true"},
+	} {
+		_, err := RulesFrom([]config.Alert{bad})
+		require.Error(t, err, "%+v", bad)
+	}
+	_, err := RulesFrom([]config.Alert{{Name: "a", Command: "true"}, {Name: "a", Command: "true"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package alertsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/gen2brain/beeep"
+)
+
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+
+	// NotifyTimeout bounds how long a webhook or command can take.
+	NotifyTimeout = 10 * time.Second
+)
+
+// Notification tells that a rule fired or was resolved.
+type Notification struct {
+	Rule    string    `json:"rule"`
+	State   string    `json:"state"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+	// Count is how many events matched the rule within its window.
+	Count int `json:"count"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Desktop shows notifications on the desktop, with a sound when rules fire.
+type Desktop struct{}
+
+func (Desktop) Notify(ctx context.Context, n Notification) error {
+	title := "humanlog: " + n.Rule + " " + n.State
+	if n.State == StateFiring {
+		return beeep.Alert(title, n.Message, "")
+	}
+	return beeep.Notify(title, n.Message, "")
+}
+
+// Webhook POSTs notifications as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (wh Webhook) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, NotifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", res.Status)
+	}
+	return nil
+}
+
+// Command runs a shell command for notifications, with the notification in
+// the HUMANLOG_ALERT_* env vars.
+type Command struct {
+	Cmd string
+}
+
+func (c Command) Notify(ctx context.Context, n Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, NotifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Cmd)
+	cmd.Env = append(os.Environ(),
+		"HUMANLOG_ALERT_RULE="+n.Rule,
+		"HUMANLOG_ALERT_STATE="+n.State,
+		"HUMANLOG_ALERT_MESSAGE="+n.Message,
+		"HUMANLOG_ALERT_COUNT="+strconv.Itoa(n.Count),
+		"HUMANLOG_ALERT_AT="+n.At.Format(time.RFC3339),
+	)
+	out, err := cmd.CombinedOutput()
+	if out = bytes.TrimSpace(out); err != nil && len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return err
+}
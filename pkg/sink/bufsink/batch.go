@@ -0,0 +1,182 @@
+package bufsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/metrics"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"google.golang.org/protobuf/proto"
+)
+
+const DefaultMaxEvents = 1000
+
+// ErrClosed is returned for the events received after `Close`.
+var ErrClosed = errors.New("batcher is closed")
+
+type BatchOpts struct {
+	// MaxEvents is how many events a batch holds at most,
+	// `DefaultMaxEvents` if zero.
+	MaxEvents int
+	// MaxBytes is how big the events of a batch can be once encoded, a
+	// single event bigger than that is sent alone. No limit if zero.
+	MaxBytes int
+	// MaxLatency is how long an event can wait for its batch to be sent.
+	// No limit if zero.
+	MaxLatency time.Duration
+
+	// Stage is the label of the batcher's metrics, "buffer" if empty.
+	Stage string
+
+	// OnError is told about the errors of the batches sent because of
+	// `MaxLatency`, since there's no caller to return them to.
+	OnError func(err error)
+}
+
+// Batcher adapts a `sink.BatchSink` to a `sink.Sink`, sending it the events
+// in batches, as soon as one of the limits of its options is reached.
+//
+// A batch is sent while receiving the event that completes it, so a slow
+// sink slows down whoever sends events to the batcher. The events a batch
+// failed to send, all of them or those after a `sink.PartialError`, stay
+// to be sent with the next batch. When that's more than `MaxEvents`, the
+// oldest are dropped.
+type Batcher struct {
+	next sink.BatchSink
+	opts BatchOpts
+
+	mu       sync.Mutex
+	buffered []*typesv1.LogEvent
+	bytes    int
+	timer    *time.Timer
+	// batch is incremented as batches are sent, so that timers set for a
+	// batch that was sent don't send the next one
+	batch  uint64
+	closed bool
+}
+
+var _ sink.Sink = (*Batcher)(nil)
+
+func NewBatcher(next sink.BatchSink, opts BatchOpts) *Batcher {
+	if opts.MaxEvents <= 0 {
+		opts.MaxEvents = DefaultMaxEvents
+	}
+	if opts.Stage == "" {
+		opts.Stage = stage
+	}
+	return &Batcher{
+		next:     next,
+		opts:     opts,
+		buffered: make([]*typesv1.LogEvent, 0, min(opts.MaxEvents, DefaultMaxEvents)),
+	}
+}
+
+func (b *Batcher) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	metrics.Received.Inc(b.opts.Stage)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		metrics.Dropped.Inc(b.opts.Stage)
+		return ErrClosed
+	}
+	cev := proto.Clone(ev).(*typesv1.LogEvent)
+	size := proto.Size(cev)
+	var err error
+	if b.opts.MaxBytes > 0 && len(b.buffered) > 0 && b.bytes+size > b.opts.MaxBytes {
+		// the event would make the batch too big, it goes in the next one
+		err = b.flush(ctx)
+	}
+	if len(b.buffered) >= b.opts.MaxEvents {
+		// what failed to be sent takes all the room
+		metrics.Dropped.Inc(b.opts.Stage)
+		b.bytes -= proto.Size(b.buffered[0])
+		b.buffered = append(b.buffered[:0], b.buffered[1:]...)
+	}
+	b.buffered = append(b.buffered, cev)
+	b.bytes += size
+	switch {
+	case len(b.buffered) >= b.opts.MaxEvents,
+		b.opts.MaxBytes > 0 && b.bytes >= b.opts.MaxBytes:
+		err = errors.Join(err, b.flush(ctx))
+	case len(b.buffered) == 1:
+		b.startTimer()
+	}
+	metrics.QueueDepth.Set(float64(len(b.buffered)), b.opts.Stage)
+	return err
+}
+
+// Flush sends the batch, however small it is.
+func (b *Batcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush(ctx)
+}
+
+func (b *Batcher) flush(ctx context.Context) error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.batch++
+	if len(b.buffered) == 0 {
+		return nil
+	}
+	n := len(b.buffered)
+	err := b.next.ReceiveBatch(ctx, b.buffered)
+	sent := sink.Received(n, err)
+	metrics.BatchSize.Observe(float64(n), b.opts.Stage)
+	metrics.Sent.Add(float64(sent), b.opts.Stage)
+	b.buffered = append(b.buffered[:0], b.buffered[sent:]...)
+	if len(b.buffered) > 0 {
+		b.bytes = 0
+		for _, ev := range b.buffered {
+			b.bytes += proto.Size(ev)
+		}
+		b.startTimer()
+	} else {
+		b.bytes = 0
+	}
+	metrics.QueueDepth.Set(float64(len(b.buffered)), b.opts.Stage)
+	if err != nil {
+		return fmt.Errorf("sending batch of %d events, %d weren't sent: %w", n, n-sent, err)
+	}
+	return nil
+}
+
+func (b *Batcher) startTimer() {
+	if b.opts.MaxLatency <= 0 || b.closed {
+		return
+	}
+	batch := b.batch
+	b.timer = time.AfterFunc(b.opts.MaxLatency, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.batch != batch || b.closed {
+			return
+		}
+		if err := b.flush(context.Background()); err != nil && b.opts.OnError != nil {
+			b.opts.OnError(err)
+		}
+	})
+}
+
+// Close sends the last batch, then closes the next sink, which the batcher
+// owns. The events that can't be sent are dropped.
+func (b *Batcher) Close(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	err := b.flush(ctx)
+	if left := len(b.buffered); left > 0 {
+		metrics.Dropped.Add(float64(left), b.opts.Stage)
+		b.buffered = b.buffered[:0]
+		metrics.QueueDepth.Set(0, b.opts.Stage)
+	}
+	return errors.Join(err, b.next.Close(ctx))
+}
@@ -0,0 +1,119 @@
+package bufsink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/stretchr/testify/require"
+)
+
+type batchSink struct {
+	mu      sync.Mutex
+	batches [][]string
+	// accept is how many events of the next batch are received, all of
+	// them if negative
+	accept int
+	closed bool
+}
+
+func (b *batchSink) ReceiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(evs)
+	var err error
+	if b.accept >= 0 && b.accept < n {
+		n = b.accept
+		err = &sink.PartialError{Received: n, Err: errors.New("unreachable")}
+		b.accept = -1
+	}
+	var batch []string
+	for _, ev := range evs[:n] {
+		batch = append(batch, string(ev.Raw))
+	}
+	b.batches = append(b.batches, batch)
+	return err
+}
+
+func (b *batchSink) Close(ctx context.Context) error {
+	b.closed = true
+	return nil
+}
+
+func (b *batchSink) received() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string(nil), b.batches...)
+}
+
+func receive(t *testing.T, snk sink.Sink, raws ...string) {
+	t.Helper()
+	for _, raw := range raws {
+		require.NoError(t, snk.Receive(context.Background(), &typesv1.LogEvent{Raw: []byte(raw)}))
+	}
+}
+
+func TestBatcherMaxEvents(t *testing.T) {
+	next := &batchSink{accept: -1}
+	b := NewBatcher(next, BatchOpts{MaxEvents: 2})
+	receive(t, b, "1", "2", "3")
+	require.Equal(t, [][]string{{"1", "2"}}, next.received())
+
+	require.NoError(t, b.Close(context.Background()))
+	require.Equal(t, [][]string{{"1", "2"}, {"3"}}, next.received(), "the last batch is sent on close")
+	require.True(t, next.closed)
+	require.ErrorIs(t, b.Receive(context.Background(), &typesv1.LogEvent{}), ErrClosed)
+}
+
+func TestBatcherMaxBytes(t *testing.T) {
+	next := &batchSink{accept: -1}
+	// each event is 2 bytes for the tag and length, and its raw line
+	b := NewBatcher(next, BatchOpts{MaxBytes: 10})
+	receive(t, b, "aaa", "bbb", "cccccccc", "dd")
+	require.Equal(t, [][]string{{"aaa", "bbb"}, {"cccccccc"}}, next.received())
+}
+
+func TestBatcherMaxLatency(t *testing.T) {
+	next := &batchSink{accept: -1}
+	b := NewBatcher(next, BatchOpts{MaxLatency: 10 * time.Millisecond})
+	receive(t, b, "1", "2")
+	require.Eventually(t, func() bool { return len(next.received()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, [][]string{{"1", "2"}}, next.received())
+	require.NoError(t, b.Close(context.Background()))
+}
+
+func TestBatcherPartialFailure(t *testing.T) {
+	next := &batchSink{accept: 1}
+	b := NewBatcher(next, BatchOpts{MaxEvents: 3})
+	receive(t, b, "1", "2")
+	err := b.Receive(context.Background(), &typesv1.LogEvent{Raw: []byte("3")})
+	require.ErrorContains(t, err, "2 weren't sent")
+	var perr *sink.PartialError
+	require.ErrorAs(t, err, &perr)
+
+	receive(t, b, "4")
+	require.NoError(t, b.Close(context.Background()))
+	require.Equal(t, [][]string{{"1"}, {"2", "3", "4"}}, next.received(), "what wasn't sent is sent with the next batch")
+}
+
+func TestBatcherDropsOldestFailures(t *testing.T) {
+	next := &batchSink{accept: 0}
+	b := NewBatcher(next, BatchOpts{MaxEvents: 2})
+	receive(t, b, "1")
+	require.Error(t, b.Receive(context.Background(), &typesv1.LogEvent{Raw: []byte("2")}))
+	receive(t, b, "3")
+	require.Equal(t, [][]string{nil, {"2", "3"}}, next.received())
+}
+
+func TestSizedBufferCloseFlushes(t *testing.T) {
+	next := &batchSink{accept: -1}
+	b := NewSizedBufferedSink(2, next)
+	receive(t, b, "1", "2", "3")
+	require.NoError(t, b.Close(context.Background()))
+	require.Equal(t, [][]string{{"1", "2"}, {"3"}}, next.received())
+	require.True(t, next.closed)
+}
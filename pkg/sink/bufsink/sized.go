@@ -2,8 +2,10 @@ package bufsink
 
 import (
 	"context"
+	"errors"
 
 	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/metrics"
 	"github.com/humanlogio/humanlog/pkg/sink"
 	"google.golang.org/protobuf/proto"
 )
@@ -16,6 +18,8 @@ type SizedBuffer struct {
 
 var _ sink.Sink = (*SizedBuffer)(nil)
 
+const stage = "buffer"
+
 func NewSizedBufferedSink(size int, flush sink.BatchSink) *SizedBuffer {
 	return &SizedBuffer{
 		size:     size,
@@ -24,19 +28,43 @@ func NewSizedBufferedSink(size int, flush sink.BatchSink) *SizedBuffer {
 	}
 }
 
+// Close sends what's buffered, however little, then closes the sink it's
+// sent to: the buffer owns that sink, which mustn't be closed again.
 func (sn *SizedBuffer) Close(ctx context.Context) error {
-	return nil
+	if sn.flush == nil {
+		return nil
+	}
+	if len(sn.Buffered) > 0 {
+		n := len(sn.Buffered)
+		metrics.BatchSize.Observe(float64(n), stage)
+		err := sn.flush.ReceiveBatch(ctx, sn.Buffered)
+		sent := sink.Received(n, err)
+		metrics.Sent.Add(float64(sent), stage)
+		metrics.Dropped.Add(float64(n-sent), stage)
+		sn.Buffered = sn.Buffered[:0]
+		metrics.QueueDepth.Set(0, stage)
+		if err != nil {
+			return errors.Join(err, sn.flush.Close(ctx))
+		}
+	}
+	return sn.flush.Close(ctx)
 }
 
 func (sn *SizedBuffer) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	metrics.Received.Inc(stage)
 	cev := proto.Clone(ev).(*typesv1.LogEvent)
 	sn.Buffered = append(sn.Buffered, cev)
 	if len(sn.Buffered) == sn.size {
+		metrics.BatchSize.Observe(float64(len(sn.Buffered)), stage)
 		if err := sn.flush.ReceiveBatch(ctx, sn.Buffered); err != nil {
 			sn.Buffered = sn.Buffered[:len(sn.Buffered)-1]
+			metrics.Dropped.Inc(stage)
+			metrics.QueueDepth.Set(float64(len(sn.Buffered)), stage)
 			return err
 		}
+		metrics.Sent.Add(float64(len(sn.Buffered)), stage)
 		sn.Buffered = sn.Buffered[:0:sn.size]
 	}
+	metrics.QueueDepth.Set(float64(len(sn.Buffered)), stage)
 	return nil
 }
@@ -0,0 +1,236 @@
+// Package chartsink samples a numeric key of the events passed to it, to
+// chart its percentiles over time and the distribution of its values.
+package chartsink
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/sink"
+)
+
+type Sample struct {
+	At    time.Time
+	Value float64
+}
+
+// Point is the value of a percentile over a bucket of time, starting at
+// `At`.
+type Point struct {
+	At    time.Time
+	Value float64
+}
+
+// Series are the values of a percentile of the samples of a group, over
+// time.
+type Series struct {
+	Group      string
+	Percentile float64
+	Points     []Point
+}
+
+// Bin counts the values in [Low, High).
+type Bin struct {
+	Low, High float64
+	Count     int64
+}
+
+// Sampler keeps the values of a key of structured events, grouped by the
+// value of another key. Durations, and strings like "12.5ms", are sampled
+// in milliseconds. Events without a numeric value for the key are
+// skipped.
+type Sampler struct {
+	key string
+	by  string
+
+	groups  map[string][]Sample
+	order   []string
+	skipped int64
+}
+
+var _ sink.Sink = (*Sampler)(nil)
+
+// NewSampler samples `key`, by the value of `by` if it's not empty.
+func NewSampler(key, by string) *Sampler {
+	return &Sampler{key: key, by: by, groups: make(map[string][]Sample)}
+}
+
+func (s *Sampler) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	data := ev.Structured
+	if data == nil {
+		return nil
+	}
+	var (
+		value float64
+		found bool
+		group string
+	)
+	for _, kv := range data.Kvs {
+		switch kv.Key {
+		case s.key:
+			value, found = logqleval.Numeric(kv.Value)
+		case s.by:
+			group = logqleval.FormatVal(kv.Value)
+		}
+	}
+	if !found {
+		s.skipped++
+		return nil
+	}
+	at := ev.GetParsedAt().AsTime()
+	if ts := data.Timestamp; ts != nil && !ts.AsTime().IsZero() {
+		at = ts.AsTime()
+	}
+	if _, ok := s.groups[group]; !ok {
+		s.order = append(s.order, group)
+	}
+	s.groups[group] = append(s.groups[group], Sample{At: at, Value: value})
+	return nil
+}
+
+func (s *Sampler) Close(ctx context.Context) error {
+	return nil
+}
+
+// Skipped is how many structured events had no numeric value for the key.
+func (s *Sampler) Skipped() int64 {
+	return s.skipped
+}
+
+// Groups returns the groups in the order they were first seen.
+func (s *Sampler) Groups() []string {
+	return s.order
+}
+
+// TimeRange returns the times of the first and last samples.
+func (s *Sampler) TimeRange() (from, to time.Time) {
+	for _, samples := range s.groups {
+		for _, sample := range samples {
+			if from.IsZero() || sample.At.Before(from) {
+				from = sample.At
+			}
+			if sample.At.After(to) {
+				to = sample.At
+			}
+		}
+	}
+	return from, to
+}
+
+// Series splits the time range of the samples in `buckets` of the same
+// width, and computes `percentiles` of each group for each of them.
+// Buckets without samples have no point.
+func (s *Sampler) Series(buckets int, percentiles []float64) []Series {
+	if buckets <= 0 {
+		buckets = 1
+	}
+	from, to := s.TimeRange()
+	width := to.Sub(from) / time.Duration(buckets)
+	if width <= 0 {
+		width = 1
+	}
+	var out []Series
+	for _, group := range s.order {
+		byBucket := make([][]float64, buckets)
+		for _, sample := range s.groups[group] {
+			i := min(int(sample.At.Sub(from)/width), buckets-1)
+			byBucket[i] = append(byBucket[i], sample.Value)
+		}
+		for _, values := range byBucket {
+			sort.Float64s(values)
+		}
+		for _, p := range percentiles {
+			series := Series{Group: group, Percentile: p}
+			for i, values := range byBucket {
+				if len(values) == 0 {
+					continue
+				}
+				series.Points = append(series.Points, Point{
+					At:    from.Add(time.Duration(i) * width),
+					Value: Percentile(values, p),
+				})
+			}
+			out = append(out, series)
+		}
+	}
+	return out
+}
+
+// Histogram counts the values of all the groups in `bins` of the same
+// width.
+func (s *Sampler) Histogram(bins int) []Bin {
+	if bins <= 0 {
+		bins = 1
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, samples := range s.groups {
+		for _, sample := range samples {
+			lo, hi = math.Min(lo, sample.Value), math.Max(hi, sample.Value)
+		}
+	}
+	if math.IsInf(lo, 1) {
+		return nil
+	}
+	if lo == hi {
+		bins = 1
+	}
+	width := (hi - lo) / float64(bins)
+	out := make([]Bin, bins)
+	for i := range out {
+		out[i].Low = lo + float64(i)*width
+		out[i].High = lo + float64(i+1)*width
+	}
+	out[bins-1].High = hi
+	for _, samples := range s.groups {
+		for _, sample := range samples {
+			i := bins - 1
+			if width > 0 {
+				i = min(int((sample.Value-lo)/width), bins-1)
+			}
+			out[i].Count++
+		}
+	}
+	return out
+}
+
+// Percentile computes the `p`th percentile of sorted values, interpolating
+// between the closest ones.
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	if lo == hi {
+		return sorted[lo]
+	}
+	return sorted[lo] + (rank-float64(lo))*(sorted[hi]-sorted[lo])
+}
+
+// ParsePercentiles parses percentiles like "50,95,99.9".
+func ParsePercentiles(s string) ([]float64, error) {
+	var out []float64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(strings.TrimPrefix(part, "p"), 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("%q isn't a percentile, they're between 0 and 100", part)
+		}
+		out = append(out, p)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no percentiles in %q", s)
+	}
+	return out, nil
+}
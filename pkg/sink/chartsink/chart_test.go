@@ -0,0 +1,105 @@
+package chartsink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5}
+	require.Equal(t, 1.0, Percentile(values, 0))
+	require.Equal(t, 3.0, Percentile(values, 50))
+	require.Equal(t, 5.0, Percentile(values, 100))
+	require.InDelta(t, 4.8, Percentile(values, 95), 1e-9)
+	require.Equal(t, 7.0, Percentile([]float64{7}, 99))
+}
+
+func TestParsePercentiles(t *testing.T) {
+	got, err := ParsePercentiles("50, p95,99.9")
+	require.NoError(t, err)
+	require.Equal(t, []float64{50, 95, 99.9}, got)
+
+	for _, bad := range []string{"", "101", "-1", "fast"} {
+		_, err := ParsePercentiles(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	s := NewSampler("latency_ms", "service")
+	receive := func(at time.Duration, service string, latency *typesv1.Val) {
+		kvs := []*typesv1.KV{typesv1.KeyVal("service", typesv1.ValStr(service))}
+		if latency != nil {
+			kvs = append(kvs, typesv1.KeyVal("latency_ms", latency))
+		}
+		require.NoError(t, s.Receive(ctx, &typesv1.LogEvent{
+			ParsedAt:   timestamppb.New(now.Add(time.Hour)),
+			Structured: &typesv1.StructuredLogEvent{Timestamp: timestamppb.New(now.Add(at)), Kvs: kvs},
+		}))
+	}
+	receive(0, "api", typesv1.ValI64(10))
+	receive(time.Second, "api", typesv1.ValI64(30))
+	receive(time.Second, "db", typesv1.ValF64(5))
+	receive(9*time.Second, "api", typesv1.ValI64(50))
+	receive(10*time.Second, "db", typesv1.ValStr("1"))
+	receive(5*time.Second, "db", nil)
+	require.NoError(t, s.Receive(ctx, &typesv1.LogEvent{Raw: []byte("not structured")}))
+
+	require.Equal(t, []string{"api", "db"}, s.Groups())
+	require.Equal(t, int64(1), s.Skipped())
+	from, to := s.TimeRange()
+	require.Equal(t, now, from)
+	require.Equal(t, now.Add(10*time.Second), to)
+
+	series := s.Series(2, []float64{50, 100})
+	require.Equal(t, []Series{
+		{Group: "api", Percentile: 50, Points: []Point{{now, 20}, {now.Add(5 * time.Second), 50}}},
+		{Group: "api", Percentile: 100, Points: []Point{{now, 30}, {now.Add(5 * time.Second), 50}}},
+		{Group: "db", Percentile: 50, Points: []Point{{now, 5}, {now.Add(5 * time.Second), 1}}},
+		{Group: "db", Percentile: 100, Points: []Point{{now, 5}, {now.Add(5 * time.Second), 1}}},
+	}, series)
+
+	require.Equal(t, []Bin{
+		{Low: 1, High: 13.25, Count: 3},
+		{Low: 13.25, High: 25.5, Count: 0},
+		{Low: 25.5, High: 37.75, Count: 1},
+		{Low: 37.75, High: 50, Count: 1},
+	}, s.Histogram(4))
+}
+
+func TestSamplerEmpty(t *testing.T) {
+	s := NewSampler("latency_ms", "")
+	require.Nil(t, s.Histogram(10))
+	require.Empty(t, s.Series(10, []float64{50}))
+
+	require.NoError(t, s.Receive(context.Background(), &typesv1.LogEvent{
+		Structured: &typesv1.StructuredLogEvent{
+			Timestamp: timestamppb.New(time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)),
+			Kvs:       []*typesv1.KV{typesv1.KeyVal("latency_ms", typesv1.ValI64(3))},
+		},
+	}))
+	require.Equal(t, []Bin{{Low: 3, High: 3, Count: 1}}, s.Histogram(10))
+	require.Len(t, s.Series(10, []float64{50})[0].Points, 1)
+}
+
+func TestSamplerSkipsNonFinite(t *testing.T) {
+	s := NewSampler("latency_ms", "")
+	at := timestamppb.New(time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC))
+	for _, v := range []string{"1", "+Inf", "NaN", "3"} {
+		require.NoError(t, s.Receive(context.Background(), &typesv1.LogEvent{
+			Structured: &typesv1.StructuredLogEvent{
+				Timestamp: at,
+				Kvs:       []*typesv1.KV{typesv1.KeyVal("latency_ms", typesv1.ValStr(v))},
+			},
+		}))
+	}
+	require.Equal(t, int64(2), s.Skipped())
+	require.Equal(t, []Bin{{Low: 1, High: 2, Count: 1}, {Low: 2, High: 3, Count: 1}}, s.Histogram(2))
+}
@@ -0,0 +1,359 @@
+// Package dedupsink keeps floods of repeated events from reaching a sink,
+// by collapsing repeats and rate limiting what's left.
+package dedupsink
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/metrics"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DefaultMaxGroups bounds how many distinct events are tracked at once.
+	DefaultMaxGroups = 10000
+
+	// AnyLevel is the key of the rate limit that applies to the levels
+	// without one of their own.
+	AnyLevel = "*"
+)
+
+// RateLimit lets `PerSecond` events through on average, and up to `Burst`
+// at once.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+type Opts struct {
+	// Window is how long repeats of a structured event are collapsed for,
+	// after it's first seen. Zero turns collapsing off.
+	Window time.Duration
+	// RateLimits are by level, in lower case. `AnyLevel` applies to the
+	// levels that aren't listed.
+	RateLimits map[string]RateLimit
+	MaxGroups  int
+
+	// ReportLimited is whether how many events the rate limits dropped is
+	// reported in a warning event. It's for what's printed, as the warning
+	// would be stored like any event when sent to be stored.
+	ReportLimited bool
+	// Name labels the deduper's metrics, as the stage "dedup:<name>".
+	Name string
+}
+
+// Deduper passes the first of a run of repeated structured events on to
+// the next sink, and holds back the repeats that come within `Window`.
+// Once the window is over, a single event stands for them: the last
+// repeat, with `repeated=N` and the timestamps of the first and last
+// events of the run.
+//
+// Events are repeats of each other when they have the same level, the same
+// message once the numbers, IDs and such are taken out, and the same keys.
+// Raw lines are never collapsed, they're often part of multiline output.
+//
+// Events over their level's rate limit are dropped and counted in the
+// pipeline metrics. With `ReportLimited`, how many were is also reported in
+// a warning every second.
+type Deduper struct {
+	next sink.Sink
+	opts Opts
+
+	mu      sync.Mutex
+	groups  map[string]*group
+	buckets map[string]*bucket
+	// limited counts, per level, the events dropped since the last report
+	limited    map[string]int
+	reportedAt time.Time
+
+	timeNow func() time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type group struct {
+	until       time.Time
+	first, last time.Time
+	repeated    int64
+	lastEv      *typesv1.LogEvent
+}
+
+var _ sink.Sink = (*Deduper)(nil)
+
+func NewDeduper(next sink.Sink, opts Opts) *Deduper {
+	return newDeduper(next, opts, time.Now, true)
+}
+
+func newDeduper(next sink.Sink, opts Opts, timeNow func() time.Time, tick bool) *Deduper {
+	if opts.MaxGroups <= 0 {
+		opts.MaxGroups = DefaultMaxGroups
+	}
+	if opts.Name == "" {
+		opts.Name = "dedup"
+	} else {
+		opts.Name = "dedup:" + opts.Name
+	}
+	d := &Deduper{
+		next:    next,
+		opts:    opts,
+		groups:  make(map[string]*group),
+		buckets: make(map[string]*bucket),
+		limited: make(map[string]int),
+		timeNow: timeNow,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	d.reportedAt = timeNow()
+	if !tick {
+		close(d.done)
+		return d
+	}
+	interval := time.Second
+	if opts.Window > 0 && opts.Window < interval {
+		interval = opts.Window
+	}
+	go d.tick(interval)
+	return d
+}
+
+func (d *Deduper) tick(interval time.Duration) {
+	defer close(d.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			_ = d.expire(context.Background(), d.timeNow(), false)
+			d.mu.Unlock()
+		}
+	}
+}
+
+func (d *Deduper) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.timeNow()
+	if err := d.expire(ctx, now, false); err != nil {
+		return err
+	}
+	var key string
+	if ev.Structured != nil && d.opts.Window > 0 {
+		key = groupKey(ev.Structured)
+		if g, ok := d.groups[key]; ok {
+			g.repeated++
+			g.last = eventTime(ev, now)
+			// the scanner reuses events
+			g.lastEv = proto.Clone(ev).(*typesv1.LogEvent)
+			return nil
+		}
+	}
+	lvl := levelOf(ev)
+	if !d.allow(lvl, now) {
+		metrics.Dropped.Inc(d.opts.Name)
+		if d.opts.ReportLimited {
+			d.limited[lvl]++
+		}
+		return nil
+	}
+	if key != "" && len(d.groups) < d.opts.MaxGroups {
+		ts := eventTime(ev, now)
+		d.groups[key] = &group{until: now.Add(d.opts.Window), first: ts, last: ts}
+	}
+	return d.next.Receive(ctx, ev)
+}
+
+// Flush passes on the events standing for the repeats held back so far,
+// and reports the events that were rate limited. It's called once all the
+// events were received, as windows aren't ended in the background anymore
+// after it.
+func (d *Deduper) Flush(ctx context.Context) error {
+	select {
+	case <-d.stop:
+	default:
+		close(d.stop)
+	}
+	<-d.done
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expire(ctx, d.timeNow(), true)
+}
+
+func (d *Deduper) Close(ctx context.Context) error {
+	if err := d.Flush(ctx); err != nil {
+		return err
+	}
+	return d.next.Close(ctx)
+}
+
+// expire ends the windows that are over, or all of them if `all`.
+func (d *Deduper) expire(ctx context.Context, now time.Time, all bool) error {
+	var ended []*group
+	for key, g := range d.groups {
+		if all || !now.Before(g.until) {
+			delete(d.groups, key)
+			if g.repeated > 0 {
+				ended = append(ended, g)
+			}
+		}
+	}
+	// in the order the runs started, not the map's
+	sort.Slice(ended, func(i, j int) bool { return ended[i].first.Before(ended[j].first) })
+	for _, g := range ended {
+		if err := d.next.Receive(ctx, summarize(g)); err != nil {
+			return err
+		}
+	}
+	if !all && now.Sub(d.reportedAt) < time.Second {
+		return nil
+	}
+	return d.reportLimited(ctx, now)
+}
+
+func summarize(g *group) *typesv1.LogEvent {
+	ev := g.lastEv
+	ev.Structured.Kvs = append(ev.Structured.Kvs,
+		typesv1.KeyVal("repeated", typesv1.ValI64(g.repeated)),
+		typesv1.KeyVal("first_ts", typesv1.ValTime(g.first)),
+		typesv1.KeyVal("last_ts", typesv1.ValTime(g.last)),
+	)
+	return ev
+}
+
+func (d *Deduper) reportLimited(ctx context.Context, now time.Time) error {
+	d.reportedAt = now
+	if len(d.limited) == 0 {
+		return nil
+	}
+	levels := make([]string, 0, len(d.limited))
+	for lvl := range d.limited {
+		levels = append(levels, lvl)
+	}
+	sort.Strings(levels)
+	for _, lvl := range levels {
+		ev := &typesv1.LogEvent{
+			ParsedAt: timestamppb.New(now),
+			Structured: &typesv1.StructuredLogEvent{
+				Timestamp: timestamppb.New(now),
+				Lvl:       "warn",
+				Msg:       "events were rate limited",
+				Kvs: []*typesv1.KV{
+					typesv1.KeyVal("level", typesv1.ValStr(lvl)),
+					typesv1.KeyVal("dropped", typesv1.ValI64(int64(d.limited[lvl]))),
+				},
+			},
+		}
+		delete(d.limited, lvl)
+		if err := d.next.Receive(ctx, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eventTime(ev *typesv1.LogEvent, now time.Time) time.Time {
+	if ts := ev.GetStructured().GetTimestamp(); ts != nil && !ts.AsTime().IsZero() {
+		return ts.AsTime()
+	}
+	return now
+}
+
+func levelOf(ev *typesv1.LogEvent) string {
+	if ev.Structured == nil {
+		return "raw"
+	}
+	return strings.ToLower(ev.Structured.Lvl)
+}
+
+// variables are the parts of messages that change between repeats of the
+// same event.
+var variables = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|0x[0-9a-fA-F]+|\b[0-9a-fA-F]*[0-9][0-9a-fA-F]*\b|\d+(?:\.\d+)?`)
+
+// Template replaces the variable parts of a message, so that messages
+// that only differ by those are the same.
+func Template(msg string) string {
+	return variables.ReplaceAllString(msg, "<*>")
+}
+
+func groupKey(data *typesv1.StructuredLogEvent) string {
+	keys := make([]string, 0, len(data.Kvs))
+	for _, kv := range data.Kvs {
+		keys = append(keys, kv.Key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(data.Lvl))
+	sb.WriteByte(0)
+	sb.WriteString(Template(data.Msg))
+	for _, key := range keys {
+		sb.WriteByte(0)
+		sb.WriteString(key)
+	}
+	return sb.String()
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func (d *Deduper) allow(lvl string, now time.Time) bool {
+	limit, ok := d.opts.RateLimits[lvl]
+	if !ok {
+		if limit, ok = d.opts.RateLimits[AnyLevel]; !ok {
+			return true
+		}
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.PerSecond))
+	}
+	b, ok := d.buckets[lvl]
+	if !ok {
+		b = &bucket{tokens: burst, at: now}
+		d.buckets[lvl] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.at).Seconds()*limit.PerSecond)
+	b.at = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// OptsFrom reads the options of a deduper from its config. `ok` is false
+// when it has nothing to do.
+func OptsFrom(cfg *config.DedupSink) (opts Opts, ok bool, err error) {
+	if cfg == nil {
+		return opts, false, nil
+	}
+	if cfg.Window != nil && *cfg.Window != "" {
+		if opts.Window, err = time.ParseDuration(*cfg.Window); err != nil {
+			return opts, false, fmt.Errorf("invalid window: %v", err)
+		}
+	}
+	if cfg.RateLimits != nil {
+		opts.RateLimits = make(map[string]RateLimit, len(*cfg.RateLimits))
+		for lvl, rl := range *cfg.RateLimits {
+			if rl.PerSecond <= 0 {
+				return opts, false, fmt.Errorf("rate limit of %q needs a positive per-second", lvl)
+			}
+			opts.RateLimits[strings.ToLower(lvl)] = RateLimit{PerSecond: rl.PerSecond, Burst: rl.Burst}
+		}
+	}
+	return opts, opts.Window > 0 || len(opts.RateLimits) > 0, nil
+}
@@ -0,0 +1,168 @@
+package dedupsink
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/metrics"
+	"github.com/humanlogio/humanlog/pkg/sink/bufsink"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// lines formats events as "lvl msg k=v...", raw lines as they are.
+func lines(evs []*typesv1.LogEvent) []string {
+	var out []string
+	for _, ev := range evs {
+		if ev.Structured == nil {
+			out = append(out, string(ev.Raw))
+			continue
+		}
+		line := ev.Structured.Lvl + " " + ev.Structured.Msg
+		for _, kv := range ev.Structured.Kvs {
+			switch v := kv.Value.GetKind().(type) {
+			case *typesv1.Val_I64:
+				line += fmt.Sprintf(" %s=%d", kv.Key, v.I64)
+			case *typesv1.Val_Str:
+				line += fmt.Sprintf(" %s=%s", kv.Key, v.Str)
+			case *typesv1.Val_Ts:
+				line += fmt.Sprintf(" %s=%s", kv.Key, v.Ts.AsTime().Format(time.TimeOnly))
+			}
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func event(ts time.Time, lvl, msg string, kvs ...*typesv1.KV) *typesv1.LogEvent {
+	return &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{
+		Timestamp: timestamppb.New(ts),
+		Lvl:       lvl,
+		Msg:       msg,
+		Kvs:       kvs,
+	}}
+}
+
+func TestDeduper(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := bufsink.NewSizedBufferedSink(100, nil)
+	d := newDeduper(rec, Opts{Window: 5 * time.Second}, func() time.Time { return now }, false)
+
+	receive := func(ev *typesv1.LogEvent) {
+		require.NoError(t, d.Receive(ctx, ev))
+	}
+	port := func(p int64) *typesv1.KV { return typesv1.KeyVal("port", typesv1.ValI64(p)) }
+
+	receive(event(now, "error", "dial tcp 10.0.0.1:5432: connection refused", port(5432)))
+	now = now.Add(time.Second)
+	receive(event(now, "error", "dial tcp 10.0.0.2:5433: connection refused", port(5433)))
+	receive(&typesv1.LogEvent{Raw: []byte("retrying")})
+	receive(&typesv1.LogEvent{Raw: []byte("retrying")})
+	// different keys, not a repeat
+	receive(event(now, "error", "dial tcp 10.0.0.3:5432: connection refused"))
+	now = now.Add(time.Second)
+	receive(event(now, "error", "dial tcp 10.0.0.4:5434: connection refused", port(5434)))
+	// the window is over
+	now = now.Add(4 * time.Second)
+	receive(event(now, "error", "dial tcp 10.0.0.5:5435: connection refused", port(5435)))
+	now = now.Add(time.Second)
+	receive(event(now, "error", "dial tcp 10.0.0.6:5436: connection refused", port(5436)))
+	require.NoError(t, d.Close(ctx))
+
+	require.Equal(t, []string{
+		"error dial tcp 10.0.0.1:5432: connection refused port=5432",
+		"retrying",
+		"retrying",
+		"error dial tcp 10.0.0.3:5432: connection refused",
+		"error dial tcp 10.0.0.4:5434: connection refused port=5434 repeated=2 first_ts=19:36:00 last_ts=19:36:02",
+		"error dial tcp 10.0.0.5:5435: connection refused port=5435",
+		"error dial tcp 10.0.0.6:5436: connection refused port=5436 repeated=1 first_ts=19:36:06 last_ts=19:36:07",
+	}, lines(rec.Buffered))
+}
+
+func TestDeduperRateLimits(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := bufsink.NewSizedBufferedSink(100, nil)
+	d := newDeduper(rec, Opts{ReportLimited: true, RateLimits: map[string]RateLimit{
+		"debug":  {PerSecond: 1},
+		AnyLevel: {PerSecond: 2, Burst: 3},
+	}}, func() time.Time { return now }, false)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, d.Receive(ctx, event(now, "info", fmt.Sprintf("info %d", i))))
+		require.NoError(t, d.Receive(ctx, event(now, "debug", fmt.Sprintf("debug %d", i))))
+	}
+	now = now.Add(time.Second)
+	require.NoError(t, d.Receive(ctx, event(now, "info", "info 5")))
+	require.NoError(t, d.Close(ctx))
+
+	require.Equal(t, []string{
+		"info info 0",
+		"debug debug 0",
+		"info info 1",
+		"info info 2",
+		"warn events were rate limited level=debug dropped=4",
+		"warn events were rate limited level=info dropped=2",
+		"info info 5",
+	}, lines(rec.Buffered))
+}
+
+func TestDeduperRateLimitsUnreported(t *testing.T) {
+	dropped := func() float64 {
+		for _, s := range metrics.Pipeline.Snapshot() {
+			if s.Name == "humanlog_events_dropped_total" && s.Labels["stage"] == "dedup:remote" {
+				return s.Value
+			}
+		}
+		return 0
+	}
+	before := dropped()
+
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := bufsink.NewSizedBufferedSink(100, nil)
+	d := newDeduper(rec, Opts{Name: "remote", RateLimits: map[string]RateLimit{
+		AnyLevel: {PerSecond: 1},
+	}}, func() time.Time { return now }, false)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, d.Receive(ctx, event(now, "info", fmt.Sprintf("info %d", i))))
+	}
+	require.NoError(t, d.Close(ctx))
+
+	require.Equal(t, []string{"info info 0"}, lines(rec.Buffered), "no warning is made up for what's sent to be stored")
+	require.Equal(t, float64(2), dropped()-before)
+}
+
+func TestTemplate(t *testing.T) {
+	require.Equal(t,
+		"request <*> took <*>.<*>ms for user <*> at <*>",
+		Template("request 3f2a9c1e-7b4d-4c2a-9f1e-0a1b2c3d4e5f took 12.5ms for user 42 at 0xdeadbeef"),
+	)
+	require.Equal(t, Template("retry 1 of 5"), Template("retry 2 of 5"))
+	require.NotEqual(t, Template("cache hit"), Template("cache miss"))
+}
+
+func TestOptsFrom(t *testing.T) {
+	_, ok, err := OptsFrom(nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	opts, ok, err := OptsFrom(&config.DedupSink{
+		Window:     config.Ptr("2s"),
+		RateLimits: &map[string]config.RateLimit{"INFO": {PerSecond: 10}},
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, Opts{Window: 2 * time.Second, RateLimits: map[string]RateLimit{"info": {PerSecond: 10}}}, opts)
+
+	_, _, err = OptsFrom(&config.DedupSink{Window: config.Ptr("soon")})
+	require.Error(t, err)
+	_, _, err = OptsFrom(&config.DedupSink{RateLimits: &map[string]config.RateLimit{"info": {}}})
+	require.Error(t, err)
+}
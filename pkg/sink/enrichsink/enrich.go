@@ -0,0 +1,218 @@
+// Package enrichsink attaches metadata about where events come from, like
+// the host or the git branch, to the events passed to a sink.
+package enrichsink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Fields are the metadata that can be collected.
+var Fields = []string{"hostname", "pid", "user", "cwd", "git", "k8s"}
+
+// SessionMsg is the message of the event that starts a session, when the
+// metadata is only sent once.
+const SessionMsg = "humanlog session started"
+
+type Opts struct {
+	KVs []*typesv1.KV
+	// Session sends the KVs once, in an event of their own before the first
+	// one, instead of adding them to every structured event.
+	Session bool
+}
+
+// gitTimeout bounds how long looking up the git branch and commit can
+// take, it's done before any event is read.
+const gitTimeout = 2 * time.Second
+
+// OptsFrom collects the metadata the config asks for. `ok` is false when
+// there's nothing to attach.
+func OptsFrom(cfg *config.Enrich, tags map[string]string) (opts Opts, ok bool, err error) {
+	var fields []string
+	if cfg != nil {
+		if cfg.Fields != nil {
+			fields = *cfg.Fields
+		}
+		if cfg.Scope != nil {
+			switch *cfg.Scope {
+			case "event", "":
+			case "session":
+				opts.Session = true
+			default:
+				return opts, false, fmt.Errorf("%q is not a scope (try 'event' or 'session')", *cfg.Scope)
+			}
+		}
+		if cfg.Tags != nil {
+			merged := make(map[string]string, len(*cfg.Tags)+len(tags))
+			for k, v := range *cfg.Tags {
+				merged[k] = v
+			}
+			// the ones given on the command line win
+			for k, v := range tags {
+				merged[k] = v
+			}
+			tags = merged
+		}
+	}
+	if opts.KVs, err = Collect(fields); err != nil {
+		return opts, false, err
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		opts.KVs = append(opts.KVs, typesv1.KeyVal(k, typesv1.ValStr(tags[k])))
+	}
+	return opts, len(opts.KVs) > 0, nil
+}
+
+// ParseTags parses `k=v` labels.
+func ParseTags(tags []string) (map[string]string, error) {
+	out := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%q isn't a tag, tags are like k=v", tag)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// Collect looks up the metadata of `fields`. Metadata that can't be found,
+// like the git branch outside of a repository, is left out.
+func Collect(fields []string) ([]*typesv1.KV, error) {
+	var kvs []*typesv1.KV
+	add := func(key, value string) {
+		if value != "" {
+			kvs = append(kvs, typesv1.KeyVal(key, typesv1.ValStr(value)))
+		}
+	}
+	for _, field := range fields {
+		switch field {
+		case "hostname":
+			hostname, _ := os.Hostname()
+			add("host.name", hostname)
+		case "pid":
+			kvs = append(kvs, typesv1.KeyVal("process.pid", typesv1.ValI64(int64(os.Getpid()))))
+		case "user":
+			if u, err := user.Current(); err == nil {
+				add("user.name", u.Username)
+			}
+		case "cwd":
+			cwd, _ := os.Getwd()
+			add("process.cwd", cwd)
+		case "git":
+			add("git.branch", git("rev-parse", "--abbrev-ref", "HEAD"))
+			add("git.commit", git("rev-parse", "HEAD"))
+		case "k8s":
+			add("k8s.pod.name", os.Getenv("POD_NAME"))
+			namespace := os.Getenv("POD_NAMESPACE")
+			if namespace == "" {
+				namespace = os.Getenv("NAMESPACE")
+			}
+			add("k8s.namespace.name", namespace)
+			add("k8s.node.name", os.Getenv("NODE_NAME"))
+		default:
+			return nil, fmt.Errorf("unknown field %q, try one of %q", field, Fields)
+		}
+	}
+	return kvs, nil
+}
+
+func git(args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Enricher adds metadata to the events it passes on to the next sink.
+// Events are copied before KVs are added to them, since other sinks can be
+// given the same events.
+type Enricher struct {
+	next sink.Sink
+	opts Opts
+
+	sentSession bool
+	timeNow     func() time.Time
+}
+
+var _ sink.Sink = (*Enricher)(nil)
+
+func NewEnricher(next sink.Sink, opts Opts) *Enricher {
+	return &Enricher{next: next, opts: opts, timeNow: time.Now}
+}
+
+func (e *Enricher) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	if e.opts.Session {
+		if !e.sentSession {
+			e.sentSession = true
+			now := timestamppb.New(e.timeNow())
+			start := &typesv1.LogEvent{
+				ParsedAt: now,
+				Structured: &typesv1.StructuredLogEvent{
+					Timestamp: now,
+					Lvl:       "info",
+					Msg:       SessionMsg,
+					Kvs:       e.opts.KVs,
+				},
+			}
+			if err := e.next.Receive(ctx, start); err != nil {
+				return err
+			}
+		}
+		return e.next.Receive(ctx, ev)
+	}
+	data := ev.Structured
+	if data == nil {
+		return e.next.Receive(ctx, ev)
+	}
+	kvs := make([]*typesv1.KV, len(data.Kvs), len(data.Kvs)+len(e.opts.KVs))
+	copy(kvs, data.Kvs)
+	for _, kv := range e.opts.KVs {
+		// what the event says about itself wins
+		if !hasKey(data.Kvs, kv.Key) {
+			kvs = append(kvs, kv)
+		}
+	}
+	return e.next.Receive(ctx, &typesv1.LogEvent{
+		ParsedAt: ev.ParsedAt,
+		Raw:      ev.Raw,
+		Structured: &typesv1.StructuredLogEvent{
+			Timestamp: data.Timestamp,
+			Lvl:       data.Lvl,
+			Msg:       data.Msg,
+			Kvs:       kvs,
+		},
+	})
+}
+
+func (e *Enricher) Close(ctx context.Context) error {
+	return e.next.Close(ctx)
+}
+
+func hasKey(kvs []*typesv1.KV, key string) bool {
+	for _, kv := range kvs {
+		if kv.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package enrichsink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/sink/bufsink"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags([]string{"env=prod", "team=core=infra", "empty="})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"env": "prod", "team": "core=infra", "empty": ""}, tags)
+
+	_, err = ParseTags([]string{"env"})
+	require.Error(t, err)
+	_, err = ParseTags([]string{"=prod"})
+	require.Error(t, err)
+}
+
+func TestOptsFrom(t *testing.T) {
+	_, ok, err := OptsFrom(nil, nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	opts, ok, err := OptsFrom(&config.Enrich{
+		Tags:  &map[string]string{"env": "staging", "team": "core"},
+		Scope: config.Ptr("session"),
+	}, map[string]string{"env": "prod"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, opts.Session)
+	require.Equal(t, []*typesv1.KV{
+		typesv1.KeyVal("env", typesv1.ValStr("prod")),
+		typesv1.KeyVal("team", typesv1.ValStr("core")),
+	}, opts.KVs)
+
+	opts, ok, err = OptsFrom(&config.Enrich{Fields: &[]string{"pid"}}, nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, opts.KVs, 1)
+	require.Equal(t, "process.pid", opts.KVs[0].Key)
+
+	_, _, err = OptsFrom(&config.Enrich{Scope: config.Ptr("forever")}, nil)
+	require.Error(t, err)
+	_, _, err = OptsFrom(&config.Enrich{Fields: &[]string{"shoe-size"}}, nil)
+	require.Error(t, err)
+}
+
+func TestEnricherEvents(t *testing.T) {
+	ctx := context.Background()
+	rec := bufsink.NewSizedBufferedSink(100, nil)
+	e := NewEnricher(rec, Opts{KVs: []*typesv1.KV{
+		typesv1.KeyVal("env", typesv1.ValStr("prod")),
+		typesv1.KeyVal("host.name", typesv1.ValStr("box")),
+	}})
+
+	ev := &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{
+		Lvl: "info",
+		Msg: "hello",
+		Kvs: []*typesv1.KV{typesv1.KeyVal("host.name", typesv1.ValStr("other"))},
+	}}
+	require.NoError(t, e.Receive(ctx, ev))
+	require.NoError(t, e.Receive(ctx, &typesv1.LogEvent{Raw: []byte("not structured")}))
+	require.NoError(t, e.Close(ctx))
+
+	require.Len(t, rec.Buffered, 2)
+	require.Equal(t, []*typesv1.KV{
+		typesv1.KeyVal("host.name", typesv1.ValStr("other")),
+		typesv1.KeyVal("env", typesv1.ValStr("prod")),
+	}, rec.Buffered[0].Structured.Kvs)
+	// the event that was received is left alone
+	require.Len(t, ev.Structured.Kvs, 1)
+	require.Nil(t, rec.Buffered[1].Structured)
+}
+
+func TestEnricherSession(t *testing.T) {
+	ctx := context.Background()
+	rec := bufsink.NewSizedBufferedSink(100, nil)
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	e := NewEnricher(rec, Opts{
+		KVs:     []*typesv1.KV{typesv1.KeyVal("env", typesv1.ValStr("prod"))},
+		Session: true,
+	})
+	e.timeNow = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, e.Receive(ctx, &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{Msg: "hello"}}))
+	}
+
+	require.Len(t, rec.Buffered, 3)
+	start := rec.Buffered[0].Structured
+	require.Equal(t, SessionMsg, start.Msg)
+	require.Equal(t, now, start.Timestamp.AsTime())
+	require.Equal(t, []*typesv1.KV{typesv1.KeyVal("env", typesv1.ValStr("prod"))}, start.Kvs)
+	require.Empty(t, rec.Buffered[1].Structured.Kvs)
+	require.Empty(t, rec.Buffered[2].Structured.Kvs)
+}
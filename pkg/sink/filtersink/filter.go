@@ -0,0 +1,231 @@
+package filtersink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"google.golang.org/protobuf/proto"
+)
+
+// Levels are the levels `MinLevel` can be set to, from the least to the
+// most severe.
+var Levels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+// LevelRank orders levels by severity. `ok` is false for levels that
+// aren't known.
+func LevelRank(lvl string) (rank int, ok bool) {
+	switch strings.ToLower(lvl) {
+	case "trace":
+		return 0, true
+	case "debug":
+		return 1, true
+	case "info":
+		return 2, true
+	case "warn", "warning":
+		return 3, true
+	case "error", "err":
+		return 4, true
+	case "fatal", "panic", "critical":
+		return 5, true
+	default:
+		return -1, false
+	}
+}
+
+type Opts struct {
+	// MinLevel hides events less severe than this level, along with the
+	// events whose level isn't known. Empty to show all levels.
+	MinLevel string
+	// Where hides events on which the expression isn't truthy.
+	Where *typesv1.Expr
+	// Grep hides events whose raw line it doesn't match.
+	Grep *regexp.Regexp
+	// Since and Until hide events timestamped outside of [Since, Until).
+	// Either is ignored when zero. Events without a timestamp are treated
+	// like raw lines.
+	Since time.Time
+	Until time.Time
+	// Sorted tells that events come in timestamp order, so that once an
+	// event is past `Until`, none of those that follow can match and
+	// `ErrPastUntil` is returned to stop reading.
+	Sorted bool
+
+	// Before and After are how many events to show before and after
+	// each match, like grep's `-B` and `-A`.
+	Before int
+	After  int
+	// Separator is printed, as a raw line, between groups of matches and
+	// their context that aren't contiguous. Nothing is printed when nil.
+	Separator []byte
+
+	// OnError is told about expressions that fail to evaluate. Events
+	// they fail on are hidden.
+	OnError func(err error)
+}
+
+// ErrPastUntil is returned by Receive when no more events can match.
+var ErrPastUntil = errors.New("past the end of the time window")
+
+// Filter only passes the events that match all the predicates of its
+// options on to the next sink, along with their context.
+//
+// Raw lines can't be checked against `MinLevel`, `Where` and the time
+// window, they pass those if the previous structured event did. This keeps
+// stack traces and other multiline output with the event they belong to.
+type Filter struct {
+	next     sink.Sink
+	opts     Opts
+	minLevel int
+
+	// lastStructured is whether the last structured event passed the
+	// predicates that only apply to structured events. Before any, it's
+	// whether none of them can reject what comes first, which is only the
+	// case of a time window without a start.
+	lastStructured bool
+	// lastInWindow is whether the last timestamped event was in the time
+	// window. Before any, events are only known to be in it when it has no
+	// start.
+	lastInWindow bool
+
+	before     []*typesv1.LogEvent
+	afterLeft  int
+	printedAny bool
+	// skipped counts the events hidden since the last one printed
+	skipped int
+}
+
+var _ sink.Sink = (*Filter)(nil)
+
+func NewFilter(next sink.Sink, opts Opts) (*Filter, error) {
+	f := &Filter{next: next, opts: opts, minLevel: -1, lastInWindow: opts.Since.IsZero()}
+	if opts.MinLevel != "" {
+		rank, ok := LevelRank(opts.MinLevel)
+		if !ok {
+			return nil, fmt.Errorf("unknown level %q, try one of %q", opts.MinLevel, Levels)
+		}
+		f.minLevel = rank
+	}
+	if opts.Before < 0 || opts.After < 0 {
+		return nil, fmt.Errorf("context lines can't be negative")
+	}
+	f.lastStructured = f.minLevel < 0 && opts.Where == nil && opts.Since.IsZero()
+	return f, nil
+}
+
+func (f *Filter) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	if f.opts.Sorted && f.pastUntil(ev) {
+		return ErrPastUntil
+	}
+	if f.matches(ev) {
+		if f.printedAny && f.skipped > len(f.before) && f.opts.Separator != nil {
+			if err := f.next.Receive(ctx, &typesv1.LogEvent{Raw: f.opts.Separator}); err != nil {
+				return err
+			}
+		}
+		for _, prev := range f.before {
+			if err := f.next.Receive(ctx, prev); err != nil {
+				return err
+			}
+		}
+		f.before = f.before[:0]
+		f.afterLeft = f.opts.After
+		return f.pass(ctx, ev)
+	}
+	if f.afterLeft > 0 {
+		f.afterLeft--
+		return f.pass(ctx, ev)
+	}
+	f.skipped++
+	if f.opts.Before > 0 {
+		if len(f.before) == f.opts.Before {
+			copy(f.before, f.before[1:])
+			f.before = f.before[:len(f.before)-1]
+		}
+		// the scanner reuses events, so those kept around are copies
+		f.before = append(f.before, proto.Clone(ev).(*typesv1.LogEvent))
+	}
+	return nil
+}
+
+func (f *Filter) pass(ctx context.Context, ev *typesv1.LogEvent) error {
+	f.printedAny = true
+	f.skipped = 0
+	return f.next.Receive(ctx, ev)
+}
+
+func (f *Filter) Close(ctx context.Context) error {
+	return f.next.Close(ctx)
+}
+
+func (f *Filter) matches(ev *typesv1.LogEvent) bool {
+	if f.opts.Grep != nil && !f.opts.Grep.Match(ev.Raw) {
+		if ev.Structured != nil {
+			// still decide for the raw lines that follow
+			f.lastStructured = f.matchesStructured(ev)
+		}
+		return false
+	}
+	if f.minLevel < 0 && f.opts.Where == nil && f.opts.Since.IsZero() && f.opts.Until.IsZero() {
+		return true
+	}
+	if ev.Structured == nil {
+		return f.lastStructured
+	}
+	f.lastStructured = f.matchesStructured(ev)
+	return f.lastStructured
+}
+
+func (f *Filter) pastUntil(ev *typesv1.LogEvent) bool {
+	if f.opts.Until.IsZero() {
+		return false
+	}
+	ts, ok := timestamp(ev)
+	return ok && !ts.Before(f.opts.Until)
+}
+
+func timestamp(ev *typesv1.LogEvent) (time.Time, bool) {
+	if ev.Structured == nil || ev.Structured.Timestamp == nil {
+		return time.Time{}, false
+	}
+	ts := ev.Structured.Timestamp.AsTime()
+	return ts, !ts.IsZero()
+}
+
+func (f *Filter) matchesStructured(ev *typesv1.LogEvent) bool {
+	if !f.opts.Since.IsZero() || !f.opts.Until.IsZero() {
+		// without a timestamp to place it in the window, the previous
+		// event decides
+		if ts, ok := timestamp(ev); ok {
+			f.lastInWindow = !ts.Before(f.opts.Since) && (f.opts.Until.IsZero() || ts.Before(f.opts.Until))
+		}
+		if !f.lastInWindow {
+			return false
+		}
+	}
+	if f.minLevel >= 0 {
+		rank, ok := LevelRank(ev.Structured.Lvl)
+		if !ok || rank < f.minLevel {
+			return false
+		}
+	}
+	if f.opts.Where != nil {
+		ok, err := logqleval.Match(f.opts.Where, ev)
+		if err != nil {
+			if f.opts.OnError != nil {
+				f.opts.OnError(err)
+			}
+			return false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package filtersink
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/sink/bufsink"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func raws(evs []*typesv1.LogEvent) []string {
+	var out []string
+	for _, ev := range evs {
+		out = append(out, string(ev.Raw))
+	}
+	return out
+}
+
+func structured(raw, lvl string, kvs ...*typesv1.KV) *typesv1.LogEvent {
+	return &typesv1.LogEvent{
+		Raw:        []byte(raw),
+		Structured: &typesv1.StructuredLogEvent{Lvl: lvl, Msg: raw, Kvs: kvs},
+	}
+}
+
+func raw(line string) *typesv1.LogEvent {
+	return &typesv1.LogEvent{Raw: []byte(line)}
+}
+
+func TestFilter(t *testing.T) {
+	events := []*typesv1.LogEvent{
+		raw("banner"),
+		structured("a", "info", typesv1.KeyVal("status", typesv1.ValI64(200))),
+		structured("b", "debug"),
+		structured("c", "error", typesv1.KeyVal("status", typesv1.ValI64(503))),
+		raw("c trace"),
+		structured("d", "info", typesv1.KeyVal("status", typesv1.ValI64(200))),
+		structured("e", "info", typesv1.KeyVal("status", typesv1.ValI64(200))),
+		structured("f", "info", typesv1.KeyVal("status", typesv1.ValI64(200))),
+		structured("g", "warn", typesv1.KeyVal("status", typesv1.ValI64(500))),
+		structured("h", "nonsense"),
+	}
+	tests := []struct {
+		name  string
+		opts  Opts
+		where string
+		want  []string
+	}{
+		{
+			name: "min level",
+			opts: Opts{MinLevel: "warn"},
+			want: []string{"c", "c trace", "g"},
+		},
+		{
+			name:  "where",
+			where: `status >= 500`,
+			want:  []string{"c", "c trace", "g"},
+		},
+		{
+			name: "grep",
+			opts: Opts{Grep: regexp.MustCompile(`^[a-c]$|banner`)},
+			want: []string{"banner", "a", "b", "c"},
+		},
+		{
+			name: "context",
+			opts: Opts{MinLevel: "error", Before: 1, After: 2, Separator: []byte("--")},
+			want: []string{"b", "c", "c trace", "d", "e"},
+		},
+		{
+			name: "separator between groups",
+			opts: Opts{MinLevel: "warn", Before: 1, Separator: []byte("--")},
+			want: []string{"b", "c", "c trace", "--", "f", "g"},
+		},
+		{
+			name: "contiguous groups",
+			opts: Opts{MinLevel: "warn", After: 5, Separator: []byte("--")},
+			want: []string{"c", "c trace", "d", "e", "f", "g", "h"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.where != "" {
+				expr, err := logqleval.ParseFilter(tt.where)
+				require.NoError(t, err)
+				tt.opts.Where = expr
+			}
+			rec := bufsink.NewSizedBufferedSink(100, nil)
+			f, err := NewFilter(rec, tt.opts)
+			require.NoError(t, err)
+			for _, ev := range events {
+				require.NoError(t, f.Receive(context.Background(), ev))
+			}
+			require.Equal(t, tt.want, raws(rec.Buffered))
+		})
+	}
+}
+
+func TestNewFilterUnknownLevel(t *testing.T) {
+	_, err := NewFilter(bufsink.NewSizedBufferedSink(100, nil), Opts{MinLevel: "loud"})
+	require.Error(t, err)
+}
+
+func TestFilterTimeWindow(t *testing.T) {
+	at := func(line string, sec int) *typesv1.LogEvent {
+		ev := structured(line, "info")
+		ev.Structured.Timestamp = timestamppb.New(time.Date(2024, 12, 13, 19, 36, sec, 0, time.UTC))
+		return ev
+	}
+	events := []*typesv1.LogEvent{
+		at("a", 1),
+		raw("a trace"),
+		at("b", 2),
+		raw("b trace"),
+		structured("no time", "info"),
+		at("c", 3),
+		at("d", 4),
+		at("e", 5),
+	}
+	opts := Opts{
+		Since: time.Date(2024, 12, 13, 19, 36, 2, 0, time.UTC),
+		Until: time.Date(2024, 12, 13, 19, 36, 4, 0, time.UTC),
+	}
+
+	rec := bufsink.NewSizedBufferedSink(100, nil)
+	f, err := NewFilter(rec, opts)
+	require.NoError(t, err)
+	for _, ev := range events {
+		require.NoError(t, f.Receive(context.Background(), ev))
+	}
+	require.Equal(t, []string{"b", "b trace", "no time", "c"}, raws(rec.Buffered))
+
+	opts.Sorted = true
+	rec = bufsink.NewSizedBufferedSink(100, nil)
+	f, err = NewFilter(rec, opts)
+	require.NoError(t, err)
+	var stoppedAt int
+	for i, ev := range events {
+		if err := f.Receive(context.Background(), ev); err != nil {
+			require.ErrorIs(t, err, ErrPastUntil)
+			stoppedAt = i
+			break
+		}
+	}
+	require.Equal(t, 6, stoppedAt)
+	require.Equal(t, []string{"b", "b trace", "no time", "c"}, raws(rec.Buffered))
+}
+
+func TestFilterUntilOnly(t *testing.T) {
+	at := structured("a", "info")
+	at.Structured.Timestamp = timestamppb.New(time.Date(2024, 12, 13, 19, 36, 1, 0, time.UTC))
+	late := structured("late", "info")
+	late.Structured.Timestamp = timestamppb.New(time.Date(2024, 12, 13, 19, 36, 5, 0, time.UTC))
+
+	rec := bufsink.NewSizedBufferedSink(100, nil)
+	f, err := NewFilter(rec, Opts{Until: time.Date(2024, 12, 13, 19, 36, 4, 0, time.UTC)})
+	require.NoError(t, err)
+	for _, ev := range []*typesv1.LogEvent{raw("header"), structured("starting", "info"), raw("banner"), at, late} {
+		require.NoError(t, f.Receive(context.Background(), ev))
+	}
+	require.Equal(t, []string{"header", "starting", "banner", "a"}, raws(rec.Buffered), "what comes before any timestamp is within a window without a start")
+
+	rec = bufsink.NewSizedBufferedSink(100, nil)
+	f, err = NewFilter(rec, Opts{MinLevel: "warn", Until: time.Date(2024, 12, 13, 19, 36, 4, 0, time.UTC)})
+	require.NoError(t, err)
+	for _, ev := range []*typesv1.LogEvent{raw("header"), structured("starting", "info"), raw("banner"), at} {
+		require.NoError(t, f.Receive(context.Background(), ev))
+	}
+	require.Empty(t, raws(rec.Buffered), "a level filter could have rejected what comes before any level")
+}
+
+func TestParseTimeBound(t *testing.T) {
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"15m", now.Add(-15 * time.Minute)},
+		{"2h ago", now.Add(-2 * time.Hour)},
+		{"2024-12-13T10:00:00Z", time.Date(2024, 12, 13, 10, 0, 0, 0, time.UTC)},
+		{"2024-12-13T10:00:00+01:00", time.Date(2024, 12, 13, 9, 0, 0, 0, time.UTC)},
+		{"2024-12-13 10:00", time.Date(2024, 12, 13, 10, 0, 0, 0, time.UTC)},
+		{"2024-12-12", time.Date(2024, 12, 12, 0, 0, 0, 0, time.UTC)},
+		{"10:30", time.Date(2024, 12, 13, 10, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeBound(tt.in, now, time.UTC)
+		require.NoError(t, err, tt.in)
+		require.True(t, tt.want.Equal(got), "%q: want %v, got %v", tt.in, tt.want, got)
+	}
+	_, err := ParseTimeBound("yesterday-ish", now, time.UTC)
+	require.Error(t, err)
+}
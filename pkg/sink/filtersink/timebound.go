@@ -0,0 +1,50 @@
+package filtersink
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeBoundLayouts are the absolute times accepted by ParseTimeBound, in
+// the order they're tried.
+var timeBoundLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// clockLayouts are times of day, taken to be today.
+var clockLayouts = []string{
+	"15:04:05.999999999",
+	"15:04",
+}
+
+// ParseTimeBound parses the value of `--since` or `--until`, which is
+// either an absolute time or a duration before `now`, like "15m" or
+// "2h ago". Absolute times without a zone are in `loc`.
+func ParseTimeBound(s string, now time.Time, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(strings.TrimSpace(strings.TrimSuffix(s, "ago"))); err == nil {
+		if d < 0 {
+			d = -d
+		}
+		return now.Add(-d), nil
+	}
+	for _, layout := range timeBoundLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range clockLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			y, m, d := now.In(loc).Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a time like 2006-01-02T15:04:05Z07:00 nor a duration like 15m", s)
+}
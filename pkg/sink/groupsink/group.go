@@ -0,0 +1,410 @@
+// Package groupsink holds back events that belong together, like those of a
+// trace or a request, to pass them on contiguously instead of interleaved
+// with those of concurrent requests.
+package groupsink
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/humanlogio/humanlog/pkg/sink/filtersink"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DefaultIdle is how long a group is held back after its last event.
+	DefaultIdle = 2 * time.Second
+	// DefaultMaxGroups bounds how many groups are held back at once.
+	DefaultMaxGroups = 1000
+
+	DefaultSpanKey   = "span_id"
+	DefaultParentKey = "parent_span_id"
+
+	// HeaderMsg is the message of the events that start groups.
+	HeaderMsg = "grouped events"
+)
+
+// DefaultKeys are the keys events are grouped by when none are set.
+var DefaultKeys = []string{"trace_id", "request_id"}
+
+type Opts struct {
+	// Keys are the correlation keys, an event is grouped by the first of
+	// them it has.
+	Keys []string
+	// Idle is how long a group is held back after its last event, before
+	// it's passed on.
+	Idle time.Duration
+	// SpanKey and ParentKey identify the span of an event and its parent,
+	// to nest the spans of a group under their parents.
+	SpanKey   string
+	ParentKey string
+	MaxGroups int
+}
+
+// postProcessor is a sink that can alter the pattern events are printed
+// with, like stdio sinks.
+type postProcessor interface {
+	ReceiveWithPostProcess(ctx context.Context, ev *typesv1.LogEvent, postProcess func(string) string) error
+}
+
+// Grouper holds back the structured events that have a correlation key,
+// until their group is idle for `Idle`. The group is then passed on at
+// once: first an event with the correlation key, the number of events,
+// their duration and most severe level, then the events, span after span.
+// When the next sink is a stdio sink, the events of a span are indented
+// under those of their parent span.
+//
+// Raw lines and events without a correlation key aren't held back.
+type Grouper struct {
+	next sink.Sink
+	opts Opts
+
+	mu     sync.Mutex
+	groups map[string]*group
+
+	timeNow func() time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type group struct {
+	key, id string
+	seenAt  time.Time
+	events  []*typesv1.LogEvent
+}
+
+var _ sink.Sink = (*Grouper)(nil)
+
+func NewGrouper(next sink.Sink, opts Opts) *Grouper {
+	return newGrouper(next, opts, time.Now, true)
+}
+
+func newGrouper(next sink.Sink, opts Opts, timeNow func() time.Time, tick bool) *Grouper {
+	if len(opts.Keys) == 0 {
+		opts.Keys = DefaultKeys
+	}
+	if opts.Idle <= 0 {
+		opts.Idle = DefaultIdle
+	}
+	if opts.SpanKey == "" {
+		opts.SpanKey = DefaultSpanKey
+	}
+	if opts.ParentKey == "" {
+		opts.ParentKey = DefaultParentKey
+	}
+	if opts.MaxGroups <= 0 {
+		opts.MaxGroups = DefaultMaxGroups
+	}
+	g := &Grouper{
+		next:    next,
+		opts:    opts,
+		groups:  make(map[string]*group),
+		timeNow: timeNow,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if !tick {
+		close(g.done)
+		return g
+	}
+	go g.tick(min(opts.Idle, time.Second))
+	return g
+}
+
+func (g *Grouper) tick(interval time.Duration) {
+	defer close(g.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			g.mu.Lock()
+			_ = g.expire(context.Background(), g.timeNow(), false)
+			g.mu.Unlock()
+		}
+	}
+}
+
+func (g *Grouper) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.timeNow()
+	if err := g.expire(ctx, now, false); err != nil {
+		return err
+	}
+	key, id, ok := g.correlation(ev.Structured)
+	if !ok {
+		return g.next.Receive(ctx, ev)
+	}
+	gkey := key + "\x00" + id
+	grp, ok := g.groups[gkey]
+	if !ok {
+		if len(g.groups) >= g.opts.MaxGroups {
+			if err := g.evict(ctx); err != nil {
+				return err
+			}
+		}
+		grp = &group{key: key, id: id}
+		g.groups[gkey] = grp
+	}
+	grp.seenAt = now
+	// the scanner reuses events
+	grp.events = append(grp.events, proto.Clone(ev).(*typesv1.LogEvent))
+	return nil
+}
+
+// Flush passes on the groups held back so far. It's called once all the
+// events were received, as groups aren't passed on in the background
+// anymore after it.
+func (g *Grouper) Flush(ctx context.Context) error {
+	select {
+	case <-g.stop:
+	default:
+		close(g.stop)
+	}
+	<-g.done
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.expire(ctx, g.timeNow(), true)
+}
+
+func (g *Grouper) Close(ctx context.Context) error {
+	if err := g.Flush(ctx); err != nil {
+		return err
+	}
+	return g.next.Close(ctx)
+}
+
+func (g *Grouper) correlation(data *typesv1.StructuredLogEvent) (key, id string, ok bool) {
+	if data == nil {
+		return "", "", false
+	}
+	for _, key := range g.opts.Keys {
+		if v, ok := lookup(data, key); ok && v != "" {
+			return key, v, true
+		}
+	}
+	return "", "", false
+}
+
+// expire passes on the groups that are idle, or all of them if `all`.
+func (g *Grouper) expire(ctx context.Context, now time.Time, all bool) error {
+	var idle []*group
+	for gkey, grp := range g.groups {
+		if all || now.Sub(grp.seenAt) >= g.opts.Idle {
+			delete(g.groups, gkey)
+			idle = append(idle, grp)
+		}
+	}
+	// in the order the groups started, not the map's
+	sort.Slice(idle, func(i, j int) bool { return startOf(idle[i]).Before(startOf(idle[j])) })
+	for _, grp := range idle {
+		if err := g.pass(ctx, grp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict passes on the group that was idle the longest, to make room.
+func (g *Grouper) evict(ctx context.Context) error {
+	var (
+		oldestKey string
+		oldest    *group
+	)
+	for gkey, grp := range g.groups {
+		if oldest == nil || grp.seenAt.Before(oldest.seenAt) {
+			oldestKey, oldest = gkey, grp
+		}
+	}
+	delete(g.groups, oldestKey)
+	return g.pass(ctx, oldest)
+}
+
+func (g *Grouper) pass(ctx context.Context, grp *group) error {
+	if err := g.next.Receive(ctx, header(grp)); err != nil {
+		return err
+	}
+	pp, indents := g.next.(postProcessor)
+	for _, item := range g.tree(grp.events) {
+		if !indents || item.depth == 0 {
+			if err := g.next.Receive(ctx, item.ev); err != nil {
+				return err
+			}
+			continue
+		}
+		prefix := strings.Repeat("  ", item.depth)
+		if err := pp.ReceiveWithPostProcess(ctx, item.ev, func(pattern string) string {
+			return prefix + pattern
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func header(grp *group) *typesv1.LogEvent {
+	first, last := timeOf(grp.events[0]), timeOf(grp.events[0])
+	maxLvl, maxRank := "", -1
+	for _, ev := range grp.events {
+		at := timeOf(ev)
+		if at.Before(first) {
+			first = at
+		}
+		if at.After(last) {
+			last = at
+		}
+		if rank, ok := filtersink.LevelRank(ev.Structured.Lvl); ok && rank > maxRank {
+			maxLvl, maxRank = ev.Structured.Lvl, rank
+		}
+	}
+	return &typesv1.LogEvent{
+		ParsedAt: grp.events[0].ParsedAt,
+		Structured: &typesv1.StructuredLogEvent{
+			Timestamp: timestamppb.New(first),
+			Lvl:       maxLvl,
+			Msg:       HeaderMsg,
+			Kvs: []*typesv1.KV{
+				typesv1.KeyVal(grp.key, typesv1.ValStr(grp.id)),
+				typesv1.KeyVal("events", typesv1.ValI64(int64(len(grp.events)))),
+				typesv1.KeyVal("duration", typesv1.ValDuration(last.Sub(first))),
+			},
+		},
+	}
+}
+
+type node struct {
+	events   []*typesv1.LogEvent
+	children []*node
+}
+
+type treeItem struct {
+	ev    *typesv1.LogEvent
+	depth int
+}
+
+// tree orders the events of a group span after span, each span followed by
+// its children. Spans whose parent isn't in the group are roots, and so are
+// events without a span, which keep their place among the roots.
+func (g *Grouper) tree(events []*typesv1.LogEvent) []treeItem {
+	var (
+		roots   []*node
+		spans   = make(map[string]*node)
+		parents = make(map[*node]string)
+		order   []*node
+	)
+	for _, ev := range events {
+		span, ok := lookup(ev.Structured, g.opts.SpanKey)
+		if !ok || span == "" {
+			order = append(order, &node{events: []*typesv1.LogEvent{ev}})
+			continue
+		}
+		n, ok := spans[span]
+		if !ok {
+			n = &node{}
+			spans[span] = n
+			order = append(order, n)
+		}
+		n.events = append(n.events, ev)
+		if parent, ok := lookup(ev.Structured, g.opts.ParentKey); ok && parent != "" && parent != span {
+			parents[n] = parent
+		}
+	}
+	for _, n := range order {
+		parent, ok := spans[parents[n]]
+		if ok && !descends(parent, n, spans, parents) {
+			parent.children = append(parent.children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+	var (
+		out  = make([]treeItem, 0, len(events))
+		walk func(n *node, depth int)
+	)
+	walk = func(n *node, depth int) {
+		for _, ev := range n.events {
+			out = append(out, treeItem{ev: ev, depth: depth})
+		}
+		for _, child := range n.children {
+			walk(child, depth+1)
+		}
+	}
+	for _, n := range roots {
+		walk(n, 0)
+	}
+	return out
+}
+
+// descends tells whether `n` is an ancestor of `parent`, in which case
+// nesting them would make a cycle.
+func descends(parent, n *node, spans map[string]*node, parents map[*node]string) bool {
+	seen := make(map[*node]bool)
+	for at := parent; !seen[at]; {
+		if at == n {
+			return true
+		}
+		seen[at] = true
+		next, ok := spans[parents[at]]
+		if !ok {
+			return false
+		}
+		at = next
+	}
+	return false
+}
+
+func lookup(data *typesv1.StructuredLogEvent, key string) (string, bool) {
+	for _, kv := range data.Kvs {
+		if kv.Key == key {
+			return logqleval.FormatVal(kv.Value), true
+		}
+	}
+	return "", false
+}
+
+func timeOf(ev *typesv1.LogEvent) time.Time {
+	if ts := ev.Structured.GetTimestamp(); ts != nil && !ts.AsTime().IsZero() {
+		return ts.AsTime()
+	}
+	return ev.GetParsedAt().AsTime()
+}
+
+func startOf(grp *group) time.Time {
+	return timeOf(grp.events[0])
+}
+
+// OptsFrom reads the options of a grouper from its config. `ok` is false
+// when it has nothing to do.
+func OptsFrom(cfg *config.Group) (opts Opts, ok bool, err error) {
+	if cfg == nil || cfg.Keys == nil || len(*cfg.Keys) == 0 {
+		return opts, false, nil
+	}
+	opts.Keys = *cfg.Keys
+	if cfg.Idle != nil && *cfg.Idle != "" {
+		if opts.Idle, err = time.ParseDuration(*cfg.Idle); err != nil {
+			return opts, false, fmt.Errorf("invalid idle: %v", err)
+		}
+		if opts.Idle <= 0 {
+			return opts, false, fmt.Errorf("idle must be positive, not %v", opts.Idle)
+		}
+	}
+	if cfg.SpanKey != nil {
+		opts.SpanKey = *cfg.SpanKey
+	}
+	if cfg.ParentKey != nil {
+		opts.ParentKey = *cfg.ParentKey
+	}
+	return opts, true, nil
+}
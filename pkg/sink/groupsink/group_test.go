@@ -0,0 +1,147 @@
+package groupsink
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// recordSink records events the way a stdio sink indents them.
+type recordSink struct{ got []string }
+
+func (r *recordSink) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	return r.ReceiveWithPostProcess(ctx, ev, nil)
+}
+
+func (r *recordSink) ReceiveWithPostProcess(ctx context.Context, ev *typesv1.LogEvent, postProcess func(string) string) error {
+	var line string
+	if postProcess != nil {
+		line = postProcess("")
+	}
+	if ev.Structured == nil {
+		r.got = append(r.got, line+string(ev.Raw))
+		return nil
+	}
+	line += ev.Structured.Lvl + " " + ev.Structured.Msg
+	if ev.Structured.Msg == HeaderMsg {
+		for _, kv := range ev.Structured.Kvs {
+			switch v := kv.Value.GetKind().(type) {
+			case *typesv1.Val_I64:
+				line += fmt.Sprintf(" %s=%d", kv.Key, v.I64)
+			case *typesv1.Val_Str:
+				line += fmt.Sprintf(" %s=%s", kv.Key, v.Str)
+			case *typesv1.Val_Dur:
+				line += fmt.Sprintf(" %s=%s", kv.Key, v.Dur.AsDuration())
+			}
+		}
+	}
+	r.got = append(r.got, line)
+	return nil
+}
+
+func (r *recordSink) Close(ctx context.Context) error { return nil }
+
+func event(ts time.Time, lvl, msg string, kvs ...string) *typesv1.LogEvent {
+	ev := &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{
+		Timestamp: timestamppb.New(ts),
+		Lvl:       lvl,
+		Msg:       msg,
+	}}
+	for i := 0; i < len(kvs); i += 2 {
+		ev.Structured.Kvs = append(ev.Structured.Kvs, typesv1.KeyVal(kvs[i], typesv1.ValStr(kvs[i+1])))
+	}
+	return ev
+}
+
+func TestGrouper(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := &recordSink{}
+	g := newGrouper(rec, Opts{Idle: 2 * time.Second}, func() time.Time { return now }, false)
+
+	receive := func(ev *typesv1.LogEvent) {
+		require.NoError(t, g.Receive(ctx, ev))
+	}
+	receive(event(now, "info", "request started", "trace_id", "t1", "span_id", "a"))
+	receive(event(now, "info", "request started", "trace_id", "t2", "span_id", "x"))
+	receive(event(now.Add(100*time.Millisecond), "debug", "query", "trace_id", "t1", "span_id", "b", "parent_span_id", "a"))
+	receive(&typesv1.LogEvent{Raw: []byte("not structured")})
+	receive(event(now.Add(200*time.Millisecond), "info", "no correlation key"))
+	receive(event(now.Add(300*time.Millisecond), "warn", "cache miss", "trace_id", "t1", "span_id", "c", "parent_span_id", "b"))
+	receive(event(now.Add(400*time.Millisecond), "info", "request done", "trace_id", "t1", "span_id", "a"))
+	// t2 goes idle while t1 keeps going
+	now = now.Add(time.Second)
+	receive(event(now, "info", "retrying", "trace_id", "t1"))
+	now = now.Add(1500 * time.Millisecond)
+	receive(event(now, "info", "request done", "request_id", "r1"))
+	require.NoError(t, g.Close(ctx))
+
+	require.Equal(t, []string{
+		"not structured",
+		"info no correlation key",
+		"info grouped events trace_id=t2 events=1 duration=0s",
+		"info request started",
+		"warn grouped events trace_id=t1 events=5 duration=1s",
+		"info request started",
+		"info request done",
+		"  debug query",
+		"    warn cache miss",
+		"info retrying",
+		"info grouped events request_id=r1 events=1 duration=0s",
+		"info request done",
+	}, rec.got)
+}
+
+func TestGrouperMaxGroups(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := &recordSink{}
+	g := newGrouper(rec, Opts{MaxGroups: 2}, func() time.Time { return now }, false)
+
+	for _, id := range []string{"t1", "t2", "t3"} {
+		require.NoError(t, g.Receive(ctx, event(now, "info", id, "trace_id", id)))
+		now = now.Add(time.Millisecond)
+	}
+	require.Equal(t, []string{"info grouped events trace_id=t1 events=1 duration=0s", "info t1"}, rec.got)
+	require.NoError(t, g.Flush(ctx))
+	require.Len(t, rec.got, 6)
+}
+
+func TestGrouperSpanCycle(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	rec := &recordSink{}
+	g := newGrouper(rec, Opts{}, func() time.Time { return now }, false)
+
+	require.NoError(t, g.Receive(ctx, event(now, "info", "a", "trace_id", "t1", "span_id", "a", "parent_span_id", "b")))
+	require.NoError(t, g.Receive(ctx, event(now, "info", "b", "trace_id", "t1", "span_id", "b", "parent_span_id", "a")))
+	require.NoError(t, g.Close(ctx))
+
+	require.Equal(t, []string{"info grouped events trace_id=t1 events=2 duration=0s", "info a", "info b"}, rec.got)
+}
+
+func TestOptsFrom(t *testing.T) {
+	_, ok, err := OptsFrom(nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	opts, ok, err := OptsFrom(&config.Group{
+		Keys:    config.Ptr([]string{"request_id"}),
+		Idle:    config.Ptr("5s"),
+		SpanKey: config.Ptr("span"),
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, Opts{Keys: []string{"request_id"}, Idle: 5 * time.Second, SpanKey: "span"}, opts)
+
+	_, _, err = OptsFrom(&config.Group{Keys: config.Ptr([]string{"trace_id"}), Idle: config.Ptr("soon")})
+	require.Error(t, err)
+	_, _, err = OptsFrom(&config.Group{Keys: config.Ptr([]string{"trace_id"}), Idle: config.Ptr("-1s")})
+	require.Error(t, err)
+}
@@ -0,0 +1,21 @@
+package logsvcsink
+
+import (
+	"time"
+
+	"github.com/humanlogio/humanlog/pkg/metrics"
+)
+
+// observeSend accounts for a batch of `n` events the sink `name` tried to
+// send. Batches that failed are kept to be sent again, so they aren't
+// counted as dropped.
+func observeSend(name string, n int, took time.Duration, err error) {
+	if n == 0 {
+		return
+	}
+	metrics.BatchSize.Observe(float64(n), name)
+	metrics.SendLatency.Observe(float64(took)/float64(time.Millisecond), name)
+	if err == nil {
+		metrics.Sent.Add(float64(n), name)
+	}
+}
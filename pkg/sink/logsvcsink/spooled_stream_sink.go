@@ -0,0 +1,297 @@
+package logsvcsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"connectrpc.com/connect"
+	v1 "github.com/humanlogio/api/go/svc/ingest/v1"
+	"github.com/humanlogio/api/go/svc/ingest/v1/ingestv1connect"
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/metrics"
+	"github.com/humanlogio/humanlog/pkg/retry"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/humanlogio/humanlog/pkg/spool"
+)
+
+var (
+	_ sink.Sink = (*ConnectSpooledStreamSink)(nil)
+)
+
+// SpoolSeqsHeader is set on the streams of `ConnectSpooledStreamSink` to
+// the seqs of the first and last events they carry, as "<first>-<last>".
+// Along with the machine and session IDs, they identify the events that
+// are sent again, so that the ingestor can skip those it already stored.
+const SpoolSeqsHeader = "Humanlog-Spool-Seqs"
+
+// ConnectSpooledStreamSink streams events like `ConnectStreamSink`, but
+// buffers them in a spool on disk rather than in memory. Events are
+// acknowledged in the spool once the ingestor confirmed it received them,
+// the others are sent again after reconnecting, or by the next sink to open
+// the spool, in the session they were first sent in.
+type ConnectSpooledStreamSink struct {
+	ll    *slog.Logger
+	name  string
+	spool *spool.Spool
+	// session is the ID of the session events are appended in
+	session      atomic.Uint64
+	wake         chan struct{}
+	closing      chan struct{}
+	doneFlushing chan struct{}
+}
+
+// StartSpooledStreamSink starts sending the events of the spool, which the
+// sink takes ownership of.
+func StartSpooledStreamSink(
+	ctx context.Context,
+	ll *slog.Logger,
+	client ingestv1connect.IngestServiceClient,
+	name string,
+	machineID uint64,
+	bufferSize int,
+	drainBufferFor time.Duration,
+	spl *spool.Spool,
+	notifyUnableToIngest func(err error),
+) *ConnectSpooledStreamSink {
+	snk := &ConnectSpooledStreamSink{
+		ll: ll.With(
+			slog.String("sink", name),
+			slog.Uint64("machine_id", machineID),
+		),
+		name:         name,
+		spool:        spl,
+		wake:         make(chan struct{}, 1),
+		closing:      make(chan struct{}),
+		doneFlushing: make(chan struct{}),
+	}
+	snk.session.Store(uint64(time.Now().UnixNano()))
+	metrics.QueueDepth.Set(float64(spl.Pending()), name)
+
+	go func() {
+		var (
+			heartbeatEvery = 5 * time.Second
+			err            error
+		)
+		for {
+			startedAt := time.Now()
+			heartbeatEvery, err = snk.connectAndSendSpool(ctx, client, machineID, bufferSize, drainBufferFor, heartbeatEvery)
+			if err == io.EOF {
+				close(snk.doneFlushing)
+				return
+			}
+			if errors.Is(err, spool.ErrClosed) {
+				// closed before it was done flushing
+				return
+			}
+			var cerr *connect.Error
+			if errors.As(err, &cerr) && cerr.Code() == connect.CodeResourceExhausted {
+				close(snk.doneFlushing)
+				notifyUnableToIngest(err)
+				return
+			}
+			if err != nil {
+				ll.ErrorContext(ctx, "failed to send logs", slog.Any("err", err))
+			}
+			// what wasn't sent stays in the spool
+			if time.Since(startedAt) < time.Second {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+			} else {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+			}
+		}
+	}()
+
+	return snk
+}
+
+func (snk *ConnectSpooledStreamSink) connectAndSendSpool(
+	ctx context.Context,
+	client ingestv1connect.IngestServiceClient,
+	machineID uint64,
+	bufferSize int,
+	drainBufferFor time.Duration,
+	heartbeatEvery time.Duration,
+) (time.Duration, error) {
+	ll := snk.ll
+	ll.DebugContext(ctx, "contacting log ingestor")
+	err := retry.Do(ctx, func(ctx context.Context) (bool, error) {
+		hbRes, err := client.GetHeartbeat(ctx, connect.NewRequest(&v1.GetHeartbeatRequest{MachineId: &machineID}))
+		if err != nil {
+			var cerr *connect.Error
+			if errors.As(err, &cerr) && cerr.Code() == connect.CodeResourceExhausted {
+				return false, cerr
+			}
+			return true, fmt.Errorf("requesting heartbeat config from ingestor: %v", err)
+		}
+		heartbeatEvery = hbRes.Msg.HeartbeatIn.AsDuration()
+		return false, nil
+	}, retry.UseCapSleep(time.Second), retry.UseLog(func(attempt float64, err error) {
+		metrics.Retried.Inc(snk.name)
+		ll.WarnContext(ctx, "can't reach ingestion service", slog.Int("attempt", int(attempt)), slog.Any("err", err))
+	}))
+	if err != nil {
+		return heartbeatEvery, fmt.Errorf("retry aborted: %w", err)
+	}
+
+	ll.DebugContext(ctx, "ready to send logs")
+	heartbeater := time.NewTicker(heartbeatEvery)
+	defer heartbeater.Stop()
+	// replay from the last event that was acknowledged, in order
+	after := snk.spool.Acked()
+	flushing := false
+	for {
+		records, err := snk.spool.Read(after, bufferSize)
+		if err != nil {
+			return heartbeatEvery, err
+		}
+		if len(records) == 0 {
+			// wait for any event to come
+			select {
+			case <-snk.wake:
+				// let more events come for a bit, then send what we have
+				select {
+				case <-time.After(drainBufferFor):
+				case <-snk.closing:
+				case <-ctx.Done():
+					return heartbeatEvery, nil
+				}
+				continue
+			case <-snk.closing:
+				if flushing {
+					return heartbeatEvery, io.EOF
+				}
+				// read once more, for the events that came right before
+				flushing = true
+				continue
+			case <-heartbeater.C:
+				// send whatever is there, which is nothing
+			case <-ctx.Done():
+				return heartbeatEvery, nil
+			}
+		}
+		sent, hb, err := snk.sendBatch(ctx, client, machineID, records)
+		if err != nil {
+			return heartbeatEvery, err
+		}
+		if hb != 0 {
+			heartbeatEvery = hb
+		}
+		if sent > 0 {
+			after = records[sent-1].Seq
+		}
+		metrics.QueueDepth.Set(float64(snk.spool.Pending()), snk.name)
+	}
+}
+
+// sendBatch sends the records that were appended in the same session as the
+// first one, on a stream of their own, and returns how many it sent.
+// They're only acknowledged in the spool once the ingestor confirmed it
+// received them, by closing the stream without error. Until then, they're
+// sent again after reconnecting, and the ingestor skips those it stored
+// already with the session and the seqs.
+func (snk *ConnectSpooledStreamSink) sendBatch(
+	ctx context.Context,
+	client ingestv1connect.IngestServiceClient,
+	machineID uint64,
+	records []spool.Record,
+) (sent int, heartbeatEvery time.Duration, _ error) {
+	sessionID := snk.session.Load()
+	if len(records) > 0 {
+		sessionID = records[0].Session
+		for i, rec := range records {
+			if rec.Session != sessionID {
+				records = records[:i]
+				break
+			}
+		}
+	}
+	req := &v1.IngestStreamRequest{MachineId: machineID, SessionId: sessionID}
+	for _, rec := range records {
+		req.Events = append(req.Events, rec.Event)
+	}
+	start := time.Now()
+	stream := client.IngestStream(ctx)
+	if len(records) > 0 {
+		stream.RequestHeader().Set(SpoolSeqsHeader, fmt.Sprintf("%d-%d", records[0].Seq, records[len(records)-1].Seq))
+	}
+	err := stream.Send(req)
+	res, cerr := stream.CloseAndReceive()
+	if err == nil || errors.Is(err, io.EOF) {
+		// the reason the stream failed is found when closing it
+		err = cerr
+	}
+	dur := time.Since(start)
+	observeSend(snk.name, len(req.Events), dur, err)
+	snk.ll.DebugContext(ctx, "sent logs",
+		slog.String("sink", snk.name),
+		slog.Uint64("session_id", sessionID),
+		slog.Int64("send_ms", dur.Milliseconds()),
+		slog.Any("err", err),
+		slog.Int("ev_count", len(req.Events)),
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(records) > 0 {
+		if err := snk.spool.Ack(records[len(records)-1].Seq); err != nil {
+			snk.ll.ErrorContext(ctx, "unable to acknowledge sent logs in spool", slog.Any("err", err))
+		}
+	}
+	if res.Msg == nil {
+		return len(records), 0, nil
+	}
+	if res.Msg.SessionId != 0 && res.Msg.SessionId != sessionID {
+		// the ingestor picked another ID for the session, the events
+		// appended from now on are sent in it
+		snk.session.CompareAndSwap(sessionID, res.Msg.SessionId)
+	}
+	return len(records), res.Msg.HeartbeatIn.AsDuration(), nil
+}
+
+func (snk *ConnectSpooledStreamSink) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	metrics.Received.Inc(snk.name)
+	if _, err := snk.spool.Append(snk.session.Load(), ev); err != nil {
+		metrics.Dropped.Inc(snk.name)
+		snk.ll.WarnContext(ctx, "dropping log event, can't spool it", slog.Any("err", err))
+		return nil
+	}
+	metrics.QueueDepth.Set(float64(snk.spool.Pending()), snk.name)
+	select {
+	case snk.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close can only be called once, calling it twice will panic. The events
+// that couldn't be sent before `ctx` is done stay in the spool.
+func (snk *ConnectSpooledStreamSink) Close(ctx context.Context) error {
+	close(snk.closing)
+	snk.ll.DebugContext(ctx, "starting to flush")
+	defer func() {
+		if err := snk.spool.Close(); err != nil {
+			snk.ll.ErrorContext(ctx, "unable to close spool", slog.Any("err", err))
+		}
+	}()
+	select {
+	case <-snk.doneFlushing:
+		snk.ll.DebugContext(ctx, "done flushing")
+	case <-ctx.Done():
+		snk.ll.DebugContext(ctx, "unable to finish flushing, the rest stays spooled")
+		return ctx.Err()
+	}
+	return nil
+}
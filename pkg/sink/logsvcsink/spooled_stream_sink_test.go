@@ -0,0 +1,166 @@
+package logsvcsink
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	v1 "github.com/humanlogio/api/go/svc/ingest/v1"
+	"github.com/humanlogio/api/go/svc/ingest/v1/ingestv1connect"
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/spool"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type ingestedBatch struct {
+	session uint64
+	seqs    string
+	msgs    []string
+	failed  bool
+}
+
+// fakeIngestor fails the first `failures` streams after receiving them, as
+// if the connection broke before the ingestor could confirm them.
+type fakeIngestor struct {
+	ingestv1connect.UnimplementedIngestServiceHandler
+
+	mu       sync.Mutex
+	failures int
+	batches  []ingestedBatch
+}
+
+func (f *fakeIngestor) GetHeartbeat(ctx context.Context, req *connect.Request[v1.GetHeartbeatRequest]) (*connect.Response[v1.GetHeartbeatResponse], error) {
+	return connect.NewResponse(&v1.GetHeartbeatResponse{HeartbeatIn: durationpb.New(time.Hour)}), nil
+}
+
+func (f *fakeIngestor) IngestStream(ctx context.Context, req *connect.ClientStream[v1.IngestStreamRequest]) (*connect.Response[v1.IngestStreamResponse], error) {
+	var batch ingestedBatch
+	for req.Receive() {
+		batch.session = req.Msg().SessionId
+		for _, ev := range req.Msg().Events {
+			batch.msgs = append(batch.msgs, string(ev.Raw))
+		}
+	}
+	if len(batch.msgs) == 0 {
+		return connect.NewResponse(&v1.IngestStreamResponse{}), nil
+	}
+	batch.seqs = req.RequestHeader().Get(SpoolSeqsHeader)
+	if err := f.ingest(batch); err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&v1.IngestStreamResponse{SessionId: batch.session}), nil
+}
+
+func (f *fakeIngestor) Ingest(ctx context.Context, req *connect.Request[v1.IngestRequest]) (*connect.Response[v1.IngestResponse], error) {
+	batch := ingestedBatch{session: req.Msg.SessionId}
+	for _, ev := range req.Msg.Events {
+		batch.msgs = append(batch.msgs, string(ev.Raw))
+	}
+	if len(batch.msgs) == 0 {
+		return connect.NewResponse(&v1.IngestResponse{}), nil
+	}
+	if err := f.ingest(batch); err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&v1.IngestResponse{SessionId: batch.session}), nil
+}
+
+func (f *fakeIngestor) ingest(batch ingestedBatch) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		batch.failed = true
+		f.batches = append(f.batches, batch)
+		return connect.NewError(connect.CodeUnavailable, errors.New("connection reset"))
+	}
+	f.batches = append(f.batches, batch)
+	return nil
+}
+
+func (f *fakeIngestor) ingested() []ingestedBatch {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ingestedBatch(nil), f.batches...)
+}
+
+func startIngestor(t *testing.T, f *fakeIngestor) ingestv1connect.IngestServiceClient {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	srv.EnableHTTP2 = true
+	_, handler := ingestv1connect.NewIngestServiceHandler(f)
+	srv.Config.Handler = handler
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return ingestv1connect.NewIngestServiceClient(srv.Client(), srv.URL)
+}
+
+func TestSpooledStreamSinkReplaysWhatWasntConfirmed(t *testing.T) {
+	dir := t.TempDir()
+	spl, err := spool.Open(dir, spool.Opts{})
+	require.NoError(t, err)
+	f := &fakeIngestor{failures: 1}
+	client := startIngestor(t, f)
+
+	ctx := context.Background()
+	snk := StartSpooledStreamSink(ctx, slog.Default(), client, "test", 1, 100, time.Millisecond, spl, func(error) {})
+	for _, msg := range []string{"1", "2", "3"} {
+		require.NoError(t, snk.Receive(ctx, &typesv1.LogEvent{Raw: []byte(msg)}))
+	}
+	require.Eventually(t, func() bool {
+		batches := f.ingested()
+		return len(batches) > 0 && !batches[len(batches)-1].failed
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, snk.Close(ctx))
+
+	batches := f.ingested()
+	require.Len(t, batches, 2)
+	require.Equal(t, ingestedBatch{session: batches[0].session, seqs: "1-3", msgs: []string{"1", "2", "3"}, failed: true}, batches[0])
+	require.Equal(t, ingestedBatch{session: batches[0].session, seqs: "1-3", msgs: []string{"1", "2", "3"}}, batches[1],
+		"the events are sent again in the same session with the same seqs, so the ingestor can tell")
+
+	spl, err = spool.Open(dir, spool.Opts{})
+	require.NoError(t, err)
+	defer spl.Close()
+	require.Zero(t, spl.Pending(), "what was confirmed is acknowledged")
+}
+
+func TestSpooledStreamSinkReplaysPreviousSessions(t *testing.T) {
+	dir := t.TempDir()
+	spl, err := spool.Open(dir, spool.Opts{})
+	require.NoError(t, err)
+	// a previous run exited before sending these
+	for _, msg := range []string{"1", "2"} {
+		_, err := spl.Append(42, &typesv1.LogEvent{Raw: []byte(msg)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, spl.Close())
+
+	spl, err = spool.Open(dir, spool.Opts{})
+	require.NoError(t, err)
+	f := &fakeIngestor{}
+	client := startIngestor(t, f)
+	ctx := context.Background()
+	snk := StartSpooledStreamSink(ctx, slog.Default(), client, "test", 1, 100, time.Millisecond, spl, func(error) {})
+	require.NoError(t, snk.Receive(ctx, &typesv1.LogEvent{Raw: []byte("3")}))
+	require.Eventually(t, func() bool {
+		var n int
+		for _, b := range f.ingested() {
+			n += len(b.msgs)
+		}
+		return n == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, snk.Close(ctx))
+
+	batches := f.ingested()
+	require.Len(t, batches, 2)
+	require.Equal(t, ingestedBatch{session: 42, seqs: "1-2", msgs: []string{"1", "2"}}, batches[0], "replayed in the session they were first sent in")
+	require.NotEqual(t, uint64(42), batches[1].session)
+	require.Equal(t, ingestedBatch{session: batches[1].session, seqs: "3-3", msgs: []string{"3"}}, batches[1])
+}
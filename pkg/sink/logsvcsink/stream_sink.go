@@ -12,6 +12,7 @@ import (
 	v1 "github.com/humanlogio/api/go/svc/ingest/v1"
 	"github.com/humanlogio/api/go/svc/ingest/v1/ingestv1connect"
 	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/metrics"
 	"github.com/humanlogio/humanlog/pkg/retry"
 	"github.com/humanlogio/humanlog/pkg/sink"
 	"google.golang.org/protobuf/proto"
@@ -78,12 +79,14 @@ func StartStreamSink(
 			if time.Since(startedAt) < time.Second {
 				select {
 				case <-ctx.Done():
+					metrics.Dropped.Add(float64(len(buffered)), snk.name)
 					return
 				case <-time.After(time.Second):
 				}
 			} else {
 				select {
 				case <-ctx.Done():
+					metrics.Dropped.Add(float64(len(buffered)), snk.name)
 					return
 				default:
 				}
@@ -127,11 +130,14 @@ func (snk *ConnectStreamSink) connectAndHandleBuffer(
 		}
 		return false, nil
 	}, retry.UseCapSleep(time.Second), retry.UseLog(func(attempt float64, err error) {
+		metrics.Retried.Inc(snk.name)
 		ll.WarnContext(ctx, "can't reach ingestion service", slog.Int("attempt", int(attempt)), slog.Any("err", err))
 	}))
 	if err != nil {
 		return buffered, sessionID, heartbeatEvery, fmt.Errorf("retry aborted: %w", err)
 	}
+	// what was buffered went with the first request
+	metrics.Sent.Add(float64(len(buffered)), snk.name)
 
 	defer func() {
 		res, err := stream.CloseAndReceive()
@@ -207,6 +213,8 @@ func (snk *ConnectStreamSink) connectAndHandleBuffer(
 		start := time.Now()
 		sendErr = stream.Send(req)
 		dur := time.Since(start)
+		observeSend(snk.name, len(req.Events), dur, sendErr)
+		metrics.QueueDepth.Set(float64(len(snk.eventsc)), snk.name)
 		ll.DebugContext(ctx, "sent logs",
 			slog.String("sink", snk.name),
 			slog.Int64("send_ms", dur.Milliseconds()),
@@ -224,19 +232,24 @@ func (snk *ConnectStreamSink) connectAndHandleBuffer(
 }
 
 func (snk *ConnectStreamSink) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	metrics.Received.Inc(snk.name)
+	defer func() { metrics.QueueDepth.Set(float64(len(snk.eventsc)), snk.name) }()
 	send := proto.Clone(ev).(*typesv1.LogEvent)
 	if snk.dropIfFull {
 		select {
 		case snk.eventsc <- send:
 		case <-ctx.Done():
+			metrics.Dropped.Inc(snk.name)
 			return ctx.Err()
 		default:
+			metrics.Dropped.Inc(snk.name)
 			snk.ll.WarnContext(ctx, "dropping log event, buffer full!")
 		}
 	} else {
 		select {
 		case snk.eventsc <- send:
 		case <-ctx.Done():
+			metrics.Dropped.Inc(snk.name)
 			return ctx.Err()
 		default:
 			// would have blocked~
@@ -244,6 +257,7 @@ func (snk *ConnectStreamSink) Receive(ctx context.Context, ev *typesv1.LogEvent)
 			select {
 			case snk.eventsc <- send:
 			case <-ctx.Done():
+				metrics.Dropped.Inc(snk.name)
 				return ctx.Err()
 			}
 		}
@@ -12,8 +12,10 @@ import (
 	v1 "github.com/humanlogio/api/go/svc/ingest/v1"
 	"github.com/humanlogio/api/go/svc/ingest/v1/ingestv1connect"
 	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/metrics"
 	"github.com/humanlogio/humanlog/pkg/retry"
 	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/humanlogio/humanlog/pkg/sink/bufsink"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -52,15 +54,22 @@ func StartUnarySink(
 	}
 
 	go func() {
-		var (
-			buffered       []*typesv1.LogEvent
-			sessionID      = uint64(time.Now().UnixNano())
-			heartbeatEvery = 5 * time.Second
-			err            error
-		)
+		ing := &unaryIngester{
+			snk:            snk,
+			client:         client,
+			machineID:      machineID,
+			sessionID:      uint64(time.Now().UnixNano()),
+			heartbeatEvery: 5 * time.Second,
+		}
+		// what fails to be sent stays in the batcher, to be sent again
+		// once reconnected
+		batcher := bufsink.NewBatcher(ing, bufsink.BatchOpts{
+			MaxEvents: bufferSize,
+			Stage:     "batch:" + name,
+		})
 		for {
 			startedAt := time.Now()
-			buffered, sessionID, heartbeatEvery, err = snk.connectAndHandleBuffer(ctx, client, machineID, bufferSize, drainBufferFor, buffered, sessionID, heartbeatEvery)
+			err := snk.connectAndHandleBuffer(ctx, client, ing, batcher, drainBufferFor)
 			if err == io.EOF {
 				close(snk.doneFlushing)
 				return
@@ -77,12 +86,14 @@ func StartUnarySink(
 			if time.Since(startedAt) < time.Second {
 				select {
 				case <-ctx.Done():
+					_ = batcher.Close(ctx)
 					return
 				case <-time.After(time.Second):
 				}
 			} else {
 				select {
 				case <-ctx.Done():
+					_ = batcher.Close(ctx)
 					return
 				default:
 				}
@@ -97,17 +108,14 @@ func StartUnarySink(
 func (snk *ConnectUnarySink) connectAndHandleBuffer(
 	ctx context.Context,
 	client ingestv1connect.IngestServiceClient,
-	machineID uint64,
-	bufferSize int,
+	ing *unaryIngester,
+	batcher *bufsink.Batcher,
 	drainBufferFor time.Duration,
-	buffered []*typesv1.LogEvent,
-	sessionID uint64,
-	heartbeatEvery time.Duration,
-) (lastBuffer []*typesv1.LogEvent, _ uint64, _ time.Duration, _ error) {
+) error {
 	ll := snk.ll
 	ll.DebugContext(ctx, "contacting log ingestor")
 	err := retry.Do(ctx, func(ctx context.Context) (bool, error) {
-		hbRes, err := client.GetHeartbeat(ctx, connect.NewRequest(&v1.GetHeartbeatRequest{MachineId: &machineID}))
+		hbRes, err := client.GetHeartbeat(ctx, connect.NewRequest(&v1.GetHeartbeatRequest{MachineId: &ing.machineID}))
 		if err != nil {
 			var cerr *connect.Error
 			if errors.As(err, &cerr) && cerr.Code() == connect.CodeResourceExhausted {
@@ -115,105 +123,132 @@ func (snk *ConnectUnarySink) connectAndHandleBuffer(
 			}
 			return true, fmt.Errorf("requesting heartbeat config from ingestor: %v", err)
 		}
-		heartbeatEvery = hbRes.Msg.HeartbeatIn.AsDuration()
+		ing.heartbeatEvery = hbRes.Msg.HeartbeatIn.AsDuration()
 		return false, nil
 	}, retry.UseCapSleep(time.Second), retry.UseLog(func(attempt float64, err error) {
+		metrics.Retried.Inc(snk.name)
 		ll.WarnContext(ctx, "can't reach ingestion service", slog.Int("attempt", int(attempt)), slog.Any("err", err))
 	}))
 	if err != nil {
-		return buffered, sessionID, heartbeatEvery, fmt.Errorf("retry aborted: %w", err)
+		return fmt.Errorf("retry aborted: %w", err)
 	}
 
 	ll.DebugContext(ctx, "ready to send logs")
-	heartbeater := time.NewTicker(heartbeatEvery)
+	// first, what failed to be sent before reconnecting
+	if err := batcher.Flush(ctx); err != nil {
+		return err
+	}
+	heartbeater := time.NewTicker(ing.heartbeatEvery)
 	defer heartbeater.Stop()
-	ticker := time.NewTicker(drainBufferFor)
-	ticker.Stop()
-	req := connect.NewRequest(&v1.IngestRequest{
-		MachineId: machineID,
-	})
-	flushing := false
-	heartbeat := false
-	for !flushing {
-		// wait for any event to come
+	// once an event comes, wait for more for `drainBufferFor` before
+	// sending them, unless the batch fills up first
+	drain := time.NewTimer(drainBufferFor)
+	drain.Stop()
+	draining := false
+	for {
 		select {
 		case ev, more := <-snk.eventsc:
 			if !more {
-				flushing = true
+				if err := batcher.Flush(ctx); err != nil {
+					return err
+				}
+				return io.EOF
+			}
+			if err := batcher.Receive(ctx, ev); err != nil {
+				return err
 			}
-			if ev != nil {
-				req.Msg.Events = append(req.Msg.Events, ev)
+			if !draining {
+				drain.Reset(drainBufferFor)
+				draining = true
+			}
+		case <-drain.C:
+			draining = false
+			if err := batcher.Flush(ctx); err != nil {
+				return err
 			}
-			heartbeat = false
 		case <-heartbeater.C:
-			heartbeat = true
-			// send whatever is there
-		case <-ctx.Done():
-			return req.Msg.Events, sessionID, heartbeatEvery, nil
-		}
-		ticker.Reset(drainBufferFor)
-
-		if !heartbeat {
-			// unless we're just heartbeating,
-			// try to drain the channel for 100ms
-		drain_buffered_events_loop:
-			for len(req.Msg.Events) < bufferSize {
-				select {
-				case ev, more := <-snk.eventsc:
-					if !more {
-						flushing = true
-					}
-					if ev != nil {
-						req.Msg.Events = append(req.Msg.Events, ev)
-					}
-				case <-ticker.C:
-					ticker.Stop()
-					break drain_buffered_events_loop
+			// send whatever is there, or an empty request if nothing
+			// was sent since the last heartbeat
+			if err := batcher.Flush(ctx); err != nil {
+				return err
+			}
+			if !ing.sent {
+				if err := ing.ReceiveBatch(ctx, nil); err != nil {
+					return err
 				}
 			}
-			// until it's empty, then send what we have
-		}
-		req.Msg.MachineId = machineID
-		req.Msg.SessionId = sessionID
-		start := time.Now()
-		res, err := client.Ingest(ctx, req)
-		dur := time.Since(start)
-		ll.DebugContext(ctx, "sent logs",
-			slog.String("sink", snk.name),
-			slog.Int64("send_ms", dur.Milliseconds()),
-			slog.Any("err", err),
-			slog.Int("ev_count", len(req.Msg.Events)),
-			slog.Int("buffer_size", bufferSize),
-			slog.Int64("drain_for_ms", drainBufferFor.Milliseconds()),
-		)
-		if err != nil {
-			return req.Msg.Events, sessionID, heartbeatEvery, err
-		}
-		if res.Msg.SessionId != 0 {
-			sessionID = res.Msg.SessionId
-		}
-		if res.Msg.HeartbeatIn != nil {
-			heartbeatEvery = res.Msg.HeartbeatIn.AsDuration()
+			ing.sent = false
+		case <-ctx.Done():
+			return nil
 		}
-		req.Msg.Events = req.Msg.Events[:0:len(req.Msg.Events)]
 	}
-	return nil, sessionID, heartbeatEvery, io.EOF
 }
 
+// unaryIngester sends each batch of events to the ingestor in a request.
+type unaryIngester struct {
+	snk            *ConnectUnarySink
+	client         ingestv1connect.IngestServiceClient
+	machineID      uint64
+	sessionID      uint64
+	heartbeatEvery time.Duration
+	// sent is whether a request was sent since the last heartbeat
+	sent bool
+}
+
+var _ sink.BatchSink = (*unaryIngester)(nil)
+
+func (ing *unaryIngester) ReceiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error {
+	snk := ing.snk
+	req := connect.NewRequest(&v1.IngestRequest{
+		MachineId: ing.machineID,
+		SessionId: ing.sessionID,
+		Events:    evs,
+	})
+	start := time.Now()
+	res, err := ing.client.Ingest(ctx, req)
+	dur := time.Since(start)
+	observeSend(snk.name, len(evs), dur, err)
+	metrics.QueueDepth.Set(float64(len(snk.eventsc)), snk.name)
+	snk.ll.DebugContext(ctx, "sent logs",
+		slog.String("sink", snk.name),
+		slog.Int64("send_ms", dur.Milliseconds()),
+		slog.Any("err", err),
+		slog.Int("ev_count", len(evs)),
+	)
+	if err != nil {
+		return err
+	}
+	ing.sent = true
+	if res.Msg.SessionId != 0 {
+		ing.sessionID = res.Msg.SessionId
+	}
+	if res.Msg.HeartbeatIn != nil {
+		ing.heartbeatEvery = res.Msg.HeartbeatIn.AsDuration()
+	}
+	return nil
+}
+
+func (ing *unaryIngester) Close(ctx context.Context) error { return nil }
+
 func (snk *ConnectUnarySink) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	metrics.Received.Inc(snk.name)
+	defer func() { metrics.QueueDepth.Set(float64(len(snk.eventsc)), snk.name) }()
 	send := proto.Clone(ev).(*typesv1.LogEvent)
 	if snk.dropIfFull {
 		select {
 		case snk.eventsc <- send:
 		case <-ctx.Done():
+			metrics.Dropped.Inc(snk.name)
 			return ctx.Err()
 		default:
+			metrics.Dropped.Inc(snk.name)
 			snk.ll.WarnContext(ctx, "dropping log event, buffer full!")
 		}
 	} else {
 		select {
 		case snk.eventsc <- send:
 		case <-ctx.Done():
+			metrics.Dropped.Inc(snk.name)
 			return ctx.Err()
 		default:
 			// would have blocked~
@@ -221,6 +256,7 @@ func (snk *ConnectUnarySink) Receive(ctx context.Context, ev *typesv1.LogEvent)
 			select {
 			case snk.eventsc <- send:
 			case <-ctx.Done():
+				metrics.Dropped.Inc(snk.name)
 				return ctx.Err()
 			}
 		}
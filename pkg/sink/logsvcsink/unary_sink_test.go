@@ -0,0 +1,35 @@
+package logsvcsink
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnarySinkResendsWhatFailed(t *testing.T) {
+	f := &fakeIngestor{failures: 1}
+	client := startIngestor(t, f)
+
+	ctx := context.Background()
+	snk := StartUnarySink(ctx, slog.Default(), client, "test", 1, 100, 50*time.Millisecond, false, func(error) {})
+	for _, msg := range []string{"1", "2", "3"} {
+		require.NoError(t, snk.Receive(ctx, &typesv1.LogEvent{Raw: []byte(msg)}))
+	}
+	require.Eventually(t, func() bool {
+		batches := f.ingested()
+		return len(batches) > 0 && !batches[len(batches)-1].failed
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, snk.Receive(ctx, &typesv1.LogEvent{Raw: []byte("4")}))
+	require.NoError(t, snk.Close(ctx))
+
+	batches := f.ingested()
+	require.Len(t, batches, 3)
+	session := batches[0].session
+	require.Equal(t, ingestedBatch{session: session, msgs: []string{"1", "2", "3"}, failed: true}, batches[0])
+	require.Equal(t, ingestedBatch{session: session, msgs: []string{"1", "2", "3"}}, batches[1], "sent again once reconnected")
+	require.Equal(t, ingestedBatch{session: session, msgs: []string{"4"}}, batches[2], "sent when closing")
+}
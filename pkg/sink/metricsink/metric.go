@@ -0,0 +1,149 @@
+// Package metricsink derives counters and histograms from the events it's
+// given to observe, i.e. with a tapsink.Tap.
+package metricsink
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/metrics"
+)
+
+const (
+	TypeCounter   = "counter"
+	TypeHistogram = "histogram"
+)
+
+type derived struct {
+	where     *typesv1.Expr
+	value     *typesv1.Expr
+	labels    []*typesv1.Expr
+	counter   *metrics.Counter
+	histogram *metrics.Histogram
+}
+
+// Deriver updates metrics from the events it observes. Values are numbers,
+// durations and strings like "12.5ms" are in milliseconds. Events without a
+// value, or on which an expression can't be evaluated, are skipped.
+type Deriver struct {
+	metrics []*derived
+}
+
+// NewDeriver registers the metrics of the config in `reg`.
+func NewDeriver(reg *metrics.Registry, cfgs []config.Metric) (*Deriver, error) {
+	d := &Deriver{}
+	for i, cfg := range cfgs {
+		m, err := newDerived(reg, cfg)
+		if err != nil {
+			name := cfg.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("metric %s: %v", name, err)
+		}
+		d.metrics = append(d.metrics, m)
+	}
+	return d, nil
+}
+
+func newDerived(reg *metrics.Registry, cfg config.Metric) (m *derived, err error) {
+	m = &derived{}
+	parse := func(what, s string) (*typesv1.Expr, error) {
+		if s == "" {
+			return nil, nil
+		}
+		expr, err := logqleval.ParseFilter(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", what, err)
+		}
+		return expr, nil
+	}
+	if m.where, err = parse("where", cfg.Where); err != nil {
+		return nil, err
+	}
+	if m.value, err = parse("value", cfg.Value); err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0, len(cfg.Labels))
+	for _, label := range cfg.Labels {
+		expr, err := parse("label", label)
+		if err != nil {
+			return nil, err
+		}
+		m.labels = append(m.labels, expr)
+		labels = append(labels, LabelName(label))
+	}
+	switch cfg.Type {
+	case TypeCounter:
+		m.counter, err = reg.Counter(cfg.Name, cfg.Help, labels...)
+	case TypeHistogram:
+		if m.value == nil {
+			return nil, fmt.Errorf("histograms need a value to observe")
+		}
+		m.histogram, err = reg.Histogram(cfg.Name, cfg.Help, cfg.Buckets, labels...)
+	default:
+		return nil, fmt.Errorf("unknown type %q, types are %s and %s", cfg.Type, TypeCounter, TypeHistogram)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// LabelName turns the expression of a label into a valid label name, i.e.
+// `http.method` into `http_method`.
+func LabelName(expr string) string {
+	name := strings.Trim(invalidLabelChars.ReplaceAllString(expr, "_"), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// Observe updates the metrics the event accounts for.
+func (d *Deriver) Observe(ev *typesv1.LogEvent) {
+	if ev.Structured == nil {
+		return
+	}
+	for _, m := range d.metrics {
+		m.observe(ev)
+	}
+}
+
+func (m *derived) observe(ev *typesv1.LogEvent) {
+	if m.where != nil {
+		if ok, err := logqleval.Match(m.where, ev); err != nil || !ok {
+			return
+		}
+	}
+	value := 1.0
+	if m.value != nil {
+		v, err := logqleval.Eval(m.value, ev)
+		if err != nil {
+			return
+		}
+		var ok bool
+		if value, ok = logqleval.Numeric(v); !ok {
+			return
+		}
+	}
+	labelValues := make([]string, 0, len(m.labels))
+	for _, expr := range m.labels {
+		v, err := logqleval.Eval(expr, ev)
+		if err != nil {
+			return
+		}
+		labelValues = append(labelValues, logqleval.FormatVal(v))
+	}
+	if m.counter != nil {
+		m.counter.Add(value, labelValues...)
+	} else {
+		m.histogram.Observe(value, labelValues...)
+	}
+}
@@ -0,0 +1,76 @@
+package metricsink
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func event(lvl, msg string, kvs ...*typesv1.KV) *typesv1.LogEvent {
+	return &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{Lvl: lvl, Msg: msg, Kvs: kvs}}
+}
+
+func TestDeriver(t *testing.T) {
+	reg := metrics.NewRegistry()
+	d, err := NewDeriver(reg, []config.Metric{
+		{Name: "errors_total", Type: TypeCounter, Where: `lvl == "error"`, Labels: []string{"service"}},
+		{Name: "bytes_total", Type: TypeCounter, Value: "bytes"},
+		{Name: "latency_ms", Type: TypeHistogram, Value: "latency", Buckets: []float64{10, 100}, Labels: []string{"http.method"}},
+	})
+	require.NoError(t, err)
+
+	for _, ev := range []*typesv1.LogEvent{
+		event("error", "boom", typesv1.KeyVal("service", typesv1.ValStr("api"))),
+		event("error", "boom", typesv1.KeyVal("service", typesv1.ValStr("api")), typesv1.KeyVal("bytes", typesv1.ValI64(10))),
+		event("info", "ok", typesv1.KeyVal("service", typesv1.ValStr("api")), typesv1.KeyVal("bytes", typesv1.ValF64(2.5))),
+		event("info", "get", typesv1.KeyVal("http.method", typesv1.ValStr("GET")), typesv1.KeyVal("latency", typesv1.ValDuration(5*time.Millisecond))),
+		event("info", "post", typesv1.KeyVal("http.method", typesv1.ValStr("POST")), typesv1.KeyVal("latency", typesv1.ValStr("50ms"))),
+		event("info", "not a number", typesv1.KeyVal("bytes", typesv1.ValStr("many"))),
+		{Raw: []byte("unstructured")},
+	} {
+		d.Observe(ev)
+	}
+
+	var sb strings.Builder
+	_, err = reg.WriteTo(&sb)
+	require.NoError(t, err)
+	require.Equal(t, `# TYPE bytes_total counter
+bytes_total 12.5
+# TYPE errors_total counter
+errors_total{service="api"} 2
+# TYPE latency_ms histogram
+latency_ms_bucket{http_method="GET",le="10"} 1
+latency_ms_bucket{http_method="GET",le="100"} 1
+latency_ms_bucket{http_method="GET",le="+Inf"} 1
+latency_ms_sum{http_method="GET"} 5
+latency_ms_count{http_method="GET"} 1
+latency_ms_bucket{http_method="POST",le="10"} 0
+latency_ms_bucket{http_method="POST",le="100"} 1
+latency_ms_bucket{http_method="POST",le="+Inf"} 1
+latency_ms_sum{http_method="POST"} 50
+latency_ms_count{http_method="POST"} 1
+`, sb.String())
+}
+
+func TestNewDeriverInvalid(t *testing.T) {
+	for _, cfg := range []config.Metric{
+		{Name: "a", Type: "gauge"},
+		{Name: "a", Type: TypeHistogram},
+		{Name: "a", Type: TypeCounter, Where: "lvl =="},
+		{Name: "a b", Type: TypeCounter},
+	} {
+		_, err := NewDeriver(metrics.NewRegistry(), []config.Metric{cfg})
+		require.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestLabelName(t *testing.T) {
+	require.Equal(t, "http_method", LabelName("http.method"))
+	require.Equal(t, "_1x", LabelName("1x"))
+	require.Equal(t, "kv_user_id", LabelName(`kv["user id"]`))
+}
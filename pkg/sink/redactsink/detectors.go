@@ -0,0 +1,69 @@
+package redactsink
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// DetectorNames are the built-in detectors, in the order they're documented.
+var DetectorNames = []string{"jwt", "bearer", "aws-key", "email", "credit-card", "ip"}
+
+// detectors find common secrets and personal data. When a pattern has
+// capture groups, only what they capture is redacted, i.e. the token of a
+// bearer authorization but not the word "Bearer".
+var detectors = map[string]Rule{
+	"jwt": {
+		Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	},
+	"bearer": {
+		Pattern: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`),
+	},
+	"aws-key": {
+		Pattern: regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b|(?i:aws_?secret_?access_?key)["'\s:=]+([A-Za-z0-9/+=]{40})`),
+	},
+	"email": {
+		Pattern: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`),
+	},
+	"credit-card": {
+		Pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		Valid:   luhn,
+	},
+	"ip": {
+		Pattern: regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|(?:[0-9A-Fa-f]{1,4})?(?::[0-9A-Fa-f]{0,4}){2,7}`),
+		Valid: func(s string) bool {
+			// times like 19:36:00 look a lot like IPv6 addresses
+			return net.ParseIP(s) != nil
+		},
+	},
+}
+
+// Detector returns the built-in detector called `name`.
+func Detector(name string) (Rule, bool) {
+	rule, ok := detectors[name]
+	if ok {
+		rule.Name = name
+	}
+	return rule, ok
+}
+
+// luhn tells whether a number has a valid Luhn checksum, like credit card
+// numbers do, which rules out most numbers that just happen to be long.
+func luhn(s string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(s)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
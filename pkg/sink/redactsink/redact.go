@@ -0,0 +1,350 @@
+// Package redactsink hides secrets and personal data from events before
+// they reach the sinks that print, store or send them.
+package redactsink
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/internal/pkg/keymatch"
+	"github.com/humanlogio/humanlog/pkg/sink"
+)
+
+// Action is what's done with what a rule finds.
+type Action int
+
+const (
+	// Mask replaces it with a placeholder naming the rule.
+	Mask Action = iota
+	// Hash replaces it with a hash, so that equal values can still be told
+	// apart from different ones.
+	Hash
+	// Drop removes it. KVs are removed whole.
+	Drop
+)
+
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(s) {
+	case "mask", "":
+		return Mask, nil
+	case "hash":
+		return Hash, nil
+	case "drop":
+		return Drop, nil
+	default:
+		return Mask, fmt.Errorf("%q is not an action (try 'mask', 'hash' or 'drop')", s)
+	}
+}
+
+// Rule finds what to redact, either in text with `Pattern`, or as the
+// values of the keys matched by `Keys`.
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	// Valid, when set, checks what `Pattern` found before it's redacted.
+	Valid  func(match string) bool
+	Keys   *keymatch.Matcher
+	Action Action
+}
+
+type Opts struct {
+	Rules []Rule
+	// HashKey keys the hashes of the Hash action. Without a key, values
+	// that are easy to guess, like IPs, can be found back from their hash.
+	HashKey []byte
+}
+
+func OptsFrom(cfg config.Config) (Opts, error) {
+	var opts Opts
+	if cfg.Redact == nil {
+		return opts, nil
+	}
+	if cfg.Redact.HashKey != nil {
+		opts.HashKey = []byte(*cfg.Redact.HashKey)
+	}
+	if cfg.Redact.Rules == nil {
+		return opts, nil
+	}
+	for i, rc := range *cfg.Redact.Rules {
+		rule, err := ruleFrom(rc)
+		if err != nil {
+			return opts, fmt.Errorf("rule %d: %v", i, err)
+		}
+		opts.Rules = append(opts.Rules, rule)
+	}
+	return opts, nil
+}
+
+func ruleFrom(rc config.RedactRule) (Rule, error) {
+	var (
+		rule Rule
+		set  int
+		err  error
+	)
+	if rc.Detector != "" {
+		set++
+		var ok bool
+		if rule, ok = Detector(rc.Detector); !ok {
+			return rule, fmt.Errorf("unknown detector %q, try one of %q", rc.Detector, DetectorNames)
+		}
+	}
+	if rc.Pattern != "" {
+		set++
+		if rule.Pattern, err = regexp.Compile(rc.Pattern); err != nil {
+			return rule, fmt.Errorf("invalid pattern: %v", err)
+		}
+	}
+	if len(rc.Keys) > 0 {
+		set++
+		if rule.Keys, err = keymatch.Compile(rc.Keys); err != nil {
+			return rule, fmt.Errorf("invalid keys: %v", err)
+		}
+	}
+	if set != 1 {
+		return rule, fmt.Errorf("needs one of a detector, a pattern or keys")
+	}
+	if rc.Name != "" {
+		rule.Name = rc.Name
+	}
+	if rule.Action, err = ParseAction(rc.Action); err != nil {
+		return rule, err
+	}
+	return rule, nil
+}
+
+// Redactor redacts the events it receives in place, then passes them on
+// to the next sink. Patterns apply to the raw line, the message and the
+// values of KVs. The values of the keys matched by a rule are replaced
+// wherever they appear in the raw line too, so that they don't leak from
+// there.
+type Redactor struct {
+	next sink.Sink
+	opts Opts
+}
+
+var _ sink.Sink = (*Redactor)(nil)
+
+func NewRedactor(next sink.Sink, opts Opts) *Redactor {
+	return &Redactor{next: next, opts: opts}
+}
+
+func (r *Redactor) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	r.Redact(ev)
+	return r.next.Receive(ctx, ev)
+}
+
+func (r *Redactor) Close(ctx context.Context) error {
+	return r.next.Close(ctx)
+}
+
+// Redact redacts `ev` in place.
+func (r *Redactor) Redact(ev *typesv1.LogEvent) {
+	// values of redacted keys, to find them back in the raw line
+	var replaced []string
+	if data := ev.Structured; data != nil {
+		data.Msg, _ = r.redactString(data.Msg)
+		kvs := data.Kvs[:0]
+		for _, kv := range data.Kvs {
+			v, keep, orig, with := r.redactKV(kv)
+			if len(orig) >= minRawValueLen {
+				replaced = append(replaced, orig, with)
+			}
+			if !keep {
+				continue
+			}
+			kv.Value = v
+			kvs = append(kvs, kv)
+		}
+		data.Kvs = kvs
+	}
+	if len(ev.Raw) == 0 {
+		return
+	}
+	raw, changed := r.redactString(string(ev.Raw))
+	if len(replaced) > 0 {
+		withValues := strings.NewReplacer(replaced...).Replace(raw)
+		changed = changed || withValues != raw
+		raw = withValues
+	}
+	if changed {
+		// the raw line can belong to the scanner, never write into it
+		ev.Raw = []byte(raw)
+	}
+}
+
+// minRawValueLen is how long the value of a redacted key must be to be
+// replaced in the raw line, shorter ones would replace bits of unrelated
+// text, like the digits of a timestamp.
+const minRawValueLen = 4
+
+// redactKV returns the redacted value of `kv`, or keep=false if it's
+// dropped. When a rule on its key applies, the original value is returned
+// along with what replaces it in the raw line.
+func (r *Redactor) redactKV(kv *typesv1.KV) (v *typesv1.Val, keep bool, orig, with string) {
+	for _, rule := range r.opts.Rules {
+		if !rule.Keys.Match(kv.Key) {
+			continue
+		}
+		orig, _ = valueString(kv.Value)
+		if rule.Name == "" {
+			rule.Name = kv.Key
+		}
+		with = r.replacement(rule, orig, true)
+		if rule.Action == Drop {
+			return nil, false, orig, with
+		}
+		return typesv1.ValStr(r.replacement(rule, orig, false)), true, orig, with
+	}
+	v, keep = r.redactVal(kv.Value)
+	return v, keep, "", ""
+}
+
+func (r *Redactor) redactVal(v *typesv1.Val) (*typesv1.Val, bool) {
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_Str:
+		s, dropped := r.redactString(t.Str)
+		if dropped {
+			return nil, false
+		}
+		if s != t.Str {
+			return typesv1.ValStr(s), true
+		}
+	case *typesv1.Val_I64, *typesv1.Val_F64:
+		// long numbers, like credit card ones, can be numbers in JSON
+		orig, _ := valueString(v)
+		s, dropped := r.redactString(orig)
+		if dropped {
+			return nil, false
+		}
+		if s != orig {
+			return typesv1.ValStr(s), true
+		}
+	case *typesv1.Val_Arr:
+		items := make([]*typesv1.Val, 0, len(t.Arr.Items))
+		for _, item := range t.Arr.Items {
+			if item, keep := r.redactVal(item); keep {
+				items = append(items, item)
+			}
+		}
+		return typesv1.ValArr(items...), true
+	case *typesv1.Val_Obj:
+		kvs := make([]*typesv1.KV, 0, len(t.Obj.Kvs))
+		for _, kv := range t.Obj.Kvs {
+			if v, keep, _, _ := r.redactKV(kv); keep {
+				kvs = append(kvs, typesv1.KeyVal(kv.Key, v))
+			}
+		}
+		return typesv1.ValObj(kvs...), true
+	}
+	return v, true
+}
+
+// redactString applies the pattern rules to `s`. `dropped` tells whether a
+// rule with the Drop action found something.
+func (r *Redactor) redactString(s string) (out string, dropped bool) {
+	out = s
+	for _, rule := range r.opts.Rules {
+		if rule.Pattern == nil {
+			continue
+		}
+		var found bool
+		out, found = r.apply(rule, out)
+		dropped = dropped || (found && rule.Action == Drop)
+	}
+	return out, dropped
+}
+
+func (r *Redactor) apply(rule Rule, s string) (string, bool) {
+	matches := rule.Pattern.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, false
+	}
+	var (
+		sb    strings.Builder
+		last  int
+		found bool
+	)
+	for _, m := range matches {
+		for _, span := range secretSpans(m) {
+			secret := s[span[0]:span[1]]
+			if span[0] < last || (rule.Valid != nil && !rule.Valid(secret)) {
+				continue
+			}
+			sb.WriteString(s[last:span[0]])
+			sb.WriteString(r.replacement(rule, secret, false))
+			last = span[1]
+			found = true
+		}
+	}
+	if !found {
+		return s, false
+	}
+	sb.WriteString(s[last:])
+	return sb.String(), true
+}
+
+// secretSpans returns the spans of the groups that took part in match `m`,
+// or of the whole match if there are none.
+func secretSpans(m []int) [][2]int {
+	var spans [][2]int
+	for i := 2; i+1 < len(m); i += 2 {
+		if m[i] >= 0 {
+			spans = append(spans, [2]int{m[i], m[i+1]})
+		}
+	}
+	if len(spans) == 0 {
+		spans = append(spans, [2]int{m[0], m[1]})
+	}
+	return spans
+}
+
+// replacement returns what replaces `secret`. Dropped secrets are masked
+// when they can't be removed, like in the middle of a raw line.
+func (r *Redactor) replacement(rule Rule, secret string, cantDrop bool) string {
+	switch {
+	case rule.Action == Hash:
+		return "hash:" + r.hash(secret)
+	case rule.Action == Drop && !cantDrop:
+		return ""
+	case rule.Name == "":
+		return "[redacted]"
+	default:
+		return "[redacted:" + rule.Name + "]"
+	}
+}
+
+func (r *Redactor) hash(s string) string {
+	var sum []byte
+	if len(r.opts.HashKey) > 0 {
+		mac := hmac.New(sha256.New, r.opts.HashKey)
+		mac.Write([]byte(s))
+		sum = mac.Sum(nil)
+	} else {
+		h := sha256.Sum256([]byte(s))
+		sum = h[:]
+	}
+	return hex.EncodeToString(sum[:8])
+}
+
+func valueString(v *typesv1.Val) (string, bool) {
+	switch t := v.GetKind().(type) {
+	case *typesv1.Val_Str:
+		return t.Str, true
+	case *typesv1.Val_I64:
+		return strconv.FormatInt(t.I64, 10), true
+	case *typesv1.Val_F64:
+		return strconv.FormatFloat(t.F64, 'f', -1, 64), true
+	case *typesv1.Val_Bool:
+		return strconv.FormatBool(t.Bool), true
+	default:
+		return "", false
+	}
+}
@@ -2,6 +2,8 @@ package sink
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	typesv1 "github.com/humanlogio/api/go/types/v1"
 )
@@ -15,3 +17,29 @@ type BatchSink interface {
 	ReceiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error
 	Close(ctx context.Context) error
 }
+
+// PartialError is returned by a `BatchSink` that only received the first
+// `Received` events of a batch, the others can be sent again.
+type PartialError struct {
+	Received int
+	Err      error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("only the first %d events were received: %v", e.Received, e.Err)
+}
+
+func (e *PartialError) Unwrap() error { return e.Err }
+
+// Received is how many of the `n` events of a batch were received by a
+// `BatchSink` that returned `err`.
+func Received(n int, err error) int {
+	if err == nil {
+		return n
+	}
+	var perr *PartialError
+	if errors.As(err, &perr) {
+		return min(max(perr.Received, 0), n)
+	}
+	return 0
+}
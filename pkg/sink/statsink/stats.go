@@ -0,0 +1,210 @@
+// Package statsink keeps statistics about the events passed to it, to
+// summarize an input at a glance.
+package statsink
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/patterns"
+	"github.com/humanlogio/humanlog/pkg/sink"
+)
+
+const (
+	// DefaultTop is how many templates and keys are reported.
+	DefaultTop = 10
+	// MaxCardinality bounds how many distinct values of a key are counted.
+	MaxCardinality = 100000
+
+	// NoHandler is the handler of lines that weren't recognized.
+	NoHandler = "raw"
+	// NoLevel is the level of structured events without one.
+	NoLevel = "none"
+)
+
+// Report is what's known about the events received.
+type Report struct {
+	Events     int64 `json:"events"`
+	Structured int64 `json:"structured"`
+	Raw        int64 `json:"raw"`
+	// First and Last are the times of the earliest and latest events. Like
+	// `PerMinute`, they only account for events with a timestamp, since the
+	// time lines are read at can be long after they were logged.
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	// RatePerMinute is the average number of events with a timestamp per
+	// minute, between `First` and `Last`.
+	RatePerMinute float64          `json:"rate_per_minute"`
+	Handlers      map[string]int64 `json:"handlers"`
+	Levels        map[string]int64 `json:"levels"`
+	PerMinute     []MinuteCount    `json:"per_minute"`
+	Templates     []TemplateCount  `json:"templates"`
+	Keys          []KeyCount       `json:"keys"`
+}
+
+type MinuteCount struct {
+	Minute time.Time `json:"minute"`
+	Events int64     `json:"events"`
+}
+
+type TemplateCount struct {
+	ID       string `json:"pattern_id"`
+	Template string `json:"template"`
+	Events   int64  `json:"events"`
+}
+
+type KeyCount struct {
+	Key    string `json:"key"`
+	Events int64  `json:"events"`
+	// Cardinality is how many distinct values the key has. It's at most
+	// `MaxCardinality`, in which case `Capped` is true.
+	Cardinality int64 `json:"cardinality"`
+	Capped      bool  `json:"capped,omitempty"`
+}
+
+type keyStats struct {
+	events int64
+	values map[uint64]struct{}
+}
+
+// Collector counts the events it receives, and the handlers that
+// recognized their lines when it's told about them with `Handled`.
+type Collector struct {
+	top int
+
+	report    Report
+	timed     int64
+	perMinute map[time.Time]int64
+	keys      map[string]*keyStats
+	miner     *patterns.Miner
+}
+
+var _ sink.Sink = (*Collector)(nil)
+
+// NewCollector returns a collector reporting the `top` most frequent
+// templates and keys.
+func NewCollector(top int) *Collector {
+	if top <= 0 {
+		top = DefaultTop
+	}
+	return &Collector{
+		top: top,
+		report: Report{
+			Handlers: make(map[string]int64),
+			Levels:   make(map[string]int64),
+		},
+		perMinute: make(map[time.Time]int64),
+		keys:      make(map[string]*keyStats),
+		miner:     patterns.NewMiner(patterns.Opts{}),
+	}
+}
+
+// Handled counts a line recognized by `handler`, it's meant to be used as
+// `HandlerOptions.OnHandled`.
+func (c *Collector) Handled(handler string) {
+	if handler == "" {
+		handler = NoHandler
+	}
+	c.report.Handlers[handler]++
+}
+
+func (c *Collector) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	r := &c.report
+	r.Events++
+	data := ev.Structured
+	if data == nil {
+		r.Raw++
+		c.miner.Add(string(ev.Raw), time.Time{})
+		return nil
+	}
+	r.Structured++
+	var at time.Time
+	if ts := data.Timestamp; ts != nil && !ts.AsTime().IsZero() {
+		at = ts.AsTime()
+		c.countTime(at)
+	}
+	lvl := strings.ToLower(data.Lvl)
+	if lvl == "" {
+		lvl = NoLevel
+	}
+	r.Levels[lvl]++
+	c.miner.Add(data.Msg, at)
+	for _, kv := range data.Kvs {
+		ks, ok := c.keys[kv.Key]
+		if !ok {
+			ks = &keyStats{values: make(map[uint64]struct{})}
+			c.keys[kv.Key] = ks
+		}
+		ks.events++
+		if len(ks.values) < MaxCardinality {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(logqleval.FormatVal(kv.Value)))
+			ks.values[h.Sum64()] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (c *Collector) countTime(at time.Time) {
+	r := &c.report
+	c.timed++
+	if r.First.IsZero() || at.Before(r.First) {
+		r.First = at
+	}
+	if at.After(r.Last) {
+		r.Last = at
+	}
+	c.perMinute[at.UTC().Truncate(time.Minute)]++
+}
+
+func (c *Collector) Close(ctx context.Context) error {
+	return nil
+}
+
+// Report returns what's known about the events received so far.
+func (c *Collector) Report() Report {
+	r := c.report
+	if span := r.Last.Sub(r.First); span > 0 {
+		r.RatePerMinute = float64(c.timed) / span.Minutes()
+	}
+
+	r.PerMinute = make([]MinuteCount, 0, len(c.perMinute))
+	for minute, n := range c.perMinute {
+		r.PerMinute = append(r.PerMinute, MinuteCount{Minute: minute, Events: n})
+	}
+	sort.Slice(r.PerMinute, func(i, j int) bool { return r.PerMinute[i].Minute.Before(r.PerMinute[j].Minute) })
+
+	clusters := c.miner.Clusters()
+	if len(clusters) > c.top {
+		clusters = clusters[:c.top]
+	}
+	r.Templates = make([]TemplateCount, 0, len(clusters))
+	for _, cl := range clusters {
+		r.Templates = append(r.Templates, TemplateCount{ID: cl.ID, Template: cl.Template(), Events: cl.Count})
+	}
+
+	r.Keys = make([]KeyCount, 0, len(c.keys))
+	for key, ks := range c.keys {
+		r.Keys = append(r.Keys, KeyCount{
+			Key:         key,
+			Events:      ks.events,
+			Cardinality: int64(len(ks.values)),
+			Capped:      len(ks.values) >= MaxCardinality,
+		})
+	}
+	sort.Slice(r.Keys, func(i, j int) bool {
+		if r.Keys[i].Events != r.Keys[j].Events {
+			return r.Keys[i].Events > r.Keys[j].Events
+		}
+		return r.Keys[i].Key < r.Keys[j].Key
+	})
+	if len(r.Keys) > c.top {
+		r.Keys = r.Keys[:c.top]
+	}
+	return r
+}
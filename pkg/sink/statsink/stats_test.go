@@ -0,0 +1,56 @@
+package statsink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCollector(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	c := NewCollector(2)
+
+	event := func(ts time.Time, lvl, msg string, kvs ...*typesv1.KV) {
+		c.Handled("json")
+		require.NoError(t, c.Receive(ctx, &typesv1.LogEvent{Structured: &typesv1.StructuredLogEvent{
+			Timestamp: timestamppb.New(ts),
+			Lvl:       lvl,
+			Msg:       msg,
+			Kvs:       kvs,
+		}}))
+	}
+	svc := func(s string) *typesv1.KV { return typesv1.KeyVal("service", typesv1.ValStr(s)) }
+	event(now, "INFO", "request 1 took 3ms", svc("api"))
+	event(now.Add(30*time.Second), "info", "request 2 took 5ms", svc("api"), typesv1.KeyVal("user", typesv1.ValI64(42)))
+	event(now.Add(time.Minute), "error", "cache miss for key user", svc("worker"))
+	event(now.Add(2*time.Minute), "", "request 3 took 1ms", svc("api"))
+	c.Handled("")
+	require.NoError(t, c.Receive(ctx, &typesv1.LogEvent{Raw: []byte("panic: oops")}))
+
+	r := c.Report()
+	require.Equal(t, int64(5), r.Events)
+	require.Equal(t, int64(4), r.Structured)
+	require.Equal(t, int64(1), r.Raw)
+	require.Equal(t, now, r.First)
+	require.Equal(t, now.Add(2*time.Minute), r.Last)
+	require.Equal(t, 2.0, r.RatePerMinute)
+	require.Equal(t, map[string]int64{"json": 4, NoHandler: 1}, r.Handlers)
+	require.Equal(t, map[string]int64{"info": 2, "error": 1, NoLevel: 1}, r.Levels)
+	require.Equal(t, []MinuteCount{
+		{Minute: now, Events: 2},
+		{Minute: now.Add(time.Minute), Events: 1},
+		{Minute: now.Add(2 * time.Minute), Events: 1},
+	}, r.PerMinute)
+	require.Len(t, r.Templates, 2)
+	require.Equal(t, "request <*> took <*>", r.Templates[0].Template)
+	require.Equal(t, int64(3), r.Templates[0].Events)
+	require.Equal(t, []KeyCount{
+		{Key: "service", Events: 4, Cardinality: 2},
+		{Key: "user", Events: 1, Cardinality: 1},
+	}, r.Keys)
+}
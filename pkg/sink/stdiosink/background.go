@@ -0,0 +1,75 @@
+package stdiosink
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DetectLightBg tells whether the terminal has a light background. It asks
+// the terminal for its background color (OSC 11) and falls back on the
+// `$COLORFGBG` convention. `ok` is false when neither gave an answer.
+func DetectLightBg(timeout time.Duration) (light bool, ok bool) {
+	if r, g, b, ok := queryTermBackground(timeout); ok {
+		return isLightColor(r, g, b), true
+	}
+	return lightBgFromColorFgBg(os.Getenv("COLORFGBG"))
+}
+
+// isLightColor uses the relative luminance of a color, with each channel
+// in [0, 1].
+func isLightColor(r, g, b float64) bool {
+	return 0.2126*r+0.7152*g+0.0722*b > 0.5
+}
+
+// parseOSC11Response finds the color in a reply such as
+// "\x1b]11;rgb:ffff/ffff/ffff\x1b\\". Each channel can have 1 to 4 hex
+// digits.
+func parseOSC11Response(resp []byte) (r, g, b float64, ok bool) {
+	start := bytes.Index(resp, []byte("]11;rgb:"))
+	if start < 0 {
+		return 0, 0, 0, false
+	}
+	rest := resp[start+len("]11;rgb:"):]
+	end := bytes.IndexAny(rest, "\x07\x1b")
+	if end < 0 {
+		return 0, 0, 0, false
+	}
+	channels := strings.Split(string(rest[:end]), "/")
+	if len(channels) != 3 {
+		return 0, 0, 0, false
+	}
+	var out [3]float64
+	for i, ch := range channels {
+		if len(ch) == 0 || len(ch) > 4 {
+			return 0, 0, 0, false
+		}
+		v, err := strconv.ParseUint(ch, 16, 16)
+		if err != nil {
+			return 0, 0, 0, false
+		}
+		out[i] = float64(v) / float64(uint64(1)<<(4*len(ch))-1)
+	}
+	return out[0], out[1], out[2], true
+}
+
+// lightBgFromColorFgBg reads a value like "15;0" set by some terminals,
+// where the last field is the background's index in the 16-color table.
+func lightBgFromColorFgBg(v string) (light bool, ok bool) {
+	if v == "" {
+		return false, false
+	}
+	fields := strings.Split(v, ";")
+	bg, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return false, false
+	}
+	switch bg {
+	case 7, 9, 10, 11, 12, 13, 14, 15:
+		return true, true
+	default:
+		return false, true
+	}
+}
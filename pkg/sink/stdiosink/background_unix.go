@@ -0,0 +1,51 @@
+//go:build !windows
+
+package stdiosink
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"github.com/charmbracelet/x/term"
+)
+
+// queryTermBackground asks the controlling terminal for its background
+// color. A primary device attributes request (DA1) is sent right after,
+// since every terminal answers it: seeing its reply means the terminal is
+// done answering, so we don't leave a late OSC 11 reply to leak on screen.
+func queryTermBackground(timeout time.Duration) (r, g, b float64, ok bool) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	defer tty.Close()
+	prev, err := term.MakeRaw(tty.Fd())
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	defer func() { _ = term.Restore(tty.Fd(), prev) }()
+
+	if _, err := tty.WriteString("\x1b]11;?\x07\x1b[c"); err != nil {
+		return 0, 0, 0, false
+	}
+	if err := tty.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, 0, 0, false
+	}
+	var (
+		resp []byte
+		buf  = make([]byte, 64)
+	)
+	for {
+		n, err := tty.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if err != nil || len(resp) > 1024 {
+			break
+		}
+		// DA1 replies look like "\x1b[?62;22c"
+		if da1 := bytes.Index(resp, []byte("\x1b[?")); da1 >= 0 && bytes.IndexByte(resp[da1:], 'c') >= 0 {
+			break
+		}
+	}
+	return parseOSC11Response(resp)
+}
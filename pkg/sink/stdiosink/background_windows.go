@@ -0,0 +1,10 @@
+//go:build windows
+
+package stdiosink
+
+import "time"
+
+// queryTermBackground isn't supported on Windows consoles.
+func queryTermBackground(timeout time.Duration) (r, g, b float64, ok bool) {
+	return 0, 0, 0, false
+}
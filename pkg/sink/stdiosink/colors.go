@@ -2,7 +2,12 @@ package stdiosink
 
 import (
 	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
 
+	"github.com/crazy3lf/colorconv"
 	"github.com/fatih/color"
 	"github.com/humanlogio/humanlog/internal/pkg/config"
 )
@@ -26,8 +31,10 @@ var DefaultPalette = Palette{
 }
 
 type Palette struct {
-	KeyColor              *color.Color
-	ValColor              *color.Color
+	KeyColor *color.Color
+	ValColor *color.Color
+	// ValLightBgColor replaces `ValColor` on light backgrounds, when set.
+	ValLightBgColor       *color.Color
 	TimeLightBgColor      *color.Color
 	TimeDarkBgColor       *color.Color
 	MsgLightBgColor       *color.Color
@@ -54,6 +61,12 @@ func PaletteFrom(pl config.TextPalette) (*Palette, error) {
 	if err != nil {
 		return nil, fmt.Errorf("in palette key %q, %v", "val", err)
 	}
+	if len(pl.ValLightBgColor) > 0 {
+		out.ValLightBgColor, err = attributesToColor(pl.ValLightBgColor)
+		if err != nil {
+			return nil, fmt.Errorf("in palette key %q, %v", "val_light_bg", err)
+		}
+	}
 	out.TimeLightBgColor, err = attributesToColor(pl.TimeLightBgColor)
 	if err != nil {
 		return nil, fmt.Errorf("in palette key %q, %v", "time_light_bg", err)
@@ -112,16 +125,129 @@ func PaletteFrom(pl config.TextPalette) (*Palette, error) {
 func attributesToColor(names []string) (*color.Color, error) {
 	attrs := make([]color.Attribute, 0, len(names))
 	for _, name := range names {
-		attr, ok := colorAttributeIndex[name]
-		if !ok {
-			return nil, fmt.Errorf("color %q isn't supported", name)
+		if attr, ok := colorAttributeIndex[name]; ok {
+			attrs = append(attrs, attr)
+			continue
 		}
-		attrs = append(attrs, attr)
+		extended, err := extendedColorAttributes(name)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, extended...)
 	}
 	return color.New(attrs...), nil
 }
 
+// extendedColorAttributes parses colors that aren't part of the basic
+// 16 colors: hex codes like "#ff8800", "fg_#ff8800" or "bg_#ff8800", and
+// indices in the 256-color table like "fg_208" or "bg_208".
+func extendedColorAttributes(name string) ([]color.Attribute, error) {
+	bg := false
+	spec := name
+	switch {
+	case strings.HasPrefix(name, "fg_"):
+		spec = strings.TrimPrefix(name, "fg_")
+	case strings.HasPrefix(name, "bg_"):
+		spec = strings.TrimPrefix(name, "bg_")
+		bg = true
+	}
+	if strings.HasPrefix(spec, "#") {
+		r, g, b, err := colorconv.HexToRGB(spec)
+		if err != nil {
+			return nil, fmt.Errorf("color %q isn't a valid hex code: %v", name, err)
+		}
+		return rgbAttributes(r, g, b, bg), nil
+	}
+	if spec != name {
+		idx, err := strconv.ParseUint(spec, 10, 8)
+		if err == nil {
+			return ansi256Attributes(uint8(idx), bg), nil
+		}
+	}
+	return nil, fmt.Errorf("color %q isn't supported", name)
+}
+
+// supportsTrueColor is true when the terminal advertises 24-bit colors,
+// otherwise RGB colors are approximated in the 256-color table.
+var supportsTrueColor = func() bool {
+	switch strings.ToLower(os.Getenv("COLORTERM")) {
+	case "truecolor", "24bit":
+		return true
+	}
+	return false
+}()
+
+func rgbAttributes(r, g, b uint8, bg bool) []color.Attribute {
+	if !supportsTrueColor {
+		return ansi256Attributes(rgbToANSI256(r, g, b), bg)
+	}
+	mode := color.Attribute(38)
+	if bg {
+		mode = 48
+	}
+	return []color.Attribute{mode, 2, color.Attribute(r), color.Attribute(g), color.Attribute(b)}
+}
+
+func ansi256Attributes(idx uint8, bg bool) []color.Attribute {
+	mode := color.Attribute(38)
+	if bg {
+		mode = 48
+	}
+	return []color.Attribute{mode, 5, color.Attribute(idx)}
+}
+
+// rgbToANSI256 finds the closest color in the 6x6x6 cube or in the
+// grayscale ramp of the 256-color table.
+func rgbToANSI256(r, g, b uint8) uint8 {
+	if r == g && g == b {
+		switch {
+		case r < 8:
+			return 16
+		case r > 248:
+			return 231
+		default:
+			return uint8(232 + (int(r)-8)*24/241)
+		}
+	}
+	toCube := func(v uint8) int {
+		if v < 48 {
+			return 0
+		}
+		if v < 115 {
+			return 1
+		}
+		return (int(v) - 35) / 40
+	}
+	return uint8(16 + 36*toCube(r) + 6*toCube(g) + toCube(b))
+}
+
+// hashColor derives a color from `value`, so that the same value is
+// always printed the same way, and different values are likely to look
+// different.
+func hashColor(value string, lightBg bool) *color.Color {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(value))
+	sum := h.Sum32()
+	hue := float64(sum % 360)
+	// vary saturation a bit too, so that close hues remain distinguishable
+	sat := 0.55 + float64((sum>>9)%4)*0.1
+	val := 0.95
+	if lightBg {
+		val = 0.55
+	}
+	r, g, b, err := colorconv.HSVToRGB(hue, sat, val)
+	if err != nil {
+		return color.New(color.FgHiWhite)
+	}
+	return color.New(rgbAttributes(r, g, b, false)...)
+}
+
 var colorAttributeIndex = map[string]color.Attribute{
+	"bold":          color.Bold,
+	"faint":         color.Faint,
+	"italic":        color.Italic,
+	"underline":     color.Underline,
+	"reverse":       color.ReverseVideo,
 	"fg_black":      color.FgBlack,
 	"fg_red":        color.FgRed,
 	"fg_green":      color.FgGreen,
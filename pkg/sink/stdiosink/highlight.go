@@ -0,0 +1,46 @@
+package stdiosink
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// highlightColor marks the text matched by `StdioOpts.Highlight`. Reversing
+// the colors stands out whatever the palette.
+var highlightColor = color.New(color.ReverseVideo, color.Bold)
+
+// colorize prints `s` in `c`, with the parts matched by the highlight
+// pattern, if any, highlighted. A nil `c` leaves `s` uncolored.
+func (std *Stdio) colorize(s string, c *color.Color) string {
+	sprint := fmt.Sprint
+	if c != nil {
+		sprint = c.Sprint
+	}
+	if std.opts.Highlight == nil {
+		return sprint(s)
+	}
+	matches := std.opts.Highlight.FindAllStringIndex(s, -1)
+	if len(matches) == 0 {
+		return sprint(s)
+	}
+	var (
+		sb   strings.Builder
+		last int
+	)
+	for _, m := range matches {
+		if m[0] == m[1] {
+			continue
+		}
+		if m[0] > last {
+			sb.WriteString(sprint(s[last:m[0]]))
+		}
+		sb.WriteString(highlightColor.Sprint(s[m[0]:m[1]]))
+		last = m[1]
+	}
+	if last < len(s) {
+		sb.WriteString(sprint(s[last:]))
+	}
+	return sb.String()
+}
@@ -0,0 +1,81 @@
+package stdiosink
+
+import (
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultEditorURL opens callers as plain files. Editors usually register
+// their own schemes, i.e. "vscode://file/{path}:{line}".
+const DefaultEditorURL = "file://{path}"
+
+// hyperlink wraps `text` in an OSC 8 escape sequence, which terminals that
+// support it render as a clickable link to `target`.
+func hyperlink(target, text string) string {
+	return "\x1b]8;;" + target + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+}
+
+// linkFor returns where the value of `key` should link to, if anywhere.
+func (std *Stdio) linkFor(key, value string) (string, bool) {
+	if !std.opts.Hyperlinks || !safeInEscapeSequence(value) {
+		return "", false
+	}
+	if _, ok := std.opts.CallerKeys[key]; ok {
+		if link, ok := std.callerLink(value); ok {
+			return link, true
+		}
+	}
+	if _, ok := std.opts.TraceKeys[key]; ok && std.opts.TraceURL != "" {
+		return strings.ReplaceAll(std.opts.TraceURL, "{value}", url.PathEscape(value)), true
+	}
+	if u, err := url.Parse(value); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return value, true
+	}
+	return "", false
+}
+
+// callerLink turns a caller like "zapper/zapper.go:18" into a link to the
+// file, relative to the source root.
+func (std *Stdio) callerLink(caller string) (string, bool) {
+	path, line := caller, ""
+	if i := strings.LastIndexByte(caller, ':'); i > 0 {
+		if _, err := strconv.Atoi(caller[i+1:]); err == nil {
+			path, line = caller[:i], caller[i+1:]
+			// "file.go:18:5", keep the line, drop the column
+			if j := strings.LastIndexByte(path, ':'); j > 0 {
+				if _, err := strconv.Atoi(path[j+1:]); err == nil {
+					path, line = path[:j], path[j+1:]
+				}
+			}
+		}
+	}
+	if path == "" || strings.ContainsAny(path, " \t") {
+		return "", false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(std.opts.SourceRoot, path)
+	}
+	path = filepath.ToSlash(path)
+	if line == "" {
+		line = "1"
+	}
+	tmpl := std.opts.EditorURL
+	if tmpl == "" {
+		tmpl = DefaultEditorURL
+	}
+	link := strings.NewReplacer("{path}", path, "{line}", line).Replace(tmpl)
+	return link, true
+}
+
+// safeInEscapeSequence guards against log lines that would smuggle their
+// own escape sequences in a link.
+func safeInEscapeSequence(s string) bool {
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,296 @@
+package stdiosink
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+)
+
+// ValueRenderer changes how values of some keys or types are printed, i.e.
+// `latency_ms=1532` as `latency_ms=1.532s`.
+type ValueRenderer struct {
+	keys   []string
+	types  map[string]struct{}
+	render renderFunc
+}
+
+// renderFunc returns the text to print and, optionally, a color that
+// replaces the palette's value color. `ok` is false if the value can't be
+// rendered this way, in which case it's printed as is.
+type renderFunc func(std *Stdio, v any) (text string, c *color.Color, ok bool)
+
+var renderFuncs = map[string]renderFunc{
+	"duration_ns": renderDuration(time.Nanosecond),
+	"duration_us": renderDuration(time.Microsecond),
+	"duration_ms": renderDuration(time.Millisecond),
+	"duration_s":  renderDuration(time.Second),
+	"bytes":       renderBytes,
+	"http_status": renderHTTPStatus,
+	"bool":        renderBool,
+	"time":        renderTime,
+}
+
+var valueTypes = map[string]struct{}{
+	"string":   {},
+	"int":      {},
+	"float":    {},
+	"bool":     {},
+	"time":     {},
+	"duration": {},
+}
+
+func ValueRenderersFrom(cfgs []config.ValueRenderer) ([]ValueRenderer, error) {
+	out := make([]ValueRenderer, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		render, ok := renderFuncs[cfg.As]
+		if !ok {
+			return nil, fmt.Errorf("value renderer %d: can't render as %q", i, cfg.As)
+		}
+		for _, key := range cfg.Keys {
+			if _, err := path.Match(key, ""); err != nil {
+				return nil, fmt.Errorf("value renderer %d: invalid key pattern %q: %v", i, key, err)
+			}
+		}
+		var types map[string]struct{}
+		if len(cfg.Types) > 0 {
+			types = make(map[string]struct{}, len(cfg.Types))
+			for _, typ := range cfg.Types {
+				if _, ok := valueTypes[typ]; !ok {
+					return nil, fmt.Errorf("value renderer %d: unknown type %q", i, typ)
+				}
+				types[typ] = struct{}{}
+			}
+		}
+		out = append(out, ValueRenderer{keys: cfg.Keys, types: types, render: render})
+	}
+	return out, nil
+}
+
+func (vr *ValueRenderer) matches(key string, v any) bool {
+	if vr.types != nil {
+		if _, ok := vr.types[valueType(v)]; !ok {
+			return false
+		}
+	}
+	if len(vr.keys) == 0 {
+		return true
+	}
+	for _, pattern := range vr.keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func valueType(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	case time.Time:
+		return "time"
+	case time.Duration:
+		return "duration"
+	default:
+		return ""
+	}
+}
+
+// renderValue applies the first renderer that matches the key and value,
+// if any.
+func (std *Stdio) renderValue(key string, v any) (string, *color.Color, bool) {
+	for i := range std.opts.ValueRenderers {
+		vr := &std.opts.ValueRenderers[i]
+		if !vr.matches(key, v) {
+			continue
+		}
+		if text, c, ok := vr.render(std, v); ok {
+			return text, c, true
+		}
+	}
+	return "", nil, false
+}
+
+func renderDuration(unit time.Duration) renderFunc {
+	return func(std *Stdio, v any) (string, *color.Color, bool) {
+		var d time.Duration
+		switch t := v.(type) {
+		case int64:
+			d = time.Duration(t) * unit
+		case float64:
+			d = time.Duration(t * float64(unit))
+		case string:
+			f, err := strconv.ParseFloat(t, 64)
+			if err != nil {
+				return "", nil, false
+			}
+			d = time.Duration(f * float64(unit))
+		default:
+			return "", nil, false
+		}
+		return roundDuration(d).String(), nil, true
+	}
+}
+
+// roundDuration keeps 3 significant digits or so, `1.234567891s` isn't
+// much more useful than `1.235s`.
+func roundDuration(d time.Duration) time.Duration {
+	abs := d
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs >= time.Minute:
+		return d.Round(time.Second)
+	case abs >= time.Second:
+		return d.Round(time.Millisecond)
+	case abs >= time.Millisecond:
+		return d.Round(time.Microsecond)
+	default:
+		return d
+	}
+}
+
+func renderBytes(std *Stdio, v any) (string, *color.Color, bool) {
+	var n float64
+	switch t := v.(type) {
+	case int64:
+		n = float64(t)
+	case float64:
+		n = t
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return "", nil, false
+		}
+		n = f
+	default:
+		return "", nil, false
+	}
+	return humanizeBytes(n), nil, true
+}
+
+func humanizeBytes(n float64) string {
+	const unit = 1024
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	if n < unit {
+		return sign + strconv.FormatFloat(n, 'f', -1, 64) + "B"
+	}
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	i := -1
+	for n >= unit && i < len(units)-1 {
+		n /= unit
+		i++
+	}
+	return sign + strconv.FormatFloat(n, 'f', 1, 64) + units[i]
+}
+
+func renderHTTPStatus(std *Stdio, v any) (string, *color.Color, bool) {
+	var code int64
+	switch t := v.(type) {
+	case int64:
+		code = t
+	case float64:
+		code = int64(t)
+	case string:
+		i, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return "", nil, false
+		}
+		code = i
+	default:
+		return "", nil, false
+	}
+	var c *color.Color
+	switch {
+	case code >= 100 && code < 200, code >= 300 && code < 400:
+		c = std.opts.Palette.DebugLevelColor
+	case code >= 200 && code < 300:
+		c = std.opts.Palette.InfoLevelColor
+	case code >= 400 && code < 500:
+		c = std.opts.Palette.WarnLevelColor
+	case code >= 500 && code < 600:
+		c = std.opts.Palette.ErrorLevelColor
+	default:
+		return "", nil, false
+	}
+	return strconv.FormatInt(code, 10), c, true
+}
+
+func renderBool(std *Stdio, v any) (string, *color.Color, bool) {
+	var b bool
+	switch t := v.(type) {
+	case bool:
+		b = t
+	case string:
+		switch strings.ToLower(t) {
+		case "true", "yes", "y", "on", "1":
+			b = true
+		case "false", "no", "n", "off", "0":
+			b = false
+		default:
+			return "", nil, false
+		}
+	case int64:
+		if t != 0 && t != 1 {
+			return "", nil, false
+		}
+		b = t == 1
+	default:
+		return "", nil, false
+	}
+	if b {
+		return "true", std.opts.Palette.InfoLevelColor, true
+	}
+	return "false", std.opts.Palette.WarnLevelColor, true
+}
+
+// valueTimeFormats are tried, in order, when a string value is rendered as
+// a time.
+var valueTimeFormats = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func renderTime(std *Stdio, v any) (string, *color.Color, bool) {
+	var ts time.Time
+	switch t := v.(type) {
+	case time.Time:
+		ts = t
+	case string:
+		parsed := false
+		for _, layout := range valueTimeFormats {
+			if p, err := time.Parse(layout, t); err == nil {
+				ts, parsed = p, true
+				break
+			}
+		}
+		if !parsed {
+			return "", nil, false
+		}
+	default:
+		return "", nil, false
+	}
+	if std.opts.TimeZone != nil {
+		ts = ts.In(std.opts.TimeZone)
+	}
+	return ts.Format(std.opts.TimeFormat), nil, true
+}
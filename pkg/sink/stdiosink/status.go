@@ -0,0 +1,204 @@
+package stdiosink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/x/ansi"
+	"github.com/fatih/color"
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/sink"
+)
+
+const (
+	// clearLine moves the cursor to the start of the line and erases it.
+	clearLine = "\r\x1b[2K"
+
+	DefaultStatusLineInterval = 250 * time.Millisecond
+)
+
+// StatusLine wraps a Stdio sink to keep a line of running counts at the
+// bottom of the terminal. The line is erased before each event is printed
+// and drawn again after, so it never ends up in the scrollback. It must
+// only be used when the Stdio sink writes to a terminal.
+type StatusLine struct {
+	std *Stdio
+
+	mu      sync.Mutex
+	drawn   bool
+	counts  [len(statusLevels)]int
+	raw     int
+	total   int
+	lastErr time.Time
+
+	// rate is the number of events per second, measured between ticks
+	rate      float64
+	rateTotal int
+	rateAt    time.Time
+
+	timeNow func() time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+var _ sink.Sink = (*StatusLine)(nil)
+
+// statusLevels are the levels counted by the status line, anything else
+// is counted as unknown.
+var statusLevels = [...]string{"debug", "info", "warn", "error", "fatal", "unknown"}
+
+// NewStatusLine starts redrawing the status line every `interval`, until
+// Close is called.
+func NewStatusLine(std *Stdio, interval time.Duration) *StatusLine {
+	if interval <= 0 {
+		interval = DefaultStatusLineInterval
+	}
+	sl := &StatusLine{
+		std:     std,
+		timeNow: std.timeNow,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	sl.rateAt = sl.timeNow()
+	go sl.tick(interval)
+	return sl
+}
+
+func (sl *StatusLine) tick(interval time.Duration) {
+	defer close(sl.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sl.stop:
+			return
+		case <-ticker.C:
+			sl.mu.Lock()
+			sl.updateRate()
+			_ = sl.draw()
+			sl.mu.Unlock()
+		}
+	}
+}
+
+func (sl *StatusLine) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	return sl.ReceiveWithPostProcess(ctx, ev, nil)
+}
+
+func (sl *StatusLine) ReceiveWithPostProcess(ctx context.Context, ev *typesv1.LogEvent, postProcess func(string) string) error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if err := sl.erase(); err != nil {
+		return err
+	}
+	if err := sl.std.ReceiveWithPostProcess(ctx, ev, postProcess); err != nil {
+		return err
+	}
+	sl.count(ev)
+	return sl.draw()
+}
+
+// Close erases the status line, leaving the terminal as if it was never
+// there.
+func (sl *StatusLine) Close(ctx context.Context) error {
+	close(sl.stop)
+	<-sl.done
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if err := sl.erase(); err != nil {
+		return err
+	}
+	return sl.std.Close(ctx)
+}
+
+func (sl *StatusLine) count(ev *typesv1.LogEvent) {
+	sl.total++
+	if ev.Structured == nil {
+		sl.raw++
+		return
+	}
+	i := statusLevelIndex(ev.Structured.Lvl)
+	sl.counts[i]++
+	if lvl := statusLevels[i]; lvl == "error" || lvl == "fatal" {
+		sl.lastErr = sl.timeNow()
+	}
+}
+
+func statusLevelIndex(lvl string) int {
+	switch strings.ToLower(lvl) {
+	case "debug", "trace":
+		return 0
+	case "info":
+		return 1
+	case "warn", "warning":
+		return 2
+	case "error", "err":
+		return 3
+	case "fatal", "panic", "critical":
+		return 4
+	default:
+		return 5
+	}
+}
+
+func (sl *StatusLine) updateRate() {
+	now := sl.timeNow()
+	elapsed := now.Sub(sl.rateAt)
+	if elapsed < time.Second {
+		return
+	}
+	sl.rate = float64(sl.total-sl.rateTotal) / elapsed.Seconds()
+	sl.rateTotal = sl.total
+	sl.rateAt = now
+}
+
+func (sl *StatusLine) erase() error {
+	if !sl.drawn {
+		return nil
+	}
+	sl.drawn = false
+	_, err := sl.std.w.Write([]byte(clearLine))
+	return err
+}
+
+func (sl *StatusLine) draw() error {
+	line := sl.render()
+	if width := sl.std.opts.TermWidth; width > 0 {
+		// a line as wide as the terminal would wrap the cursor onto the
+		// next one, which can't be erased anymore
+		line = ansi.Truncate(line, width-1, "")
+	}
+	_, err := sl.std.w.Write([]byte(clearLine + line))
+	sl.drawn = err == nil
+	return err
+}
+
+func (sl *StatusLine) render() string {
+	pl := sl.std.opts.Palette
+	colors := [len(statusLevels)]*color.Color{
+		pl.DebugLevelColor,
+		pl.InfoLevelColor,
+		pl.WarnLevelColor,
+		pl.ErrorLevelColor,
+		pl.FatalLevelColor,
+		pl.UnknownLevelColor,
+	}
+	var sb strings.Builder
+	for i, lvl := range statusLevels {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(colors[i].Sprint(strings.ToUpper(lvl[:4])))
+		fmt.Fprintf(&sb, " %d", sl.counts[i])
+	}
+	fmt.Fprintf(&sb, " | %.1f ev/s", sl.rate)
+	fmt.Fprintf(&sb, " | %d structured, %d raw", sl.total-sl.raw, sl.raw)
+	if !sl.lastErr.IsZero() {
+		ago := sl.timeNow().Sub(sl.lastErr).Truncate(time.Second)
+		fmt.Fprintf(&sb, " | last error %s ago", ago)
+	}
+	return sb.String()
+}
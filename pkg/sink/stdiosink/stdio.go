@@ -5,16 +5,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"regexp"
 	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/charmbracelet/x/ansi"
 	"github.com/fatih/color"
 	"github.com/humanlogio/api/go/pkg/logql"
 	typesv1 "github.com/humanlogio/api/go/types/v1"
 	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/internal/pkg/keymatch"
 	"github.com/humanlogio/humanlog/pkg/sink"
+	"github.com/mattn/go-runewidth"
 )
 
 var (
@@ -28,45 +33,102 @@ type Stdio struct {
 	lastRaw   bool
 	lastLevel string
 	lastKVs   map[string]string
+
+	firstTs time.Time
+	prevTs  time.Time
+	timeNow func() time.Time
 }
 
 type StdioOpts struct {
-	Keep           map[string]struct{}
-	Skip           map[string]struct{}
-	SkipUnchanged  bool
-	SortLongest    bool
-	TimeFormat     string
-	TimeZone       *time.Location
+	// Keep and Skip match keys to always show and to hide. A key matched
+	// by both is kept, so `Skip: *` with a few `Keep` only shows those.
+	Keep          *keymatch.Matcher
+	Skip          *keymatch.Matcher
+	SkipUnchanged bool
+	SortLongest   bool
+	TimeFormat    string
+	TimeZone      *time.Location
+	// TimeMode decides whether the time column shows absolute times, or
+	// durations relative to other events or to now.
+	TimeMode TimeMode
+	// SlowGap highlights, in `TimeModeDelta`, events that came this long
+	// or longer after the previous one. Disabled when 0.
+	SlowGap        time.Duration
 	TruncateLength int
 	Truncates      bool
+	// TruncateStrategy decides how values longer than what they're
+	// allowed are shortened.
+	TruncateStrategy TruncateStrategy
+	// TermWidth is the width of the terminal the sink writes to, or 0
+	// if unknown. When known, the room left on a line after the message
+	// is shared between KVs, and `TruncateLength` becomes the minimum
+	// width a value gets truncated to.
+	TermWidth int
 
 	ColorFlag string
 	LightBg   bool
 	Palette   Palette
+	// HashColorKeys are keys whose values are colored with a color derived
+	// from the value itself, instead of `Palette.ValColor`.
+	HashColorKeys map[string]struct{}
+	// ValueRenderers are tried in order on each KV, the first that matches
+	// decides how the value is printed.
+	ValueRenderers []ValueRenderer
+
+	// Hyperlinks turns callers, URLs and trace IDs into OSC 8 links.
+	Hyperlinks bool
+	// SourceRoot is where relative caller paths are found.
+	SourceRoot string
+	// EditorURL is a template for links to callers, with "{path}" and
+	// "{line}" placeholders.
+	EditorURL  string
+	CallerKeys map[string]struct{}
+	// TraceURL is a template for links to a tracing UI, with a "{value}"
+	// placeholder for the trace ID. No links are made when empty.
+	TraceURL  string
+	TraceKeys map[string]struct{}
+
+	// Highlight marks what it matches in messages, values and raw lines,
+	// i.e. the terms that `--grep` matched.
+	Highlight *regexp.Regexp
 }
 
 var DefaultStdioOpts = StdioOpts{
 
-	SkipUnchanged:  true,
-	SortLongest:    true,
-	TimeFormat:     time.Stamp,
-	TimeZone:       time.Local,
-	TruncateLength: 15,
-	Truncates:      true,
+	SkipUnchanged:    true,
+	SortLongest:      true,
+	TimeFormat:       time.Stamp,
+	TimeZone:         time.Local,
+	TimeMode:         TimeModeAbsolute,
+	TruncateLength:   15,
+	Truncates:        true,
+	TruncateStrategy: TruncateEnd,
 
 	ColorFlag: "auto",
 	LightBg:   false,
 	Palette:   DefaultPalette,
+
+	EditorURL:  DefaultEditorURL,
+	CallerKeys: map[string]struct{}{"caller": {}, "source": {}},
+	TraceKeys:  map[string]struct{}{"trace_id": {}, "traceId": {}, "trace.id": {}, "TraceId": {}},
 }
 
 func StdioOptsFrom(cfg config.Config) (StdioOpts, []error) {
 	var errs []error
 	opts := DefaultStdioOpts
 	if cfg.Skip != nil {
-		opts.Skip = sliceToSet(cfg.Skip)
+		var err error
+		opts.Skip, err = keymatch.Compile(*cfg.Skip)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid --skip: %v", err))
+		}
 	}
 	if cfg.Keep != nil {
-		opts.Keep = sliceToSet(cfg.Keep)
+		var err error
+		opts.Keep, err = keymatch.Compile(*cfg.Keep)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid --keep: %v", err))
+		}
 	}
 	if cfg.SortLongest != nil {
 		opts.SortLongest = *cfg.SortLongest
@@ -83,9 +145,30 @@ func StdioOptsFrom(cfg config.Config) (StdioOpts, []error) {
 	if cfg.TruncateLength != nil {
 		opts.TruncateLength = *cfg.TruncateLength
 	}
+	if cfg.TruncateStrategy != nil {
+		var err error
+		opts.TruncateStrategy, err = GrokTruncateStrategy(*cfg.TruncateStrategy)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid --truncate-strategy=%q: %v", *cfg.TruncateStrategy, err))
+		}
+	}
 	if cfg.TimeFormat != nil {
 		opts.TimeFormat = *cfg.TimeFormat
 	}
+	if cfg.TimeMode != nil {
+		var err error
+		opts.TimeMode, err = GrokTimeMode(*cfg.TimeMode)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid --time-mode=%q: %v", *cfg.TimeMode, err))
+		}
+	}
+	if cfg.SlowGap != nil {
+		var err error
+		opts.SlowGap, err = time.ParseDuration(*cfg.SlowGap)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid --slow-gap=%q: %v", *cfg.SlowGap, err))
+		}
+	}
 	if cfg.TimeZone != nil {
 		var err error
 		opts.TimeZone, err = time.LoadLocation(*cfg.TimeZone)
@@ -108,6 +191,57 @@ func StdioOptsFrom(cfg config.Config) (StdioOpts, []error) {
 			// to do here.
 		}
 	}
+	if cfg.Theme != nil {
+		pl, err := PaletteFromTheme(*cfg.Theme)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid --theme=%q, using default one: %v", *cfg.Theme, err))
+		} else {
+			opts.Palette = *pl
+		}
+	}
+	if cfg.HashColorKeys != nil {
+		opts.HashColorKeys = sliceToSet(cfg.HashColorKeys)
+	}
+	if cfg.ValueRenderers != nil {
+		renderers, err := ValueRenderersFrom(*cfg.ValueRenderers)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid value renderers: %v", err))
+		} else {
+			opts.ValueRenderers = renderers
+		}
+	}
+	if cfg.Hyperlinks != nil {
+		hl := cfg.Hyperlinks
+		if hl.Mode != nil {
+			mode, err := config.GrokColorMode(*hl.Mode)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid --hyperlinks=%q: %v", *hl.Mode, err))
+			}
+			// 'auto' depends on the output being a terminal, which the
+			// caller knows about
+			opts.Hyperlinks = mode == config.ColorModeOn
+		}
+		if hl.SourceRoot != nil {
+			opts.SourceRoot = *hl.SourceRoot
+		}
+		if hl.EditorURL != nil {
+			opts.EditorURL = *hl.EditorURL
+		}
+		if hl.CallerKeys != nil {
+			opts.CallerKeys = sliceToSet(hl.CallerKeys)
+		}
+		if hl.TraceURL != nil {
+			opts.TraceURL = *hl.TraceURL
+		}
+		if hl.TraceKeys != nil {
+			opts.TraceKeys = sliceToSet(hl.TraceKeys)
+		}
+	}
+	if opts.SourceRoot == "" {
+		if wd, err := os.Getwd(); err == nil {
+			opts.SourceRoot = wd
+		}
+	}
 	if cfg.Palette != nil {
 		pl, err := PaletteFrom(*cfg.Palette)
 		if err != nil {
@@ -123,8 +257,9 @@ var _ sink.Sink = (*Stdio)(nil)
 
 func NewStdio(w io.Writer, opts StdioOpts) *Stdio {
 	return &Stdio{
-		w:    w,
-		opts: opts,
+		w:       w,
+		opts:    opts,
+		timeNow: time.Now,
 	}
 }
 
@@ -141,7 +276,11 @@ func (std *Stdio) ReceiveWithPostProcess(ctx context.Context, ev *typesv1.LogEve
 		std.lastRaw = true
 		std.lastLevel = ""
 		std.lastKVs = nil
-		if _, err := std.w.Write(ev.Raw); err != nil {
+		raw := ev.Raw
+		if std.opts.Highlight != nil {
+			raw = []byte(std.colorize(string(raw), nil))
+		}
+		if _, err := std.w.Write(raw); err != nil {
 			return err
 		}
 		if _, err := std.w.Write(eol[:]); err != nil {
@@ -165,11 +304,16 @@ func (std *Stdio) ReceiveWithPostProcess(ctx context.Context, ev *typesv1.LogEve
 		msgColor = std.opts.Palette.MsgDarkBgColor
 		msgAbsentColor = std.opts.Palette.MsgAbsentDarkBgColor
 	}
-	var msg string
+	var (
+		msg      string
+		msgWidth int
+	)
 	if data.Msg == "" {
 		msg = msgAbsentColor.Sprint("<no msg>")
+		msgWidth = len("<no msg>")
 	} else {
-		msg = msgColor.Sprint(data.Msg)
+		msg = std.colorize(data.Msg, msgColor)
+		msgWidth = runewidth.StringWidth(data.Msg)
 	}
 
 	lvl := strings.ToUpper(data.Lvl)[:imin(4, len(data.Lvl))]
@@ -195,26 +339,48 @@ func (std *Stdio) ReceiveWithPostProcess(ctx context.Context, ev *typesv1.LogEve
 	} else {
 		timeColor = std.opts.Palette.TimeDarkBgColor
 	}
-	var timestr string
+	var (
+		timestr   string
+		timeWidth int
+	)
 	ts := data.Timestamp.AsTime()
 	if ts.IsZero() {
 		timestr = "<no time>"
+		timeWidth = len(timestr)
 	} else {
-		if std.opts.TimeZone != nil {
-			ts = ts.In(std.opts.TimeZone)
+		formatted, highlight := std.formatTime(ts)
+		if highlight != nil {
+			timeColor = highlight
 		}
-		timestr = timeColor.Sprint(ts.Format(std.opts.TimeFormat))
+		timestr = timeColor.Sprint(formatted)
+		timeWidth = runewidth.StringWidth(formatted)
 	}
 
 	pattern := "%s |%s| %s\t %s"
 	if postProcess != nil {
 		pattern = postProcess(pattern)
 	}
+
+	// '<time> |<lvl>| ', under which wrapped KVs are indented
+	indent := timeWidth + 2 + len(lvl) + 2
+	// what's left on the line for KVs after '<msg> '
+	available := 0
+	if std.opts.TermWidth > 0 {
+		available = std.opts.TermWidth - indent - msgWidth - 1
+	}
+
+	kvs := std.joinKVs(data, "=", available)
+	var kvstr string
+	if std.opts.TermWidth > 0 && std.opts.TruncateStrategy == TruncateWrap {
+		kvstr = std.wrapKVs(kvs, indent, indent+msgWidth)
+	} else {
+		kvstr = strings.Join(kvs, "\t ")
+	}
 	_, _ = fmt.Fprintf(out, pattern,
 		timestr,
 		level,
 		msg,
-		strings.Join(std.joinKVs(data, "="), "\t "),
+		kvstr,
 	)
 
 	if err := out.Flush(); err != nil {
@@ -227,26 +393,22 @@ func (std *Stdio) ReceiveWithPostProcess(ctx context.Context, ev *typesv1.LogEve
 		return err
 	}
 
-	kvs := make(map[string]string, len(data.Kvs))
+	lastKVs := make(map[string]string, len(data.Kvs))
 	for _, kv := range data.Kvs {
 		key := kv.Key
 		value, err := logql.ResolveVal(kv.Value, logql.MakeFlatGoMap, logql.MakeFlatMapGoSlice)
 		if err != nil {
 			return err
 		}
-		put(&kvs, key, value)
+		put(&lastKVs, key, value)
 	}
 	std.lastRaw = false
 	std.lastLevel = ev.Structured.Lvl
-	std.lastKVs = kvs
+	std.lastKVs = lastKVs
 	return nil
 }
 
-func toString(value *typesv1.Val) (string, error) {
-	v, err := logql.ResolveVal(value, nil, nil)
-	if err != nil {
-		return "", err
-	}
+func toString(v any) (string, error) {
 	switch t := v.(type) {
 	case string:
 		return t, nil
@@ -288,16 +450,25 @@ func put(ref *map[string]string, key string, value any) {
 	}
 }
 
-func (std *Stdio) joinKVs(data *typesv1.StructuredLogEvent, sep string) []string {
+func (std *Stdio) joinKVs(data *typesv1.StructuredLogEvent, sep string, available int) []string {
 	wasSameLevel := std.lastLevel == data.Lvl
 	skipUnchanged := !std.lastRaw && std.opts.SkipUnchanged && wasSameLevel
 
-	kv := make([]string, 0, len(data.Kvs))
+	var (
+		keys   []string
+		vals   []string
+		colors []*color.Color
+		links  []string
+	)
 	for _, pair := range data.Kvs {
-		k, v := pair.Key, pair.Value
+		k := pair.Key
 		if !std.opts.shouldShowKey(k) {
 			continue
 		}
+		v, err := logql.ResolveVal(pair.Value, nil, nil)
+		if err != nil {
+			continue
+		}
 		w, err := toString(v)
 		if err != nil {
 			continue
@@ -308,15 +479,44 @@ func (std *Stdio) joinKVs(data *typesv1.StructuredLogEvent, sep string) []string
 				continue
 			}
 		}
+		link, _ := std.linkFor(k, w)
+		var c *color.Color
+		if _, ok := std.opts.HashColorKeys[k]; ok {
+			// hash the full value, so that truncating doesn't change its color
+			c = hashColor(w, std.opts.LightBg)
+		}
+		if rendered, rc, ok := std.renderValue(k, v); ok {
+			w = rendered
+			if c == nil {
+				c = rc
+			}
+		}
+		if c == nil {
+			c = std.opts.Palette.ValColor
+			if std.opts.LightBg && std.opts.Palette.ValLightBgColor != nil {
+				c = std.opts.Palette.ValLightBgColor
+			}
+		}
+		keys = append(keys, k)
+		vals = append(vals, w)
+		colors = append(colors, c)
+		links = append(links, link)
+	}
+
+	limits := std.valueWidthLimits(keys, vals, available)
+
+	kv := make([]string, 0, len(keys))
+	for i, k := range keys {
 		kstr := std.opts.Palette.KeyColor.Sprint(k)
 
-		var vstr string
-		if std.opts.Truncates && len(w) > std.opts.TruncateLength {
-			vstr = w[:std.opts.TruncateLength] + "..."
-		} else {
-			vstr = w
+		vstr := vals[i]
+		if limits != nil {
+			vstr = truncate(vstr, limits[i], std.opts.TruncateStrategy)
+		}
+		vstr = std.colorize(vstr, colors[i])
+		if links[i] != "" {
+			vstr = hyperlink(links[i], vstr)
 		}
-		vstr = std.opts.Palette.ValColor.Sprint(vstr)
 		kv = append(kv, kstr+sep+vstr)
 	}
 
@@ -329,27 +529,75 @@ func (std *Stdio) joinKVs(data *typesv1.StructuredLogEvent, sep string) []string
 	return kv
 }
 
-func (opts *StdioOpts) shouldShowKey(key string) bool {
-	if len(opts.Keep) != 0 {
-		if _, keep := opts.Keep[key]; keep {
-			return true
-		}
+// valueWidthLimits returns how wide each value is allowed to be, or nil if
+// values shouldn't be truncated.
+func (std *Stdio) valueWidthLimits(keys, vals []string, available int) []int {
+	if !std.opts.Truncates || std.opts.TruncateStrategy == TruncateWrap {
+		return nil
 	}
-	if len(opts.Skip) != 0 {
-		if _, skip := opts.Skip[key]; skip {
-			return false
+	limits := make([]int, len(vals))
+	if available <= 0 {
+		for i := range limits {
+			limits[i] = std.opts.TruncateLength
 		}
+		return limits
+	}
+	keyWidths := make([]int, len(keys))
+	valWidths := make([]int, len(vals))
+	for i := range keys {
+		keyWidths[i] = runewidth.StringWidth(keys[i])
+		valWidths[i] = runewidth.StringWidth(vals[i])
 	}
-	return true
+	return budgetValueWidths(available, keyWidths, valWidths, std.opts.TruncateLength)
 }
 
-func (opts *StdioOpts) shouldShowUnchanged(key string) bool {
-	if len(opts.Keep) != 0 {
-		if _, keep := opts.Keep[key]; keep {
-			return true
+// wrapKVs lays out KVs over as many lines as needed to fit in the terminal,
+// starting after `startAt` cells on the first line and indenting the following
+// ones by `indent` cells.
+func (std *Stdio) wrapKVs(kvs []string, indent, startAt int) string {
+	var (
+		sb      strings.Builder
+		width   = std.opts.TermWidth
+		room    = width - indent
+		newline = "\n" + strings.Repeat(" ", indent)
+		// the pattern already puts a space after the message
+		cur = startAt + 1
+	)
+	for i, kv := range kvs {
+		kvWidth := ansi.StringWidth(kv)
+		if i > 0 {
+			if cur+1+kvWidth > width {
+				sb.WriteString(newline)
+				cur = indent
+			} else {
+				sb.WriteString(" ")
+				cur++
+			}
+		} else if cur+kvWidth > width && cur > indent+1 && kvWidth <= room {
+			sb.WriteString(newline)
+			cur = indent
+		}
+		if kvWidth > room && room > 0 {
+			lines := strings.Split(ansi.Hardwrap(kv, room, true), "\n")
+			sb.WriteString(strings.Join(lines, newline))
+			cur = indent + ansi.StringWidth(lines[len(lines)-1])
+			continue
 		}
+		sb.WriteString(kv)
+		cur += kvWidth
+	}
+	return sb.String()
+}
+
+func (opts *StdioOpts) shouldShowKey(key string) bool {
+	if opts.Keep.Match(key) {
+		return true
 	}
-	return false
+	return !opts.Skip.Match(key)
+}
+
+func (opts *StdioOpts) shouldShowUnchanged(key string) bool {
+	return opts.Keep.Match(key)
 }
 
 type byLongest []string
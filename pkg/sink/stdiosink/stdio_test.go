@@ -1,12 +1,19 @@
 package stdiosink
 
 import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/fatih/color"
 	"github.com/humanlogio/api/go/pkg/logql"
 	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestPutKV(t *testing.T) {
@@ -76,3 +83,330 @@ func TestPutKV(t *testing.T) {
 		})
 	}
 }
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		width    int
+		strategy TruncateStrategy
+		want     string
+	}{
+		{name: "fits", in: "short", width: 10, strategy: TruncateEnd, want: "short"},
+		{name: "end", in: "abcdefghij", width: 4, strategy: TruncateEnd, want: "abcd..."},
+		{name: "middle", in: "req-0123456789-abcd", width: 8, strategy: TruncateMiddle, want: "req-...abcd"},
+		{name: "wrap never cuts", in: "abcdefghij", width: 4, strategy: TruncateWrap, want: "abcdefghij"},
+		{name: "doesn't split runes", in: "héllo wörld", width: 5, strategy: TruncateEnd, want: "héllo..."},
+		{name: "counts wide runes as 2 cells", in: "日本語のテキスト", width: 5, strategy: TruncateEnd, want: "日本..."},
+		{name: "middle with wide runes", in: "日本語のテキスト", width: 8, strategy: TruncateMiddle, want: "日本...スト"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncate(tt.in, tt.width, tt.strategy)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBudgetValueWidths(t *testing.T) {
+	tests := []struct {
+		name      string
+		available int
+		keyWidths []int
+		valWidths []int
+		floor     int
+		want      []int
+	}{
+		{
+			name:      "everything fits",
+			available: 100,
+			keyWidths: []int{2, 2},
+			valWidths: []int{5, 10},
+			floor:     3,
+			want:      []int{5, 10},
+		},
+		{
+			name:      "short values leave room to long ones",
+			available: 40,
+			keyWidths: []int{2, 2},
+			valWidths: []int{5, 100},
+			floor:     3,
+			want:      []int{5, 27},
+		},
+		{
+			name:      "never below the floor",
+			available: 10,
+			keyWidths: []int{2, 2},
+			valWidths: []int{50, 100},
+			floor:     15,
+			want:      []int{15, 15},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := budgetValueWidths(tt.available, tt.keyWidths, tt.valWidths, tt.floor)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWrapKVs(t *testing.T) {
+	std := NewStdio(nil, StdioOpts{TermWidth: 20})
+	got := std.wrapKVs([]string{"a=1", "bb=22", "ccc=333", "d=0123456789abcdefghij"}, 4, 8)
+	want := "a=1 bb=22\n    ccc=333\n    d=0123456789abcd\n    efghij"
+	require.Equal(t, want, got)
+}
+
+func TestExtendedColorAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []color.Attribute
+		wantErr bool
+	}{
+		{name: "256 fg", in: "fg_208", want: []color.Attribute{38, 5, 208}},
+		{name: "256 bg", in: "bg_17", want: []color.Attribute{48, 5, 17}},
+		{name: "hex bg", in: "bg_#ffffff", want: []color.Attribute{48, 5, 231}},
+		{name: "hex", in: "#000000", want: []color.Attribute{38, 5, 16}},
+		{name: "hex in the cube", in: "fg_#ff8700", want: []color.Attribute{38, 5, 208}},
+		{name: "out of range", in: "fg_256", wantErr: true},
+		{name: "bad hex", in: "#zzzzzz", wantErr: true},
+		{name: "unknown", in: "chartreuse", wantErr: true},
+	}
+	prev := supportsTrueColor
+	supportsTrueColor = false
+	defer func() { supportsTrueColor = prev }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extendedColorAttributes(tt.in)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestThemesAreValid(t *testing.T) {
+	for _, name := range ThemeNames() {
+		t.Run(name, func(t *testing.T) {
+			pl, err := PaletteFromTheme(name)
+			require.NoError(t, err)
+			if name != "default" && name != "monochrome" {
+				require.NotNil(t, pl.ValLightBgColor, "values must be readable on light backgrounds")
+			}
+		})
+	}
+}
+
+func TestHashColor(t *testing.T) {
+	a1 := hashColor("req-1", false)
+	a2 := hashColor("req-1", false)
+	b := hashColor("req-2", false)
+	require.True(t, a1.Equals(a2), "same value should get the same color")
+	require.False(t, a1.Equals(b), "different values should get different colors")
+}
+
+func TestParseOSC11Response(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		wantLight bool
+		wantOK    bool
+	}{
+		{name: "white, ST terminated", in: "\x1b]11;rgb:ffff/ffff/ffff\x1b\\", wantLight: true, wantOK: true},
+		{name: "black, BEL terminated", in: "\x1b]11;rgb:0000/0000/0000\x07", wantLight: false, wantOK: true},
+		{name: "2 digits per channel", in: "\x1b]11;rgb:fd/f6/e3\x07\x1b[?62;22c", wantLight: true, wantOK: true},
+		{name: "only DA1", in: "\x1b[?62;22c", wantOK: false},
+		{name: "garbage", in: "\x1b]11;rgb:zz/zz\x07", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, g, b, ok := parseOSC11Response([]byte(tt.in))
+			require.Equal(t, tt.wantOK, ok)
+			if ok {
+				require.Equal(t, tt.wantLight, isLightColor(r, g, b))
+			}
+		})
+	}
+}
+
+func TestHumanizeBytes(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want string
+	}{
+		{in: 0, want: "0B"},
+		{in: 1023, want: "1023B"},
+		{in: 1024, want: "1.0KiB"},
+		{in: 1536, want: "1.5KiB"},
+		{in: 3 * 1024 * 1024, want: "3.0MiB"},
+		{in: -2048, want: "-2.0KiB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			require.Equal(t, tt.want, humanizeBytes(tt.in))
+		})
+	}
+}
+
+func TestValueRenderersFrom(t *testing.T) {
+	_, err := ValueRenderersFrom([]config.ValueRenderer{{As: "furlongs"}})
+	require.Error(t, err)
+	_, err = ValueRenderersFrom([]config.ValueRenderer{{Types: []string{"complex"}, As: "bytes"}})
+	require.Error(t, err)
+	_, err = ValueRenderersFrom([]config.ValueRenderer{{Keys: []string{"[a-"}, As: "bytes"}})
+	require.Error(t, err)
+	renderers, err := ValueRenderersFrom(*config.DefaultConfig.ValueRenderers)
+	require.NoError(t, err)
+	require.Len(t, renderers, len(*config.DefaultConfig.ValueRenderers))
+}
+
+func TestFormatTime(t *testing.T) {
+	start := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	times := []time.Time{start, start.Add(12 * time.Millisecond), start.Add(1512 * time.Millisecond)}
+	tests := []struct {
+		name string
+		mode TimeMode
+		want []string
+	}{
+		{name: "absolute", mode: TimeModeAbsolute, want: []string{"19:36:00.000", "19:36:00.012", "19:36:01.512"}},
+		{name: "relative", mode: TimeModeRelative, want: []string{"       +0s", "     +12ms", "   +1.512s"}},
+		{name: "delta", mode: TimeModeDelta, want: []string{"       +0s", "     +12ms", "     +1.5s"}},
+		{name: "ago", mode: TimeModeAgo, want: []string{"    2s ago", "    2s ago", " 488ms ago"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			std := NewStdio(nil, StdioOpts{
+				TimeFormat: "15:04:05.000",
+				TimeZone:   time.UTC,
+				TimeMode:   tt.mode,
+				SlowGap:    time.Second,
+				Palette:    DefaultPalette,
+			})
+			std.timeNow = func() time.Time { return start.Add(2 * time.Second) }
+			for i, ts := range times {
+				got, highlight := std.formatTime(ts)
+				require.Equal(t, tt.want[i], got)
+				if tt.mode == TimeModeDelta && i == 2 {
+					require.NotNil(t, highlight, "slow gap should be highlighted")
+				} else {
+					require.Nil(t, highlight)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkFor(t *testing.T) {
+	std := NewStdio(nil, StdioOpts{
+		Hyperlinks: true,
+		SourceRoot: "/src/app",
+		EditorURL:  "vscode://file/{path}:{line}",
+		CallerKeys: map[string]struct{}{"caller": {}},
+		TraceURL:   "http://localhost:16686/trace/{value}",
+		TraceKeys:  map[string]struct{}{"trace_id": {}},
+	})
+	tests := []struct {
+		name   string
+		key    string
+		value  string
+		want   string
+		wantOK bool
+	}{
+		{name: "relative caller", key: "caller", value: "zapper/zapper.go:18", want: "vscode://file//src/app/zapper/zapper.go:18", wantOK: true},
+		{name: "absolute caller with column", key: "caller", value: "/tmp/main.go:42:7", want: "vscode://file//tmp/main.go:42", wantOK: true},
+		{name: "trace", key: "trace_id", value: "4bf92f3577b34da6", want: "http://localhost:16686/trace/4bf92f3577b34da6", wantOK: true},
+		{name: "url", key: "referer", value: "https://humanlog.io/docs?q=1", want: "https://humanlog.io/docs?q=1", wantOK: true},
+		{name: "not a url", key: "msg", value: "hello world", wantOK: false},
+		{name: "escape sequences aren't let through", key: "referer", value: "https://evil.example/\x1b]8;;", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := std.linkFor(tt.key, tt.value)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestStatusLine(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = true
+	defer func() { color.NoColor = noColor }()
+
+	now := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	buf := bytes.NewBuffer(nil)
+	std := NewStdio(buf, StdioOpts{
+		TimeFormat: time.Kitchen,
+		TimeZone:   time.UTC,
+		Palette:    DefaultPalette,
+	})
+	std.timeNow = func() time.Time { return now }
+	sl := NewStatusLine(std, time.Hour)
+
+	ctx := context.Background()
+	events := []*typesv1.LogEvent{
+		{Raw: []byte("starting up")},
+		{Raw: []byte(`{"msg":"hello"}`), Structured: &typesv1.StructuredLogEvent{Timestamp: timestamppb.New(now), Lvl: "info", Msg: "hello"}},
+		{Raw: []byte(`{"msg":"oops"}`), Structured: &typesv1.StructuredLogEvent{Timestamp: timestamppb.New(now), Lvl: "ERROR", Msg: "oops"}},
+	}
+	for _, ev := range events {
+		require.NoError(t, sl.Receive(ctx, ev))
+	}
+	now = now.Add(3 * time.Second)
+	sl.updateRate()
+	require.Equal(t, "DEBU 0 INFO 1 WARN 0 ERRO 1 FATA 0 UNKN 0 | 1.0 ev/s | 2 structured, 1 raw | last error 3s ago", sl.render())
+
+	require.NoError(t, sl.Close(ctx))
+	out := buf.String()
+	require.True(t, strings.HasSuffix(out, clearLine), "status line should be erased on close: %q", out)
+
+	// without the status lines, the output is the same as without a
+	// status line at all
+	var printed strings.Builder
+	for _, part := range strings.Split(out, clearLine) {
+		if !strings.HasPrefix(part, "DEBU ") {
+			printed.WriteString(part)
+		}
+	}
+	want := bytes.NewBuffer(nil)
+	plain := NewStdio(want, std.opts)
+	for _, ev := range events {
+		require.NoError(t, plain.Receive(ctx, ev))
+	}
+	require.Equal(t, want.String(), printed.String())
+}
+
+func TestColorizeHighlight(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+
+	std := NewStdio(nil, StdioOpts{Highlight: regexp.MustCompile(`o+`)})
+	got := std.colorize("foo bar", nil)
+	require.Equal(t, "f"+highlightColor.Sprint("oo")+" bar", got)
+
+	std.opts.Highlight = nil
+	require.Equal(t, "foo bar", std.colorize("foo bar", nil))
+}
+
+func TestWriteTable(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = true
+	defer func() { color.NoColor = noColor }()
+
+	buf := bytes.NewBuffer(nil)
+	std := NewStdio(buf, StdioOpts{Palette: DefaultPalette})
+	err := std.WriteTable(
+		[]string{"service", "count()"},
+		[][]string{{"api", "12"}, {"checkout", "3"}},
+	)
+	require.NoError(t, err)
+	want := "service   count()\n" +
+		"api       12\n" +
+		"checkout  3\n"
+	require.Equal(t, want, buf.String())
+}
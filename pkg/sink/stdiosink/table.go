@@ -0,0 +1,43 @@
+package stdiosink
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/x/ansi"
+	"github.com/fatih/color"
+)
+
+// WriteTable prints rows of values under a header, in aligned columns. It's
+// used to show results that aren't log events, like those of a query that
+// summarizes them.
+func (std *Stdio) WriteTable(columns []string, rows [][]string) error {
+	widths := make([]int, len(columns))
+	for i, col := range columns {
+		widths[i] = ansi.StringWidth(col)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], ansi.StringWidth(cell))
+		}
+	}
+	pl := std.opts.Palette
+	var sb strings.Builder
+	writeRow := func(cells []string, c *color.Color) {
+		for i, cell := range cells {
+			if i > 0 {
+				sb.WriteString("  ")
+			}
+			sb.WriteString(std.colorize(cell, c))
+			if i < len(cells)-1 {
+				sb.WriteString(strings.Repeat(" ", widths[i]-ansi.StringWidth(cell)))
+			}
+		}
+		sb.WriteString("\n")
+	}
+	writeRow(columns, pl.KeyColor)
+	for _, row := range rows {
+		writeRow(row, pl.ValColor)
+	}
+	_, err := std.w.Write([]byte(sb.String()))
+	return err
+}
@@ -0,0 +1,125 @@
+package stdiosink
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+)
+
+// Themes are the named palettes that ship with humanlog. A `palette` in the
+// config file takes precedence over a theme.
+var Themes = map[string]config.TextPalette{
+	"dracula": {
+		KeyColor:              []string{"#50fa7b"},
+		ValColor:              []string{"#f8f8f2"},
+		ValLightBgColor:       []string{"#282a36"},
+		TimeLightBgColor:      []string{"#44475a"},
+		TimeDarkBgColor:       []string{"#6272a4"},
+		MsgLightBgColor:       []string{"#282a36"},
+		MsgAbsentLightBgColor: []string{"#6272a4"},
+		MsgDarkBgColor:        []string{"#f8f8f2"},
+		MsgAbsentDarkBgColor:  []string{"#6272a4"},
+		DebugLevelColor:       []string{"#bd93f9"},
+		InfoLevelColor:        []string{"#8be9fd"},
+		WarnLevelColor:        []string{"#f1fa8c"},
+		ErrorLevelColor:       []string{"#ff5555"},
+		PanicLevelColor:       []string{"bg_#ff5555"},
+		FatalLevelColor:       []string{"bg_#ff5555", "#f8f8f2", "bold"},
+		UnknownLevelColor:     []string{"#ff79c6"},
+	},
+	"gruvbox": {
+		KeyColor:              []string{"#b8bb26"},
+		ValColor:              []string{"#ebdbb2"},
+		ValLightBgColor:       []string{"#3c3836"},
+		TimeLightBgColor:      []string{"#7c6f64"},
+		TimeDarkBgColor:       []string{"#a89984"},
+		MsgLightBgColor:       []string{"#3c3836"},
+		MsgAbsentLightBgColor: []string{"#928374"},
+		MsgDarkBgColor:        []string{"#fbf1c7"},
+		MsgAbsentDarkBgColor:  []string{"#928374"},
+		DebugLevelColor:       []string{"#d3869b"},
+		InfoLevelColor:        []string{"#83a598"},
+		WarnLevelColor:        []string{"#fabd2f"},
+		ErrorLevelColor:       []string{"#fb4934"},
+		PanicLevelColor:       []string{"bg_#cc241d"},
+		FatalLevelColor:       []string{"bg_#cc241d", "#fbf1c7", "bold"},
+		UnknownLevelColor:     []string{"#fe8019"},
+	},
+	"nord": {
+		KeyColor:              []string{"#a3be8c"},
+		ValColor:              []string{"#eceff4"},
+		ValLightBgColor:       []string{"#2e3440"},
+		TimeLightBgColor:      []string{"#4c566a"},
+		TimeDarkBgColor:       []string{"#d8dee9"},
+		MsgLightBgColor:       []string{"#2e3440"},
+		MsgAbsentLightBgColor: []string{"#4c566a"},
+		MsgDarkBgColor:        []string{"#eceff4"},
+		MsgAbsentDarkBgColor:  []string{"#4c566a"},
+		DebugLevelColor:       []string{"#b48ead"},
+		InfoLevelColor:        []string{"#88c0d0"},
+		WarnLevelColor:        []string{"#ebcb8b"},
+		ErrorLevelColor:       []string{"#bf616a"},
+		PanicLevelColor:       []string{"bg_#bf616a"},
+		FatalLevelColor:       []string{"bg_#bf616a", "#eceff4", "bold"},
+		UnknownLevelColor:     []string{"#d08770"},
+	},
+	"solarized": {
+		KeyColor:              []string{"#859900"},
+		ValColor:              []string{"#93a1a1"},
+		ValLightBgColor:       []string{"#073642"},
+		TimeLightBgColor:      []string{"#657b83"},
+		TimeDarkBgColor:       []string{"#839496"},
+		MsgLightBgColor:       []string{"#073642"},
+		MsgAbsentLightBgColor: []string{"#93a1a1"},
+		MsgDarkBgColor:        []string{"#eee8d5"},
+		MsgAbsentDarkBgColor:  []string{"#586e75"},
+		DebugLevelColor:       []string{"#6c71c4"},
+		InfoLevelColor:        []string{"#2aa198"},
+		WarnLevelColor:        []string{"#b58900"},
+		ErrorLevelColor:       []string{"#dc322f"},
+		PanicLevelColor:       []string{"bg_#dc322f"},
+		FatalLevelColor:       []string{"bg_#dc322f", "#fdf6e3", "bold"},
+		UnknownLevelColor:     []string{"#d33682"},
+	},
+	"monochrome": {
+		KeyColor:              []string{"faint"},
+		ValColor:              []string{},
+		TimeLightBgColor:      []string{"faint"},
+		TimeDarkBgColor:       []string{"faint"},
+		MsgLightBgColor:       []string{"bold"},
+		MsgAbsentLightBgColor: []string{"faint"},
+		MsgDarkBgColor:        []string{"bold"},
+		MsgAbsentDarkBgColor:  []string{"faint"},
+		DebugLevelColor:       []string{"faint"},
+		InfoLevelColor:        []string{},
+		WarnLevelColor:        []string{"underline"},
+		ErrorLevelColor:       []string{"bold"},
+		PanicLevelColor:       []string{"reverse"},
+		FatalLevelColor:       []string{"reverse", "bold"},
+		UnknownLevelColor:     []string{"italic"},
+	},
+}
+
+// ThemeNames lists the themes that can be given to `--theme`.
+func ThemeNames() []string {
+	names := make([]string, 0, len(Themes)+1)
+	names = append(names, "default")
+	for name := range Themes {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+func PaletteFromTheme(name string) (*Palette, error) {
+	if name == "" || name == "default" {
+		pl := DefaultPalette
+		return &pl, nil
+	}
+	theme, ok := Themes[name]
+	if !ok {
+		return nil, fmt.Errorf("no theme named %q, try one of %q", name, ThemeNames())
+	}
+	return PaletteFrom(theme)
+}
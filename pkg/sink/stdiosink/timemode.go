@@ -0,0 +1,79 @@
+package stdiosink
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// TimeMode decides what's printed in the timestamp column.
+type TimeMode int
+
+const (
+	// TimeModeAbsolute prints the event's time with `TimeFormat`.
+	TimeModeAbsolute TimeMode = iota
+	// TimeModeRelative prints the time elapsed since the first event.
+	TimeModeRelative
+	// TimeModeDelta prints the time elapsed since the previous event.
+	TimeModeDelta
+	// TimeModeAgo prints how long ago the event happened.
+	TimeModeAgo
+)
+
+// durations are padded so that the columns after them stay aligned
+const durationColumnWidth = 10
+
+func GrokTimeMode(mode string) (TimeMode, error) {
+	switch strings.ToLower(mode) {
+	case "absolute", "abs", "":
+		return TimeModeAbsolute, nil
+	case "relative", "rel":
+		return TimeModeRelative, nil
+	case "delta":
+		return TimeModeDelta, nil
+	case "ago":
+		return TimeModeAgo, nil
+	default:
+		return TimeModeAbsolute, fmt.Errorf("'%s' is not a time mode (try 'absolute', 'relative', 'delta' or 'ago')", mode)
+	}
+}
+
+// formatTime renders `ts` according to the time mode, and returns the
+// color to use if it should stand out, i.e. after a slow gap.
+func (std *Stdio) formatTime(ts time.Time) (string, *color.Color) {
+	defer func() { std.prevTs = ts }()
+	if std.firstTs.IsZero() {
+		std.firstTs = ts
+	}
+	switch std.opts.TimeMode {
+	case TimeModeRelative:
+		return padDuration("+" + roundDuration(ts.Sub(std.firstTs)).String()), nil
+	case TimeModeDelta:
+		var gap time.Duration
+		if !std.prevTs.IsZero() {
+			gap = ts.Sub(std.prevTs)
+		}
+		str := padDuration("+" + roundDuration(gap).String())
+		if std.opts.SlowGap > 0 && gap >= std.opts.SlowGap {
+			return str, std.opts.Palette.WarnLevelColor
+		}
+		return str, nil
+	case TimeModeAgo:
+		ago := std.timeNow().Sub(ts)
+		if ago >= time.Second {
+			ago = ago.Round(time.Second)
+		}
+		return padDuration(roundDuration(ago).String() + " ago"), nil
+	default:
+		if std.opts.TimeZone != nil {
+			ts = ts.In(std.opts.TimeZone)
+		}
+		return ts.Format(std.opts.TimeFormat), nil
+	}
+}
+
+func padDuration(s string) string {
+	return fmt.Sprintf("%*s", durationColumnWidth, s)
+}
@@ -0,0 +1,124 @@
+package stdiosink
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/x/term"
+	"github.com/mattn/go-runewidth"
+)
+
+// TruncateStrategy decides what happens to values that don't fit in the
+// room they've been given.
+type TruncateStrategy int
+
+const (
+	// TruncateEnd keeps the start of a value and cuts the rest.
+	TruncateEnd TruncateStrategy = iota
+	// TruncateMiddle keeps the start and the end of a value, which is
+	// usually what matters for long IDs and paths.
+	TruncateMiddle
+	// TruncateWrap never cuts values, instead it wraps the line to the
+	// terminal width with a hanging indent.
+	TruncateWrap
+)
+
+const ellipsis = "..."
+
+func GrokTruncateStrategy(strategy string) (TruncateStrategy, error) {
+	switch strings.ToLower(strategy) {
+	case "end", "":
+		return TruncateEnd, nil
+	case "middle":
+		return TruncateMiddle, nil
+	case "wrap":
+		return TruncateWrap, nil
+	default:
+		return TruncateEnd, fmt.Errorf("'%s' is not a truncate strategy (try 'end', 'middle' or 'wrap')", strategy)
+	}
+}
+
+// DetectTermWidth returns the width of the terminal behind `fd`, or 0 if
+// it isn't a terminal.
+func DetectTermWidth(fd uintptr) int {
+	if !term.IsTerminal(fd) {
+		return 0
+	}
+	width, _, err := term.GetSize(fd)
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+// truncate cuts `s` so that it spans at most `width` cells, not counting
+// the ellipsis that marks that it was cut.
+func truncate(s string, width int, strategy TruncateStrategy) string {
+	if width <= 0 || runewidth.StringWidth(s) <= width {
+		return s
+	}
+	switch strategy {
+	case TruncateMiddle:
+		tailWidth := width / 2
+		headWidth := width - tailWidth
+		head := runewidth.Truncate(s, headWidth, "")
+		tail := truncateLeft(s, tailWidth)
+		return head + ellipsis + tail
+	case TruncateWrap:
+		return s
+	default:
+		return runewidth.Truncate(s, width, "") + ellipsis
+	}
+}
+
+// truncateLeft keeps the last `width` cells of `s`.
+func truncateLeft(s string, width int) string {
+	runes := []rune(s)
+	w := 0
+	i := len(runes)
+	for i > 0 {
+		rw := runewidth.RuneWidth(runes[i-1])
+		if w+rw > width {
+			break
+		}
+		w += rw
+		i--
+	}
+	return string(runes[i:])
+}
+
+// budgetValueWidths splits the `available` cells of a line between KVs,
+// given the width of their keys and values. Pairs that fit are given the
+// room they need and the leftover is shared among the longer ones. The
+// returned widths are for the values only and are never less than `floor`.
+func budgetValueWidths(available int, keyWidths, valWidths []int, floor int) []int {
+	out := make([]int, len(valWidths))
+	idx := make([]int, len(valWidths))
+	for i := range idx {
+		idx[i] = i
+	}
+	need := func(i int) int {
+		// 'key=value '
+		return keyWidths[i] + 1 + valWidths[i] + 1
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return need(idx[a]) < need(idx[b]) })
+
+	remaining := available
+	for n, i := range idx {
+		share := remaining / (len(idx) - n)
+		allot := need(i)
+		if allot > share {
+			allot = share
+		}
+		if allot < 0 {
+			allot = 0
+		}
+		remaining -= allot
+		out[i] = allot - keyWidths[i] - 2
+		if out[i] < floor {
+			out[i] = floor
+		}
+	}
+	return out
+}
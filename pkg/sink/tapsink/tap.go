@@ -0,0 +1,55 @@
+// Package tapsink lets events be looked at on their way to a sink.
+package tapsink
+
+import (
+	"context"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/sink"
+)
+
+// Tap passes the events it receives to its observers, then on to the next
+// sink. It receives batches as well, whether the next sink does or not.
+type Tap struct {
+	next      sink.Sink
+	observers []func(ev *typesv1.LogEvent)
+}
+
+var (
+	_ sink.Sink      = (*Tap)(nil)
+	_ sink.BatchSink = (*Tap)(nil)
+)
+
+func NewTap(next sink.Sink, observers ...func(ev *typesv1.LogEvent)) *Tap {
+	return &Tap{next: next, observers: observers}
+}
+
+func (t *Tap) observe(ev *typesv1.LogEvent) {
+	for _, observe := range t.observers {
+		observe(ev)
+	}
+}
+
+func (t *Tap) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	t.observe(ev)
+	return t.next.Receive(ctx, ev)
+}
+
+func (t *Tap) ReceiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error {
+	for _, ev := range evs {
+		t.observe(ev)
+	}
+	if bsnk, ok := t.next.(sink.BatchSink); ok {
+		return bsnk.ReceiveBatch(ctx, evs)
+	}
+	for _, ev := range evs {
+		if err := t.next.Receive(ctx, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tap) Close(ctx context.Context) error {
+	return t.next.Close(ctx)
+}
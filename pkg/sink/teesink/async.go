@@ -0,0 +1,340 @@
+package teesink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/metrics"
+	"github.com/humanlogio/humanlog/pkg/sink"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	DefaultQueueSize = 10000
+	DefaultRetries   = 3
+
+	// maxBatch bounds how many queued events are passed at once to the
+	// sinks that receive batches.
+	maxBatch = 1000
+	// retryDelay is how long the first retry waits, the next ones wait
+	// longer.
+	retryDelay = 100 * time.Millisecond
+)
+
+// ErrClosed is returned for the events received after `Close`.
+var ErrClosed = errors.New("tee is closed")
+
+// Overflow is what a branch does with an event that doesn't fit in its
+// queue.
+type Overflow int
+
+const (
+	// OverflowBlock waits for the event to fit.
+	OverflowBlock Overflow = iota
+	// OverflowDropOldest drops the event that waited the longest.
+	OverflowDropOldest
+	// OverflowDropNewest drops the event.
+	OverflowDropNewest
+)
+
+// OnError is what a branch does when its sink fails to receive events.
+type OnError int
+
+const (
+	// ErrorFail has the tee fail, with the error, from then on.
+	ErrorFail OnError = iota
+	// ErrorDisable stops sending events to the sink.
+	ErrorDisable
+	// ErrorRetry sends the events again, up to `Policy.Retries` times,
+	// before dropping them.
+	ErrorRetry
+)
+
+// Policy is how a branch deals with a sink that's slow or failing.
+type Policy struct {
+	// QueueSize bounds how many events wait for the sink,
+	// `DefaultQueueSize` if zero.
+	QueueSize int
+	Overflow  Overflow
+	OnError   OnError
+	// Retries is how many times events are sent again with `ErrorRetry`,
+	// `DefaultRetries` if zero.
+	Retries int
+}
+
+// Branch is a sink of an async tee, `Name` identifies it in errors and
+// metrics.
+type Branch struct {
+	Name   string
+	Sink   sink.Sink
+	Policy Policy
+}
+
+type AsyncOpts struct {
+	// OnError is told about the errors of the sinks, and about the events
+	// they dropped because of them.
+	OnError func(branch string, err error)
+}
+
+// AsyncTee sends events to each of its sinks from a goroutine of their
+// own, through a bounded queue, so that a sink that's slow or failing
+// doesn't hold back the others.
+type AsyncTee struct {
+	opts     AsyncOpts
+	branches []*branch
+
+	failed    atomic.Pointer[error]
+	closeOnce sync.Once
+	closing   chan struct{}
+	// ctx is that of the sinks, it's canceled when closing is aborted
+	ctx   context.Context
+	abort context.CancelFunc
+}
+
+type branch struct {
+	Branch
+	stage    string
+	queue    chan *typesv1.LogEvent
+	disabled atomic.Bool
+	done     chan struct{}
+	// unsent is how many events were being sent when closing was aborted
+	unsent int
+}
+
+var (
+	_ sink.Sink      = (*AsyncTee)(nil)
+	_ sink.BatchSink = (*AsyncTee)(nil)
+)
+
+func NewAsyncTeeSink(opts AsyncOpts, branches ...Branch) *AsyncTee {
+	t := &AsyncTee{
+		opts:    opts,
+		closing: make(chan struct{}),
+	}
+	t.ctx, t.abort = context.WithCancel(context.Background())
+	for i, br := range branches {
+		if br.Name == "" {
+			br.Name = fmt.Sprint(i)
+		}
+		if br.Policy.QueueSize <= 0 {
+			br.Policy.QueueSize = DefaultQueueSize
+		}
+		if br.Policy.Retries <= 0 {
+			br.Policy.Retries = DefaultRetries
+		}
+		b := &branch{
+			Branch: br,
+			stage:  "queue:" + br.Name,
+			queue:  make(chan *typesv1.LogEvent, br.Policy.QueueSize),
+			done:   make(chan struct{}),
+		}
+		t.branches = append(t.branches, b)
+		go t.run(b)
+	}
+	return t
+}
+
+func (t *AsyncTee) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	if err := t.failed.Load(); err != nil {
+		return *err
+	}
+	for _, b := range t.branches {
+		if err := t.enqueue(ctx, b, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *AsyncTee) ReceiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error {
+	for _, ev := range evs {
+		if err := t.Receive(ctx, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *AsyncTee) enqueue(ctx context.Context, b *branch, ev *typesv1.LogEvent) error {
+	metrics.Received.Inc(b.stage)
+	if b.disabled.Load() {
+		metrics.Dropped.Inc(b.stage)
+		return nil
+	}
+	// each sink gets its own copy, since the sinks can change them
+	cev := proto.Clone(ev).(*typesv1.LogEvent)
+	defer func() { metrics.QueueDepth.Set(float64(len(b.queue)), b.stage) }()
+	select {
+	case <-t.closing:
+		return ErrClosed
+	default:
+	}
+	switch b.Policy.Overflow {
+	case OverflowDropNewest:
+		select {
+		case b.queue <- cev:
+		default:
+			metrics.Dropped.Inc(b.stage)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case b.queue <- cev:
+				return nil
+			default:
+			}
+			select {
+			case <-b.queue:
+				metrics.Dropped.Inc(b.stage)
+			default:
+			}
+		}
+	default:
+		select {
+		case b.queue <- cev:
+		case <-t.closing:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// run sends the events of the queue of the branch to its sink, until the
+// tee is closed and the queue is drained, or until closing is aborted.
+func (t *AsyncTee) run(b *branch) {
+	defer close(b.done)
+	batch := make([]*typesv1.LogEvent, 0, maxBatch)
+	for {
+		select {
+		case ev := <-b.queue:
+			batch = append(batch[:0], ev)
+		case <-t.closing:
+			select {
+			case ev := <-b.queue:
+				batch = append(batch[:0], ev)
+			default:
+				return
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	drain:
+		for len(batch) < maxBatch {
+			select {
+			case ev := <-b.queue:
+				batch = append(batch, ev)
+			default:
+				break drain
+			}
+		}
+		metrics.QueueDepth.Set(float64(len(b.queue)), b.stage)
+		t.deliver(b, batch)
+		if t.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (t *AsyncTee) deliver(b *branch, evs []*typesv1.LogEvent) {
+	if b.disabled.Load() {
+		metrics.Dropped.Add(float64(len(evs)), b.stage)
+		return
+	}
+	metrics.BatchSize.Observe(float64(len(evs)), b.stage)
+	for attempt := 0; ; attempt++ {
+		err := send(t.ctx, b.Sink, evs)
+		// only what wasn't received is sent again
+		sent := sink.Received(len(evs), err)
+		metrics.Sent.Add(float64(sent), b.stage)
+		evs = evs[sent:]
+		if err == nil {
+			return
+		}
+		if t.ctx.Err() != nil {
+			// closing was aborted, which isn't the sink's fault
+			b.unsent = len(evs)
+			return
+		}
+		if b.Policy.OnError == ErrorRetry && attempt < b.Policy.Retries {
+			metrics.Retried.Inc(b.stage)
+			select {
+			case <-time.After(retryDelay << attempt):
+				continue
+			case <-t.ctx.Done():
+			}
+		}
+		metrics.Dropped.Add(float64(len(evs)), b.stage)
+		err = fmt.Errorf("tee sink %s: %w", b.Name, err)
+		switch b.Policy.OnError {
+		case ErrorDisable:
+			b.disabled.Store(true)
+			err = fmt.Errorf("%w, no longer sending it events", err)
+		case ErrorFail:
+			t.failed.CompareAndSwap(nil, &err)
+		default:
+			err = fmt.Errorf("%w, dropped %d events", err, len(evs))
+		}
+		if t.opts.OnError != nil {
+			t.opts.OnError(b.Name, err)
+		}
+		return
+	}
+}
+
+func send(ctx context.Context, snk sink.Sink, evs []*typesv1.LogEvent) error {
+	if bsnk, ok := snk.(sink.BatchSink); ok {
+		return bsnk.ReceiveBatch(ctx, evs)
+	}
+	for i, ev := range evs {
+		if err := snk.Receive(ctx, ev); err != nil {
+			if i == 0 {
+				return err
+			}
+			return &sink.PartialError{Received: i, Err: err}
+		}
+	}
+	return nil
+}
+
+// Close waits for the queued events to be sent, or for `ctx` to be done,
+// then closes all the sinks. The errors of all the sinks are returned.
+func (t *AsyncTee) Close(ctx context.Context) error {
+	var errs []error
+	t.closeOnce.Do(func() {
+		defer t.abort()
+		close(t.closing)
+	waiting:
+		for _, b := range t.branches {
+			select {
+			case <-b.done:
+			case <-ctx.Done():
+				t.abort()
+				break waiting
+			}
+		}
+		// sinks can't be closed while they're being sent events
+		for _, b := range t.branches {
+			<-b.done
+		}
+		if err := t.failed.Load(); err != nil {
+			errs = append(errs, *err)
+		}
+		for _, b := range t.branches {
+			if left := len(b.queue) + b.unsent; left > 0 {
+				metrics.Dropped.Add(float64(left), b.stage)
+				errs = append(errs, fmt.Errorf("tee sink %s: %d events weren't sent: %w", b.Name, left, ctx.Err()))
+			}
+			if err := b.Sink.Close(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("tee sink %s: %w", b.Name, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
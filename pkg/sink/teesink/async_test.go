@@ -0,0 +1,150 @@
+package teesink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type recordSink struct {
+	mu       sync.Mutex
+	got      []string
+	block    chan struct{}
+	failures int
+	closeErr error
+}
+
+func (r *recordSink) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	if r.block != nil {
+		select {
+		case <-r.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("unreachable")
+	}
+	r.got = append(r.got, string(ev.Raw))
+	return nil
+}
+
+func (r *recordSink) Close(ctx context.Context) error { return r.closeErr }
+
+func (r *recordSink) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.got...)
+}
+
+func event(raw string) *typesv1.LogEvent {
+	return &typesv1.LogEvent{Raw: []byte(raw)}
+}
+
+func receive(t *testing.T, tee *AsyncTee, raws ...string) {
+	t.Helper()
+	for _, raw := range raws {
+		require.NoError(t, tee.Receive(context.Background(), event(raw)))
+	}
+}
+
+func TestAsyncTeeIsolatesSlowSinks(t *testing.T) {
+	fast := &recordSink{}
+	slow := &recordSink{block: make(chan struct{})}
+	tee := NewAsyncTeeSink(AsyncOpts{},
+		Branch{Name: "fast", Sink: fast},
+		Branch{Name: "slow", Sink: slow, Policy: Policy{QueueSize: 2, Overflow: OverflowDropOldest}},
+	)
+	receive(t, tee, "1", "2", "3", "4", "5")
+	require.Eventually(t, func() bool { return len(fast.received()) == 5 }, time.Second, time.Millisecond)
+	require.Empty(t, slow.received())
+
+	close(slow.block)
+	require.NoError(t, tee.Close(context.Background()))
+	require.Equal(t, []string{"1", "2", "3", "4", "5"}, fast.received())
+	got := slow.received()
+	require.Equal(t, []string{"4", "5"}, got[len(got)-2:], "the most recent events are kept")
+	require.Less(t, len(got), 5)
+}
+
+func TestAsyncTeeDropNewest(t *testing.T) {
+	slow := &recordSink{block: make(chan struct{})}
+	tee := NewAsyncTeeSink(AsyncOpts{}, Branch{Sink: slow, Policy: Policy{QueueSize: 2, Overflow: OverflowDropNewest}})
+	receive(t, tee, "1")
+	// wait for the first one to be taken out of the queue
+	require.Eventually(t, func() bool { return len(tee.branches[0].queue) == 0 }, time.Second, time.Millisecond)
+	receive(t, tee, "2", "3", "4")
+	close(slow.block)
+	require.NoError(t, tee.Close(context.Background()))
+	require.Equal(t, []string{"1", "2", "3"}, slow.received())
+}
+
+func TestAsyncTeeBlock(t *testing.T) {
+	slow := &recordSink{block: make(chan struct{})}
+	tee := NewAsyncTeeSink(AsyncOpts{}, Branch{Sink: slow, Policy: Policy{QueueSize: 1}})
+	receive(t, tee, "1")
+	require.Eventually(t, func() bool { return len(tee.branches[0].queue) == 0 }, time.Second, time.Millisecond)
+	receive(t, tee, "2")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, tee.Receive(ctx, event("3")), context.DeadlineExceeded)
+	close(slow.block)
+	require.NoError(t, tee.Close(context.Background()))
+	require.Equal(t, []string{"1", "2"}, slow.received())
+}
+
+func TestAsyncTeeErrors(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		reported []string
+	)
+	opts := AsyncOpts{OnError: func(branch string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, err.Error())
+	}}
+
+	retried := &recordSink{failures: 2}
+	disabled := &recordSink{failures: 1}
+	tee := NewAsyncTeeSink(opts,
+		Branch{Name: "retried", Sink: retried, Policy: Policy{OnError: ErrorRetry}},
+		Branch{Name: "disabled", Sink: disabled, Policy: Policy{OnError: ErrorDisable}},
+	)
+	receive(t, tee, "1")
+	require.Eventually(t, func() bool { return len(retried.received()) == 1 }, time.Second, time.Millisecond)
+	receive(t, tee, "2")
+	require.NoError(t, tee.Close(context.Background()))
+	require.Equal(t, []string{"1", "2"}, retried.received())
+	require.Empty(t, disabled.received())
+	require.Equal(t, []string{"tee sink disabled: unreachable, no longer sending it events"}, reported)
+
+	failing := &recordSink{failures: 1, closeErr: errors.New("can't flush")}
+	other := &recordSink{closeErr: errors.New("can't flush either")}
+	tee = NewAsyncTeeSink(AsyncOpts{}, Branch{Name: "failing", Sink: failing}, Branch{Name: "other", Sink: other})
+	receive(t, tee, "1")
+	require.Eventually(t, func() bool { return tee.failed.Load() != nil }, time.Second, time.Millisecond)
+	require.EqualError(t, tee.Receive(context.Background(), event("2")), "tee sink failing: unreachable")
+	err := tee.Close(context.Background())
+	require.EqualError(t, err, "tee sink failing: unreachable\ntee sink failing: can't flush\ntee sink other: can't flush either")
+	require.EqualError(t, tee.Receive(context.Background(), event("3")), "tee sink failing: unreachable")
+}
+
+func TestAsyncTeeCloseGivesUp(t *testing.T) {
+	stuck := &recordSink{block: make(chan struct{})}
+	tee := NewAsyncTeeSink(AsyncOpts{}, Branch{Name: "stuck", Sink: stuck, Policy: Policy{OnError: ErrorDisable}})
+	receive(t, tee, "1", "2", "3")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := tee.Close(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Contains(t, err.Error(), "tee sink stuck: 3 events weren't sent")
+	require.ErrorIs(t, tee.Receive(context.Background(), event("4")), ErrClosed)
+}
@@ -2,15 +2,41 @@ package teesink
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/metrics"
 	"github.com/humanlogio/humanlog/pkg/sink"
 )
 
 var _ sink.Sink = (*Tee)(nil)
 
+const stage = "tee"
+
+// observe accounts for `n` events received by the tee of the stage, and
+// whether they were passed on to all its sinks.
+func observe(stage string, n int, err error) error {
+	metrics.Received.Add(float64(n), stage)
+	if err != nil {
+		metrics.Dropped.Add(float64(n), stage)
+	} else {
+		metrics.Sent.Add(float64(n), stage)
+	}
+	return err
+}
+
 func NewTeeSink(sinks ...sink.Sink) sink.Sink {
+	return NewNamedTeeSink("", sinks...)
+}
+
+// NewNamedTeeSink returns a tee whose metrics are those of the stage
+// "tee:<name>", so that they can be told apart from those of other tees.
+func NewNamedTeeSink(name string, sinks ...sink.Sink) sink.Sink {
+	stage := stage
+	if name != "" {
+		stage += ":" + name
+	}
 	var (
 		nonbatchers []sink.Sink
 		batchers    []sink.BatchSink
@@ -23,19 +49,24 @@ func NewTeeSink(sinks ...sink.Sink) sink.Sink {
 		}
 	}
 	if len(batchers) != 0 && len(nonbatchers) != 0 {
-		return &MixedBatchingTee{nonbatchers: nonbatchers, batchers: batchers}
+		return &MixedBatchingTee{stage: stage, nonbatchers: nonbatchers, batchers: batchers}
 	}
 	if len(batchers) != 0 {
-		return &BatchingTee{batchers: batchers}
+		return &BatchingTee{stage: stage, batchers: batchers}
 	}
-	return &Tee{sinks: sinks}
+	return &Tee{stage: stage, sinks: sinks}
 }
 
 type Tee struct {
+	stage string
 	sinks []sink.Sink
 }
 
 func (sn *Tee) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	return observe(sn.stage, 1, sn.receive(ctx, ev))
+}
+
+func (sn *Tee) receive(ctx context.Context, ev *typesv1.LogEvent) error {
 	for i, sinks := range sn.sinks {
 		if err := sinks.Receive(ctx, ev); err != nil {
 			return fmt.Errorf("tee sink %d: %w", i, err)
@@ -45,20 +76,26 @@ func (sn *Tee) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
 }
 
 func (sn *Tee) Close(ctx context.Context) error {
+	var errs []error
 	for i, sinks := range sn.sinks {
 		if err := sinks.Close(ctx); err != nil {
-			return fmt.Errorf("tee sink %d: %w", i, err)
+			errs = append(errs, fmt.Errorf("tee sink %d: %w", i, err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 type MixedBatchingTee struct {
+	stage       string
 	nonbatchers []sink.Sink
 	batchers    []sink.BatchSink
 }
 
 func (sn *MixedBatchingTee) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	return observe(sn.stage, 1, sn.receive(ctx, ev))
+}
+
+func (sn *MixedBatchingTee) receive(ctx context.Context, ev *typesv1.LogEvent) error {
 	for i, sinks := range sn.nonbatchers {
 		if err := sinks.Receive(ctx, ev); err != nil {
 			return fmt.Errorf("tee sink %d: %w", i, err)
@@ -73,6 +110,10 @@ func (sn *MixedBatchingTee) Receive(ctx context.Context, ev *typesv1.LogEvent) e
 }
 
 func (sn *MixedBatchingTee) ReceiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error {
+	return observe(sn.stage, len(evs), sn.receiveBatch(ctx, evs))
+}
+
+func (sn *MixedBatchingTee) receiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error {
 	for i, sinks := range sn.nonbatchers {
 		for _, ev := range evs {
 			if err := sinks.Receive(ctx, ev); err != nil {
@@ -89,24 +130,30 @@ func (sn *MixedBatchingTee) ReceiveBatch(ctx context.Context, evs []*typesv1.Log
 }
 
 func (sn *MixedBatchingTee) Close(ctx context.Context) error {
+	var errs []error
 	for i, sinks := range sn.nonbatchers {
 		if err := sinks.Close(ctx); err != nil {
-			return fmt.Errorf("tee sink %d: %w", i, err)
+			errs = append(errs, fmt.Errorf("tee sink %d: %w", i, err))
 		}
 	}
 	for i, sinks := range sn.batchers {
 		if err := sinks.Close(ctx); err != nil {
-			return fmt.Errorf("tee sink %d: %w", i, err)
+			errs = append(errs, fmt.Errorf("tee sink %d: %w", i, err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 type BatchingTee struct {
+	stage    string
 	batchers []sink.BatchSink
 }
 
 func (sn *BatchingTee) Receive(ctx context.Context, ev *typesv1.LogEvent) error {
+	return observe(sn.stage, 1, sn.receive(ctx, ev))
+}
+
+func (sn *BatchingTee) receive(ctx context.Context, ev *typesv1.LogEvent) error {
 	for i, sinks := range sn.batchers {
 		if err := sinks.ReceiveBatch(ctx, []*typesv1.LogEvent{ev}); err != nil {
 			return fmt.Errorf("tee sink %d: %w", i, err)
@@ -116,6 +163,10 @@ func (sn *BatchingTee) Receive(ctx context.Context, ev *typesv1.LogEvent) error
 }
 
 func (sn *BatchingTee) ReceiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error {
+	return observe(sn.stage, len(evs), sn.receiveBatch(ctx, evs))
+}
+
+func (sn *BatchingTee) receiveBatch(ctx context.Context, evs []*typesv1.LogEvent) error {
 	for i, sinks := range sn.batchers {
 		if err := sinks.ReceiveBatch(ctx, evs); err != nil {
 			return fmt.Errorf("tee sink %d: %w", i, err)
@@ -125,10 +176,11 @@ func (sn *BatchingTee) ReceiveBatch(ctx context.Context, evs []*typesv1.LogEvent
 }
 
 func (sn *BatchingTee) Close(ctx context.Context) error {
+	var errs []error
 	for i, sinks := range sn.batchers {
 		if err := sinks.Close(ctx); err != nil {
-			return fmt.Errorf("tee sink %d: %w", i, err)
+			errs = append(errs, fmt.Errorf("tee sink %d: %w", i, err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
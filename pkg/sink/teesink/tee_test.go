@@ -0,0 +1,29 @@
+package teesink
+
+import (
+	"context"
+	"testing"
+
+	"github.com/humanlogio/humanlog/pkg/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamedTeesAreCountedApart(t *testing.T) {
+	received := func(stage string) float64 {
+		for _, s := range metrics.Pipeline.Snapshot() {
+			if s.Name == "humanlog_events_received_total" && s.Labels["stage"] == stage {
+				return s.Value
+			}
+		}
+		return 0
+	}
+	outer, inner := received("tee:outer"), received("tee:inner")
+
+	ctx := context.Background()
+	tee := NewNamedTeeSink("outer", NewNamedTeeSink("inner", &recordSink{}, &recordSink{}), &recordSink{})
+	require.NoError(t, tee.Receive(ctx, event("1")))
+	require.NoError(t, tee.Receive(ctx, event("2")))
+
+	require.Equal(t, float64(2), received("tee:outer")-outer)
+	require.Equal(t, float64(2), received("tee:inner")-inner)
+}
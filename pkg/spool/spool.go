@@ -0,0 +1,489 @@
+// Package spool keeps events on disk until they're acknowledged, so that
+// they survive the sink they're sent to being unreachable, and the process
+// exiting before they could be sent.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/pkg/metrics"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	DefaultMaxBytes = 256 << 20
+	DefaultMaxAge   = 72 * time.Hour
+
+	// MaxLanes bounds how many processes can spool under the same dir at
+	// once, see `OpenLane`.
+	MaxLanes = 16
+
+	defaultSegmentBytes = 8 << 20
+	maxRecordBytes      = 64 << 20
+	segmentExt          = ".spool"
+	ackedFile           = "acked"
+	lockFile            = "lock"
+	stage               = "spool"
+
+	// a record is its seq, the session it was appended in, the unix
+	// nanoseconds at which it was appended, the length and the CRC-32 of its
+	// payload, then the payload: an event
+	headerBytes = 8 + 8 + 8 + 4 + 4
+)
+
+var (
+	ErrLocked = errors.New("spool is in use by another process")
+	ErrClosed = errors.New("spool is closed")
+)
+
+// Opts bound a spool. Once it holds more than `MaxBytes`, or events older
+// than `MaxAge`, the oldest events are dropped, whether they were
+// acknowledged or not. Zero values stand for the defaults.
+type Opts struct {
+	MaxBytes int64
+	MaxAge   time.Duration
+	// SegmentBytes is the size of the files events are written to, which
+	// are dropped as a whole.
+	SegmentBytes int64
+}
+
+// Record is an event along with its seq, which identifies it within the
+// spool, and the session it was appended in. Seqs only go up, across runs.
+type Record struct {
+	Seq     uint64
+	Session uint64
+	Event   *typesv1.LogEvent
+}
+
+type segment struct {
+	path        string
+	first, last uint64
+	lastAt      time.Time
+	size        int64
+}
+
+// Spool is a write-ahead log of events. Events are appended as they're
+// received, read in order from the last one that was acknowledged, and
+// removed once acknowledged. What is acknowledged is kept on disk, so that
+// events that were sent aren't sent again on the next run.
+type Spool struct {
+	dir     string
+	opts    Opts
+	lockf   *os.File
+	timeNow func() time.Time
+
+	mu       sync.Mutex
+	closed   bool
+	segments []*segment
+	w        *os.File
+	next     uint64
+	acked    uint64
+
+	// the reader is kept where it stopped, so that reading the events in
+	// order doesn't scan the segment from its start every time
+	r      *os.File
+	rseg   *segment
+	roff   int64
+	rafter uint64
+}
+
+// OpenLane opens the first spool under `dir` that isn't in use by another
+// process. Events spooled by a process that exited are sent by the next
+// one to open its lane.
+func OpenLane(dir string, opts Opts) (*Spool, error) {
+	for lane := 0; lane < MaxLanes; lane++ {
+		s, err := Open(filepath.Join(dir, strconv.Itoa(lane)), opts)
+		if errors.Is(err, ErrLocked) {
+			continue
+		}
+		return s, err
+	}
+	return nil, fmt.Errorf("all the %d spools under %q are in use", MaxLanes, dir)
+}
+
+// Open opens the spool in `dir`, creating it if needed. It fails with
+// `ErrLocked` if another process has it open.
+func Open(dir string, opts Opts) (*Spool, error) {
+	return open(dir, opts, time.Now)
+}
+
+func open(dir string, opts Opts, timeNow func() time.Time) (*Spool, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = DefaultMaxAge
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = min(defaultSegmentBytes, max(opts.MaxBytes/4, 1))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating spool dir: %v", err)
+	}
+	lockf, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening spool lock: %v", err)
+	}
+	if err := lock(lockf); err != nil {
+		_ = lockf.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("locking spool: %v", err)
+	}
+	s := &Spool{dir: dir, opts: opts, lockf: lockf, timeNow: timeNow}
+	if err := s.load(); err != nil {
+		_ = lockf.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) load() error {
+	acked, err := os.ReadFile(filepath.Join(s.dir, ackedFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("reading spool acknowledgement: %v", err)
+	default:
+		if s.acked, err = strconv.ParseUint(strings.TrimSpace(string(acked)), 10, 64); err != nil {
+			return fmt.Errorf("invalid spool acknowledgement: %v", err)
+		}
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	// the names are the zero-padded seq of their first record
+	sort.Strings(paths)
+	var last uint64
+	for _, path := range paths {
+		seg, err := loadSegment(path)
+		if err != nil {
+			return err
+		}
+		if seg.size == 0 || seg.first <= last {
+			// empty, or overlapping the previous one
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("removing spool segment: %v", err)
+			}
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		last = seg.last
+	}
+	s.next = max(last, s.acked) + 1
+	s.prune()
+	return nil
+}
+
+// loadSegment reads the records of a segment, and truncates it after the
+// last valid one, i.e. if the process exited while appending it.
+func loadSegment(path string) (*segment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening spool segment: %v", err)
+	}
+	defer f.Close()
+	seg := &segment{path: path}
+	br := bufio.NewReader(f)
+	for {
+		h, n, err := readRecord(br, nil)
+		if err != nil {
+			break
+		}
+		if seg.first == 0 {
+			seg.first = h.seq
+		} else if h.seq != seg.last+1 {
+			break
+		}
+		seg.last, seg.lastAt = h.seq, h.at
+		seg.size += int64(n)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != seg.size {
+		if err := f.Truncate(seg.size); err != nil {
+			return nil, fmt.Errorf("truncating spool segment: %v", err)
+		}
+	}
+	return seg, nil
+}
+
+type header struct {
+	seq, session uint64
+	at           time.Time
+}
+
+// readRecord reads a record, unmarshaling its event into `ev` unless it's
+// nil. It returns the number of bytes it read.
+func readRecord(r io.Reader, ev *typesv1.LogEvent) (h header, n int, err error) {
+	var buf [headerBytes]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return h, 0, err
+	}
+	h.seq = binary.BigEndian.Uint64(buf[0:])
+	h.session = binary.BigEndian.Uint64(buf[8:])
+	h.at = time.Unix(0, int64(binary.BigEndian.Uint64(buf[16:])))
+	size := binary.BigEndian.Uint32(buf[24:])
+	sum := binary.BigEndian.Uint32(buf[28:])
+	if size > maxRecordBytes {
+		return h, 0, fmt.Errorf("record of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return h, 0, fmt.Errorf("record %d is corrupted", h.seq)
+	}
+	if ev != nil {
+		if err := proto.Unmarshal(payload, ev); err != nil {
+			return h, 0, fmt.Errorf("record %d: %v", h.seq, err)
+		}
+	}
+	return h, headerBytes + int(size), nil
+}
+
+// Append writes the event to the spool, along with the session it's sent
+// in, and returns its seq.
+func (s *Spool) Append(session uint64, ev *typesv1.LogEvent) (uint64, error) {
+	payload, err := proto.Marshal(ev)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) > maxRecordBytes {
+		return 0, fmt.Errorf("event of %d bytes is too large", len(payload))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	now := s.timeNow()
+	if s.w == nil || s.active().size >= s.opts.SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	seq := s.next
+	record := make([]byte, headerBytes+len(payload))
+	binary.BigEndian.PutUint64(record[0:], seq)
+	binary.BigEndian.PutUint64(record[8:], session)
+	binary.BigEndian.PutUint64(record[16:], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint32(record[24:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[28:], crc32.ChecksumIEEE(payload))
+	copy(record[headerBytes:], payload)
+	if _, err := s.w.Write(record); err != nil {
+		// what was written is truncated when the segment is loaded again
+		_ = s.w.Close()
+		s.w = nil
+		return 0, fmt.Errorf("writing to spool: %v", err)
+	}
+	seg := s.active()
+	seg.last, seg.lastAt = seq, now
+	seg.size += int64(len(record))
+	s.next++
+	s.prune()
+	return seq, nil
+}
+
+// active is the segment being appended to, when `w` isn't nil.
+func (s *Spool) active() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) rotate() error {
+	if s.w != nil {
+		if err := s.w.Close(); err != nil {
+			return fmt.Errorf("closing spool segment: %v", err)
+		}
+		s.w = nil
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.next, segmentExt))
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("creating spool segment: %v", err)
+	}
+	s.w = w
+	s.segments = append(s.segments, &segment{path: path, first: s.next, last: s.next - 1, lastAt: s.timeNow()})
+	return nil
+}
+
+// prune removes the oldest segments once they're acknowledged, or once the
+// spool is over its bounds.
+func (s *Spool) prune() {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	now := s.timeNow()
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.w != nil && seg == s.active() {
+			return
+		}
+		acked := seg.last <= s.acked
+		if !acked && size <= s.opts.MaxBytes && now.Sub(seg.lastAt) <= s.opts.MaxAge {
+			return
+		}
+		if !acked {
+			metrics.Dropped.Add(float64(seg.last-max(seg.first-1, s.acked)), stage)
+		}
+		if seg == s.rseg {
+			s.resetReader()
+		}
+		_ = os.Remove(seg.path)
+		size -= seg.size
+		s.segments = s.segments[1:]
+	}
+}
+
+// Read returns up to `limit` records that follow the seq `after`, in order.
+func (s *Spool) Read(after uint64, limit int) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	var records []Record
+	for _, seg := range s.segments {
+		if len(records) >= limit {
+			break
+		}
+		if seg.last <= after {
+			continue
+		}
+		if s.rseg != seg || s.rafter != after {
+			s.resetReader()
+			r, err := os.Open(seg.path)
+			if err != nil {
+				return records, fmt.Errorf("opening spool segment: %v", err)
+			}
+			s.r, s.rseg = r, seg
+		}
+		// only what's known to be written is read, the segment could be
+		// appended to meanwhile
+		br := bufio.NewReader(io.NewSectionReader(s.r, s.roff, seg.size-s.roff))
+		for len(records) < limit && after < seg.last {
+			ev := new(typesv1.LogEvent)
+			h, n, err := readRecord(br, ev)
+			if err != nil {
+				s.resetReader()
+				return records, fmt.Errorf("reading spool segment: %v", err)
+			}
+			s.roff += int64(n)
+			if h.seq <= after {
+				continue
+			}
+			records = append(records, Record{Seq: h.seq, Session: h.session, Event: ev})
+			after = h.seq
+		}
+		s.rafter = after
+	}
+	return records, nil
+}
+
+func (s *Spool) resetReader() {
+	if s.r != nil {
+		_ = s.r.Close()
+	}
+	s.r, s.rseg, s.roff, s.rafter = nil, nil, 0, 0
+}
+
+// Ack acknowledges the records up to `seq`, which won't be read again.
+func (s *Spool) Ack(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if seq <= s.acked {
+		return nil
+	}
+	s.acked = seq
+	path := filepath.Join(s.dir, ackedFile)
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatUint(seq, 10)), 0600); err != nil {
+		return fmt.Errorf("writing spool acknowledgement: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("writing spool acknowledgement: %v", err)
+	}
+	s.prune()
+	return nil
+}
+
+// Acked is the seq of the last record that was acknowledged.
+func (s *Spool) Acked() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+// Pending is how many records are waiting to be acknowledged.
+func (s *Spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := 0
+	for _, seg := range s.segments {
+		if seg.last > s.acked {
+			pending += int(seg.last - max(seg.first-1, s.acked))
+		}
+	}
+	return pending
+}
+
+// Close syncs the spool to disk and releases it.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.resetReader()
+	var err error
+	if s.w != nil {
+		err = errors.Join(s.w.Sync(), s.w.Close())
+	}
+	return errors.Join(err, s.lockf.Close())
+}
+
+// OptsFrom reads the options of the config, `ok` is false unless the
+// spool is enabled.
+func OptsFrom(cfg *config.Spool) (opts Opts, ok bool, err error) {
+	if cfg == nil || cfg.Enabled == nil || !*cfg.Enabled {
+		return opts, false, nil
+	}
+	if cfg.MaxBytes != nil {
+		if *cfg.MaxBytes <= 0 {
+			return opts, false, fmt.Errorf("max-bytes must be positive, not %d", *cfg.MaxBytes)
+		}
+		opts.MaxBytes = *cfg.MaxBytes
+	}
+	if cfg.MaxAge != nil && *cfg.MaxAge != "" {
+		if opts.MaxAge, err = time.ParseDuration(*cfg.MaxAge); err != nil {
+			return opts, false, fmt.Errorf("invalid max-age: %v", err)
+		}
+		if opts.MaxAge <= 0 {
+			return opts, false, fmt.Errorf("max-age must be positive, not %v", opts.MaxAge)
+		}
+	}
+	return opts, true, nil
+}
@@ -0,0 +1,143 @@
+package spool
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func event(msg string) *typesv1.LogEvent {
+	return &typesv1.LogEvent{Raw: []byte(msg), Structured: &typesv1.StructuredLogEvent{Msg: msg}}
+}
+
+func appendN(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		_, err := s.Append(1, event(strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+}
+
+func msgs(records []Record) []string {
+	var out []string
+	for _, rec := range records {
+		out = append(out, rec.Event.GetStructured().GetMsg())
+	}
+	return out
+}
+
+func TestSpoolReplaysWhatWasntAcked(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, Opts{SegmentBytes: 64})
+	require.NoError(t, err)
+	appendN(t, s, 1, 5)
+
+	records, err := s.Read(0, 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2", "3"}, msgs(records))
+	require.Equal(t, []uint64{1, 2, 3}, []uint64{records[0].Seq, records[1].Seq, records[2].Seq})
+
+	// events appended while reading are read in order
+	appendN(t, s, 6, 6)
+	records, err = s.Read(3, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"4", "5", "6"}, msgs(records))
+
+	require.NoError(t, s.Ack(4))
+	require.Equal(t, 2, s.Pending())
+
+	// reconnecting replays from what was acknowledged
+	records, err = s.Read(s.Acked(), 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"5", "6"}, msgs(records))
+	require.NoError(t, s.Close())
+
+	// and so does the next run, whose events follow
+	s, err = Open(dir, Opts{SegmentBytes: 64})
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(4), s.Acked())
+	seq, err := s.Append(2, event("7"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), seq)
+	records, err = s.Read(s.Acked(), 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"5", "6", "7"}, msgs(records))
+	require.Equal(t, []uint64{1, 1, 2}, []uint64{records[0].Session, records[1].Session, records[2].Session}, "records keep the session they were sent in")
+
+	require.NoError(t, s.Ack(7))
+	require.Equal(t, 0, s.Pending())
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	require.NoError(t, err)
+	require.Len(t, segments, 1, "only the segment being appended to is kept once acknowledged")
+}
+
+func TestSpoolTruncatesTornRecords(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, Opts{})
+	require.NoError(t, err)
+	appendN(t, s, 1, 3)
+	require.NoError(t, s.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	fi, err := os.Stat(segments[0])
+	require.NoError(t, err)
+	// the process exited in the middle of appending the 3rd event
+	require.NoError(t, os.Truncate(segments[0], fi.Size()-3))
+
+	s, err = Open(dir, Opts{})
+	require.NoError(t, err)
+	defer s.Close()
+	records, err := s.Read(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2"}, msgs(records))
+	seq, err := s.Append(1, event("3 again"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), seq)
+}
+
+func TestSpoolBounds(t *testing.T) {
+	now := time.Date(2024, 12, 13, 19, 30, 0, 0, time.UTC)
+	timeNow := func() time.Time { return now }
+
+	s, err := open(t.TempDir(), Opts{MaxBytes: 200, MaxAge: time.Hour, SegmentBytes: 60}, timeNow)
+	require.NoError(t, err)
+	defer s.Close()
+	appendN(t, s, 1, 12)
+	records, err := s.Read(0, 100)
+	require.NoError(t, err)
+	require.Less(t, len(records), 12, "the oldest events are dropped past max bytes")
+	require.Equal(t, "12", msgs(records)[len(records)-1])
+
+	now = now.Add(2 * time.Hour)
+	appendN(t, s, 13, 14)
+	records, err = s.Read(0, 100)
+	require.NoError(t, err)
+	require.Equal(t, []string{"13", "14"}, msgs(records), "events older than max age are dropped")
+}
+
+func TestOpenLane(t *testing.T) {
+	dir := t.TempDir()
+	first, err := OpenLane(dir, Opts{})
+	require.NoError(t, err)
+	_, err = Open(filepath.Join(dir, "0"), Opts{})
+	require.ErrorIs(t, err, ErrLocked)
+
+	second, err := OpenLane(dir, Opts{})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "1"), second.dir)
+	require.NoError(t, second.Close())
+
+	require.NoError(t, first.Close())
+	again, err := OpenLane(dir, Opts{})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "0"), again.dir)
+	require.NoError(t, again.Close())
+}
@@ -0,0 +1,162 @@
+// Package valueparse derives structured fields from values that pack a lot
+// in a string, like user agents, URLs and IP addresses. It works offline,
+// without any database to download.
+package valueparse
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+)
+
+// Types are the kinds of values that can be parsed.
+var Types = []string{"user-agent", "url", "ip"}
+
+// Parser derives fields from a value. The keys of the fields are relative
+// to the key of the value. `ok` is false when the value isn't of the kind
+// the parser expects.
+type Parser func(s string) (fields []*typesv1.KV, ok bool)
+
+// New returns the parser of values of type `typ`. `ranges` are named lists
+// of CIDRs that IP addresses are matched against, they're only used by the
+// "ip" parser.
+func New(typ string, ranges map[string][]string) (Parser, error) {
+	if len(ranges) > 0 && typ != "ip" {
+		return nil, fmt.Errorf("only ip addresses can be matched against ranges")
+	}
+	switch typ {
+	case "user-agent":
+		return UserAgent, nil
+	case "url":
+		return URL, nil
+	case "ip":
+		r, err := ParseRanges(ranges)
+		if err != nil {
+			return nil, err
+		}
+		return r.IP, nil
+	default:
+		return nil, fmt.Errorf("can't parse %q, try one of %q", typ, Types)
+	}
+}
+
+// URL derives `scheme`, `host`, `port`, `path`, `fragment` and a
+// `query.<param>` per query parameter from a URL. Parameters given more
+// than once are flattened like JSON arrays are, i.e. `query.tag.0`.
+//
+// Only URLs with a scheme and a host, or paths starting with "/", are
+// URLs: any word would otherwise be a relative path.
+func URL(s string) ([]*typesv1.KV, bool) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, false
+	}
+	if (u.Scheme == "" || u.Host == "") && !strings.HasPrefix(s, "/") {
+		return nil, false
+	}
+	var kvs []*typesv1.KV
+	add := func(key, value string) {
+		if value != "" {
+			kvs = append(kvs, typesv1.KeyVal(key, typesv1.ValStr(value)))
+		}
+	}
+	add("scheme", u.Scheme)
+	add("host", u.Hostname())
+	if port, err := strconv.ParseInt(u.Port(), 10, 64); err == nil {
+		kvs = append(kvs, typesv1.KeyVal("port", typesv1.ValI64(port)))
+	}
+	add("path", u.Path)
+	add("fragment", u.Fragment)
+	query := u.Query()
+	params := make([]string, 0, len(query))
+	for param := range query {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		values := query[param]
+		if len(values) == 1 {
+			kvs = append(kvs, typesv1.KeyVal("query."+param, typesv1.ValStr(values[0])))
+			continue
+		}
+		for i, v := range values {
+			kvs = append(kvs, typesv1.KeyVal("query."+param+"."+strconv.Itoa(i), typesv1.ValStr(v)))
+		}
+	}
+	return kvs, true
+}
+
+// Ranges are named lists of CIDRs.
+type Ranges struct {
+	names []string
+	nets  map[string][]*net.IPNet
+}
+
+// ParseRanges parses the CIDRs of named ranges, i.e. `{"office":
+// ["10.1.0.0/16"]}`.
+func ParseRanges(ranges map[string][]string) (*Ranges, error) {
+	r := &Ranges{nets: make(map[string][]*net.IPNet, len(ranges))}
+	for name, cidrs := range ranges {
+		if len(cidrs) == 0 {
+			return nil, fmt.Errorf("range %q has no CIDRs", name)
+		}
+		for _, cidr := range cidrs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("range %q: %v", name, err)
+			}
+			r.nets[name] = append(r.nets[name], ipnet)
+		}
+		r.names = append(r.names, name)
+	}
+	sort.Strings(r.names)
+	return r, nil
+}
+
+// Match returns the names of the ranges that contain `ip`.
+func (r *Ranges) Match(ip net.IP) []string {
+	var names []string
+	for _, name := range r.names {
+		for _, ipnet := range r.nets[name] {
+			if ipnet.Contains(ip) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// IP derives the `version` of an IP address, whether it's `private` or
+// `loopback`, and a `range.<name>` for each of the ranges it's in. Ports,
+// like in "10.0.0.1:5432", are ignored.
+func (r *Ranges) IP(s string) ([]*typesv1.KV, bool) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		host, _, err := net.SplitHostPort(s)
+		if err != nil {
+			return nil, false
+		}
+		if ip = net.ParseIP(host); ip == nil {
+			return nil, false
+		}
+	}
+	version := int64(6)
+	if ip.To4() != nil {
+		version = 4
+	}
+	kvs := []*typesv1.KV{
+		typesv1.KeyVal("version", typesv1.ValI64(version)),
+		typesv1.KeyVal("private", typesv1.ValBool(ip.IsPrivate())),
+		typesv1.KeyVal("loopback", typesv1.ValBool(ip.IsLoopback())),
+	}
+	for _, name := range r.Match(ip) {
+		kvs = append(kvs, typesv1.KeyVal("range."+name, typesv1.ValBool(true)))
+	}
+	return kvs, true
+}
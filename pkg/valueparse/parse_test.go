@@ -0,0 +1,126 @@
+package valueparse
+
+import (
+	"testing"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want Agent
+	}{
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			Agent{Browser: "Edge", BrowserVersion: "120.0.2210.91", OS: "Windows", OSVersion: "10", Device: "desktop"},
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			Agent{Browser: "Safari", BrowserVersion: "17.2", OS: "macOS", OSVersion: "10.15.7", Device: "desktop"},
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			Agent{Browser: "Chrome", BrowserVersion: "120.0.6099.119", OS: "iOS", OSVersion: "17.2", Device: "mobile"},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 14; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Safari/537.36",
+			Agent{Browser: "Samsung Internet", BrowserVersion: "23.0", OS: "Android", OSVersion: "14", Device: "tablet"},
+		},
+		{
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			Agent{Browser: "Firefox", BrowserVersion: "121.0", OS: "Linux", Device: "desktop"},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Agent{Browser: "Googlebot", BrowserVersion: "2.1", Device: "bot", Bot: true},
+		},
+		{
+			"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)",
+			Agent{Browser: "Slurp", Device: "bot", Bot: true},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 11; CUBOT X50) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Mobile Safari/537.36",
+			Agent{Browser: "Chrome", BrowserVersion: "114.0.0.0", OS: "Android", OSVersion: "11", Device: "mobile"},
+		},
+		{
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36",
+			Agent{Browser: "Headless Chrome", BrowserVersion: "120.0.0.0", OS: "Linux", Device: "bot", Bot: true},
+		},
+		{
+			"curl/8.4.0",
+			Agent{Browser: "curl", BrowserVersion: "8.4.0", Device: "other"},
+		},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, ParseUserAgent(tt.ua), tt.ua)
+	}
+}
+
+func TestURL(t *testing.T) {
+	got, ok := URL("https://shop.example.com:8443/api/v2/orders?id=42&tag=a&tag=b#top")
+	require.True(t, ok)
+	require.Equal(t, []*typesv1.KV{
+		typesv1.KeyVal("scheme", typesv1.ValStr("https")),
+		typesv1.KeyVal("host", typesv1.ValStr("shop.example.com")),
+		typesv1.KeyVal("port", typesv1.ValI64(8443)),
+		typesv1.KeyVal("path", typesv1.ValStr("/api/v2/orders")),
+		typesv1.KeyVal("fragment", typesv1.ValStr("top")),
+		typesv1.KeyVal("query.id", typesv1.ValStr("42")),
+		typesv1.KeyVal("query.tag.0", typesv1.ValStr("a")),
+		typesv1.KeyVal("query.tag.1", typesv1.ValStr("b")),
+	}, got)
+
+	got, ok = URL("/health?verbose=1")
+	require.True(t, ok)
+	require.Equal(t, []*typesv1.KV{
+		typesv1.KeyVal("path", typesv1.ValStr("/health")),
+		typesv1.KeyVal("query.verbose", typesv1.ValStr("1")),
+	}, got)
+
+	for _, notURL := range []string{"%zz", "done", "v1.2.3", "mailto:ops@example.com"} {
+		_, ok = URL(notURL)
+		require.False(t, ok, notURL)
+	}
+}
+
+func TestIP(t *testing.T) {
+	parse, err := New("ip", map[string][]string{
+		"office": {"10.1.0.0/16", "2001:db8::/32"},
+		"vpn":    {"10.1.2.0/24"},
+	})
+	require.NoError(t, err)
+
+	got, ok := parse("10.1.2.3:5432")
+	require.True(t, ok)
+	require.Equal(t, []*typesv1.KV{
+		typesv1.KeyVal("version", typesv1.ValI64(4)),
+		typesv1.KeyVal("private", typesv1.ValBool(true)),
+		typesv1.KeyVal("loopback", typesv1.ValBool(false)),
+		typesv1.KeyVal("range.office", typesv1.ValBool(true)),
+		typesv1.KeyVal("range.vpn", typesv1.ValBool(true)),
+	}, got)
+
+	got, ok = parse("::1")
+	require.True(t, ok)
+	require.Equal(t, []*typesv1.KV{
+		typesv1.KeyVal("version", typesv1.ValI64(6)),
+		typesv1.KeyVal("private", typesv1.ValBool(false)),
+		typesv1.KeyVal("loopback", typesv1.ValBool(true)),
+	}, got)
+
+	_, ok = parse("not an ip")
+	require.False(t, ok)
+}
+
+func TestNewErrors(t *testing.T) {
+	_, err := New("mac", nil)
+	require.Error(t, err)
+	_, err = New("url", map[string][]string{"office": {"10.1.0.0/16"}})
+	require.Error(t, err)
+	_, err = New("ip", map[string][]string{"office": {"10.1.0.0"}})
+	require.Error(t, err)
+	_, err = New("ip", map[string][]string{"office": {}})
+	require.Error(t, err)
+}
@@ -0,0 +1,146 @@
+package valueparse
+
+import (
+	"regexp"
+	"strings"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+)
+
+// Agent is what a user agent says about the client.
+type Agent struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	// Device is "desktop", "mobile", "tablet", "bot" or "other".
+	Device string
+	Bot    bool
+}
+
+type uaRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// browsers are in the order they must be tried: most browsers also claim
+// to be the ones they're based on, i.e. Edge says it's Chrome and Safari.
+var browsers = []uaRule{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Headless Chrome", regexp.MustCompile(`HeadlessChrome/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+	{"curl", regexp.MustCompile(`^curl/([\d.]+)`)},
+	{"Wget", regexp.MustCompile(`^Wget/([\d.]+)`)},
+	{"Python Requests", regexp.MustCompile(`^python-requests/([\d.]+)`)},
+	{"Go", regexp.MustCompile(`^Go-http-client/([\d.]+)`)},
+	{"okhttp", regexp.MustCompile(`^okhttp/([\d.]+)`)},
+}
+
+var (
+	// bots are products named like one, i.e. "Googlebot/2.1" or "Yahoo!
+	// Slurp;", but not the "CUBOT X30" phone: the name must end the product,
+	// or a part of it like "AdsBot-Google".
+	bots = regexp.MustCompile(`(?i)([\w.-]*(?:bot|crawler|spider|slurp|archiver|facebookexternalhit|pingdom|uptime|lighthouse)(?:[-_][\w.-]*)?)(?:/([\d.]+)|[;,()]|$)`)
+
+	windows = regexp.MustCompile(`Windows NT ([\d.]+)`)
+	ios     = regexp.MustCompile(`(?:iPhone|iPad|iPod|CPU) OS ([\d_]+)`)
+	macos   = regexp.MustCompile(`Mac OS X ([\d_.]+)`)
+	android = regexp.MustCompile(`Android ([\d.]+)`)
+
+	// the versions of Windows NT are marketed under other names
+	windowsVersions = map[string]string{
+		"10.0": "10",
+		"6.3":  "8.1",
+		"6.2":  "8",
+		"6.1":  "7",
+		"6.0":  "Vista",
+		"5.1":  "XP",
+	}
+)
+
+// ParseUserAgent finds out the browser, OS and kind of device from a user
+// agent. What can't be found out is left empty.
+func ParseUserAgent(s string) Agent {
+	var a Agent
+	if m := bots.FindStringSubmatch(s); m != nil {
+		a.Bot = true
+		a.Browser, a.BrowserVersion = m[1], m[2]
+	}
+	if a.Browser == "" {
+		for _, rule := range browsers {
+			if m := rule.pattern.FindStringSubmatch(s); m != nil {
+				a.Browser, a.BrowserVersion = rule.name, m[1]
+				break
+			}
+		}
+	}
+	a.Bot = a.Bot || a.Browser == "Headless Chrome"
+
+	switch {
+	case strings.Contains(s, "Windows"):
+		a.OS = "Windows"
+		if m := windows.FindStringSubmatch(s); m != nil {
+			a.OSVersion = m[1]
+			if v, ok := windowsVersions[m[1]]; ok {
+				a.OSVersion = v
+			}
+		}
+	case ios.MatchString(s):
+		a.OS = "iOS"
+		a.OSVersion = strings.ReplaceAll(ios.FindStringSubmatch(s)[1], "_", ".")
+	case macos.MatchString(s):
+		a.OS = "macOS"
+		a.OSVersion = strings.ReplaceAll(macos.FindStringSubmatch(s)[1], "_", ".")
+	case strings.Contains(s, "Android"):
+		a.OS = "Android"
+		if m := android.FindStringSubmatch(s); m != nil {
+			a.OSVersion = m[1]
+		}
+	case strings.Contains(s, "CrOS"):
+		a.OS = "ChromeOS"
+	case strings.Contains(s, "Linux"):
+		a.OS = "Linux"
+	}
+
+	switch {
+	case a.Bot:
+		a.Device = "bot"
+	case strings.Contains(s, "iPad") || strings.Contains(s, "Tablet") ||
+		(a.OS == "Android" && !strings.Contains(s, "Mobile")):
+		a.Device = "tablet"
+	case strings.Contains(s, "Mobi") || strings.Contains(s, "iPhone") || strings.Contains(s, "iPod"):
+		a.Device = "mobile"
+	case a.OS != "":
+		a.Device = "desktop"
+	default:
+		a.Device = "other"
+	}
+	return a
+}
+
+// UserAgent derives `browser`, `browser_version`, `os`, `os_version`,
+// `device` and `bot` from a user agent.
+func UserAgent(s string) ([]*typesv1.KV, bool) {
+	if strings.TrimSpace(s) == "" {
+		return nil, false
+	}
+	a := ParseUserAgent(s)
+	var kvs []*typesv1.KV
+	add := func(key, value string) {
+		if value != "" {
+			kvs = append(kvs, typesv1.KeyVal(key, typesv1.ValStr(value)))
+		}
+	}
+	add("browser", a.Browser)
+	add("browser_version", a.BrowserVersion)
+	add("os", a.OS)
+	add("os_version", a.OSVersion)
+	add("device", a.Device)
+	kvs = append(kvs, typesv1.KeyVal("bot", typesv1.ValBool(a.Bot)))
+	return kvs, true
+}
@@ -8,11 +8,30 @@ import (
 	"io"
 
 	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/pkg/metrics"
 	"github.com/humanlogio/humanlog/pkg/sink"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-const maxBufferSize = 1024 * 1024
+const (
+	maxBufferSize = 1024 * 1024
+	stageScan     = "scan"
+)
+
+// Names of the handlers that recognize lines, as given to
+// `HandlerOptions.OnHandled`.
+const (
+	HandlerJSON                = "json"
+	HandlerLogfmt              = "logfmt"
+	HandlerDockerComposeJSON   = "docker-compose+json"
+	HandlerDockerComposeLogfmt = "docker-compose+logfmt"
+	HandlerZap                 = "zap"
+)
+
+type lineHandler struct {
+	name      string
+	tryHandle func([]byte, *typesv1.StructuredLogEvent) bool
+}
 
 // Scan reads JSON-structured lines from src and prettify them onto dst. If
 // the lines aren't JSON-structured, it will simply write them out with no
@@ -32,18 +51,18 @@ func Scan(ctx context.Context, src io.Reader, sink sink.Sink, opts *HandlerOptio
 	data := new(typesv1.StructuredLogEvent)
 	ev.Structured = data
 
-	handlers := []func([]byte, *typesv1.StructuredLogEvent) bool{
-		jsonEntry.TryHandle,
-		logfmtEntry.TryHandle,
-		func(lineData []byte, data *typesv1.StructuredLogEvent) bool {
+	handlers := []lineHandler{
+		{HandlerJSON, jsonEntry.TryHandle},
+		{HandlerLogfmt, logfmtEntry.TryHandle},
+		{HandlerDockerComposeJSON, func(lineData []byte, data *typesv1.StructuredLogEvent) bool {
 			return tryDockerComposePrefix(lineData, data, &jsonEntry)
-		},
-		func(lineData []byte, data *typesv1.StructuredLogEvent) bool {
+		}},
+		{HandlerDockerComposeLogfmt, func(lineData []byte, data *typesv1.StructuredLogEvent) bool {
 			return tryDockerComposePrefix(lineData, data, &logfmtEntry)
-		},
-		func(lineData []byte, data *typesv1.StructuredLogEvent) bool {
+		}},
+		{HandlerZap, func(lineData []byte, data *typesv1.StructuredLogEvent) bool {
 			return tryZapDevPrefix(lineData, data, &jsonEntry)
-		},
+		}},
 	}
 
 	skipNextScan := false
@@ -69,6 +88,7 @@ func Scan(ctx context.Context, src io.Reader, sink sink.Sink, opts *HandlerOptio
 
 		line++
 		lineData := in.Bytes()
+		metrics.Received.Inc(stageScan)
 
 		if ev.Structured == nil {
 			ev.Structured = data
@@ -81,18 +101,25 @@ func Scan(ctx context.Context, src io.Reader, sink sink.Sink, opts *HandlerOptio
 		lineData = bytes.TrimPrefix(lineData, []byte("@cee: "))
 
 		handled := false
+		handledBy := ""
 	handled_line:
-		for i, tryHandler := range handlers {
-			if tryHandler(lineData, data) {
+		for i, h := range handlers {
+			if h.tryHandle(lineData, data) {
 				if dynamicReordering {
 					handlers = moveToFront(i, handlers)
 				}
 				handled = true
+				handledBy = h.name
 				break handled_line
 			}
 		}
+		if opts.OnHandled != nil {
+			opts.OnHandled(handledBy)
+		}
 		if !handled {
 			ev.Structured = nil
+		} else {
+			applyTransforms(opts.Transforms, ev)
 		}
 		// switch {
 
@@ -110,8 +137,10 @@ func Scan(ctx context.Context, src io.Reader, sink sink.Sink, opts *HandlerOptio
 
 		// }
 		if err := sink.Receive(ctx, ev); err != nil {
+			metrics.Dropped.Inc(stageScan)
 			return err
 		}
+		metrics.Sent.Inc(stageScan)
 		select {
 		case <-ctx.Done():
 			return nil
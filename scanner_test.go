@@ -48,6 +48,24 @@ func TestScannerLongLine(t *testing.T) {
 	}
 }
 
+func TestScannerOnHandled(t *testing.T) {
+	ctx := context.Background()
+	src := strings.NewReader(strings.Join([]string{
+		`{"msg":"json"}`,
+		`level=info msg=logfmt`,
+		`web_1  | {"msg":"docker compose"}`,
+		`2021-02-05T12:41:50.064-0700    INFO    zapper/zapper.go:18     zap dev   {"a": 1}`,
+		`not structured`,
+	}, "\n"))
+
+	var got []string
+	opts := DefaultOptions()
+	opts.OnHandled = func(handler string) { got = append(got, handler) }
+	err := Scan(ctx, src, bufsink.NewSizedBufferedSink(100, nil), opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{HandlerJSON, HandlerLogfmt, HandlerDockerComposeJSON, HandlerZap, ""}, got)
+}
+
 func TestLargePayload(t *testing.T) {
 
 	ctx := context.Background()
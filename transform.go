@@ -0,0 +1,348 @@
+package humanlog
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/humanlogio/humanlog/internal/pkg/keymatch"
+	"github.com/humanlogio/humanlog/pkg/logqleval"
+	"github.com/humanlogio/humanlog/pkg/valueparse"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Transform changes a structured event after it's parsed, i.e. to rename
+// keys that are named differently by different services. See
+// `config.Transform` for what each op does.
+type Transform struct {
+	op      string
+	key     string
+	keys    *keymatch.Matcher
+	to      string
+	value   *typesv1.Val
+	typ     string
+	pattern *regexp.Regexp
+	parse   valueparse.Parser
+	when    *typesv1.Expr
+}
+
+var (
+	transformOps  = []string{"rename", "copy", "drop", "default", "cast", "extract", "promote", "parse"}
+	castTypes     = []string{"string", "int", "float", "bool", "time", "duration"}
+	promoteFields = []string{"msg", "lvl", "ts"}
+)
+
+// TransformsFrom compiles the transforms of `cfg`.
+func TransformsFrom(cfg config.Config) ([]Transform, error) {
+	if cfg.Transforms == nil {
+		return nil, nil
+	}
+	out := make([]Transform, 0, len(*cfg.Transforms))
+	for i, tc := range *cfg.Transforms {
+		t, err := compileTransform(tc)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d (%s): %v", i, tc.Op, err)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func compileTransform(tc config.Transform) (Transform, error) {
+	t := Transform{op: tc.Op, key: tc.Key, to: tc.To, typ: tc.Type}
+	if tc.Key == "" {
+		return t, fmt.Errorf("needs a key")
+	}
+	var err error
+	switch tc.Op {
+	case "rename", "copy":
+		if tc.To == "" {
+			return t, fmt.Errorf("needs a key to %s to", tc.Op)
+		}
+	case "drop":
+		if t.keys, err = keymatch.Compile([]string{tc.Key}); err != nil {
+			return t, err
+		}
+	case "default":
+		if t.value, err = jsonVal(tc.Value); err != nil {
+			return t, err
+		}
+	case "cast":
+		if !contains(castTypes, tc.Type) {
+			return t, fmt.Errorf("can't cast to %q, try one of %q", tc.Type, castTypes)
+		}
+	case "extract":
+		if t.pattern, err = regexp.Compile(tc.Pattern); err != nil {
+			return t, fmt.Errorf("invalid pattern: %v", err)
+		}
+		named := false
+		for _, name := range t.pattern.SubexpNames() {
+			named = named || name != ""
+		}
+		if !named {
+			return t, fmt.Errorf("pattern %q has no named groups, i.e. (?P<name>...), to extract", tc.Pattern)
+		}
+	case "promote":
+		if !contains(promoteFields, tc.To) {
+			return t, fmt.Errorf("can't promote to %q, try one of %q", tc.To, promoteFields)
+		}
+	case "parse":
+		if t.parse, err = valueparse.New(tc.Type, tc.Ranges); err != nil {
+			return t, err
+		}
+		if t.to == "" {
+			t.to = tc.Key
+		}
+	default:
+		return t, fmt.Errorf("unknown op %q, try one of %q", tc.Op, transformOps)
+	}
+	if tc.When != "" {
+		if t.when, err = logqleval.ParseFilter(tc.When); err != nil {
+			return t, fmt.Errorf("invalid condition: %v", err)
+		}
+	}
+	return t, nil
+}
+
+func jsonVal(v interface{}) (*typesv1.Val, error) {
+	switch v := v.(type) {
+	case string:
+		return typesv1.ValStr(v), nil
+	case bool:
+		return typesv1.ValBool(v), nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return typesv1.ValI64(int64(v)), nil
+		}
+		return typesv1.ValF64(v), nil
+	case nil:
+		return nil, fmt.Errorf("needs a value")
+	default:
+		return nil, fmt.Errorf("needs a string, number or bool value, not %T", v)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func applyTransforms(transforms []Transform, ev *typesv1.LogEvent) {
+	for i := range transforms {
+		transforms[i].apply(ev)
+	}
+}
+
+func (t *Transform) apply(ev *typesv1.LogEvent) {
+	data := ev.Structured
+	if data == nil {
+		return
+	}
+	if t.when != nil {
+		if ok, err := logqleval.Match(t.when, ev); err != nil || !ok {
+			return
+		}
+	}
+	if t.op == "drop" {
+		kvs := data.Kvs[:0]
+		for _, kv := range data.Kvs {
+			if !t.keys.Match(kv.Key) {
+				kvs = append(kvs, kv)
+			}
+		}
+		data.Kvs = kvs
+		return
+	}
+	i := kvIndex(data, t.key)
+	if i < 0 {
+		if t.op == "default" {
+			data.Kvs = append(data.Kvs, typesv1.KeyVal(t.key, t.value))
+		}
+		return
+	}
+	v := data.Kvs[i].Value
+	switch t.op {
+	case "rename":
+		data.Kvs[i].Key = t.to
+		removeKV(data, t.to, i)
+	case "copy":
+		setKV(data, t.to, proto.Clone(v).(*typesv1.Val))
+	case "cast":
+		if cast, ok := castVal(v, t.typ); ok {
+			data.Kvs[i].Value = cast
+		}
+	case "extract":
+		s, ok := valString(v)
+		if !ok {
+			return
+		}
+		m := t.pattern.FindStringSubmatch(s)
+		if m == nil {
+			return
+		}
+		for j, name := range t.pattern.SubexpNames() {
+			if name != "" {
+				setKV(data, name, typesv1.ValStr(m[j]))
+			}
+		}
+	case "promote":
+		if promote(data, t.to, v) {
+			removeKV(data, t.key, -1)
+		}
+	case "parse":
+		s, ok := v.GetKind().(*typesv1.Val_Str)
+		if !ok {
+			return
+		}
+		fields, ok := t.parse(s.Str)
+		if !ok {
+			return
+		}
+		for _, kv := range fields {
+			setKV(data, t.to+"."+kv.Key, kv.Value)
+		}
+	}
+}
+
+func kvIndex(data *typesv1.StructuredLogEvent, key string) int {
+	for i, kv := range data.Kvs {
+		if kv.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeKV removes `key`, unless it's at index `except`.
+func removeKV(data *typesv1.StructuredLogEvent, key string, except int) {
+	kvs := data.Kvs[:0]
+	for i, kv := range data.Kvs {
+		if kv.Key != key || i == except {
+			kvs = append(kvs, kv)
+		}
+	}
+	data.Kvs = kvs
+}
+
+func setKV(data *typesv1.StructuredLogEvent, key string, v *typesv1.Val) {
+	if i := kvIndex(data, key); i >= 0 {
+		data.Kvs[i].Value = v
+		return
+	}
+	data.Kvs = append(data.Kvs, typesv1.KeyVal(key, v))
+}
+
+func promote(data *typesv1.StructuredLogEvent, field string, v *typesv1.Val) bool {
+	switch field {
+	case "msg":
+		s, ok := valString(v)
+		if ok {
+			data.Msg = s
+		}
+		return ok
+	case "lvl":
+		s, ok := valString(v)
+		if ok {
+			data.Lvl = s
+		}
+		return ok
+	case "ts":
+		ts, ok := valTime(v)
+		if ok {
+			data.Timestamp = timestamppb.New(ts)
+		}
+		return ok
+	}
+	return false
+}
+
+func castVal(v *typesv1.Val, typ string) (*typesv1.Val, bool) {
+	switch typ {
+	case "string":
+		s, ok := valString(v)
+		return typesv1.ValStr(s), ok
+	case "int":
+		switch k := v.GetKind().(type) {
+		case *typesv1.Val_I64:
+			return v, true
+		case *typesv1.Val_F64:
+			return typesv1.ValI64(int64(k.F64)), true
+		case *typesv1.Val_Str:
+			if i, err := strconv.ParseInt(k.Str, 10, 64); err == nil {
+				return typesv1.ValI64(i), true
+			}
+			if f, err := strconv.ParseFloat(k.Str, 64); err == nil {
+				return typesv1.ValI64(int64(f)), true
+			}
+		}
+	case "float":
+		switch k := v.GetKind().(type) {
+		case *typesv1.Val_F64:
+			return v, true
+		case *typesv1.Val_I64:
+			return typesv1.ValF64(float64(k.I64)), true
+		case *typesv1.Val_Str:
+			if f, err := strconv.ParseFloat(k.Str, 64); err == nil {
+				return typesv1.ValF64(f), true
+			}
+		}
+	case "bool":
+		switch k := v.GetKind().(type) {
+		case *typesv1.Val_Bool:
+			return v, true
+		case *typesv1.Val_I64:
+			return typesv1.ValBool(k.I64 != 0), true
+		case *typesv1.Val_Str:
+			if b, err := strconv.ParseBool(k.Str); err == nil {
+				return typesv1.ValBool(b), true
+			}
+		}
+	case "time":
+		if ts, ok := valTime(v); ok {
+			return typesv1.ValTime(ts), true
+		}
+	case "duration":
+		switch k := v.GetKind().(type) {
+		case *typesv1.Val_Dur:
+			return v, true
+		case *typesv1.Val_Str:
+			if d, err := time.ParseDuration(k.Str); err == nil {
+				return typesv1.ValDuration(d), true
+			}
+		}
+	}
+	return v, false
+}
+
+func valString(v *typesv1.Val) (string, bool) {
+	switch v.GetKind().(type) {
+	case *typesv1.Val_Str, *typesv1.Val_I64, *typesv1.Val_F64, *typesv1.Val_Bool, *typesv1.Val_Ts, *typesv1.Val_Dur:
+		return logqleval.FormatVal(v), true
+	default:
+		return "", false
+	}
+}
+
+func valTime(v *typesv1.Val) (time.Time, bool) {
+	switch k := v.GetKind().(type) {
+	case *typesv1.Val_Ts:
+		return k.Ts.AsTime(), true
+	case *typesv1.Val_Str:
+		return tryParseTime(k.Str)
+	case *typesv1.Val_I64:
+		return tryParseTime(k.I64)
+	case *typesv1.Val_F64:
+		return tryParseTime(k.F64)
+	default:
+		return time.Time{}, false
+	}
+}
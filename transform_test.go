@@ -0,0 +1,67 @@
+package humanlog
+
+import (
+	"testing"
+	"time"
+
+	typesv1 "github.com/humanlogio/api/go/types/v1"
+	"github.com/humanlogio/humanlog/internal/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransformsFromErrors(t *testing.T) {
+	for _, tc := range []config.Transform{
+		{Op: "rename", Key: "svc"},
+		{Op: "explode", Key: "svc"},
+		{Op: "default", Key: "env"},
+		{Op: "cast", Key: "latency", Type: "decimal"},
+		{Op: "extract", Key: "path", Pattern: `^/api/(v\d+)`},
+		{Op: "promote", Key: "event", To: "body"},
+		{Op: "drop", Key: "internal", When: "lvl =="},
+		{Op: "parse", Key: "ua", Type: "browser"},
+		{Op: "parse", Key: "client_ip", Type: "ip", Ranges: map[string][]string{"office": {"10.1.0.0/33"}}},
+		{Op: "drop"},
+	} {
+		_, err := TransformsFrom(config.Config{Transforms: &[]config.Transform{tc}})
+		require.Error(t, err, "%+v", tc)
+	}
+}
+
+func TestCastVal(t *testing.T) {
+	ts := time.Date(2024, 12, 13, 19, 36, 0, 0, time.UTC)
+	tests := []struct {
+		in   *typesv1.Val
+		typ  string
+		want *typesv1.Val
+		ok   bool
+	}{
+		{typesv1.ValStr("42"), "int", typesv1.ValI64(42), true},
+		{typesv1.ValStr("4.2"), "int", typesv1.ValI64(4), true},
+		{typesv1.ValF64(4.0), "int", typesv1.ValI64(4), true},
+		{typesv1.ValStr("4.2"), "float", typesv1.ValF64(4.2), true},
+		{typesv1.ValI64(3), "float", typesv1.ValF64(3), true},
+		{typesv1.ValI64(3), "string", typesv1.ValStr("3"), true},
+		{typesv1.ValStr("true"), "bool", typesv1.ValBool(true), true},
+		{typesv1.ValI64(0), "bool", typesv1.ValBool(false), true},
+		{typesv1.ValStr("1.5s"), "duration", typesv1.ValDuration(1500 * time.Millisecond), true},
+		{typesv1.ValStr("2024-12-13T19:36:00Z"), "time", typesv1.ValTime(ts), true},
+		{typesv1.ValStr("nope"), "int", typesv1.ValStr("nope"), false},
+	}
+	for _, tt := range tests {
+		got, ok := castVal(tt.in, tt.typ)
+		require.Equal(t, tt.ok, ok, "%v to %s", tt.in, tt.typ)
+		require.Equal(t, tt.want, got, "%v to %s", tt.in, tt.typ)
+	}
+}
+
+func TestPromoteKeepsFieldOnNonScalar(t *testing.T) {
+	data := &typesv1.StructuredLogEvent{Msg: "hello", Lvl: "info"}
+	obj := typesv1.ValObj(typesv1.KeyVal("a", typesv1.ValI64(1)))
+	require.False(t, promote(data, "msg", obj))
+	require.False(t, promote(data, "lvl", obj))
+	require.Equal(t, "hello", data.Msg)
+	require.Equal(t, "info", data.Lvl)
+
+	require.True(t, promote(data, "msg", typesv1.ValStr("bye")))
+	require.Equal(t, "bye", data.Msg)
+}